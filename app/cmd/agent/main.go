@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/danutavadanei/nice-lab-go/internal/agent"
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+	"github.com/spf13/viper"
+)
+
+// version is reported to the pipeline; it is set at build time.
+var version = "dev"
+
+// state is what the agent keeps across restarts.
+type state struct {
+	Token string `json:"token"`
+	LabID uint64 `json:"lab_id"`
+}
+
+func main() {
+	v := viper.New()
+	v.AutomaticEnv()
+
+	cfg := config.NewLabAgentConfig(v)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	hostname, _ := os.Hostname()
+
+	st, err := loadState(cfg.StatePath)
+	if err != nil {
+		panic(err)
+	}
+
+	client := agent.NewClient(cfg.PipelineUrl, st.Token)
+
+	if st.Token == "" {
+		if cfg.EnrollmentToken == "" {
+			panic("AGENT_ENROLLMENT_TOKEN is required to enroll the agent")
+		}
+
+		if st.Token, st.LabID, err = client.Enroll(ctx, cfg.EnrollmentToken, hostname, version); err != nil {
+			panic(err)
+		}
+
+		if err := saveState(cfg.StatePath, st); err != nil {
+			panic(err)
+		}
+
+		log.Printf("enrolled for lab %d", st.LabID)
+	}
+
+	go heartbeat(ctx, client, hostname, cfg.HeartbeatInterval)
+
+	runner := agent.NewRunner(cfg.MaxOutput)
+
+	log.Printf("agent %s polling %s for jobs of lab %d", version, cfg.PipelineUrl, st.LabID)
+
+	for ctx.Err() == nil {
+		job, err := client.Poll(ctx, cfg.PollWait)
+
+		if errors.Is(err, agent.ErrForbidden) {
+			log.Fatalf("the pipeline refused the agent token, enroll the agent again")
+		}
+
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("error polling for jobs:  %v", err)
+				sleep(ctx, 5*time.Second)
+			}
+			continue
+		}
+
+		if job == nil {
+			continue
+		}
+
+		log.Printf("running job %s", job.UUID)
+
+		result := runner.Run(ctx, *job)
+
+		if err := report(ctx, client, job.UUID, result); errors.Is(err, agent.ErrJobGone) {
+			log.Printf("job %s was cancelled by the pipeline", job.UUID)
+			continue
+		} else if err != nil {
+			log.Printf("error reporting job %s:  %v", job.UUID, err)
+			continue
+		}
+
+		log.Printf("job %s exited with %d", job.UUID, result.ExitCode)
+	}
+
+	log.Println("agent stopped")
+}
+
+// heartbeat tells the pipeline the agent is online, also while it runs
+// jobs and does not poll.
+func heartbeat(ctx context.Context, client *agent.Client, hostname string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := client.Heartbeat(ctx, hostname, version); err != nil && ctx.Err() == nil {
+			log.Printf("error sending heartbeat:  %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// report sends the result of the job, retrying while the pipeline cannot be
+// reached. Results of jobs the pipeline gave up on are dropped.
+func report(ctx context.Context, client *agent.Client, id string, result agent.Result) error {
+	var err error
+
+	for attempt := 0; attempt < 5; attempt++ {
+		if err = client.Report(ctx, id, result); err == nil || errors.Is(err, agent.ErrForbidden) || errors.Is(err, agent.ErrJobGone) {
+			return err
+		}
+
+		sleep(ctx, time.Duration(attempt+1)*2*time.Second)
+	}
+
+	return err
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+func loadState(path string) (state, error) {
+	var st state
+
+	data, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+
+	if err != nil {
+		return st, err
+	}
+
+	return st, json.Unmarshal(data, &st)
+}
+
+// saveState writes the state readable by the agent only, since it holds its
+// token.
+func saveState(path string, st state) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(st)
+
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0600)
+}
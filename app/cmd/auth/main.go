@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
 	"github.com/danutavadanei/nice-lab-go/internal/config"
+	"github.com/danutavadanei/nice-lab-go/internal/provision"
 	"github.com/danutavadanei/nice-lab-go/internal/server"
 	"github.com/danutavadanei/nice-lab-go/internal/server/middleware"
 	"github.com/gorilla/mux"
@@ -14,13 +15,14 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func main() {
 	v := viper.New()
 	v.AutomaticEnv()
 
-	sigChannel := make(chan os.Signal)
+	sigChannel := make(chan os.Signal, 1)
 	signal.Notify(sigChannel, os.Interrupt, syscall.SIGTERM)
 
 	cfg := config.NewAppConfig(v)
@@ -121,6 +123,63 @@ func main() {
 		w.Header().Set("Content-Type", "application/json")
 		_, _ = w.Write(bytes)
 	}).Methods("GET").Name("listUsers")
+	a.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			log.Printf("error parsing form:  %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		newUser := mysql.User{
+			Name:     r.FormValue("name"),
+			Email:    r.FormValue("email"),
+			Type:     mysql.UserType(r.FormValue("type")),
+			UserName: r.FormValue("username"),
+		}
+		password := r.FormValue("password")
+
+		if newUser.Type == "" {
+			newUser.Type = mysql.Student
+		}
+
+		if err := provision.ValidateUsername(newUser.UserName); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		if newUser.Name == "" || newUser.Email == "" || password == "" ||
+			(newUser.Type != mysql.Student && newUser.Type != mysql.Professor) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+
+		newUser, err := userRep.CreateUser(r.Context(), newUser, password)
+
+		if err != nil {
+			log.Printf("error creating user:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, err := json.Marshal(newUser)
+
+		if err != nil {
+			log.Printf("error marshaling user:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(bytes)
+	}).Methods("POST").Name("createUser")
 
 	srvShutdown := make(chan bool)
 	srv := server.StartHttpServer(cfg.HTTPServerConfig, m, srvShutdown)
@@ -131,7 +190,9 @@ func main() {
 }
 
 func shutdown(server *http.Server) {
-	ctxShutDown, _ := context.WithTimeout(context.Background(), 30)
+	ctxShutDown, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
 	err := server.Shutdown(ctxShutDown)
 	if err != nil {
 		log.Printf("error shutting down server (%s): %v", server.Addr, err)
@@ -13,13 +13,14 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func main() {
 	v := viper.New()
 	v.AutomaticEnv()
 
-	sigChannel := make(chan os.Signal)
+	sigChannel := make(chan os.Signal, 1)
 	signal.Notify(sigChannel, os.Interrupt, syscall.SIGTERM)
 
 	cfg := config.NewAppConfig(v)
@@ -48,7 +49,8 @@ func main() {
 		m,
 		srvShutdown,
 		handlers.AllowedOrigins([]string{"*"}),
-		handlers.AllowedHeaders([]string{"X-Session-Token"}),
+		handlers.AllowedHeaders([]string{"X-Session-Token", "Idempotency-Key"}),
+		handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "DELETE"}),
 	)
 
 	<-sigChannel
@@ -57,7 +59,9 @@ func main() {
 }
 
 func shutdown(server *http.Server) {
-	ctxShutDown, _ := context.WithTimeout(context.Background(), 30)
+	ctxShutDown, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
 	err := server.Shutdown(ctxShutDown)
 	if err != nil {
 		log.Printf("error shutting down server (%s): %v", server.Addr, err)
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/dcvsm"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/provision"
+)
+
+var errBrokerNotConfigured = errors.New("backend broker is not configured")
+
+// startBroker returns the user's session on a broker lab, asking the broker
+// for a new DCV session when the one of the active session is gone. Broker
+// labs run no provisioning template: the accounts of their users are
+// managed by the directory their DCV servers are joined to, and the broker
+// places sessions on a server of the lab's OS family, or on the lab's host
+// when it has one.
+func (s *sessionStarter) startBroker(ctx context.Context, lab *mysql.Lab, user *mysql.User) (mysql.Session, error) {
+	if s.broker == nil {
+		return mysql.Session{}, errBrokerNotConfigured
+	}
+
+	labType, err := provision.LookupLabType(lab.Type)
+
+	if err != nil {
+		return mysql.Session{}, err
+	}
+
+	session, err := s.sessionRep.GetActiveSession(ctx, user.ID, lab.ID)
+
+	switch {
+	case err == nil:
+		if session.BrokerID != nil {
+			described, err := s.broker.DescribeSession(ctx, *session.BrokerID)
+
+			if err == nil && described.Live() {
+				return session, nil
+			}
+
+			if err != nil && !errors.Is(err, dcvsm.ErrSessionNotFound) {
+				return mysql.Session{}, err
+			}
+		}
+
+		if err := s.sessionRep.EndSession(ctx, session.ID, mysql.EndReasonLost); err != nil {
+			return mysql.Session{}, err
+		}
+	case !errors.Is(err, sql.ErrNoRows):
+		return mysql.Session{}, err
+	}
+
+	session, reserved, err := s.reserve(ctx, lab, user)
+
+	if err != nil {
+		return mysql.Session{}, err
+	}
+
+	if !reserved {
+		return session, nil
+	}
+
+	brokerId, err := s.createBrokerSession(ctx, labType, lab, user, session)
+
+	if err != nil {
+		log.Printf("lab %d user %s: broker session failed:  %v", lab.ID, user.UserName, err)
+
+		if brokerId != "" {
+			s.deleteBrokerSession(brokerId, user.UserName)
+		}
+
+		return finishSession(s.sessionRep, session, lab, user, nil, err)
+	}
+
+	log.Printf("lab %d user %s: broker session %s ready", lab.ID, user.UserName, brokerId)
+
+	return finishSession(s.sessionRep, session, lab, user, nil, nil)
+}
+
+// createBrokerSession asks the broker for the session and waits for it to
+// be ready. The id of the broker session is returned once it was created,
+// also when it failed to get ready.
+func (s *sessionStarter) createBrokerSession(
+	ctx context.Context,
+	labType provision.LabType,
+	lab *mysql.Lab,
+	user *mysql.User,
+	session mysql.Session,
+) (string, error) {
+	req := dcvsm.CreateSessionRequest{
+		Name:         fmt.Sprintf("nicelab-%d", session.ID),
+		Owner:        user.UserName,
+		Type:         dcvsm.SessionVirtual,
+		Requirements: fmt.Sprintf("server:Host.Os.Family = '%s'", labType.Family),
+	}
+
+	if labType.Family == provision.Windows {
+		req.Type = dcvsm.SessionConsole
+	}
+
+	if lab.Hostname != "" {
+		req.Requirements += fmt.Sprintf(" and server:Host.Hostname = '%s'", lab.Hostname)
+	}
+
+	created, err := s.broker.CreateSession(ctx, req)
+
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.sessionRep.BindBrokerSession(ctx, session.ID, created.Id); err != nil {
+		return created.Id, err
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, s.brokerCfg.CreateTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(s.brokerCfg.PollInterval)
+	defer ticker.Stop()
+
+	for described := created; ; {
+		switch described.State {
+		case dcvsm.StateReady:
+			return created.Id, nil
+		case dcvsm.StateCreating:
+		default:
+			return created.Id, fmt.Errorf("broker session %s is %s: %s", created.Id, described.State, described.StateReason)
+		}
+
+		select {
+		case <-waitCtx.Done():
+			return created.Id, fmt.Errorf("broker session %s: %w", created.Id, waitCtx.Err())
+		case <-ticker.C:
+		}
+
+		if described, err = s.broker.DescribeSession(waitCtx, created.Id); err != nil {
+			return created.Id, err
+		}
+	}
+}
+
+// endBroker closes the broker session of the session, if it got one.
+func (s *sessionStarter) endBroker(ctx context.Context, session mysql.Session) error {
+	if session.BrokerID == nil {
+		return nil
+	}
+
+	if s.broker == nil {
+		return errBrokerNotConfigured
+	}
+
+	return s.broker.DeleteSession(ctx, *session.BrokerID, session.User.UserName)
+}
+
+// deleteBrokerSession closes a broker session that failed, even once the
+// context of the request is done.
+func (s *sessionStarter) deleteBrokerSession(id string, owner string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := s.broker.DeleteSession(ctx, id, owner); err != nil {
+		log.Printf("error deleting broker session %s:  %v", id, err)
+	}
+}
+
+// brokerConnections returns the number of clients connected to the broker
+// session of the session; gone is set when the broker lost it.
+func (s *sessionStarter) brokerConnections(ctx context.Context, session mysql.Session) (connections int, gone bool, err error) {
+	if s.broker == nil {
+		return 0, false, errBrokerNotConfigured
+	}
+
+	if session.BrokerID == nil {
+		return 0, true, nil
+	}
+
+	described, err := s.broker.DescribeSession(ctx, *session.BrokerID)
+
+	if errors.Is(err, dcvsm.ErrSessionNotFound) {
+		return 0, true, nil
+	}
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	return described.NumOfConnections, !described.Live(), nil
+}
+
+// brokerConnection returns what the user of the session needs to join its
+// broker session.
+func (s *sessionStarter) brokerConnection(ctx context.Context, session mysql.Session) (dcvsm.ConnectionData, error) {
+	if s.broker == nil {
+		return dcvsm.ConnectionData{}, errBrokerNotConfigured
+	}
+
+	if session.BrokerID == nil {
+		return dcvsm.ConnectionData{}, fmt.Errorf("session %d has no broker session", session.ID)
+	}
+
+	return s.broker.GetSessionConnectionData(ctx, *session.BrokerID, session.User.UserName)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+	"github.com/danutavadanei/nice-lab-go/internal/inventory"
+	"github.com/danutavadanei/nice-lab-go/internal/scheduler"
+)
+
+// classScheduler runs the classes of courses. From the warm-up lead before
+// a class starts, the instances of the course labs are started and every
+// enrolled student gets a session placed on them, provisioned in a batch,
+// so that nobody waits for provisioning when the class begins. Students
+// that could not be placed yet, or whose instance is still starting, are
+// retried until the start. When the class ends its sessions are torn down
+// together.
+type classScheduler struct {
+	classRep   *mysql.ClassRepository
+	courseRep  *mysql.CourseRepository
+	poolRep    *mysql.PoolRepository
+	sessionRep *mysql.SessionRepository
+	starter    *sessionStarter
+	cfg        config.ClassConfig
+}
+
+func (s *classScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.run(ctx)
+		}
+	}
+}
+
+func (s *classScheduler) run(ctx context.Context) {
+	classes, err := s.classRep.ListDueWindows(ctx, s.cfg.WarmupLead)
+
+	if err != nil {
+		log.Printf("error listing classes:  %v", err)
+		return
+	}
+
+	for _, class := range classes {
+		if err := s.advance(ctx, class); err != nil {
+			log.Printf("error running class %d:  %v", class.ID, err)
+		}
+	}
+}
+
+func (s *classScheduler) advance(ctx context.Context, class mysql.ClassWindow) error {
+	now := time.Now()
+
+	switch {
+	case !now.Before(class.EndsAt):
+		return s.end(ctx, class)
+	case !now.Before(class.StartsAt):
+		if class.Status == mysql.ClassOpen {
+			return nil
+		}
+
+		log.Printf("course %d: class %d started", class.CourseID, class.ID)
+
+		return s.classRep.SetWindowStatus(ctx, class.ID, class.Status, mysql.ClassOpen)
+	}
+
+	if class.Status == mysql.ClassScheduled {
+		log.Printf("course %d: warming up class %d", class.CourseID, class.ID)
+
+		if err := s.classRep.SetWindowStatus(ctx, class.ID, mysql.ClassScheduled, mysql.ClassWarming); err != nil {
+			return err
+		}
+	}
+
+	return s.warm(ctx, class)
+}
+
+// warm places the students that have no session on the course labs yet and
+// provisions them together, starting the instances they are placed on.
+func (s *classScheduler) warm(ctx context.Context, class mysql.ClassWindow) error {
+	loads, err := s.poolRep.ListCourseLoad(ctx, class.CourseID)
+
+	if err != nil {
+		return err
+	}
+
+	if len(loads) == 0 {
+		return fmt.Errorf("course %d has no labs", class.CourseID)
+	}
+
+	students, err := s.courseRep.ListEnrolledUsers(ctx, class.CourseID)
+
+	if err != nil {
+		return err
+	}
+
+	var batch []placement
+
+	for _, student := range students {
+		if student.Type == mysql.Professor {
+			continue
+		}
+
+		// Students already on a course lab keep their session for the class.
+		session, err := s.sessionRep.GetActiveCourseSession(ctx, student.ID, class.CourseID)
+
+		if err == nil {
+			if session.ClassWindowID == nil {
+				if err := s.sessionRep.AttachClass(ctx, session.ID, class); err != nil {
+					return err
+				}
+			}
+
+			continue
+		}
+
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		lab, err := scheduler.Place(loads)
+
+		if errors.Is(err, scheduler.ErrNoCapacity) {
+			log.Printf("course %d: class %d has no slot left for user %s", class.CourseID, class.ID, student.UserName)
+			break
+		}
+
+		// Count the slot right away so that the next student goes elsewhere.
+		for i := range loads {
+			if loads[i].ID == lab.ID {
+				loads[i].ActiveSessions++
+			}
+		}
+
+		batch = append(batch, placement{Lab: lab, User: student})
+	}
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	startCtx, cancel := context.WithTimeout(ctx, 15*time.Minute)
+	defer cancel()
+
+	sessions, errs := s.starter.StartBatch(startCtx, batch)
+
+	for i, err := range errs {
+		lab, student := batch[i].Lab, batch[i].User
+
+		switch {
+		// Instances that are still starting are provisioned on the next run.
+		case errors.Is(err, inventory.ErrInstanceStarting) || errors.Is(err, mysql.ErrLabFull):
+		case err != nil:
+			log.Printf("error provisioning user %s for class %d:  %v", student.UserName, class.ID, err)
+		default:
+			log.Printf("lab %d user %s: provisioned for class %d", lab.ID, student.UserName, class.ID)
+
+			if err := s.sessionRep.AttachClass(ctx, sessions[i].ID, class); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// end tears down the sessions of the class and closes it.
+func (s *classScheduler) end(ctx context.Context, class mysql.ClassWindow) error {
+	sessions, err := s.sessionRep.ListClassSessions(ctx, class.ID)
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("course %d: class %d ended, tearing down %d sessions", class.CourseID, class.ID, len(sessions))
+
+	jobs := make([]func(), 0, len(sessions))
+
+	for _, session := range sessions {
+		session := session
+		jobs = append(jobs, func() {
+			endCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+			defer cancel()
+
+			if err := s.starter.End(endCtx, session, mysql.EndReasonClass); err != nil {
+				log.Printf("error ending session %d of class %d:  %v", session.ID, class.ID, err)
+			}
+		})
+	}
+
+	parallel(s.cfg.Concurrency, jobs)
+
+	return s.classRep.EndWindow(ctx, class.ID)
+}
+
+// parallel runs the jobs with at most limit of them at a time.
+func parallel(limit int, jobs []func()) {
+	if limit < 1 {
+		limit = 1
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, limit)
+
+	for _, job := range jobs {
+		job := job
+		slots <- struct{}{}
+		wg.Add(1)
+
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			job()
+		}()
+	}
+
+	wg.Wait()
+}
+
+// classFromForm reads the range of a new class, in RFC 3339. Classes start
+// in the future.
+func classFromForm(r *http.Request) (class mysql.ClassWindow, err error) {
+	if err = r.ParseForm(); err != nil {
+		return
+	}
+
+	if class.StartsAt, err = time.Parse(time.RFC3339, r.FormValue("starts_at")); err != nil {
+		return class, fmt.Errorf("starts_at: %w", err)
+	}
+
+	if class.EndsAt, err = time.Parse(time.RFC3339, r.FormValue("ends_at")); err != nil {
+		return class, fmt.Errorf("ends_at: %w", err)
+	}
+
+	class.StartsAt, class.EndsAt = class.StartsAt.UTC(), class.EndsAt.UTC()
+
+	if !class.EndsAt.After(class.StartsAt) {
+		return class, fmt.Errorf("ends_at: must be after starts_at")
+	}
+
+	if !class.StartsAt.After(time.Now()) {
+		return class, fmt.Errorf("starts_at: must be in the future")
+	}
+
+	return class, nil
+}
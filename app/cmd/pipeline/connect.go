@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/inventory"
+	"github.com/danutavadanei/nice-lab-go/internal/provision"
+	"github.com/danutavadanei/nice-lab-go/internal/quota"
+)
+
+// connector serves the requests of users connecting to a lab. It is shared
+// by the lab and pool endpoints.
+type connector struct {
+	starter           *sessionStarter
+	sessionRep        *mysql.SessionRepository
+	idempotencyKeyRep *mysql.IdempotencyKeyRepository
+	reservationRep    *mysql.ReservationRepository
+	queueRep          *mysql.QueueRepository
+	quotas            *quota.Checker
+}
+
+// Connect returns the user's session on the lab, provisioning it when
+// needed. Users are queued when the lab is full or its instance is starting.
+func (c *connector) Connect(w http.ResponseWriter, r *http.Request, lab mysql.Lab) {
+	user := r.Context().Value("user").(mysql.User)
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+
+	if idempotencyKey != "" {
+		sessionId, err := c.idempotencyKeyRep.ClaimKey(r.Context(), user.ID, lab.ID, idempotencyKey)
+
+		switch {
+		case errors.Is(err, mysql.ErrIdempotencyKeyInProgress):
+			w.WriteHeader(http.StatusConflict)
+			return
+		case errors.Is(err, mysql.ErrIdempotencyKeyMismatch):
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		case err != nil:
+			log.Printf("error claiming idempotency key:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case sessionId != nil:
+			session, err := c.sessionRep.GetSessionById(r.Context(), *sessionId)
+
+			if err != nil {
+				log.Printf("error fetching session:  %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			writeSession(w, session)
+			return
+		}
+	}
+
+	if err := checkQuota(r.Context(), c.quotas, c.sessionRep, user, lab); err != nil {
+		if idempotencyKey != "" {
+			if err := c.idempotencyKeyRep.ReleaseKey(r.Context(), user.ID, idempotencyKey); err != nil {
+				log.Printf("error releasing idempotency key:  %v", err)
+			}
+		}
+
+		var exceeded *quota.Exceeded
+		if !errors.As(err, &exceeded) {
+			log.Printf("error checking quota:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeExceeded(w, exceeded)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	session, err := c.starter.Start(ctx, &lab, &user)
+
+	if err != nil {
+		if idempotencyKey != "" {
+			if err := c.idempotencyKeyRep.ReleaseKey(r.Context(), user.ID, idempotencyKey); err != nil {
+				log.Printf("error releasing idempotency key:  %v", err)
+			}
+		}
+
+		// The concurrent session limit is enforced again as the session is
+		// reserved, for parallel requests that all passed the check above.
+		var exceeded *quota.Exceeded
+		if errors.As(err, &exceeded) {
+			writeExceeded(w, exceeded)
+			return
+		}
+
+		// Users wait in the queue for a full lab or an instance that is
+		// starting, and are provisioned once it is ready.
+		if errors.Is(err, mysql.ErrLabFull) || errors.Is(err, inventory.ErrInstanceStarting) {
+			priority := mysql.PriorityStudent
+			if user.Type == mysql.Professor {
+				priority = mysql.PriorityProfessor
+			}
+
+			// Users holding a reservation are served first.
+			_, err := c.reservationRep.GetCurrentReservation(r.Context(), user.ID, lab.ID)
+
+			switch {
+			case err == nil:
+				priority = mysql.PriorityReservation
+			case !errors.Is(err, sql.ErrNoRows):
+				log.Printf("error fetching reservation:  %v", err)
+			}
+
+			entry, err := c.queueRep.Enqueue(r.Context(), user.ID, lab.ID, priority)
+
+			if err != nil {
+				log.Printf("error queueing user:  %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			view, err := describeQueueEntry(r.Context(), c.queueRep, lab, entry)
+
+			if err != nil {
+				log.Printf("error describing queue entry:  %v", err)
+			}
+
+			bytes, _ := json.Marshal(view)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Location", fmt.Sprintf("/queue/%d", entry.ID))
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = w.Write(bytes)
+			return
+		}
+
+		log.Printf("error creating session:  %v", err)
+
+		if errors.Is(err, provision.ErrUnknownLabType) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		if errors.Is(err, mysql.ErrLabUnavailable) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		if errors.Is(err, inventory.ErrInstanceGone) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		if errors.Is(err, provision.ErrInvalidUsername) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+
+		var provisionErr *provision.Error
+		if !errors.As(err, &provisionErr) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		status := http.StatusBadGateway
+		if errors.Is(err, provision.ErrAgentOffline) || errors.Is(err, provision.ErrStorageMissing) {
+			status = http.StatusServiceUnavailable
+		}
+
+		bytes, _ := json.Marshal(struct {
+			Error   provision.Kind         `json:"error"`
+			Step    string                 `json:"step,omitempty"`
+			Results []provision.StepResult `json:"results,omitempty"`
+		}{
+			Error:   provisionErr.Kind,
+			Step:    provisionErr.Step,
+			Results: provisionErr.Results,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write(bytes)
+		return
+	}
+
+	if idempotencyKey != "" {
+		if err := c.idempotencyKeyRep.CompleteKey(r.Context(), user.ID, idempotencyKey, session.ID); err != nil {
+			log.Printf("error completing idempotency key:  %v", err)
+		}
+	}
+
+	writeSession(w, session)
+}
+
+// writeSession returns the session to the user. A session another request
+// is still provisioning is accepted instead, and the user polls it at its
+// Location until it is active.
+func writeSession(w http.ResponseWriter, session mysql.Session) {
+	bytes, _ := json.Marshal(session)
+
+	if session.Status == mysql.SessionProvisioning {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", fmt.Sprintf("/sessions/%d", session.ID))
+		w.WriteHeader(http.StatusAccepted)
+	}
+
+	_, _ = w.Write(bytes)
+}
+
+// writeExceeded tells which quota refused the session.
+func writeExceeded(w http.ResponseWriter, exceeded *quota.Exceeded) {
+	status := http.StatusForbidden
+	if exceeded.Temporary {
+		status = http.StatusTooManyRequests
+	}
+
+	bytes, _ := json.Marshal(exceeded)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(bytes)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+	"github.com/danutavadanei/nice-lab-go/internal/inventory"
+	"github.com/danutavadanei/nice-lab-go/internal/provision"
+	"github.com/danutavadanei/nice-lab-go/internal/provision/provisiontest"
+	"github.com/danutavadanei/nice-lab-go/internal/quota"
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	testUser = mysql.User{ID: 3, UUID: "user-uuid", Name: "Alice", Email: "alice@example.com", Type: mysql.Professor, UserName: "alice"}
+	testLab  = mysql.Lab{ID: 7, UUID: "lab-uuid", Name: "lab", Type: mysql.Ubuntu, InstanceID: "i-0123", Available: true, Backend: mysql.BackendSSM, MaxSessions: 1, State: mysql.LabActive}
+)
+
+// newTestStarter returns a session starter provisioning with p, whose
+// repositories query mock through db.
+func newTestStarter(t *testing.T, p provision.Provisioner) (*sessionStarter, *sqlx.DB, sqlmock.Sqlmock) {
+	t.Helper()
+
+	conn, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	db := sqlx.NewDb(conn, "mysql")
+	userRep := mysql.NewUserRepository(db)
+	labRep := mysql.NewLabRepository(db)
+
+	templates, err := provision.LoadTemplates("")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &sessionStarter{
+		provisioner: p,
+		sessionRep:  mysql.NewSessionRepository(db, userRep, labRep),
+		templateRep: mysql.NewTemplateRepository(db),
+		templates:   templates,
+		power:       inventory.NewPower(nil, nil, labRep, config.PowerConfig{}),
+		warmRep:     mysql.NewWarmRepository(db),
+		warmStats:   newWarmStats(),
+		quotas:      quota.NewChecker(mysql.NewQuotaRepository(db), mysql.NewCourseRepository(db), config.QuotaConfig{MaxConcurrentSessions: 1}),
+	}, db, mock
+}
+
+// newTestConnector returns a connector provisioning with p, whose
+// repositories query mock.
+func newTestConnector(t *testing.T, p provision.Provisioner) (*connector, sqlmock.Sqlmock) {
+	t.Helper()
+
+	starter, db, mock := newTestStarter(t, p)
+
+	return &connector{
+		starter:           starter,
+		sessionRep:        starter.sessionRep,
+		idempotencyKeyRep: mysql.NewIdempotencyKeyRepository(db),
+		reservationRep:    mysql.NewReservationRepository(db),
+		queueRep:          mysql.NewQueueRepository(db),
+		quotas:            starter.quotas,
+	}, mock
+}
+
+func sessionRows(id uint64, status mysql.SessionStatus) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "user_id", "lab_id", "status", "created_at"}).
+		AddRow(id, testUser.ID, testLab.ID, status, time.Now())
+}
+
+func userRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "uuid", "name", "email", "type", "username"}).
+		AddRow(testUser.ID, testUser.UUID, testUser.Name, testUser.Email, testUser.Type, testUser.UserName)
+}
+
+func labRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "uuid", "name", "type", "hostname", "instance_id", "available", "backend", "max_sessions", "state"}).
+		AddRow(testLab.ID, testLab.UUID, testLab.Name, testLab.Type, testLab.Hostname, testLab.InstanceID, testLab.Available, testLab.Backend, testLab.MaxSessions, testLab.State)
+}
+
+// expectSession expects the session to be loaded with its user and lab.
+func expectSession(mock sqlmock.Sqlmock, id uint64, status mysql.SessionStatus) {
+	mock.ExpectQuery(`SELECT \* FROM sessions WHERE id = \?`).WithArgs(id).WillReturnRows(sessionRows(id, status))
+	mock.ExpectQuery(`SELECT id,uuid,name,email,type,username FROM users WHERE id = \?`).WithArgs(testUser.ID).WillReturnRows(userRows())
+	mock.ExpectQuery(`SELECT \* FROM labs WHERE id = \?`).WithArgs(testLab.ID).WillReturnRows(labRows())
+}
+
+// expectReserve expects a new session to be reserved on the empty test lab
+// for the test user, who has none yet.
+func expectReserve(mock sqlmock.Sqlmock, id uint64) {
+	mock.ExpectQuery(`SELECT \* FROM sessions WHERE user_id = \? AND lab_id = \? AND status = \?`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(`SELECT \* FROM provisioning_templates`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(`SELECT \* FROM sessions WHERE user_id = \? AND lab_id = \? AND status = \?`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT max_sessions, state FROM labs WHERE id = \? AND deleted_at IS NULL FOR UPDATE`).
+		WithArgs(testLab.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"max_sessions", "state"}).AddRow(1, mysql.LabActive))
+	mock.ExpectQuery(`SELECT \* FROM sessions WHERE user_id = \? AND lab_id = \? AND \(status`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM sessions`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery(`SELECT \* FROM reservations`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(`SELECT \* FROM queue_entries`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec(`INSERT INTO sessions \(user_id, lab_id, status\)`).
+		WithArgs(testUser.ID, testLab.ID, mysql.SessionProvisioning).
+		WillReturnResult(sqlmock.NewResult(int64(id), 1))
+	mock.ExpectCommit()
+	expectSession(mock, id, mysql.SessionProvisioning)
+}
+
+func connectRequest(user mysql.User) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/labs/7", nil)
+
+	return r.WithContext(context.WithValue(r.Context(), "user", user))
+}
+
+func TestConnectProvisionsSession(t *testing.T) {
+	p := &provisiontest.Provisioner{}
+	c, mock := newTestConnector(t, p)
+
+	expectReserve(mock, 42)
+	mock.ExpectExec(`UPDATE sessions JOIN labs`).WithArgs(mysql.SessionActive, 42, mysql.SessionProvisioning).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSession(mock, 42, mysql.SessionActive)
+
+	w := httptest.NewRecorder()
+	c.Connect(w, connectRequest(testUser), testLab)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	var session mysql.Session
+
+	if err := json.Unmarshal(w.Body.Bytes(), &session); err != nil {
+		t.Fatal(err)
+	}
+
+	if session.ID != 42 || session.Status != mysql.SessionActive {
+		t.Errorf("session = %d %s, want 42 active", session.ID, session.Status)
+	}
+
+	calls := p.Calls()
+
+	if len(calls) != 1 {
+		t.Fatalf("ran %d scripts, want 1", len(calls))
+	}
+
+	if calls[0].LabID != testLab.ID || !strings.Contains(calls[0].Script(), "adduser") {
+		t.Errorf("did not run the provisioning plan on lab 7:\n%s", calls[0].Script())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnectAcceptsSessionStillProvisioning(t *testing.T) {
+	p := &provisiontest.Provisioner{}
+	c, mock := newTestConnector(t, p)
+
+	none := func() *sqlmock.Rows { return sqlmock.NewRows([]string{"id"}) }
+
+	// A parallel request reserved the session and is provisioning it.
+	mock.ExpectQuery(`SELECT \* FROM sessions WHERE user_id = \? AND lab_id = \? AND status = \?`).WillReturnRows(none())
+	mock.ExpectQuery(`SELECT \* FROM provisioning_templates`).WillReturnRows(none())
+	mock.ExpectQuery(`SELECT \* FROM sessions WHERE user_id = \? AND lab_id = \? AND status = \?`).WillReturnRows(none())
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT max_sessions, state FROM labs WHERE id = \? AND deleted_at IS NULL FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows([]string{"max_sessions", "state"}).AddRow(1, mysql.LabActive))
+	mock.ExpectQuery(`SELECT \* FROM sessions WHERE user_id = \? AND lab_id = \? AND \(status`).WillReturnRows(sessionRows(42, mysql.SessionProvisioning))
+	mock.ExpectCommit()
+	mock.ExpectQuery(`SELECT id,uuid,name,email,type,username FROM users WHERE id = \?`).WithArgs(testUser.ID).WillReturnRows(userRows())
+	mock.ExpectQuery(`SELECT \* FROM labs WHERE id = \?`).WithArgs(testLab.ID).WillReturnRows(labRows())
+
+	w := httptest.NewRecorder()
+	c.Connect(w, connectRequest(testUser), testLab)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+
+	if location := w.Header().Get("Location"); location != "/sessions/42" {
+		t.Errorf("Location = %q, want /sessions/42", location)
+	}
+
+	if calls := p.Calls(); len(calls) != 0 {
+		t.Errorf("ran %d scripts, want none", len(calls))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnectUndoesAppliedStepsWhenStepFails(t *testing.T) {
+	p := &provisiontest.Provisioner{FailStep: "create-storage"}
+	c, mock := newTestConnector(t, p)
+
+	expectReserve(mock, 42)
+	mock.ExpectExec(`UPDATE sessions SET status = \?, ended_at = NOW\(\), diagnostics = \?`).
+		WithArgs(mysql.SessionFailed, sqlmock.AnyArg(), 42, mysql.SessionProvisioning).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	c.Connect(w, connectRequest(testUser), testLab)
+
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusBadGateway, w.Body)
+	}
+
+	var res struct {
+		Error provision.Kind `json:"error"`
+		Step  string         `json:"step"`
+	}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Error != provision.KindStepFailed || res.Step != "create-storage" {
+		t.Errorf("response = %+v, want step_failed at create-storage", res)
+	}
+
+	calls := p.Calls()
+
+	if len(calls) != 2 {
+		t.Fatalf("ran %d scripts, want the plan and its compensation", len(calls))
+	}
+
+	undo := calls[1].Script()
+
+	for _, command := range []string{"close-session", "userdel -r"} {
+		if !strings.Contains(undo, command) {
+			t.Errorf("compensation does not run %q:\n%s", command, undo)
+		}
+	}
+
+	if strings.Contains(undo, "NiceLabData") {
+		t.Errorf("compensation undoes a step that did not run:\n%s", undo)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnectReportsBackendError(t *testing.T) {
+	p := &provisiontest.Provisioner{Err: &provision.Error{Kind: provision.KindAgentOffline, Err: errors.New("agent of lab 7 is offline")}}
+	c, mock := newTestConnector(t, p)
+
+	expectReserve(mock, 42)
+	mock.ExpectExec(`UPDATE sessions SET status = \?, ended_at = NOW\(\), diagnostics = \?`).
+		WithArgs(mysql.SessionFailed, sqlmock.AnyArg(), 42, mysql.SessionProvisioning).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	c.Connect(w, connectRequest(testUser), testLab)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusServiceUnavailable, w.Body)
+	}
+
+	if !strings.Contains(w.Body.String(), string(provision.KindAgentOffline)) {
+		t.Errorf("response does not name the error: %s", w.Body)
+	}
+
+	if calls := p.Calls(); len(calls) != 1 {
+		t.Errorf("ran %d scripts, want 1", len(calls))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnectEnforcesConcurrentLimitWhenReserving(t *testing.T) {
+	p := &provisiontest.Provisioner{}
+	c, mock := newTestConnector(t, p)
+
+	student := testUser
+	student.Type = mysql.Student
+
+	none := func() *sqlmock.Rows { return sqlmock.NewRows([]string{"id"}) }
+
+	// The quota check passes, as a parallel request has not reserved its
+	// session yet.
+	mock.ExpectQuery(`SELECT \* FROM sessions WHERE user_id = \? AND lab_id = \? AND status = \?`).WillReturnRows(none())
+	mock.ExpectQuery(`SELECT \* FROM quota_overrides`).WillReturnRows(none())
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM sessions WHERE user_id = \?`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery(`FROM sessions WHERE user_id = \?`).WillReturnRows(sqlmock.NewRows([]string{"hours"}).AddRow(0))
+	mock.ExpectQuery(`SELECT courses.\* FROM courses`).WillReturnRows(none())
+	mock.ExpectQuery(`SELECT \* FROM provisioning_templates`).WillReturnRows(none())
+	mock.ExpectQuery(`SELECT \* FROM sessions WHERE user_id = \? AND lab_id = \? AND status = \?`).WillReturnRows(none())
+
+	// By the time the session is reserved, the parallel request got one.
+	mock.ExpectQuery(`SELECT \* FROM quota_overrides`).WillReturnRows(none())
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id FROM users WHERE id = \? FOR UPDATE`).WithArgs(student.ID).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(student.ID))
+	mock.ExpectQuery(`SELECT max_sessions, state FROM labs WHERE id = \? AND deleted_at IS NULL FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows([]string{"max_sessions", "state"}).AddRow(2, mysql.LabActive))
+	mock.ExpectQuery(`SELECT \* FROM sessions WHERE user_id = \? AND lab_id = \? AND \(status`).WillReturnRows(none())
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM sessions WHERE user_id = \? AND status IN`).
+		WithArgs(student.ID, mysql.SessionActive, mysql.SessionProvisioning).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectRollback()
+
+	w := httptest.NewRecorder()
+	c.Connect(w, connectRequest(student), testLab)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusTooManyRequests, w.Body)
+	}
+
+	if !strings.Contains(w.Body.String(), string(quota.KindConcurrentSessions)) {
+		t.Errorf("response does not name the limit: %s", w.Body)
+	}
+
+	if calls := p.Calls(); len(calls) != 0 {
+		t.Errorf("ran %d scripts, want none", len(calls))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+)
+
+// courseFromForm overwrites the fields of the course present in the request
+// form. Empty limits clear them.
+func courseFromForm(r *http.Request, course *mysql.Course) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	if _, ok := r.Form["name"]; ok {
+		course.Name = r.FormValue("name")
+	}
+
+	if course.Name == "" {
+		return fmt.Errorf("name: must not be empty")
+	}
+
+	limits := map[string]**int{
+		"max_session_minutes":     &course.MaxSessionMinutes,
+		"extension_quota_minutes": &course.ExtensionQuotaMinutes,
+		"lab_hours_budget":        &course.LabHoursBudget,
+	}
+
+	for key, field := range limits {
+		if _, ok := r.Form[key]; !ok {
+			continue
+		}
+
+		value, err := optionalCount(r.FormValue(key))
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		*field = value
+	}
+
+	return nil
+}
+
+// optionalCount parses a positive number; empty values are nil.
+func optionalCount(value string) (*int, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("must be a positive number")
+	}
+
+	return &count, nil
+}
+
+// overrideFromForm overwrites the limits of the override present in the
+// request form. Empty values restore the default.
+func overrideFromForm(r *http.Request, override *mysql.QuotaOverride) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	limits := map[string]**int{
+		"max_concurrent_sessions": &override.MaxConcurrentSessions,
+		"weekly_hours":            &override.WeeklyHours,
+	}
+
+	for key, field := range limits {
+		if _, ok := r.Form[key]; !ok {
+			continue
+		}
+
+		value, err := optionalCount(r.FormValue(key))
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		*field = value
+	}
+
+	return nil
+}
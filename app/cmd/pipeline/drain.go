@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/provision"
+)
+
+// labDrainer moves draining labs into maintenance. The users of a draining
+// lab are notified once through DCV, and the lab goes into maintenance as
+// soon as their sessions end, or once its deadline passes after ending the
+// sessions left.
+type labDrainer struct {
+	labRep      *mysql.LabRepository
+	sessionRep  *mysql.SessionRepository
+	provisioner provision.Provisioner
+	starter     *sessionStarter
+	interval    time.Duration
+}
+
+func (d *labDrainer) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.drain(ctx)
+		}
+	}
+}
+
+func (d *labDrainer) drain(ctx context.Context) {
+	labs, err := d.labRep.ListLabsByState(ctx, mysql.LabDraining)
+
+	if err != nil {
+		log.Printf("error listing draining labs:  %v", err)
+		return
+	}
+
+	for _, lab := range labs {
+		if err := d.drainLab(ctx, lab); err != nil {
+			log.Printf("error draining lab %d:  %v", lab.ID, err)
+		}
+	}
+}
+
+func (d *labDrainer) drainLab(ctx context.Context, lab mysql.Lab) error {
+	sessions, err := d.sessionRep.ListActiveLabSessions(ctx, lab.ID)
+
+	if err != nil {
+		return err
+	}
+
+	if lab.DrainNotifiedAt == nil && len(sessions) > 0 {
+		d.notify(ctx, lab, sessions)
+
+		if err := d.labRep.MarkDrainNotified(ctx, lab.ID); err != nil {
+			return err
+		}
+	}
+
+	if len(sessions) > 0 && lab.DrainDeadline != nil && time.Now().Before(*lab.DrainDeadline) {
+		return nil
+	}
+
+	for _, session := range sessions {
+		endCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+		err := d.starter.End(endCtx, session, mysql.EndReasonDrained)
+		cancel()
+
+		if err != nil {
+			log.Printf("error ending session %d of draining lab %d:  %v", session.ID, lab.ID, err)
+		}
+	}
+
+	if err := d.labRep.FinishDrain(ctx, lab.ID); err != nil {
+		return err
+	}
+
+	log.Printf("lab %d: drained, %d sessions ended, in maintenance", lab.ID, len(sessions))
+
+	return nil
+}
+
+// notify shows the drain message in every session on the lab. Users that
+// cannot be notified are still drained at the deadline.
+func (d *labDrainer) notify(ctx context.Context, lab mysql.Lab, sessions []mysql.Session) {
+	message := ""
+	if lab.DrainMessage != nil {
+		message = *lab.DrainMessage
+	}
+
+	if lab.DrainDeadline != nil {
+		message += " Sessions end at " + lab.DrainDeadline.UTC().Format("15:04 UTC") + "."
+	}
+
+	for _, session := range sessions {
+		if err := notifySession(ctx, d.provisioner, lab, session.OSUser(), message); err != nil {
+			log.Printf("error notifying user %s on lab %d:  %v", session.User.UserName, lab.ID, err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+)
+
+// labFromForm overwrites the fields of the lab present in the request form.
+// Empty pool_id, course_id, max_session_minutes, template_name and
+// template_version values clear them.
+func labFromForm(r *http.Request, lab *mysql.Lab) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	if _, ok := r.Form["name"]; ok {
+		lab.Name = r.FormValue("name")
+	}
+
+	if _, ok := r.Form["type"]; ok {
+		lab.Type = mysql.LabType(r.FormValue("type"))
+	}
+
+	if _, ok := r.Form["hostname"]; ok {
+		lab.Hostname = r.FormValue("hostname")
+	}
+
+	if _, ok := r.Form["instance_id"]; ok {
+		lab.InstanceID = r.FormValue("instance_id")
+	}
+
+	if _, ok := r.Form["backend"]; ok {
+		lab.Backend = mysql.LabBackend(r.FormValue("backend"))
+	}
+
+	if _, ok := r.Form["available"]; ok {
+		available, err := strconv.ParseBool(r.FormValue("available"))
+		if err != nil {
+			return fmt.Errorf("available: %w", err)
+		}
+		lab.Available = available
+	}
+
+	if _, ok := r.Form["max_sessions"]; ok {
+		maxSessions, err := strconv.Atoi(r.FormValue("max_sessions"))
+		if err != nil {
+			return fmt.Errorf("max_sessions: %w", err)
+		}
+		lab.MaxSessions = maxSessions
+	}
+
+	if _, ok := r.Form["warm_pool_size"]; ok {
+		size, err := strconv.Atoi(r.FormValue("warm_pool_size"))
+		if err != nil || size < 0 {
+			return fmt.Errorf("warm_pool_size: must be zero or more")
+		}
+		lab.WarmPoolSize = size
+	}
+
+	if _, ok := r.Form["pool_id"]; ok {
+		lab.PoolID = nil
+
+		if value := r.FormValue("pool_id"); value != "" {
+			poolId, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("pool_id: %w", err)
+			}
+			lab.PoolID = &poolId
+		}
+	}
+
+	if _, ok := r.Form["course_id"]; ok {
+		lab.CourseID = nil
+
+		if value := r.FormValue("course_id"); value != "" {
+			courseId, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("course_id: %w", err)
+			}
+			lab.CourseID = &courseId
+		}
+	}
+
+	if _, ok := r.Form["max_session_minutes"]; ok {
+		minutes, err := optionalCount(r.FormValue("max_session_minutes"))
+		if err != nil {
+			return fmt.Errorf("max_session_minutes: %w", err)
+		}
+		lab.MaxSessionMinutes = minutes
+	}
+
+	if _, ok := r.Form["template_name"]; ok {
+		lab.TemplateName = nil
+
+		if value := r.FormValue("template_name"); value != "" {
+			lab.TemplateName = &value
+		}
+	}
+
+	if _, ok := r.Form["template_version"]; ok {
+		lab.TemplateVersion = nil
+
+		if value := r.FormValue("template_version"); value != "" {
+			version, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("template_version: %w", err)
+			}
+			lab.TemplateVersion = &version
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+	"github.com/danutavadanei/nice-lab-go/internal/provision"
+)
+
+// sessionLimiter enforces the maximum duration of sessions. Users are
+// warned through DCV as their session crosses each warning threshold, and
+// expired sessions are torn down.
+type sessionLimiter struct {
+	sessionRep  *mysql.SessionRepository
+	provisioner provision.Provisioner
+	starter     *sessionStarter
+	cfg         config.LimitsConfig
+}
+
+func (l *sessionLimiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.cfg.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.enforce(ctx)
+		}
+	}
+}
+
+func (l *sessionLimiter) enforce(ctx context.Context) {
+	sessions, err := l.sessionRep.ListActiveSessions(ctx)
+
+	if err != nil {
+		log.Printf("error listing active sessions:  %v", err)
+		return
+	}
+
+	for _, session := range sessions {
+		if session.ExpiresAt == nil {
+			continue
+		}
+
+		if err := l.enforceSession(ctx, session); err != nil {
+			log.Printf("error enforcing time limit of session %d:  %v", session.ID, err)
+		}
+	}
+}
+
+func (l *sessionLimiter) enforceSession(ctx context.Context, session mysql.Session) error {
+	remaining := time.Until(*session.ExpiresAt)
+
+	// Sessions of a class are torn down together when it ends.
+	if remaining <= 0 && session.ClassWindowID != nil {
+		return nil
+	}
+
+	if remaining <= 0 {
+		log.Printf("lab %d user %s: session %d expired", session.Lab.ID, session.User.UserName, session.ID)
+
+		endCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+		defer cancel()
+
+		return l.starter.End(endCtx, session, mysql.EndReasonExpired)
+	}
+
+	// Thresholds are sorted from the longest; only the shortest one crossed
+	// is announced.
+	threshold := 0
+	for _, t := range l.cfg.WarnThresholds {
+		if remaining <= t {
+			threshold = int(t.Seconds())
+		}
+	}
+
+	if threshold == 0 || (session.ExpiryWarn != nil && *session.ExpiryWarn <= threshold) {
+		return nil
+	}
+
+	message := fmt.Sprintf("This session ends in %s. Save your work or request an extension.", remaining.Round(time.Minute))
+	if remaining < time.Minute {
+		message = "This session ends in less than a minute. Save your work."
+	}
+
+	if err := notifySession(ctx, l.provisioner, session.Lab, session.OSUser(), message); err != nil {
+		log.Printf("error warning user %s on lab %d:  %v", session.User.UserName, session.Lab.ID, err)
+	}
+
+	return l.sessionRep.MarkExpiryWarned(ctx, session.ID, threshold)
+}
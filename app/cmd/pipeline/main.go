@@ -2,15 +2,30 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	awscf "github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	awsec2 "github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	awsssm "github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/cloudformation"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/dcvsm"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/ec2"
 	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/ssm"
 	"github.com/danutavadanei/nice-lab-go/internal/config"
+	"github.com/danutavadanei/nice-lab-go/internal/fleet"
+	"github.com/danutavadanei/nice-lab-go/internal/inventory"
+	"github.com/danutavadanei/nice-lab-go/internal/provision"
+	"github.com/danutavadanei/nice-lab-go/internal/quota"
+	"github.com/danutavadanei/nice-lab-go/internal/scheduler"
 	"github.com/danutavadanei/nice-lab-go/internal/server"
 	"github.com/danutavadanei/nice-lab-go/internal/server/middleware"
 	"github.com/gorilla/mux"
 	"github.com/spf13/viper"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -27,7 +42,7 @@ func main() {
 	v := viper.New()
 	v.AutomaticEnv()
 
-	sigChannel := make(chan os.Signal)
+	sigChannel := make(chan os.Signal, 1)
 	signal.Notify(sigChannel, os.Interrupt, syscall.SIGTERM)
 
 	cfg := config.NewAppConfig(v)
@@ -41,326 +56,2404 @@ func main() {
 	labRep := mysql.NewLabRepository(db)
 	sessionRep := mysql.NewSessionRepository(db, userRep, labRep)
 	authTokenRep := mysql.NewAuthTokenRepository(db, userRep)
+	idempotencyKeyRep := mysql.NewIdempotencyKeyRepository(db)
+	templateRep := mysql.NewTemplateRepository(db)
+	poolRep := mysql.NewPoolRepository(db)
+	queueRep := mysql.NewQueueRepository(db)
+	fleetRep := mysql.NewFleetRepository(db)
+	healthRep := mysql.NewHealthRepository(db)
+	courseRep := mysql.NewCourseRepository(db)
+	extensionRep := mysql.NewExtensionRepository(db)
+	quotaRep := mysql.NewQuotaRepository(db)
+	reservationRep := mysql.NewReservationRepository(db)
+	classRep := mysql.NewClassRepository(db)
+	warmRep := mysql.NewWarmRepository(db)
+	agentRep := mysql.NewAgentRepository(db)
+	calendarTokenRep := mysql.NewCalendarTokenRepository(db, userRep)
 	tokenUsers, err := authTokenRep.ListTokenUsers(context.Background())
 	if err != nil {
 		panic(err)
 	}
 
 	authMiddleware := middleware.NewAuthenticationMiddleware(tokenUsers, authTokenRep)
+	agentMiddleware := middleware.NewAgentAuthenticationMiddleware(agentRep)
+	calendarMiddleware := middleware.NewCalendarAuthenticationMiddleware(calendarTokenRep)
 
-	ssmClient := ssm.NewFromConfig(*cfg.AWSConfig)
+	ssmClient := awsssm.NewFromConfig(*cfg.AWSConfig)
+
+	ssmExecutor := ssm.NewExecutor(
+		ssmClient,
+		s3.NewFromConfig(*cfg.AWSConfig),
+		cfg.SSMConfig,
+	)
+
+	agents := provision.NewAgentProvisioner(agentRep, cfg.AgentConfig)
+
+	backends := map[mysql.LabBackend]provision.Provisioner{
+		mysql.BackendSSM:   provision.NewSSMProvisioner(ssmExecutor),
+		mysql.BackendAgent: agents,
+	}
+
+	if cfg.SSHConfig.PrivateKeyPath != "" {
+		sshProvisioner, err := provision.NewSSHProvisioner(cfg.SSHConfig)
+		if err != nil {
+			panic(err)
+		}
+
+		backends[mysql.BackendSSH] = sshProvisioner
+	}
+
+	provisioner := provision.NewRouter(backends)
+
+	var broker *dcvsm.Broker
+
+	if cfg.BrokerConfig.Url != "" {
+		broker = dcvsm.NewBroker(cfg.BrokerConfig)
+	}
+
+	instances := ec2.NewInstances(awsec2.NewFromConfig(*cfg.AWSConfig))
+	managed := ssm.NewInventory(ssmClient)
+	validator := inventory.NewValidator(instances, managed)
+	power := inventory.NewPower(instances, managed, labRep, cfg.PowerConfig)
+	discovery := inventory.NewDiscovery(instances, labRep, cfg.DiscoveryConfig.TagKey)
+	health := inventory.NewHealth(instances, managed, labRep, healthRep, agents, broker, cfg.HealthConfig)
+	stacks := cloudformation.NewStacks(awscf.NewFromConfig(*cfg.AWSConfig))
+	fleetManager := fleet.NewManager(stacks, poolRep, fleetRep, labRep, cfg.FleetConfig)
+
+	templates, err := provision.LoadTemplates(cfg.ProvisioningConfig.TemplatesDir)
+	if err != nil {
+		panic(err)
+	}
+
+	quotas := quota.NewChecker(quotaRep, courseRep, cfg.QuotaConfig)
+
+	starter := &sessionStarter{
+		provisioner: provisioner,
+		sessionRep:  sessionRep,
+		templateRep: templateRep,
+		templates:   templates,
+		power:       power,
+		warmRep:     warmRep,
+		warmStats:   newWarmStats(),
+		broker:      broker,
+		brokerCfg:   cfg.BrokerConfig,
+		quotas:      quotas,
+	}
+
+	dispatcher := &queueDispatcher{
+		quotas:   quotas,
+		queueRep: queueRep,
+		labRep:   labRep,
+		userRep:  userRep,
+		starter:  starter,
+		interval: cfg.SchedulerConfig.QueueDispatchInterval,
+	}
+
+	drainer := &labDrainer{
+		labRep:      labRep,
+		sessionRep:  sessionRep,
+		provisioner: provisioner,
+		starter:     starter,
+		interval:    cfg.DrainConfig.CheckInterval,
+	}
+
+	reaper := &sessionReaper{
+		sessionRep:  sessionRep,
+		provisioner: provisioner,
+		starter:     starter,
+		cfg:         cfg.ReaperConfig,
+	}
+
+	limiter := &sessionLimiter{
+		sessionRep:  sessionRep,
+		provisioner: provisioner,
+		starter:     starter,
+		cfg:         cfg.LimitsConfig,
+	}
+
+	keeper := &reservationKeeper{
+		reservationRep: reservationRep,
+		cfg:            cfg.ReservationConfig,
+	}
+
+	classes := &classScheduler{
+		classRep:   classRep,
+		courseRep:  courseRep,
+		poolRep:    poolRep,
+		sessionRep: sessionRep,
+		starter:    starter,
+		cfg:        cfg.ClassConfig,
+	}
+
+	reconciler := &labReconciler{
+		labRep:      labRep,
+		userRep:     userRep,
+		sessionRep:  sessionRep,
+		warmRep:     warmRep,
+		provisioner: provisioner,
+		starter:     starter,
+		cfg:         cfg.ReconcileConfig,
+	}
+
+	warm := &warmPool{
+		labRep:     labRep,
+		sessionRep: sessionRep,
+		warmRep:    warmRep,
+		starter:    starter,
+		stats:      starter.warmStats,
+		cfg:        cfg.WarmConfig,
+	}
+
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	go dispatcher.Run(workersCtx)
+	go drainer.Run(workersCtx)
+
+	if cfg.DiscoveryConfig.Interval > 0 {
+		go discovery.Run(workersCtx, cfg.DiscoveryConfig.Interval)
+	}
+
+	if cfg.PowerConfig.IdleStopAfter > 0 {
+		go power.Run(workersCtx)
+	}
+
+	if cfg.FleetConfig.Interval > 0 {
+		go fleetManager.Run(workersCtx)
+	}
+
+	if cfg.LimitsConfig.CheckInterval > 0 {
+		go limiter.Run(workersCtx)
+	}
+
+	if cfg.ReaperConfig.Interval > 0 {
+		go reaper.Run(workersCtx)
+	}
+
+	if cfg.HealthConfig.CheckInterval > 0 {
+		go health.Run(workersCtx)
+	}
+
+	if cfg.ReservationConfig.Interval > 0 {
+		go keeper.Run(workersCtx)
+	}
+
+	if cfg.ClassConfig.Interval > 0 {
+		go classes.Run(workersCtx)
+	}
+
+	if cfg.ReconcileConfig.Interval > 0 {
+		go reconciler.Run(workersCtx)
+	}
+
+	if cfg.WarmConfig.Interval > 0 {
+		go warm.Run(workersCtx)
+	}
+
+	connect := (&connector{
+		starter:           starter,
+		sessionRep:        sessionRep,
+		idempotencyKeyRep: idempotencyKeyRep,
+		reservationRep:    reservationRep,
+		queueRep:          queueRep,
+		quotas:            quotas,
+	}).Connect
+
+	// queueEntry loads the queue entry of the request and its lab, allowing
+	// only its owner and professors.
+	queueEntry := func(w http.ResponseWriter, r *http.Request) (mysql.QueueEntry, mysql.Lab, bool) {
+		vars := mux.Vars(r)
+		id, err := strconv.ParseUint(vars["id"], 10, 64)
+
+		if err != nil {
+			log.Printf("error parsing request:  %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return mysql.QueueEntry{}, mysql.Lab{}, false
+		}
+
+		entry, err := queueRep.GetEntryById(r.Context(), id)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return mysql.QueueEntry{}, mysql.Lab{}, false
+		}
+
+		if err != nil {
+			log.Printf("error fetching queue entry:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return mysql.QueueEntry{}, mysql.Lab{}, false
+		}
+
+		user := r.Context().Value("user").(mysql.User)
+
+		if entry.UserID != user.ID && user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return mysql.QueueEntry{}, mysql.Lab{}, false
+		}
+
+		lab, err := labRep.GetLabById(r.Context(), entry.LabID)
+
+		if err != nil {
+			log.Printf("error fetching lab:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return mysql.QueueEntry{}, mysql.Lab{}, false
+		}
+
+		return entry, lab, true
+	}
+
+	// managedLab loads the lab of the request for a professor managing it.
+	managedLab := func(w http.ResponseWriter, r *http.Request) (mysql.Lab, bool) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return mysql.Lab{}, false
+		}
+
+		vars := mux.Vars(r)
+		id, err := strconv.ParseUint(vars["id"], 10, 64)
+
+		if err != nil {
+			log.Printf("error parsing request:  %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return mysql.Lab{}, false
+		}
+
+		lab, err := labRep.GetLabById(r.Context(), id)
+
+		if errors.Is(err, sql.ErrNoRows) || lab.DeletedAt != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return mysql.Lab{}, false
+		}
+
+		if err != nil {
+			log.Printf("error fetching lab:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return mysql.Lab{}, false
+		}
+
+		return lab, true
+	}
+
+	// saveLab validates the lab against its instance and stores it.
+	saveLab := func(w http.ResponseWriter, r *http.Request, lab mysql.Lab, status int) {
+		err := validator.Validate(r.Context(), &lab)
+
+		if errors.Is(err, inventory.ErrInvalidLab) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		if err != nil {
+			log.Printf("error validating lab:  %v", err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		if lab.ID == 0 {
+			lab, err = labRep.CreateLab(r.Context(), lab)
+		} else {
+			lab, err = labRep.UpdateLab(r.Context(), lab)
+		}
+
+		if err != nil {
+			log.Printf("error saving lab:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, _ := json.Marshal(lab)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write(bytes)
+	}
+
+	// managedPool returns the pool of the request for professors, writing the
+	// error response otherwise.
+	managedPool := func(w http.ResponseWriter, r *http.Request) (mysql.LabPool, bool) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return mysql.LabPool{}, false
+		}
+
+		vars := mux.Vars(r)
+		id, err := strconv.ParseUint(vars["id"], 10, 64)
+
+		if err != nil {
+			log.Printf("error parsing request:  %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return mysql.LabPool{}, false
+		}
+
+		pool, err := poolRep.GetPoolById(r.Context(), id)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return mysql.LabPool{}, false
+		}
+
+		if err != nil {
+			log.Printf("error fetching pool:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return mysql.LabPool{}, false
+		}
+
+		return pool, true
+	}
+
+	savePool := func(w http.ResponseWriter, r *http.Request, pool mysql.LabPool, status int) {
+		if _, err := provision.LookupLabType(pool.Type); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		var err error
+
+		if pool.ID == 0 {
+			pool, err = poolRep.CreatePool(r.Context(), pool)
+		} else {
+			pool, err = poolRep.UpdatePool(r.Context(), pool)
+		}
+
+		if err != nil {
+			log.Printf("error saving pool:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, _ := json.Marshal(pool)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write(bytes)
+	}
+
+	// managedCourse returns the course of the request for professors, writing
+	// the error response otherwise.
+	managedCourse := func(w http.ResponseWriter, r *http.Request) (mysql.Course, bool) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return mysql.Course{}, false
+		}
+
+		vars := mux.Vars(r)
+		id, err := strconv.ParseUint(vars["id"], 10, 64)
+
+		if err != nil {
+			log.Printf("error parsing request:  %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return mysql.Course{}, false
+		}
+
+		course, err := courseRep.GetCourseById(r.Context(), id)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return mysql.Course{}, false
+		}
+
+		if err != nil {
+			log.Printf("error fetching course:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return mysql.Course{}, false
+		}
+
+		return course, true
+	}
+
+	// managedClass loads the class of the request for a professor.
+	managedClass := func(w http.ResponseWriter, r *http.Request) (mysql.ClassWindow, bool) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return mysql.ClassWindow{}, false
+		}
+
+		id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return mysql.ClassWindow{}, false
+		}
+
+		class, err := classRep.GetWindowById(r.Context(), id)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return mysql.ClassWindow{}, false
+		}
+
+		if err != nil {
+			log.Printf("error fetching class:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return mysql.ClassWindow{}, false
+		}
+
+		return class, true
+	}
+
+	// reservation loads the reservation of the request, allowing only its
+	// owner and professors.
+	reservation := func(w http.ResponseWriter, r *http.Request) (mysql.Reservation, bool) {
+		id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return mysql.Reservation{}, false
+		}
+
+		res, err := reservationRep.GetReservationById(r.Context(), id)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return mysql.Reservation{}, false
+		}
+
+		if err != nil {
+			log.Printf("error fetching reservation:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return mysql.Reservation{}, false
+		}
+
+		user := r.Context().Value("user").(mysql.User)
+
+		if res.UserID != user.ID && user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return mysql.Reservation{}, false
+		}
+
+		return res, true
+	}
+
+	// writeCalendar writes the reservations as an iCalendar feed.
+	writeCalendar := func(w http.ResponseWriter, r *http.Request, name string, reservations []mysql.Reservation, private bool) {
+		labs := make(map[uint64]mysql.Lab)
+
+		for _, res := range reservations {
+			if _, ok := labs[res.LabID]; ok {
+				continue
+			}
+
+			lab, err := labRep.GetLabById(r.Context(), res.LabID)
+
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				log.Printf("error fetching lab:  %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			labs[res.LabID] = lab
+		}
+
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+
+		if err := reservationCalendar(name, reservations, labs, private).Write(w); err != nil {
+			log.Printf("error writing calendar:  %v", err)
+		}
+	}
 
 	m := mux.NewRouter()
 	m.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte("ok"))
 	}).Methods("GET").Name("health")
 
-	a := m.PathPrefix("/").Subrouter()
-	a.Use(authMiddleware.Middleware)
+	// Lab agents enroll with a one-time token and authenticate with the
+	// token they got in exchange from then on.
+	m.HandleFunc("/agent/enroll", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			log.Printf("error parsing request:  %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		agent, token, err := agentRep.Enroll(r.Context(), r.FormValue("token"), r.FormValue("hostname"), r.FormValue("version"))
+
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if err != nil {
+			log.Printf("error enrolling agent:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("lab %d: agent enrolled from %s", agent.LabID, agent.Hostname)
+
+		bytes, _ := json.Marshal(struct {
+			Token string `json:"token"`
+			LabID uint64 `json:"lab_id"`
+		}{token, agent.LabID})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(bytes)
+	}).Methods("POST").Name("enrollAgent")
+
+	g := m.PathPrefix("/agent").Subrouter()
+	g.Use(agentMiddleware.Middleware)
+
+	g.HandleFunc("/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		agent := r.Context().Value("agent").(mysql.Agent)
+
+		if err := r.ParseForm(); err != nil {
+			log.Printf("error parsing request:  %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := agentRep.Heartbeat(r.Context(), agent.ID, r.FormValue("hostname"), r.FormValue("version")); err != nil {
+			log.Printf("error recording agent heartbeat:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("POST").Name("agentHeartbeat")
+	// Agents long-poll for their jobs: the request is held until a job is
+	// queued for their lab or the wait passes, which answers no content.
+	g.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		agent := r.Context().Value("agent").(mysql.Agent)
+		wait := cfg.AgentConfig.PollWait
+
+		if value := r.URL.Query().Get("wait"); value != "" {
+			d, err := time.ParseDuration(value)
+
+			if err != nil || d < 0 {
+				http.Error(w, "wait must be a positive duration", http.StatusBadRequest)
+				return
+			}
+
+			if d < wait {
+				wait = d
+			}
+		}
+
+		if err := agentRep.Heartbeat(r.Context(), agent.ID, "", ""); err != nil {
+			log.Printf("error recording agent heartbeat:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		deadline := time.NewTimer(wait)
+		defer deadline.Stop()
+
+		ticker := time.NewTicker(cfg.AgentConfig.PollInterval)
+		defer ticker.Stop()
+
+		for {
+			job, err := agentRep.ClaimJob(r.Context(), agent)
+
+			if err == nil {
+				bytes, _ := json.Marshal(job)
+
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write(bytes)
+				return
+			}
+
+			if !errors.Is(err, sql.ErrNoRows) {
+				log.Printf("error claiming agent job:  %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-deadline.C:
+				w.WriteHeader(http.StatusNoContent)
+				return
+			case <-ticker.C:
+			}
+		}
+	}).Methods("GET").Name("pollAgentJobs")
+	g.HandleFunc("/jobs/{uuid}/result", func(w http.ResponseWriter, r *http.Request) {
+		agent := r.Context().Value("agent").(mysql.Agent)
+
+		if err := r.ParseForm(); err != nil {
+			log.Printf("error parsing request:  %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		exitCode, err := strconv.Atoi(r.FormValue("exit_code"))
+
+		if err != nil {
+			http.Error(w, "exit_code must be an integer", http.StatusBadRequest)
+			return
+		}
+
+		var jobErr *string
+		if value := r.FormValue("error"); value != "" {
+			jobErr = &value
+		}
+
+		err = agentRep.FinishJob(r.Context(), agent.ID, mux.Vars(r)["uuid"], exitCode, r.FormValue("stdout"), r.FormValue("stderr"), jobErr)
+
+		// The job was cancelled while the agent ran it.
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+
+		if err != nil {
+			log.Printf("error recording agent job:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("POST").Name("reportAgentJob")
+
+	// Calendar clients cannot send headers, so the feeds take a calendar
+	// token from the query instead of the session token.
+	c := m.NewRoute().Subrouter()
+	c.Use(calendarMiddleware.Middleware)
+
+	c.HandleFunc("/reservations.ics", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		reservations, err := reservationRep.ListUserReservations(r.Context(), user.ID, time.Now().AddDate(0, 0, -30))
+
+		if err != nil {
+			log.Printf("error listing reservations:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeCalendar(w, r, "Lab reservations", reservations, true)
+	}).Methods("GET").Name("userReservationsFeed")
+	c.HandleFunc("/labs/{id}/reservations.ics", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		lab, err := labRep.GetLabById(r.Context(), id)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			log.Printf("error fetching lab:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		reservations, err := reservationRep.ListLabReservations(r.Context(), lab.ID, time.Now().AddDate(0, 0, -30))
+
+		if err != nil {
+			log.Printf("error listing reservations:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeCalendar(w, r, lab.Name+" reservations", reservations, false)
+	}).Methods("GET").Name("labReservationsFeed")
+
+	a := m.PathPrefix("/").Subrouter()
+	a.Use(authMiddleware.Middleware)
+
+	a.HandleFunc("/labs", func(w http.ResponseWriter, r *http.Request) {
+		labs, err := labRep.ListLabs(r.Context())
+
+		if err != nil {
+			log.Printf("error listing labs:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		type labView struct {
+			mysql.Lab
+			Family provision.OSFamily `json:"family"`
+		}
+
+		views := make([]labView, 0, len(labs))
+		for _, lab := range labs {
+			labType, _ := provision.LookupLabType(lab.Type)
+			views = append(views, labView{Lab: lab, Family: labType.Family})
+		}
+
+		bytes, err := json.Marshal(views)
+
+		if err != nil {
+			log.Printf("error marshaling labs:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("listLabs")
+	a.HandleFunc("/lab-types", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := json.Marshal(provision.LabTypes())
+
+		if err != nil {
+			log.Printf("error marshaling lab types:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("listLabTypes")
+	a.HandleFunc("/labs/discover", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		result, err := discovery.Sync(r.Context())
+
+		if err != nil {
+			log.Printf("error discovering labs:  %v", err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		bytes, _ := json.Marshal(result)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("POST").Name("discoverLabs")
+	a.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		sessions, err := sessionRep.ListSessions(r.Context())
+
+		if err != nil {
+			log.Printf("error listing sessions:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, err := json.Marshal(sessions)
+
+		if err != nil {
+			log.Printf("error marshaling sessions:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("listSessions")
+	a.HandleFunc("/labs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.ParseUint(vars["id"], 10, 64)
+
+		if err != nil {
+			log.Printf("error parsing request:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		lab, err := labRep.GetLabById(r.Context(), id)
+
+		if errors.Is(err, sql.ErrNoRows) || lab.DeletedAt != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			log.Printf("error fetching lab:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if !lab.Available {
+			http.Error(w, "lab is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		connect(w, r, lab)
+	}).Methods("POST").Name("createSession")
+	a.HandleFunc("/labs", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		lab := mysql.Lab{Available: true, Backend: mysql.BackendSSM, MaxSessions: 1}
+
+		if err := labFromForm(r, &lab); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		saveLab(w, r, lab, http.StatusCreated)
+	}).Methods("POST").Name("createLab")
+	a.HandleFunc("/labs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		lab, ok := managedLab(w, r)
+
+		if !ok {
+			return
+		}
+
+		if err := labFromForm(r, &lab); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		saveLab(w, r, lab, http.StatusOK)
+	}).Methods("PUT").Name("updateLab")
+	a.HandleFunc("/labs/{id}/available", func(w http.ResponseWriter, r *http.Request) {
+		lab, ok := managedLab(w, r)
+
+		if !ok {
+			return
+		}
+
+		available, err := strconv.ParseBool(r.FormValue("available"))
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := labRep.SetAvailable(r.Context(), lab.ID, available); err != nil {
+			log.Printf("error updating lab:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("PUT").Name("setLabAvailable")
+	a.HandleFunc("/labs/{id}/drain", func(w http.ResponseWriter, r *http.Request) {
+		lab, ok := managedLab(w, r)
+
+		if !ok {
+			return
+		}
+
+		timeout := cfg.DrainConfig.DefaultTimeout
+
+		if value := r.FormValue("timeout"); value != "" {
+			parsed, err := time.ParseDuration(value)
+
+			if err != nil || parsed < 0 {
+				http.Error(w, "timeout: must be a duration such as 30m", http.StatusBadRequest)
+				return
+			}
+
+			timeout = parsed
+		}
+
+		message := cfg.DrainConfig.Message
+		if value := r.FormValue("message"); value != "" {
+			message = value
+		}
+
+		err := labRep.StartDrain(r.Context(), lab.ID, time.Now().Add(timeout), message)
+
+		if errors.Is(err, mysql.ErrLabUnavailable) {
+			http.Error(w, fmt.Sprintf("lab is %s", lab.State), http.StatusConflict)
+			return
+		}
+
+		if err != nil {
+			log.Printf("error draining lab:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("lab %d: draining for %s", lab.ID, timeout)
+
+		lab, err = labRep.GetLabById(r.Context(), lab.ID)
+
+		if err != nil {
+			log.Printf("error fetching lab:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, _ := json.Marshal(lab)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write(bytes)
+	}).Methods("PUT").Name("drainLab")
+	a.HandleFunc("/labs/{id}/drain", func(w http.ResponseWriter, r *http.Request) {
+		lab, ok := managedLab(w, r)
+
+		if !ok {
+			return
+		}
+
+		err := labRep.CancelDrain(r.Context(), lab.ID)
+
+		if errors.Is(err, mysql.ErrLabUnavailable) {
+			http.Error(w, fmt.Sprintf("lab is %s", lab.State), http.StatusConflict)
+			return
+		}
+
+		if err != nil {
+			log.Printf("error cancelling drain:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("lab %d: back in service", lab.ID)
+
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE").Name("cancelLabDrain")
+	a.HandleFunc("/labs/{id}/health", func(w http.ResponseWriter, r *http.Request) {
+		lab, ok := managedLab(w, r)
+
+		if !ok {
+			return
+		}
+
+		checks, err := healthRep.ListChecks(r.Context(), lab.ID, 100)
+
+		if err != nil {
+			log.Printf("error listing health checks:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, _ := json.Marshal(checks)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("listLabHealth")
+	a.HandleFunc("/labs/{id}/agent", func(w http.ResponseWriter, r *http.Request) {
+		lab, ok := managedLab(w, r)
+
+		if !ok {
+			return
+		}
+
+		agent, online, err := agents.LabAgent(r.Context(), lab.ID)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			log.Printf("error fetching lab agent:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, _ := json.Marshal(struct {
+			mysql.Agent
+			Online bool `json:"online"`
+		}{agent, online})
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("getLabAgent")
+	a.HandleFunc("/labs/{id}/agent", func(w http.ResponseWriter, r *http.Request) {
+		lab, ok := managedLab(w, r)
+
+		if !ok {
+			return
+		}
+
+		if err := agentRep.DeleteLabAgent(r.Context(), lab.ID); err != nil {
+			log.Printf("error revoking lab agent:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("lab %d: agent revoked", lab.ID)
+
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE").Name("revokeLabAgent")
+	// The enrollment token is only returned here; the agent of the lab is
+	// replaced once it is used.
+	a.HandleFunc("/labs/{id}/agent/enrollments", func(w http.ResponseWriter, r *http.Request) {
+		lab, ok := managedLab(w, r)
+
+		if !ok {
+			return
+		}
+
+		if lab.Backend != mysql.BackendAgent {
+			http.Error(w, "lab does not use the agent backend", http.StatusConflict)
+			return
+		}
+
+		user := r.Context().Value("user").(mysql.User)
+		expiresAt := time.Now().Add(cfg.AgentConfig.EnrollmentTTL)
+
+		token, err := agentRep.CreateEnrollment(r.Context(), lab.ID, user.ID, expiresAt)
+
+		if err != nil {
+			log.Printf("error creating agent enrollment:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, _ := json.Marshal(struct {
+			Token     string    `json:"token"`
+			ExpiresAt time.Time `json:"expires_at"`
+		}{token, expiresAt.UTC()})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(bytes)
+	}).Methods("POST").Name("createAgentEnrollment")
+	a.HandleFunc("/labs/{id}/reconcile", func(w http.ResponseWriter, r *http.Request) {
+		lab, ok := managedLab(w, r)
+
+		if !ok {
+			return
+		}
+
+		dryRun := false
+
+		if value := r.FormValue("dry_run"); value != "" {
+			var err error
+
+			if dryRun, err = strconv.ParseBool(value); err != nil {
+				http.Error(w, "dry_run: "+err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+		}
+
+		known, err := reconciler.knownUsers(r.Context())
+
+		if err != nil {
+			log.Printf("error listing users:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		report := reconciler.Reconcile(r.Context(), lab, known, dryRun, false)
+
+		if report.Error != "" {
+			log.Printf("error reconciling lab %d:  %s", lab.ID, report.Error)
+		}
+
+		bytes, _ := json.Marshal(report)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("POST").Name("reconcileLab")
+	a.HandleFunc("/reconcile", func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value("user").(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		bytes, _ := json.Marshal(reconciler.Reports())
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("listReconcileReports")
+	a.HandleFunc("/warm", func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value("user").(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		status, err := warm.Status(r.Context())
+
+		if err != nil {
+			log.Printf("error fetching warm pools:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, _ := json.Marshal(status)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("listWarmPools")
+	a.HandleFunc("/labs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		lab, ok := managedLab(w, r)
+
+		if !ok {
+			return
+		}
+
+		err := labRep.DeleteLab(r.Context(), lab.ID)
+
+		if errors.Is(err, mysql.ErrLabInUse) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		if err != nil {
+			log.Printf("error deleting lab:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE").Name("deleteLab")
+	a.HandleFunc("/pools", func(w http.ResponseWriter, r *http.Request) {
+		pools, err := poolRep.ListPools(r.Context())
+
+		if err != nil {
+			log.Printf("error listing pools:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, err := json.Marshal(pools)
+
+		if err != nil {
+			log.Printf("error marshaling pools:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("listPools")
+	a.HandleFunc("/pools", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		pool := mysql.LabPool{
+			FleetInstanceType:   "t3.medium",
+			FleetIngress:        "0.0.0.0/0",
+			FleetLabMaxSessions: 1,
+		}
+
+		if err := poolFromForm(r, &pool); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		savePool(w, r, pool, http.StatusCreated)
+	}).Methods("POST").Name("createPool")
+	a.HandleFunc("/pools/{id}", func(w http.ResponseWriter, r *http.Request) {
+		pool, ok := managedPool(w, r)
+
+		if !ok {
+			return
+		}
+
+		if err := poolFromForm(r, &pool); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		savePool(w, r, pool, http.StatusOK)
+	}).Methods("PUT").Name("updatePool")
+	a.HandleFunc("/pools/{id}/fleet", func(w http.ResponseWriter, r *http.Request) {
+		pool, ok := managedPool(w, r)
+
+		if !ok {
+			return
+		}
+
+		stacks, err := fleetRep.ListStacks(r.Context(), pool.ID)
+
+		if err != nil {
+			log.Printf("error listing fleet stacks:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, _ := json.Marshal(stacks)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("listFleetStacks")
+	a.HandleFunc("/pools/{id}/fleet", func(w http.ResponseWriter, r *http.Request) {
+		pool, ok := managedPool(w, r)
+
+		if !ok {
+			return
+		}
+
+		status, err := fleetManager.ReconcilePool(r.Context(), pool)
+
+		if err != nil {
+			log.Printf("error reconciling fleet:  %v", err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		bytes, _ := json.Marshal(status)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("POST").Name("reconcileFleet")
+	a.HandleFunc("/pools/{id}/sessions", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.ParseUint(vars["id"], 10, 64)
+
+		if err != nil {
+			log.Printf("error parsing request:  %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		pool, err := poolRep.GetPoolById(r.Context(), id)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			log.Printf("error fetching pool:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		user := r.Context().Value("user").(mysql.User)
+
+		// A user keeps the instance they are already on.
+		session, err := sessionRep.GetActivePoolSession(r.Context(), user.ID, pool.ID)
+
+		if err == nil {
+			connect(w, r, session.Lab)
+			return
+		}
+
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("error fetching pool session:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// Reservations on the pool were booked on one of its labs. Users
+		// whose reserved lab stopped taking sessions are placed like others.
+		res, err := reservationRep.GetCurrentPoolReservation(r.Context(), user.ID, pool.ID)
+
+		if err == nil {
+			lab, err := labRep.GetLabById(r.Context(), res.LabID)
+
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				log.Printf("error fetching lab:  %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if err == nil && scheduler.TakesSessions(lab) {
+				connect(w, r, lab)
+				return
+			}
+
+			log.Printf("pool %d user %s: reserved lab %d takes no sessions", pool.ID, user.UserName, res.LabID)
+		}
+
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("error fetching reservation:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		load, err := poolRep.ListPoolLoad(r.Context(), pool.ID)
+
+		if err != nil {
+			log.Printf("error fetching pool load:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		lab, err := scheduler.Place(load)
+
+		// A full pool queues the user on the lab with the shortest queue;
+		// the fleet grows with the queue when the pool has one.
+		if errors.Is(err, scheduler.ErrNoCapacity) {
+			lab, err = scheduler.Shortest(load)
+		}
+
+		if errors.Is(err, scheduler.ErrNoCapacity) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		log.Printf("pool %d user %s: placed on lab %d", pool.ID, user.UserName, lab.ID)
+
+		connect(w, r, lab)
+	}).Methods("POST").Name("createPoolSession")
+	a.HandleFunc("/labs/{id}/queue", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		vars := mux.Vars(r)
+		id, err := strconv.ParseUint(vars["id"], 10, 64)
+
+		if err != nil {
+			log.Printf("error parsing request:  %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		lab, err := labRep.GetLabById(r.Context(), id)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			log.Printf("error fetching lab:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		entries, err := queueRep.ListWaiting(r.Context(), lab.ID)
+
+		if err != nil {
+			log.Printf("error listing queue:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		views := make([]queueView, 0, len(entries))
+		for _, entry := range entries {
+			view, err := describeQueueEntry(r.Context(), queueRep, lab, entry)
+
+			if err != nil {
+				log.Printf("error describing queue entry:  %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			views = append(views, view)
+		}
+
+		bytes, _ := json.Marshal(views)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("listLabQueue")
+	a.HandleFunc("/queue/{id}", func(w http.ResponseWriter, r *http.Request) {
+		entry, lab, ok := queueEntry(w, r)
+
+		if !ok {
+			return
+		}
+
+		view, err := describeQueueEntry(r.Context(), queueRep, lab, entry)
+
+		if err != nil {
+			log.Printf("error describing queue entry:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, _ := json.Marshal(view)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("getQueueEntry")
+	a.HandleFunc("/queue/{id}", func(w http.ResponseWriter, r *http.Request) {
+		entry, _, ok := queueEntry(w, r)
+
+		if !ok {
+			return
+		}
+
+		cancelled, err := queueRep.SetStatus(r.Context(), entry.ID, mysql.QueueWaiting, mysql.QueueCancelled)
+
+		if err != nil {
+			log.Printf("error cancelling queue entry:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if !cancelled {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE").Name("cancelQueueEntry")
+	a.HandleFunc("/queue/{id}/priority", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		entry, lab, ok := queueEntry(w, r)
+
+		if !ok {
+			return
+		}
+
+		priority, err := strconv.Atoi(r.FormValue("priority"))
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if entry.Status != mysql.QueueWaiting {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		if entry, err = queueRep.SetPriority(r.Context(), entry.ID, priority); err != nil {
+			log.Printf("error updating queue entry:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		view, err := describeQueueEntry(r.Context(), queueRep, lab, entry)
+
+		if err != nil {
+			log.Printf("error describing queue entry:  %v", err)
+		}
+
+		bytes, _ := json.Marshal(view)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("PUT").Name("updateQueuePriority")
+	a.HandleFunc("/labs/{id}/provisioning/preview", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		vars := mux.Vars(r)
+		id, err := strconv.ParseUint(vars["id"], 10, 64)
+
+		if err != nil {
+			log.Printf("error parsing request:  %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		lab, err := labRep.GetLabById(r.Context(), id)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			log.Printf("error fetching lab:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		target := user
+		if userId := r.URL.Query().Get("user_id"); userId != "" {
+			uid, err := strconv.ParseUint(userId, 10, 64)
+
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			target, err = userRep.GetUserById(r.Context(), uid)
+
+			if errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			if err != nil {
+				log.Printf("error fetching user:  %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		kind := provision.TemplateKind(r.URL.Query().Get("kind"))
+		if kind == "" {
+			kind = provision.KindProvision
+		}
+
+		if kind != provision.KindProvision && kind != provision.KindTeardown {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		labType, err := provision.LookupLabType(lab.Type)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		tmpl, err := resolveTemplate(r.Context(), templateRep, templates, labType, &lab)
+
+		if err != nil {
+			log.Printf("error resolving provisioning template:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		plan, err := tmpl.Render(kind, templateData(labType, &lab, &target))
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		bytes, _ := json.Marshal(struct {
+			Template string                 `json:"template"`
+			Version  int                    `json:"version"`
+			Source   string                 `json:"source"`
+			Kind     provision.TemplateKind `json:"kind"`
+			Family   provision.OSFamily     `json:"family"`
+			Commands []string               `json:"commands"`
+		}{
+			Template: tmpl.Name,
+			Version:  tmpl.Version,
+			Source:   tmpl.Source,
+			Kind:     kind,
+			Family:   tmpl.Family,
+			Commands: plan.Script(),
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("previewProvisioning")
+	a.HandleFunc("/templates", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		stored, err := templateRep.ListTemplates(r.Context())
+
+		if err != nil {
+			log.Printf("error listing templates:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		list := templates.List()
+		for _, t := range stored {
+			parsed, err := provision.ParseTemplate([]byte(t.Body), fmt.Sprintf("database:%d", t.ID))
+
+			if err != nil {
+				log.Printf("error parsing stored template %d:  %v", t.ID, err)
+				continue
+			}
+
+			list = append(list, parsed)
+		}
+
+		bytes, err := json.Marshal(list)
+
+		if err != nil {
+			log.Printf("error marshaling templates:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("listTemplates")
+	a.HandleFunc("/templates", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+
+		if err != nil {
+			log.Printf("error reading request:  %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		tmpl, err := provision.ParseTemplate(body, "upload")
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		if latest, err := templateRep.GetTemplate(r.Context(), tmpl.Name, 0); err == nil && latest.Version >= tmpl.Version {
+			http.Error(w, fmt.Sprintf("version must be greater than %d", latest.Version), http.StatusConflict)
+			return
+		}
+
+		stored, err := templateRep.CreateTemplate(r.Context(), tmpl.Name, tmpl.Version, string(body), user.ID)
+
+		if err != nil {
+			log.Printf("error storing template:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, _ := json.Marshal(stored)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(bytes)
+	}).Methods("POST").Name("createTemplate")
+	a.HandleFunc("/courses", func(w http.ResponseWriter, r *http.Request) {
+		courses, err := courseRep.ListCourses(r.Context())
+
+		if err != nil {
+			log.Printf("error listing courses:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, _ := json.Marshal(courses)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("listCourses")
+	a.HandleFunc("/courses", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var course mysql.Course
+
+		if err := courseFromForm(r, &course); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		course, err := courseRep.CreateCourse(r.Context(), course)
+
+		if err != nil {
+			log.Printf("error saving course:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, _ := json.Marshal(course)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(bytes)
+	}).Methods("POST").Name("createCourse")
+	a.HandleFunc("/courses/{id}", func(w http.ResponseWriter, r *http.Request) {
+		course, ok := managedCourse(w, r)
+
+		if !ok {
+			return
+		}
+
+		if err := courseFromForm(r, &course); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		course, err := courseRep.UpdateCourse(r.Context(), course)
+
+		if err != nil {
+			log.Printf("error saving course:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, _ := json.Marshal(course)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("PUT").Name("updateCourse")
+	a.HandleFunc("/courses/{id}/enrollments", func(w http.ResponseWriter, r *http.Request) {
+		course, ok := managedCourse(w, r)
+
+		if !ok {
+			return
+		}
+
+		users, err := courseRep.ListEnrolledUsers(r.Context(), course.ID)
+
+		if err != nil {
+			log.Printf("error listing enrollments:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, _ := json.Marshal(users)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("listEnrollments")
+	a.HandleFunc("/courses/{id}/enrollments", func(w http.ResponseWriter, r *http.Request) {
+		course, ok := managedCourse(w, r)
+
+		if !ok {
+			return
+		}
+
+		student, err := userRep.GetUserByEmail(r.Context(), r.FormValue("email"))
+
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "no user with this email", http.StatusUnprocessableEntity)
+			return
+		}
+
+		if err != nil {
+			log.Printf("error fetching user:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if err := courseRep.Enroll(r.Context(), course.ID, student.ID); err != nil {
+			log.Printf("error enrolling user:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("POST").Name("enrollUser")
+	a.HandleFunc("/courses/{id}/enrollments/{userId}", func(w http.ResponseWriter, r *http.Request) {
+		course, ok := managedCourse(w, r)
+
+		if !ok {
+			return
+		}
+
+		userId, err := strconv.ParseUint(mux.Vars(r)["userId"], 10, 64)
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := courseRep.Unenroll(r.Context(), course.ID, userId); err != nil {
+			log.Printf("error unenrolling user:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE").Name("unenrollUser")
+	a.HandleFunc("/courses/{id}/classes", func(w http.ResponseWriter, r *http.Request) {
+		course, ok := managedCourse(w, r)
+
+		if !ok {
+			return
+		}
+
+		classes, err := classRep.ListCourseWindows(r.Context(), course.ID)
+
+		if err != nil {
+			log.Printf("error listing classes:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, _ := json.Marshal(classes)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("listClasses")
+	a.HandleFunc("/courses/{id}/classes", func(w http.ResponseWriter, r *http.Request) {
+		course, ok := managedCourse(w, r)
+
+		if !ok {
+			return
+		}
+
+		user := (r.Context().Value("user")).(mysql.User)
+
+		class, err := classFromForm(r)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		class.CourseID = course.ID
+		class.CreatedBy = &user.ID
+
+		class, err = classRep.CreateWindow(r.Context(), class)
+
+		if errors.Is(err, mysql.ErrClassOverlap) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		if err != nil {
+			log.Printf("error scheduling class:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, _ := json.Marshal(class)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", fmt.Sprintf("/classes/%d", class.ID))
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(bytes)
+	}).Methods("POST").Name("scheduleClass")
+	a.HandleFunc("/classes/{id}", func(w http.ResponseWriter, r *http.Request) {
+		class, ok := managedClass(w, r)
 
-	a.HandleFunc("/labs", func(w http.ResponseWriter, r *http.Request) {
-		labs, err := labRep.ListLabs(r.Context())
+		if !ok {
+			return
+		}
+
+		sessions, err := sessionRep.ListClassSessions(r.Context(), class.ID)
 
 		if err != nil {
-			log.Printf("error listing labs:  %v", err)
+			log.Printf("error listing class sessions:  %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		bytes, err := json.Marshal(labs)
+		bytes, _ := json.Marshal(struct {
+			mysql.ClassWindow
+			Sessions []mysql.Session `json:"sessions"`
+		}{
+			ClassWindow: class,
+			Sessions:    sessions,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("getClass")
+	a.HandleFunc("/classes/{id}", func(w http.ResponseWriter, r *http.Request) {
+		class, ok := managedClass(w, r)
+
+		if !ok {
+			return
+		}
+
+		class, err := classRep.CancelWindow(r.Context(), class.ID)
+
+		if errors.Is(err, mysql.ErrClassClosed) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 
 		if err != nil {
-			log.Printf("error marshaling labs:  %v", err)
+			log.Printf("error cancelling class:  %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
+		bytes, _ := json.Marshal(class)
+
 		w.Header().Set("Content-Type", "application/json")
 		_, _ = w.Write(bytes)
-	}).Methods("GET").Name("listLabs")
-	a.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
-		user := (r.Context().Value("user")).(mysql.User)
+	}).Methods("DELETE").Name("cancelClass")
+	a.HandleFunc("/sessions/{id}/extensions", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
 
-		if user.Type != mysql.Professor {
-			w.WriteHeader(http.StatusUnauthorized)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		sessions, err := sessionRep.ListSessions(r.Context())
+		minutes, err := strconv.Atoi(r.FormValue("minutes"))
+
+		if err != nil || minutes < 1 {
+			http.Error(w, "minutes: must be a positive number", http.StatusBadRequest)
+			return
+		}
+
+		session, err := sessionRep.GetSessionById(r.Context(), id)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 
 		if err != nil {
-			log.Printf("error listing sessions:  %v", err)
+			log.Printf("error fetching session:  %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		bytes, err := json.Marshal(sessions)
+		user := r.Context().Value("user").(mysql.User)
+
+		if session.User.ID != user.ID {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		quota := int(cfg.LimitsConfig.ExtensionQuota.Minutes())
+
+		if session.CourseID != nil {
+			course, err := courseRep.GetCourseById(r.Context(), *session.CourseID)
+
+			if err != nil {
+				log.Printf("error fetching course:  %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if course.ExtensionQuotaMinutes != nil {
+				quota = *course.ExtensionQuotaMinutes
+			}
+		}
+
+		ext, err := extensionRep.RequestExtension(r.Context(), session.ID, user.ID, minutes, quota)
+
+		if errors.Is(err, mysql.ErrSessionNotExtendable) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 
 		if err != nil {
-			log.Printf("error marshaling sessions:  %v", err)
+			log.Printf("error requesting extension:  %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
+		status := http.StatusCreated
+		if ext.Status == mysql.ExtensionPending {
+			status = http.StatusAccepted
+		}
+
+		bytes, _ := json.Marshal(ext)
+
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
 		_, _ = w.Write(bytes)
-	}).Methods("GET").Name("listSessions")
-	a.HandleFunc("/labs/{id}", func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		id, err := strconv.ParseUint(vars["id"], 10, 64)
+	}).Methods("POST").Name("requestExtension")
+	a.HandleFunc("/extensions", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		status := mysql.ExtensionPending
+		if value := r.FormValue("status"); value != "" {
+			status = mysql.ExtensionStatus(value)
+		}
+
+		extensions, err := extensionRep.ListExtensions(r.Context(), status)
 
 		if err != nil {
-			log.Printf("error parsing request:  %v", err)
+			log.Printf("error listing extensions:  %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		lab, err := labRep.GetLabById(r.Context(), id)
+		bytes, _ := json.Marshal(extensions)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("listExtensions")
+	a.HandleFunc("/extensions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
 
 		if err != nil {
-			log.Printf("error fetching lab:  %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		user := r.Context().Value("user").(mysql.User)
+		approve, err := strconv.ParseBool(r.FormValue("approve"))
+
+		if err != nil {
+			http.Error(w, "approve: must be true or false", http.StatusBadRequest)
+			return
+		}
 
-		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
-		defer cancel()
+		ext, err := extensionRep.DecideExtension(r.Context(), id, approve, user.ID)
 
-		out, err := initLabForUser(
-			ctx,
-			ssmClient,
-			&lab,
-			&user,
-		)
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 
-		log.Println(out)
+		if errors.Is(err, mysql.ErrExtensionDecided) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 
 		if err != nil {
-			log.Printf("error init lab:  %v", err)
+			log.Printf("error deciding extension:  %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		session, err := sessionRep.CreateSession(r.Context(), user, lab)
+		bytes, _ := json.Marshal(ext)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("PUT").Name("decideExtension")
+	a.HandleFunc("/me/quota", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		report, err := quotas.Report(r.Context(), user)
 
 		if err != nil {
-			log.Printf("error creating session:  %v", err)
+			log.Printf("error reporting quota:  %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		bytes, _ := json.Marshal(session)
+		bytes, _ := json.Marshal(report)
 
+		w.Header().Set("Content-Type", "application/json")
 		_, _ = w.Write(bytes)
-	}).Methods("POST").Name("createSession")
-	a.HandleFunc("/sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		id, err := strconv.ParseUint(vars["id"], 10, 64)
+	}).Methods("GET").Name("getMyQuota")
+	a.HandleFunc("/users/{id}/quota", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
 
 		if err != nil {
-			log.Printf("error parsing request:  %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		session, err := sessionRep.GetSessionById(r.Context(), id)
+		student, err := userRep.GetUserById(r.Context(), id)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 
 		if err != nil {
-			log.Printf("error fetching lab:  %v", err)
+			log.Printf("error fetching user:  %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		user := r.Context().Value("user").(mysql.User)
+		if r.Method == http.MethodPut {
+			override, err := quotaRep.GetOverride(r.Context(), student.ID)
 
-		if session.User.ID != user.ID && user.Type != mysql.Professor {
-			w.WriteHeader(http.StatusUnauthorized)
+			if err != nil {
+				log.Printf("error fetching quota override:  %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if err := overrideFromForm(r, &override); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			override.UpdatedBy = &user.ID
+
+			if err := quotaRep.SetOverride(r.Context(), override); err != nil {
+				log.Printf("error saving quota override:  %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		report, err := quotas.Report(r.Context(), student)
+
+		if err != nil {
+			log.Printf("error reporting quota:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		bytes, _ := json.Marshal(struct {
-			Hostname string `json:"hostname"`
-			Username string `json:"username"`
-			Password string `json:"password"`
-		}{
-			Hostname: session.Lab.Hostname,
-			Username: user.UserName,
-			Password: tempPassword,
-		})
+		bytes, _ := json.Marshal(report)
 
+		w.Header().Set("Content-Type", "application/json")
 		_, _ = w.Write(bytes)
-	}).Methods("GET").Name("getSessionInfo")
+	}).Methods("GET", "PUT").Name("userQuota")
+	a.HandleFunc("/reservations", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
 
-	srvShutdown := make(chan bool)
-	srv := server.StartHttpServer(cfg.HTTPServerConfig, m, srvShutdown)
+		reservations, err := reservationRep.ListUserReservations(r.Context(), user.ID, time.Now())
 
-	<-sigChannel
-	go shutdown(srv)
-	<-srvShutdown
-}
+		if err != nil {
+			log.Printf("error listing reservations:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bytes, _ := json.Marshal(reservations)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("listReservations")
+	a.HandleFunc("/reservations", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		res, err := reservationFromForm(r, cfg.ReservationConfig)
 
-func shutdown(server *http.Server) {
-	ctxShutDown, _ := context.WithTimeout(context.Background(), 30)
-	err := server.Shutdown(ctxShutDown)
-	if err != nil {
-		log.Printf("error shutting down server (%s): %v", server.Addr, err)
-		err = server.Close()
 		if err != nil {
-			log.Printf("error closing server (%s): %v", server.Addr, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-	}
-}
 
-func initLabForUser(ctx context.Context, client *ssm.Client, lab *mysql.Lab, user *mysql.User) (string, error) {
-	if lab.Type == mysql.Windows {
-		return initLabForUserWindows(ctx, client, lab, user)
-	}
+		res.UserID = user.ID
 
-	return initLabForUserLinux(ctx, client, lab, user)
-}
+		// Pool reservations are booked on the first lab of the pool with a
+		// free slot over the whole range.
+		var labIds []uint64
 
-func initLabForUserWindows(ctx context.Context, client *ssm.Client, lab *mysql.Lab, user *mysql.User) (string, error) {
-	documentName := "AWS-RunPowerShellScript"
+		if res.PoolID != nil {
+			load, err := poolRep.ListPoolLoad(r.Context(), *res.PoolID)
 
-	commands := []string{
-		fmt.Sprintf("New-LocalUser -Name \"%[1]s\" -NoPassword -FullName \"%[1]s\"", user.UserName),
-		fmt.Sprintf("net user \"%s\" \"%s\"", user.UserName, tempPassword),
-		fmt.Sprintf(
-			".\"C:\\Program Files\\NICE\\DCV\\Server\\bin\\dcv.exe\" create-session --owner=%[1]s %[1]s",
-			user.UserName,
-		),
-		fmt.Sprintf("md \"Z:\\%s\" 2>NUL", user.UserName),
-		fmt.Sprintf("md \"Z:\\%s\\windows\" 2>NUL", user.UserName),
-		fmt.Sprintf("$shortcut=(New-Object -ComObject WScript.Shell).CreateShortcut('C:\\Users\\%[1]s\\Desktop\\DCV-Storage.lnk');$shortcut.TargetPath='Z:\\%[1]s\\Windows';$shortcut.Save()", user.UserName),
-	}
-	params := &ssm.SendCommandInput{
-		DocumentName: &documentName,
-		Parameters: map[string][]string{
-			"commands": commands,
-		},
-		InstanceIds: []string{
-			lab.InstanceID,
-		},
-	}
+			if err != nil {
+				log.Printf("error fetching pool load:  %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
 
-	sendOut, err := client.SendCommand(ctx, params)
+			for _, lab := range load {
+				labIds = append(labIds, lab.ID)
+			}
+		} else {
+			labIds = append(labIds, res.LabID)
+		}
 
-	if err != nil {
-		return "", err
-	}
+		if len(labIds) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		for _, labId := range labIds {
+			res.LabID = labId
+			booked, err := reservationRep.Book(r.Context(), res)
+
+			if errors.Is(err, mysql.ErrReservationConflict) || errors.Is(err, mysql.ErrLabUnavailable) {
+				continue
+			}
+
+			if errors.Is(err, mysql.ErrReservationOverlap) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+
+			if errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			if err != nil {
+				log.Printf("error booking reservation:  %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			log.Printf("lab %d user %s: reserved from %s to %s", booked.LabID, user.UserName,
+				booked.StartsAt.Format(time.RFC3339), booked.EndsAt.Format(time.RFC3339))
+
+			bytes, _ := json.Marshal(booked)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Location", fmt.Sprintf("/reservations/%d", booked.ID))
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write(bytes)
+			return
+		}
 
-	done := make(chan bool)
-	var cmdOut *ssm.GetCommandInvocationOutput
+		http.Error(w, mysql.ErrReservationConflict.Error(), http.StatusConflict)
+	}).Methods("POST").Name("createReservation")
+	a.HandleFunc("/calendar/token", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
 
-	go func() {
-	loop:
-		cmdOut, err = client.GetCommandInvocation(
-			ctx,
-			&ssm.GetCommandInvocationInput{
-				CommandId:  sendOut.Command.CommandId,
-				InstanceId: &lab.InstanceID,
-			},
-		)
+		token, err := calendarTokenRep.NewTokenForUserId(r.Context(), user.ID)
 
 		if err != nil {
-			done <- true
+			log.Printf("error creating calendar token:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
 
-		if cmdOut != nil && cmdOut.ResponseCode == -1 {
-			time.Sleep(100 * time.Millisecond)
-			goto loop
+		bytes, _ := json.Marshal(struct {
+			Token string `json:"token"`
+		}{token})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(bytes)
+	}).Methods("POST").Name("createCalendarToken")
+	a.HandleFunc("/calendar/token", func(w http.ResponseWriter, r *http.Request) {
+		user := (r.Context().Value("user")).(mysql.User)
+
+		if err := calendarTokenRep.RevokeUserTokens(r.Context(), user.ID); err != nil {
+			log.Printf("error revoking calendar token:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
 
-		done <- true
-	}()
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE").Name("revokeCalendarToken")
+	a.HandleFunc("/reservations/{id}", func(w http.ResponseWriter, r *http.Request) {
+		res, ok := reservation(w, r)
 
-	select {
-	case <-done:
-		if err != nil {
-			return "", err
+		if !ok {
+			return
 		}
 
-		if cmdOut.ResponseCode != 0 {
-			return *cmdOut.StandardErrorContent, nil
+		bytes, _ := json.Marshal(res)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("getReservation")
+	a.HandleFunc("/reservations/{id}", func(w http.ResponseWriter, r *http.Request) {
+		res, ok := reservation(w, r)
+
+		if !ok {
+			return
 		}
 
-		return *cmdOut.StandardOutputContent, nil
-	case <-ctx.Done():
-		return "", ctx.Err()
-	}
-}
+		err := reservationRep.Cancel(r.Context(), res.ID)
 
-func initLabForUserLinux(ctx context.Context, client *ssm.Client, lab *mysql.Lab, user *mysql.User) (string, error) {
-	documentName := "AWS-RunShellScript"
-	commands := []string{
-		fmt.Sprintf("adduser --gecos \"\" %s", user.UserName),
-		fmt.Sprintf(
-			"echo \"%s:%s\" | chpasswd",
-			user.UserName,
-			tempPassword,
-		),
-		fmt.Sprintf("/usr/bin/dcv create-session --owner=%[1]s %[1]s", user.UserName),
-		fmt.Sprintf("mkdir -p /var/fsx/%s/linux", user.UserName),
-		fmt.Sprintf("mkdir -p /home/%s/Desktop", user.UserName),
-		fmt.Sprintf("chown -R %[1]s:%[1]s /home/%[1]s/Desktop", user.UserName),
-		fmt.Sprintf("ln -s /var/fsx/%[1]s/linux /home/%[1]s/Desktop/NiceLabData", user.UserName),
-	}
-	params := &ssm.SendCommandInput{
-		DocumentName: &documentName,
-		Parameters: map[string][]string{
-			"commands": commands,
-		},
-		InstanceIds: []string{
-			lab.InstanceID,
-		},
-	}
-
-	sendOut, err := client.SendCommand(ctx, params)
+		if errors.Is(err, mysql.ErrReservationClosed) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 
-	if err != nil {
-		return "", err
-	}
+		if err != nil {
+			log.Printf("error cancelling reservation:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE").Name("cancelReservation")
+	a.HandleFunc("/labs/{id}/reservations", func(w http.ResponseWriter, r *http.Request) {
+		lab, ok := managedLab(w, r)
 
-	time.Sleep(100 * time.Millisecond)
-	done := make(chan bool)
-	var cmdOut *ssm.GetCommandInvocationOutput
+		if !ok {
+			return
+		}
 
-	go func() {
-	loop:
-		cmdOut, err = client.GetCommandInvocation(
-			ctx,
-			&ssm.GetCommandInvocationInput{
-				CommandId:  sendOut.Command.CommandId,
-				InstanceId: &lab.InstanceID,
-			},
-		)
+		reservations, err := reservationRep.ListLabReservations(r.Context(), lab.ID, time.Now())
 
 		if err != nil {
-			done <- true
+			log.Printf("error listing reservations:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
 
-		if cmdOut != nil && cmdOut.ResponseCode == -1 {
-			time.Sleep(100 * time.Millisecond)
-			goto loop
+		bytes, _ := json.Marshal(reservations)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("listLabReservations")
+	a.HandleFunc("/sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.ParseUint(vars["id"], 10, 64)
+
+		if err != nil {
+			log.Printf("error parsing request:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
 
-		done <- true
-	}()
+		session, err := sessionRep.GetSessionById(r.Context(), id)
 
-	select {
-	case <-done:
 		if err != nil {
-			return "", err
+			log.Printf("error fetching lab:  %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		user := r.Context().Value("user").(mysql.User)
+
+		if session.User.ID != user.ID && user.Type != mysql.Professor {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
 		}
 
-		if cmdOut.ResponseCode != 0 {
-			return *cmdOut.StandardErrorContent, nil
+		info := struct {
+			Status          mysql.SessionStatus `json:"status"`
+			Hostname        string              `json:"hostname"`
+			Username        string              `json:"username"`
+			Password        string              `json:"password,omitempty"`
+			URL             string              `json:"url,omitempty"`
+			ConnectionToken string              `json:"connection_token,omitempty"`
+			ExpiresAt       *time.Time          `json:"expires_at,omitempty"`
+		}{
+			Status:    session.Status,
+			Hostname:  session.Lab.Hostname,
+			Username:  session.OSUser().UserName,
+			Password:  tempPassword,
+			ExpiresAt: session.ExpiresAt,
+		}
+
+		// Broker sessions are joined with a token of the broker rather than
+		// a password.
+		if session.Lab.Backend == mysql.BackendBroker && session.Status == mysql.SessionActive {
+			connection, err := starter.brokerConnection(r.Context(), session)
+
+			if err != nil {
+				log.Printf("error fetching broker connection:  %v", err)
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+
+			info.Hostname = connection.Session.Server.Hostname
+			info.Password = ""
+			info.URL = connection.URL()
+			info.ConnectionToken = connection.ConnectionToken
 		}
 
-		return *cmdOut.StandardOutputContent, nil
-	case <-ctx.Done():
-		return "", ctx.Err()
+		bytes, _ := json.Marshal(info)
+
+		_, _ = w.Write(bytes)
+	}).Methods("GET").Name("getSessionInfo")
+
+	srvShutdown := make(chan bool)
+	srv := server.StartHttpServer(cfg.HTTPServerConfig, m, srvShutdown)
+
+	<-sigChannel
+	stopWorkers()
+	go shutdown(srv)
+	<-srvShutdown
+}
+
+func shutdown(server *http.Server) {
+	ctxShutDown, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := server.Shutdown(ctxShutDown)
+	if err != nil {
+		log.Printf("error shutting down server (%s): %v", server.Addr, err)
+		err = server.Close()
+		if err != nil {
+			log.Printf("error closing server (%s): %v", server.Addr, err)
+		}
 	}
 }
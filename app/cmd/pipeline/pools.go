@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+)
+
+// poolFromForm overwrites the fields of the pool present in the request form.
+// An empty fleet_template clears it.
+func poolFromForm(r *http.Request, pool *mysql.LabPool) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	if _, ok := r.Form["name"]; ok {
+		pool.Name = r.FormValue("name")
+	}
+
+	if _, ok := r.Form["type"]; ok {
+		pool.Type = mysql.LabType(r.FormValue("type"))
+	}
+
+	if _, ok := r.Form["fleet_instance_type"]; ok {
+		pool.FleetInstanceType = r.FormValue("fleet_instance_type")
+	}
+
+	if _, ok := r.Form["fleet_ingress"]; ok {
+		pool.FleetIngress = r.FormValue("fleet_ingress")
+	}
+
+	if _, ok := r.Form["fleet_template"]; ok {
+		pool.FleetTemplate = nil
+
+		if value := r.FormValue("fleet_template"); value != "" {
+			pool.FleetTemplate = &value
+		}
+	}
+
+	numbers := map[string]*int{
+		"fleet_min":              &pool.FleetMin,
+		"fleet_max":              &pool.FleetMax,
+		"fleet_volume_size":      &pool.FleetVolumeSize,
+		"fleet_lab_max_sessions": &pool.FleetLabMaxSessions,
+	}
+
+	for key, field := range numbers {
+		if _, ok := r.Form[key]; !ok {
+			continue
+		}
+
+		value, err := strconv.Atoi(r.FormValue(key))
+		if err != nil || value < 0 {
+			return fmt.Errorf("%s: must be a non-negative number", key)
+		}
+		*field = value
+	}
+
+	if pool.FleetMin > pool.FleetMax {
+		return fmt.Errorf("fleet_min must not exceed fleet_max")
+	}
+
+	return nil
+}
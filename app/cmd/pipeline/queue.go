@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/inventory"
+	"github.com/danutavadanei/nice-lab-go/internal/quota"
+	"github.com/danutavadanei/nice-lab-go/internal/scheduler"
+)
+
+type queueView struct {
+	mysql.QueueEntry
+	Position int        `json:"position,omitempty"`
+	ETA      *time.Time `json:"eta,omitempty"`
+}
+
+// describeQueueEntry adds the position and estimated admission time to a
+// waiting entry.
+func describeQueueEntry(ctx context.Context, queueRep *mysql.QueueRepository, lab mysql.Lab, entry mysql.QueueEntry) (queueView, error) {
+	view := queueView{QueueEntry: entry}
+
+	if entry.Status != mysql.QueueWaiting {
+		return view, nil
+	}
+
+	position, err := queueRep.Position(ctx, entry)
+
+	if err != nil {
+		return view, err
+	}
+
+	average, err := queueRep.AverageSessionDuration(ctx, lab.ID)
+
+	if err != nil {
+		return view, err
+	}
+
+	eta := time.Now().Add(scheduler.EstimateWait(position, lab, average)).Truncate(time.Second)
+
+	view.Position = position
+	view.ETA = &eta
+
+	return view, nil
+}
+
+// queueDispatcher provisions waiting users as slots free up on their labs.
+type queueDispatcher struct {
+	quotas   *quota.Checker
+	queueRep *mysql.QueueRepository
+	labRep   *mysql.LabRepository
+	userRep  *mysql.UserRepository
+	starter  *sessionStarter
+	interval time.Duration
+}
+
+func (d *queueDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.dispatch(ctx)
+		}
+	}
+}
+
+func (d *queueDispatcher) dispatch(ctx context.Context) {
+	labIds, err := d.queueRep.ListWaitingLabs(ctx)
+
+	if err != nil {
+		log.Printf("error listing queued labs:  %v", err)
+		return
+	}
+
+	for _, labId := range labIds {
+		if err := d.dispatchLab(ctx, labId); err != nil {
+			log.Printf("error dispatching queue of lab %d:  %v", labId, err)
+		}
+	}
+}
+
+// dispatchLab serves the lab's queue in order until the lab is full.
+func (d *queueDispatcher) dispatchLab(ctx context.Context, labId uint64) error {
+	lab, err := d.labRep.GetLabById(ctx, labId)
+
+	if err != nil {
+		return err
+	}
+
+	// Unavailable and draining labs keep their queue until they are back.
+	if !lab.Available || lab.State != mysql.LabActive {
+		return nil
+	}
+
+	entries, err := d.queueRep.ListWaiting(ctx, labId)
+
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		user, err := d.userRep.GetUserById(ctx, entry.UserID)
+
+		if err != nil {
+			return err
+		}
+
+		// Users may have gone over quota while waiting.
+		err = checkQuota(ctx, d.quotas, d.starter.sessionRep, user, lab)
+
+		if err != nil && !errors.Is(err, quota.ErrExceeded) {
+			return err
+		}
+
+		if err != nil {
+			log.Printf("queue entry %d not admitted:  %v", entry.ID, err)
+
+			if _, err := d.queueRep.SetStatus(ctx, entry.ID, mysql.QueueWaiting, mysql.QueueFailed); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		startCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		session, err := d.starter.Start(startCtx, &lab, &user)
+		cancel()
+
+		if errors.Is(err, mysql.ErrLabFull) || errors.Is(err, inventory.ErrInstanceStarting) {
+			return nil
+		}
+
+		if err != nil {
+			log.Printf("error provisioning queued session %d:  %v", entry.ID, err)
+
+			for _, from := range []mysql.QueueStatus{mysql.QueueWaiting, mysql.QueueAdmitted} {
+				if _, err := d.queueRep.SetStatus(ctx, entry.ID, from, mysql.QueueFailed); err != nil {
+					return err
+				}
+			}
+
+			continue
+		}
+
+		// Users that already had a session are not admitted by the reservation.
+		if err := d.queueRep.Admit(ctx, entry.ID, session.ID); err != nil {
+			return err
+		}
+
+		log.Printf("lab %d user %s: admitted from queue entry %d", lab.ID, user.UserName, entry.ID)
+	}
+
+	return nil
+}
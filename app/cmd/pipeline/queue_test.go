@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/provision/provisiontest"
+)
+
+func queueRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "user_id", "lab_id", "priority", "status", "created_at"})
+}
+
+func TestDispatchAdmitsQueueUntilLabIsFull(t *testing.T) {
+	p := &provisiontest.Provisioner{}
+	starter, db, mock := newTestStarter(t, p)
+
+	d := &queueDispatcher{
+		quotas:   starter.quotas,
+		queueRep: mysql.NewQueueRepository(db),
+		labRep:   mysql.NewLabRepository(db),
+		userRep:  mysql.NewUserRepository(db),
+		starter:  starter,
+	}
+
+	bob := mysql.User{ID: 4, UUID: "bob-uuid", Name: "Bob", Email: "bob@example.com", Type: mysql.Professor, UserName: "bob"}
+	none := func() *sqlmock.Rows { return sqlmock.NewRows([]string{"id"}) }
+
+	mock.ExpectQuery(`SELECT \* FROM labs WHERE id = \?`).WithArgs(testLab.ID).WillReturnRows(labRows())
+	mock.ExpectQuery(`SELECT \* FROM queue_entries WHERE lab_id = \? AND status = \?`).WithArgs(testLab.ID, mysql.QueueWaiting).
+		WillReturnRows(queueRows().
+			AddRow(1, testUser.ID, testLab.ID, mysql.PriorityProfessor, mysql.QueueWaiting, time.Now()).
+			AddRow(2, bob.ID, testLab.ID, mysql.PriorityProfessor, mysql.QueueWaiting, time.Now()))
+
+	// The first user gets the free slot.
+	mock.ExpectQuery(`SELECT id,uuid,name,email,type,username FROM users WHERE id = \?`).WithArgs(testUser.ID).WillReturnRows(userRows())
+	expectReserve(mock, 42)
+	mock.ExpectExec(`UPDATE sessions JOIN labs`).WithArgs(mysql.SessionActive, 42, mysql.SessionProvisioning).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSession(mock, 42, mysql.SessionActive)
+	mock.ExpectExec(`UPDATE queue_entries SET status = \?, session_id = \?`).
+		WithArgs(mysql.QueueAdmitted, 42, 1, mysql.QueueWaiting).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// The second one keeps waiting, as the lab is full now.
+	mock.ExpectQuery(`SELECT id,uuid,name,email,type,username FROM users WHERE id = \?`).WithArgs(bob.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "uuid", "name", "email", "type", "username"}).
+			AddRow(bob.ID, bob.UUID, bob.Name, bob.Email, bob.Type, bob.UserName))
+	mock.ExpectQuery(`SELECT \* FROM sessions WHERE user_id = \? AND lab_id = \? AND status = \?`).WithArgs(bob.ID, testLab.ID, mysql.SessionActive).WillReturnRows(none())
+	mock.ExpectQuery(`SELECT \* FROM provisioning_templates`).WillReturnRows(none())
+	mock.ExpectQuery(`SELECT \* FROM sessions WHERE user_id = \? AND lab_id = \? AND status = \?`).WithArgs(bob.ID, testLab.ID, mysql.SessionActive).WillReturnRows(none())
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT max_sessions, state FROM labs WHERE id = \? AND deleted_at IS NULL FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows([]string{"max_sessions", "state"}).AddRow(1, mysql.LabActive))
+	mock.ExpectQuery(`SELECT \* FROM sessions WHERE user_id = \? AND lab_id = \? AND \(status`).WillReturnRows(none())
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM sessions`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectRollback()
+
+	if err := d.dispatchLab(context.Background(), testLab.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := p.Calls()
+
+	if len(calls) != 1 {
+		t.Fatalf("ran %d scripts, want the plan of the first user", len(calls))
+	}
+
+	if calls[0].LabID != testLab.ID {
+		t.Errorf("provisioned lab %d, want 7", calls[0].LabID)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDispatchFailsEntryWhenProvisioningFails(t *testing.T) {
+	p := &provisiontest.Provisioner{FailStep: "create-user"}
+	starter, db, mock := newTestStarter(t, p)
+
+	d := &queueDispatcher{
+		quotas:   starter.quotas,
+		queueRep: mysql.NewQueueRepository(db),
+		labRep:   mysql.NewLabRepository(db),
+		userRep:  mysql.NewUserRepository(db),
+		starter:  starter,
+	}
+
+	mock.ExpectQuery(`SELECT \* FROM labs WHERE id = \?`).WithArgs(testLab.ID).WillReturnRows(labRows())
+	mock.ExpectQuery(`SELECT \* FROM queue_entries WHERE lab_id = \? AND status = \?`).WithArgs(testLab.ID, mysql.QueueWaiting).
+		WillReturnRows(queueRows().AddRow(1, testUser.ID, testLab.ID, mysql.PriorityProfessor, mysql.QueueWaiting, time.Now()))
+	mock.ExpectQuery(`SELECT id,uuid,name,email,type,username FROM users WHERE id = \?`).WithArgs(testUser.ID).WillReturnRows(userRows())
+	expectReserve(mock, 42)
+	mock.ExpectExec(`UPDATE sessions SET status = \?, ended_at = NOW\(\), diagnostics = \?`).
+		WithArgs(mysql.SessionFailed, sqlmock.AnyArg(), 42, mysql.SessionProvisioning).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE queue_entries SET status = \? WHERE id = \? AND status = \?`).
+		WithArgs(mysql.QueueFailed, 1, mysql.QueueWaiting).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE queue_entries SET status = \? WHERE id = \? AND status = \?`).
+		WithArgs(mysql.QueueFailed, 1, mysql.QueueAdmitted).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := d.dispatchLab(context.Background(), testLab.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := p.Calls(); len(calls) != 1 {
+		t.Errorf("ran %d scripts, want the failed plan only", len(calls))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
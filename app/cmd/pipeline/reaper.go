@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+	"github.com/danutavadanei/nice-lab-go/internal/provision"
+)
+
+// sessionReaper ends the sessions nobody is connected to. A session seen
+// without DCV connections for the idle timeout is torn down; its users are
+// warned through DCV shortly before. Sessions whose DCV session is gone
+// from the instance on two runs in a row are ended as lost.
+type sessionReaper struct {
+	sessionRep  *mysql.SessionRepository
+	provisioner provision.Provisioner
+	starter     *sessionStarter
+	cfg         config.ReaperConfig
+
+	// missing holds the sessions found gone on the previous run.
+	missing map[uint64]bool
+}
+
+func (r *sessionReaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.reap(ctx)
+		}
+	}
+}
+
+func (r *sessionReaper) reap(ctx context.Context) {
+	sessions, err := r.sessionRep.ListActiveSessions(ctx)
+
+	if err != nil {
+		log.Printf("error listing active sessions:  %v", err)
+		return
+	}
+
+	missing := make(map[uint64]bool)
+
+	for _, session := range sessions {
+		if err := r.reapSession(ctx, session, missing); err != nil {
+			log.Printf("error reaping session %d:  %v", session.ID, err)
+		}
+	}
+
+	r.missing = missing
+}
+
+// reapSession records the session in missing when its DCV session is gone
+// and ends it when it was already gone on the previous run.
+func (r *sessionReaper) reapSession(ctx context.Context, session mysql.Session, missing map[uint64]bool) error {
+	connections, gone, err := r.connections(ctx, session)
+
+	if err != nil {
+		return err
+	}
+
+	if gone && !r.missing[session.ID] {
+		log.Printf("lab %d user %s: dcv session of session %d not found", session.Lab.ID, session.User.UserName, session.ID)
+		missing[session.ID] = true
+		return nil
+	}
+
+	if gone {
+		log.Printf("lab %d user %s: dcv session is gone, ending session %d", session.Lab.ID, session.User.UserName, session.ID)
+		return r.end(ctx, session, mysql.EndReasonLost)
+	}
+
+	if connections > 0 {
+		if session.IdleSince == nil {
+			return nil
+		}
+
+		return r.sessionRep.ClearIdle(ctx, session.ID)
+	}
+
+	if session.IdleSince == nil {
+		return r.sessionRep.MarkIdle(ctx, session.ID)
+	}
+
+	idle := time.Since(*session.IdleSince)
+
+	if idle >= r.cfg.IdleTimeout {
+		log.Printf("lab %d user %s: ending session %d idle for %s", session.Lab.ID, session.User.UserName, session.ID, idle.Truncate(time.Second))
+		return r.end(ctx, session, mysql.EndReasonIdle)
+	}
+
+	if session.IdleWarned == nil && idle >= r.cfg.IdleTimeout-r.cfg.WarnBefore {
+		if err := notifySession(ctx, r.provisioner, session.Lab, session.OSUser(), r.cfg.WarnMessage); err != nil {
+			log.Printf("error warning user %s on lab %d:  %v", session.User.UserName, session.Lab.ID, err)
+		}
+
+		return r.sessionRep.MarkIdleWarned(ctx, session.ID)
+	}
+
+	return nil
+}
+
+// connections returns the number of DCV connections of the session, asking
+// the broker for the ones of broker labs; gone is set when the DCV session
+// does not exist anymore. dcv list-connections failing is confirmed with
+// dcv describe-session, as it also fails e.g. while the server restarts.
+func (r *sessionReaper) connections(ctx context.Context, session mysql.Session) (connections int, gone bool, err error) {
+	if session.Lab.Backend == mysql.BackendBroker {
+		return r.starter.brokerConnections(ctx, session)
+	}
+
+	labType, err := provision.LookupLabType(session.Lab.Type)
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	out, err := r.provisioner.Run(ctx, &session.Lab, labType.Family, provision.ListConnectionsCommands(labType, session.OSUser().UserName))
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	if out.ExitCode != 0 {
+		described, err := r.provisioner.Run(ctx, &session.Lab, labType.Family, provision.DescribeSessionCommands(labType, session.OSUser().UserName))
+
+		if err != nil {
+			return 0, false, err
+		}
+
+		if described.ExitCode == 0 {
+			return 0, false, fmt.Errorf("dcv list-connections exited with %d: %s", out.ExitCode, out)
+		}
+
+		return 0, true, nil
+	}
+
+	connections, err = provision.CountConnections(out.Stdout)
+
+	return connections, false, err
+}
+
+func (r *sessionReaper) end(ctx context.Context, session mysql.Session, reason mysql.EndReason) error {
+	endCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	return r.starter.End(endCtx, session, reason)
+}
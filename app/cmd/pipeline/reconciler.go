@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+	"github.com/danutavadanei/nice-lab-go/internal/provision"
+	"github.com/danutavadanei/nice-lab-go/internal/reconcile"
+)
+
+// labReconciler compares what runs on the labs with the sessions table. It
+// inventories every lab over its backend and reports the drift it finds.
+// With repair enabled, sessions whose DCV session or storage is gone are
+// provisioned again, or closed when that fails, and accounts no session
+// refers to are torn down. The worker only repairs drift it saw on its
+// previous run too, so that sessions being set up or torn down at the time
+// of an inventory are left alone.
+type labReconciler struct {
+	labRep      *mysql.LabRepository
+	userRep     *mysql.UserRepository
+	sessionRep  *mysql.SessionRepository
+	warmRep     *mysql.WarmRepository
+	provisioner provision.Provisioner
+	starter     *sessionStarter
+	cfg         config.ReconcileConfig
+
+	mu      sync.Mutex
+	seen    map[uint64]map[string]bool
+	reports map[uint64]labReport
+}
+
+// labReport is the outcome of reconciling a lab.
+type labReport struct {
+	LabID     uint64            `json:"lab_id"`
+	CheckedAt time.Time         `json:"checked_at"`
+	DryRun    bool              `json:"dry_run"`
+	Drift     []reconcile.Drift `json:"drift"`
+	Error     string            `json:"error,omitempty"`
+}
+
+func (rc *labReconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(rc.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rc.run(ctx)
+		}
+	}
+}
+
+func (rc *labReconciler) run(ctx context.Context) {
+	labs, err := rc.labRep.ListLabs(ctx)
+
+	if err != nil {
+		log.Printf("error listing labs:  %v", err)
+		return
+	}
+
+	known, err := rc.knownUsers(ctx)
+
+	if err != nil {
+		log.Printf("error listing users:  %v", err)
+		return
+	}
+
+	jobs := make([]func(), 0, len(labs))
+
+	for _, lab := range labs {
+		lab := lab
+
+		// The broker keeps track of the sessions of broker labs itself.
+		if lab.DeletedAt != nil || lab.Health == mysql.HealthStopped || lab.Backend == mysql.BackendBroker {
+			continue
+		}
+
+		if lab.State != mysql.LabActive && lab.State != mysql.LabDraining {
+			continue
+		}
+
+		jobs = append(jobs, func() {
+			report := rc.Reconcile(ctx, lab, known, !rc.cfg.Repair, true)
+
+			if report.Error != "" {
+				log.Printf("error reconciling lab %d:  %s", lab.ID, report.Error)
+			}
+		})
+	}
+
+	parallel(rc.cfg.Concurrency, jobs)
+}
+
+func (rc *labReconciler) knownUsers(ctx context.Context) (map[string]bool, error) {
+	users, err := rc.userRep.ListUsers(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool, len(users))
+
+	for _, user := range users {
+		known[user.UserName] = true
+	}
+
+	return known, nil
+}
+
+// Reconcile inventories the lab and diffs it with its sessions. Unless
+// dryRun is set the drift is repaired; with confirm, only the drift already
+// found by the previous run of the lab is.
+func (rc *labReconciler) Reconcile(ctx context.Context, lab mysql.Lab, known map[string]bool, dryRun bool, confirm bool) labReport {
+	report := labReport{LabID: lab.ID, CheckedAt: time.Now().UTC(), DryRun: dryRun, Drift: []reconcile.Drift{}}
+
+	drift, err := rc.diff(ctx, lab, known)
+
+	if err != nil {
+		report.Error = err.Error()
+		rc.record(report, nil)
+		return report
+	}
+
+	seen := make(map[string]bool, len(drift))
+	closed := make(map[string]error)
+
+	rc.mu.Lock()
+	previous := rc.seen[lab.ID]
+	rc.mu.Unlock()
+
+	for i := range drift {
+		d := &drift[i]
+		key := string(d.Kind) + "/" + d.UserName
+		seen[key] = true
+
+		log.Printf("lab %d user %s: drift %s, action %s", lab.ID, d.UserName, d.Kind, d.Action)
+
+		if dryRun || d.Action == reconcile.ActionNone || (confirm && !previous[key]) {
+			continue
+		}
+
+		switch d.Action {
+		case reconcile.ActionRecreate:
+			d.Repaired, err = rc.recreate(ctx, *d.SessionID)
+		case reconcile.ActionClose:
+			// An orphan account and its DCV session are torn down together.
+			var done bool
+			if err, done = closed[d.UserName]; !done {
+				err = rc.close(ctx, lab, d.UserName)
+				closed[d.UserName] = err
+			}
+			d.Repaired = err == nil
+		}
+
+		if err != nil {
+			d.Error = err.Error()
+			log.Printf("error repairing %s of user %s on lab %d:  %v", d.Kind, d.UserName, lab.ID, err)
+		}
+	}
+
+	report.Drift = drift
+	rc.record(report, seen)
+
+	return report
+}
+
+func (rc *labReconciler) diff(ctx context.Context, lab mysql.Lab, known map[string]bool) ([]reconcile.Drift, error) {
+	labType, err := provision.LookupLabType(lab.Type)
+
+	if err != nil {
+		return nil, err
+	}
+
+	invCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	out, err := rc.provisioner.Run(invCtx, &lab, labType.Family, provision.InventoryCommands(labType))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if out.ExitCode != 0 {
+		return nil, fmt.Errorf("inventory exited with %d: %s", out.ExitCode, out)
+	}
+
+	inv, err := provision.ParseInventory(labType, out.Stdout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Sessions are listed after the inventory so that a session created
+	// meanwhile is not taken for an orphan.
+	sessions, err := rc.sessionRep.ListLiveLabSessions(ctx, lab.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	held, err := rc.warmRep.ListHeldAccounts(ctx, lab.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return reconcile.Diff(sessions, held, inv, known), nil
+}
+
+// recreate provisions an active session again, closing it as lost when that
+// fails; the failure is returned with the session repaired either way.
+// Sessions that ended meanwhile are left alone.
+func (rc *labReconciler) recreate(ctx context.Context, sessionId uint64) (bool, error) {
+	session, err := rc.sessionRep.GetSessionById(ctx, sessionId)
+
+	if err != nil {
+		return false, err
+	}
+
+	if session.Status != mysql.SessionActive {
+		return false, nil
+	}
+
+	repairCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	if err := rc.starter.Reprovision(repairCtx, session); err != nil {
+		log.Printf("lab %d user %s: could not recreate session %d, closing it", session.Lab.ID, session.User.UserName, session.ID)
+
+		if endErr := rc.starter.End(repairCtx, session, mysql.EndReasonLost); endErr != nil {
+			return false, fmt.Errorf("%v; closing session: %w", err, endErr)
+		}
+
+		return true, fmt.Errorf("%w; session closed", err)
+	}
+
+	log.Printf("lab %d user %s: recreated session %d", session.Lab.ID, session.User.UserName, session.ID)
+
+	return true, nil
+}
+
+// close tears down the account of a user that has no session on the lab,
+// checking again that none was created since the inventory.
+func (rc *labReconciler) close(ctx context.Context, lab mysql.Lab, username string) error {
+	sessions, err := rc.sessionRep.ListLiveLabSessions(ctx, lab.ID)
+
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if session.OSUser().UserName == username {
+			return fmt.Errorf("user %s has a session again", username)
+		}
+	}
+
+	held, err := rc.warmRep.ListHeldAccounts(ctx, lab.ID)
+
+	if err != nil {
+		return err
+	}
+
+	for _, account := range held {
+		if account == username {
+			return fmt.Errorf("account %s is in the warm pool", username)
+		}
+	}
+
+	repairCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	log.Printf("lab %d user %s: tearing down orphan account", lab.ID, username)
+
+	return rc.starter.teardown(repairCtx, &lab, &mysql.User{UserName: username})
+}
+
+// record keeps the report of the lab and the drift it found, which the next
+// run confirms before repairing it. Failed inventories keep the drift of the
+// run before.
+func (rc *labReconciler) record(report labReport, seen map[string]bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.reports == nil {
+		rc.reports = make(map[uint64]labReport)
+		rc.seen = make(map[uint64]map[string]bool)
+	}
+
+	rc.reports[report.LabID] = report
+
+	if seen != nil {
+		rc.seen[report.LabID] = seen
+	}
+}
+
+// Reports returns the last report of every lab, by lab id.
+func (rc *labReconciler) Reports() []labReport {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	reports := make([]labReport, 0, len(rc.reports))
+
+	for _, report := range rc.reports {
+		reports = append(reports, report)
+	}
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].LabID < reports[j].LabID })
+
+	return reports
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/calendar"
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+)
+
+// reservationKeeper releases the slots of users who did not show up within
+// the grace period of their reservation.
+type reservationKeeper struct {
+	reservationRep *mysql.ReservationRepository
+	cfg            config.ReservationConfig
+}
+
+func (k *reservationKeeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(k.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			released, err := k.reservationRep.ReleaseNoShows(ctx, time.Now().Add(-k.cfg.NoShowGrace))
+
+			if err != nil {
+				log.Printf("error releasing reservations:  %v", err)
+				continue
+			}
+
+			if released > 0 {
+				log.Printf("released %d reservations without a show", released)
+			}
+		}
+	}
+}
+
+// reservationFromForm reads the lab or pool and the range of a new
+// reservation. Times are RFC 3339; ranges must start in the future, within
+// the booking horizon, and last at most the maximum duration.
+func reservationFromForm(r *http.Request, cfg config.ReservationConfig) (reservation mysql.Reservation, err error) {
+	if err = r.ParseForm(); err != nil {
+		return
+	}
+
+	labId, poolId := r.FormValue("lab_id"), r.FormValue("pool_id")
+
+	switch {
+	case (labId == "") == (poolId == ""):
+		return reservation, fmt.Errorf("either lab_id or pool_id is required")
+	case labId != "":
+		if reservation.LabID, err = strconv.ParseUint(labId, 10, 64); err != nil {
+			return reservation, fmt.Errorf("lab_id: %w", err)
+		}
+	default:
+		id, err := strconv.ParseUint(poolId, 10, 64)
+		if err != nil {
+			return reservation, fmt.Errorf("pool_id: %w", err)
+		}
+		reservation.PoolID = &id
+	}
+
+	if reservation.StartsAt, err = time.Parse(time.RFC3339, r.FormValue("starts_at")); err != nil {
+		return reservation, fmt.Errorf("starts_at: %w", err)
+	}
+
+	if reservation.EndsAt, err = time.Parse(time.RFC3339, r.FormValue("ends_at")); err != nil {
+		return reservation, fmt.Errorf("ends_at: %w", err)
+	}
+
+	reservation.StartsAt, reservation.EndsAt = reservation.StartsAt.UTC(), reservation.EndsAt.UTC()
+	now := time.Now()
+
+	switch {
+	case !reservation.EndsAt.After(reservation.StartsAt):
+		return reservation, fmt.Errorf("ends_at: must be after starts_at")
+	case reservation.EndsAt.Sub(reservation.StartsAt) > cfg.MaxDuration:
+		return reservation, fmt.Errorf("reservations last at most %s", cfg.MaxDuration)
+	case reservation.EndsAt.Before(now):
+		return reservation, fmt.Errorf("ends_at: must be in the future")
+	case reservation.StartsAt.After(now.Add(cfg.MaxAdvance)):
+		return reservation, fmt.Errorf("starts_at: reservations are taken at most %s ahead", cfg.MaxAdvance)
+	}
+
+	return reservation, nil
+}
+
+// reservationCalendar turns reservations into a feed. Feeds that are not
+// the user's own only show busy slots, without who booked them.
+func reservationCalendar(name string, reservations []mysql.Reservation, labs map[uint64]mysql.Lab, private bool) calendar.Calendar {
+	feed := calendar.Calendar{Name: name}
+
+	for _, reservation := range reservations {
+		lab := labs[reservation.LabID]
+
+		event := calendar.Event{
+			UID:       reservation.UUID + "@nice-lab",
+			Start:     reservation.StartsAt,
+			End:       reservation.EndsAt,
+			Stamp:     reservation.CreatedAt,
+			Summary:   "Reserved: " + lab.Name,
+			Location:  lab.Name,
+			Cancelled: reservation.Status == mysql.ReservationCancelled || reservation.Status == mysql.ReservationNoShow,
+		}
+
+		if reservation.UpdatedAt != nil {
+			event.Stamp = *reservation.UpdatedAt
+		}
+
+		if private {
+			event.Description = fmt.Sprintf("Reservation %d (%s)", reservation.ID, reservation.Status)
+		}
+
+		feed.Events = append(feed.Events, event)
+	}
+
+	return feed
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/dcvsm"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+	"github.com/danutavadanei/nice-lab-go/internal/inventory"
+	"github.com/danutavadanei/nice-lab-go/internal/provision"
+	"github.com/danutavadanei/nice-lab-go/internal/quota"
+)
+
+// sessionStarter provisions user sessions on labs. It is shared by the HTTP
+// handlers and the background workers.
+type sessionStarter struct {
+	provisioner provision.Provisioner
+	sessionRep  *mysql.SessionRepository
+	templateRep *mysql.TemplateRepository
+	templates   *provision.Templates
+	power       *inventory.Power
+	warmRep     *mysql.WarmRepository
+	warmStats   *warmStats
+	broker      *dcvsm.Broker
+	brokerCfg   config.BrokerConfig
+	quotas      *quota.Checker
+}
+
+// Start returns the user's session on the lab, provisioning it when needed.
+// inventory.ErrInstanceStarting is returned while the lab instance is not
+// ready yet. Sessions on broker labs are created by the broker.
+func (s *sessionStarter) Start(ctx context.Context, lab *mysql.Lab, user *mysql.User) (mysql.Session, error) {
+	if lab.Backend == mysql.BackendBroker {
+		return s.startBroker(ctx, lab, user)
+	}
+
+	if err := s.power.Wake(ctx, lab); err != nil {
+		return mysql.Session{}, err
+	}
+
+	labType, err := provision.LookupLabType(lab.Type)
+
+	if err != nil {
+		return mysql.Session{}, err
+	}
+
+	tmpl, err := resolveTemplate(ctx, s.templateRep, s.templates, labType, lab)
+
+	if err != nil {
+		return mysql.Session{}, fmt.Errorf("resolving provisioning template: %w", err)
+	}
+
+	return s.getOrCreateSession(ctx, tmpl, labType, lab, user)
+}
+
+// getOrCreateSession returns the user's active session on the lab when its DCV
+// session is still alive on the instance, and provisions a new one otherwise.
+// The new session takes a slot on the lab before anything runs on the
+// instance; mysql.ErrLabFull is returned when there is none. Labs with a warm
+// pool hand the session one of their ready accounts instead of provisioning
+// it. A provisioning failure is recorded on the session with the output
+// collected from the instance.
+func (s *sessionStarter) getOrCreateSession(
+	ctx context.Context,
+	tmpl *provision.Template,
+	labType provision.LabType,
+	lab *mysql.Lab,
+	user *mysql.User,
+) (mysql.Session, error) {
+	p, sessionRep := s.provisioner, s.sessionRep
+	session, err := sessionRep.GetActiveSession(ctx, user.ID, lab.ID)
+
+	switch {
+	case err == nil:
+		out, err := p.Run(ctx, lab, tmpl.Family, provision.DescribeSessionCommands(labType, session.OSUser().UserName))
+
+		if err != nil {
+			return mysql.Session{}, err
+		}
+
+		if out.ExitCode == 0 {
+			return session, nil
+		}
+
+		if err := sessionRep.EndSession(ctx, session.ID, mysql.EndReasonLost); err != nil {
+			return mysql.Session{}, err
+		}
+	case !errors.Is(err, sql.ErrNoRows):
+		return mysql.Session{}, err
+	}
+
+	plan, err := tmpl.Render(provision.KindProvision, templateData(labType, lab, user))
+
+	if err != nil {
+		return mysql.Session{}, err
+	}
+
+	session, reserved, err := s.reserve(ctx, lab, user)
+
+	if err != nil {
+		return mysql.Session{}, err
+	}
+
+	// A concurrent request got the session first and provisions it.
+	if !reserved {
+		return session, nil
+	}
+
+	if lab.WarmPoolSize > 0 && tmpl.Warms() {
+		bound, ok, err := s.bindWarm(ctx, tmpl, labType, lab, user, session)
+
+		if ok || err != nil {
+			return bound, err
+		}
+	}
+
+	results, err := provision.Apply(ctx, p, lab, plan)
+
+	return finishSession(sessionRep, session, lab, user, results, err)
+}
+
+// reserve takes a slot on the lab for the user like
+// mysql.SessionRepository.ReserveSession, within the user's concurrent
+// session limit. A *quota.Exceeded error is returned when the user is at it.
+func (s *sessionStarter) reserve(ctx context.Context, lab *mysql.Lab, user *mysql.User) (mysql.Session, bool, error) {
+	limit, err := s.quotas.ConcurrentLimit(ctx, *user)
+
+	if err != nil {
+		return mysql.Session{}, false, err
+	}
+
+	session, reserved, err := s.sessionRep.ReserveSession(ctx, *user, *lab, limit)
+
+	if errors.Is(err, mysql.ErrSessionLimit) {
+		return mysql.Session{}, false, quota.ConcurrentExceeded(*limit)
+	}
+
+	return session, reserved, err
+}
+
+// bindWarm hands a ready warm account of the lab to the reserved session,
+// linking the user's storage into it. ok is false when no account was ready
+// or binding it failed, in which case the account is retired and the
+// session is left to provision.
+func (s *sessionStarter) bindWarm(
+	ctx context.Context,
+	tmpl *provision.Template,
+	labType provision.LabType,
+	lab *mysql.Lab,
+	user *mysql.User,
+	session mysql.Session,
+) (bound mysql.Session, ok bool, err error) {
+	account, err := s.warmRep.Claim(ctx, lab.ID, session.ID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		s.warmStats.miss(lab.ID)
+		return mysql.Session{}, false, nil
+	}
+
+	if err != nil {
+		log.Printf("error claiming warm account:  %v", err)
+		return mysql.Session{}, false, nil
+	}
+
+	data := templateData(labType, lab, user)
+	data.Session.Name = account.Account
+
+	plan, err := tmpl.Render(provision.KindBind, data)
+
+	if err == nil {
+		var results []provision.StepResult
+		results, err = provision.Apply(ctx, s.provisioner, lab, plan)
+
+		for _, result := range results {
+			log.Printf("lab %d user %s: bind step %s %s %s", lab.ID, user.UserName, result.Step, result.Status, result.Kind)
+		}
+	}
+
+	if err == nil {
+		err = s.sessionRep.BindAccount(ctx, session.ID, account.Account)
+	}
+
+	if err != nil {
+		log.Printf("error binding warm account %s to user %s:  %v", account.Account, user.UserName, err)
+		s.warmStats.miss(lab.ID)
+
+		if err := s.warmRep.Retire(ctx, account.ID); err != nil {
+			log.Printf("error retiring warm account:  %v", err)
+		}
+
+		return mysql.Session{}, false, nil
+	}
+
+	log.Printf("lab %d user %s: bound to warm account %s", lab.ID, user.UserName, account.Account)
+	s.warmStats.hit(lab.ID)
+
+	// Like finishSession, the session is activated even when the request
+	// timed out meanwhile.
+	activateCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	bound, err = s.sessionRep.ActivateSession(activateCtx, session.ID)
+
+	return bound, true, err
+}
+
+// finishSession activates a reserved session once its plan was applied, or
+// records the failure with the output collected from the instance.
+func finishSession(
+	sessionRep *mysql.SessionRepository,
+	session mysql.Session,
+	lab *mysql.Lab,
+	user *mysql.User,
+	results []provision.StepResult,
+	err error,
+) (mysql.Session, error) {
+	for _, result := range results {
+		log.Printf("lab %d user %s: step %s %s %s", lab.ID, user.UserName, result.Step, result.Status, result.Kind)
+	}
+
+	// The outcome is recorded even when the request timed out meanwhile, so
+	// that the session does not stay provisioning.
+	recordCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err != nil {
+		diagnostics := err.Error()
+
+		var provisionErr *provision.Error
+		if errors.As(err, &provisionErr) {
+			diagnostics = provisionErr.Output
+		}
+
+		if err := sessionRep.FailSession(recordCtx, session.ID, diagnostics); err != nil {
+			log.Printf("error recording failed session:  %v", err)
+		}
+
+		return mysql.Session{}, err
+	}
+
+	return sessionRep.ActivateSession(recordCtx, session.ID)
+}
+
+// placement is a user to provision on a lab.
+type placement struct {
+	Lab  mysql.Lab
+	User mysql.User
+}
+
+// StartBatch provisions new sessions for the users on their labs, sending
+// the plans of all of them together rather than one command per user. The
+// users must not have an active session on their lab. Stopped instances are
+// started even when they are not started on demand, since batches are
+// scheduled ahead of time. The session or the error of every placement is
+// returned in order; placements on an instance that is still starting fail
+// with inventory.ErrInstanceStarting.
+func (s *sessionStarter) StartBatch(ctx context.Context, placements []placement) ([]mysql.Session, []error) {
+	sessions := make([]mysql.Session, len(placements))
+	errs := make([]error, len(placements))
+
+	woken := make(map[uint64]error)
+	var jobs []provision.BatchJob
+	var reserved []int
+
+	for i := range placements {
+		lab, user := &placements[i].Lab, &placements[i].User
+
+		if lab.Backend == mysql.BackendBroker {
+			sessions[i], errs[i] = s.startBroker(ctx, lab, user)
+			continue
+		}
+
+		err, ok := woken[lab.ID]
+		if !ok {
+			err = s.power.Start(ctx, lab)
+			woken[lab.ID] = err
+		}
+
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		labType, err := provision.LookupLabType(lab.Type)
+
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		tmpl, err := resolveTemplate(ctx, s.templateRep, s.templates, labType, lab)
+
+		if err != nil {
+			errs[i] = fmt.Errorf("resolving provisioning template: %w", err)
+			continue
+		}
+
+		plan, err := tmpl.Render(provision.KindProvision, templateData(labType, lab, user))
+
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		// Classes are not limited by the quotas of their students.
+		session, ok, err := s.sessionRep.ReserveSession(ctx, *user, *lab, nil)
+
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		// Users that already have a session on the lab keep it.
+		sessions[i] = session
+
+		if !ok {
+			continue
+		}
+
+		jobs = append(jobs, provision.BatchJob{Lab: lab, Plan: plan})
+		reserved = append(reserved, i)
+	}
+
+	for j, result := range provision.ApplyBatch(ctx, s.provisioner, jobs) {
+		i := reserved[j]
+		sessions[i], errs[i] = finishSession(s.sessionRep, sessions[i], &placements[i].Lab, &placements[i].User, result.Results, result.Err)
+	}
+
+	return sessions, errs
+}
+
+// resolveTemplate returns the provisioning template attached to the lab,
+// falling back to the profile of its lab type. Templates stored in the
+// database take precedence over the ones loaded from files.
+func resolveTemplate(
+	ctx context.Context,
+	templateRep *mysql.TemplateRepository,
+	templates *provision.Templates,
+	labType provision.LabType,
+	lab *mysql.Lab,
+) (*provision.Template, error) {
+	name, version := labType.Profile, 0
+
+	if lab.TemplateName != nil {
+		name = *lab.TemplateName
+	}
+
+	if lab.TemplateVersion != nil {
+		version = *lab.TemplateVersion
+	}
+
+	stored, err := templateRep.GetTemplate(ctx, name, version)
+
+	if err == nil {
+		return provision.ParseTemplate([]byte(stored.Body), fmt.Sprintf("database:%d", stored.ID))
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	return templates.Get(name, version)
+}
+
+func templateData(labType provision.LabType, lab *mysql.Lab, user *mysql.User) provision.TemplateData {
+	return provision.TemplateData{
+		User:     *user,
+		Lab:      *lab,
+		Type:     labType,
+		Session:  provision.SessionData{Name: user.UserName},
+		Password: tempPassword,
+	}
+}
+
+// End tears the session down on its lab and records it as ended for reason.
+// The session is ended even when the teardown fails, so that users are not
+// kept on a lab that is going away; the failure is returned.
+func (s *sessionStarter) End(ctx context.Context, session mysql.Session, reason mysql.EndReason) error {
+	var teardownErr error
+
+	if session.Lab.Backend == mysql.BackendBroker {
+		teardownErr = s.endBroker(ctx, session)
+	} else {
+		osUser := session.OSUser()
+		teardownErr = s.teardown(ctx, &session.Lab, &osUser)
+	}
+
+	if teardownErr != nil {
+		log.Printf("error tearing down session %d:  %v", session.ID, teardownErr)
+	}
+
+	if err := s.sessionRep.EndSession(ctx, session.ID, reason); err != nil {
+		return err
+	}
+
+	return teardownErr
+}
+
+// teardown runs the teardown plan of the user's account on the lab. It is
+// also used for accounts no session refers to anymore.
+func (s *sessionStarter) teardown(ctx context.Context, lab *mysql.Lab, user *mysql.User) error {
+	labType, err := provision.LookupLabType(lab.Type)
+
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := resolveTemplate(ctx, s.templateRep, s.templates, labType, lab)
+
+	if err != nil {
+		return fmt.Errorf("resolving provisioning template: %w", err)
+	}
+
+	plan, err := tmpl.Render(provision.KindTeardown, templateData(labType, lab, user))
+
+	if err != nil {
+		return err
+	}
+
+	results, err := provision.Apply(ctx, s.provisioner, lab, plan)
+
+	for _, result := range results {
+		log.Printf("lab %d user %s: teardown step %s %s %s", lab.ID, user.UserName, result.Step, result.Status, result.Kind)
+	}
+
+	return err
+}
+
+// Reprovision applies the provisioning plan of an active session again, for
+// sessions whose DCV session or storage went missing from their lab. Steps
+// found already applied are skipped, so the account and its files are kept.
+func (s *sessionStarter) Reprovision(ctx context.Context, session mysql.Session) error {
+	lab, user := &session.Lab, &session.User
+	labType, err := provision.LookupLabType(lab.Type)
+
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := resolveTemplate(ctx, s.templateRep, s.templates, labType, lab)
+
+	if err != nil {
+		return fmt.Errorf("resolving provisioning template: %w", err)
+	}
+
+	plan, err := reprovisionPlan(tmpl, labType, session)
+
+	if err != nil {
+		return err
+	}
+
+	results, err := provision.Apply(ctx, s.provisioner, lab, plan)
+
+	for _, result := range results {
+		log.Printf("lab %d user %s: step %s %s %s", lab.ID, user.UserName, result.Step, result.Status, result.Kind)
+	}
+
+	return err
+}
+
+// reprovisionPlan is the provisioning plan of the session. Sessions bound
+// to a warm account get the account created again and bound to their user.
+func reprovisionPlan(tmpl *provision.Template, labType provision.LabType, session mysql.Session) (provision.Plan, error) {
+	if session.Account == nil {
+		return tmpl.Render(provision.KindProvision, templateData(labType, &session.Lab, &session.User))
+	}
+
+	if !tmpl.Warms() {
+		return provision.Plan{}, fmt.Errorf("template %s version %d has no warm steps", tmpl.Name, tmpl.Version)
+	}
+
+	osUser := session.OSUser()
+	plan, err := tmpl.Render(provision.KindWarm, templateData(labType, &session.Lab, &osUser))
+
+	if err != nil {
+		return provision.Plan{}, err
+	}
+
+	data := templateData(labType, &session.Lab, &session.User)
+	data.Session.Name = osUser.UserName
+
+	bind, err := tmpl.Render(provision.KindBind, data)
+
+	if err != nil {
+		return provision.Plan{}, err
+	}
+
+	plan.Steps = append(plan.Steps, bind.Steps...)
+
+	return plan, nil
+}
+
+// notifySession shows message to the users connected to the session. The
+// broker has no way to reach the users of broker labs, who are not warned.
+func notifySession(ctx context.Context, p provision.Provisioner, lab mysql.Lab, user mysql.User, message string) error {
+	if lab.Backend == mysql.BackendBroker {
+		return nil
+	}
+
+	labType, err := provision.LookupLabType(lab.Type)
+
+	if err != nil {
+		return err
+	}
+
+	out, err := p.Run(ctx, &lab, labType.Family, provision.NotifyUserCommands(labType, user.UserName, message))
+
+	if err != nil {
+		return err
+	}
+
+	if out.ExitCode != 0 {
+		return fmt.Errorf("dcv notify-user exited with %d: %s", out.ExitCode, out)
+	}
+
+	return nil
+}
+
+// checkQuota refuses a new session on the lab when the user is over quota.
+// Users reconnecting to their session on the lab are not checked.
+func checkQuota(ctx context.Context, quotas *quota.Checker, sessionRep *mysql.SessionRepository, user mysql.User, lab mysql.Lab) error {
+	_, err := sessionRep.GetActiveSession(ctx, user.ID, lab.ID)
+
+	if err == nil {
+		return nil
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	return quotas.Check(ctx, user, lab)
+}
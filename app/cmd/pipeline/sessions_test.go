@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/provision"
+	"github.com/danutavadanei/nice-lab-go/internal/provision/provisiontest"
+)
+
+var testSession = mysql.Session{ID: 42, User: testUser, Lab: testLab, Status: mysql.SessionActive}
+
+func TestEndTearsDownSession(t *testing.T) {
+	p := &provisiontest.Provisioner{}
+	starter, _, mock := newTestStarter(t, p)
+
+	mock.ExpectQuery(`SELECT \* FROM provisioning_templates`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec(`UPDATE sessions SET status = \?, ended_at = NOW\(\), end_reason = \?`).
+		WithArgs(mysql.SessionEnded, mysql.EndReasonIdle, testSession.ID, mysql.SessionActive).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := starter.End(context.Background(), testSession, mysql.EndReasonIdle); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := p.Calls()
+
+	if len(calls) != 1 {
+		t.Fatalf("ran %d scripts, want the teardown plan", len(calls))
+	}
+
+	for _, command := range []string{"close-session", "pkill -KILL -u 'alice'", "userdel -r 'alice'"} {
+		if !strings.Contains(calls[0].Script(), command) {
+			t.Errorf("teardown does not run %q:\n%s", command, calls[0].Script())
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEndRecordsSessionWhenTeardownFails(t *testing.T) {
+	p := &provisiontest.Provisioner{FailStep: "delete-user"}
+	starter, _, mock := newTestStarter(t, p)
+
+	mock.ExpectQuery(`SELECT \* FROM provisioning_templates`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec(`UPDATE sessions SET status = \?, ended_at = NOW\(\), end_reason = \?`).
+		WithArgs(mysql.SessionEnded, mysql.EndReasonRetired, testSession.ID, mysql.SessionActive).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := starter.End(context.Background(), testSession, mysql.EndReasonRetired)
+
+	var provisionErr *provision.Error
+	if !errors.As(err, &provisionErr) || provisionErr.Step != "delete-user" {
+		t.Errorf("got %v, want the failure of delete-user", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReprovisionKeepsExistingAccount(t *testing.T) {
+	p := &provisiontest.Provisioner{Existing: map[string]bool{"create-user": true, "join-managed-group": true}}
+	starter, _, mock := newTestStarter(t, p)
+
+	mock.ExpectQuery(`SELECT \* FROM provisioning_templates`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	if err := starter.Reprovision(context.Background(), testSession); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := p.Calls()
+
+	if len(calls) != 1 {
+		t.Fatalf("ran %d scripts, want the provisioning plan", len(calls))
+	}
+
+	// Steps found applied are skipped by their exists check.
+	if script := calls[0].Script(); !strings.Contains(script, "id -u 'alice'") || !strings.Contains(script, "create-session") {
+		t.Errorf("did not run the provisioning plan:\n%s", script)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReprovisionDoesNotUndoExistingAccount(t *testing.T) {
+	p := &provisiontest.Provisioner{Existing: map[string]bool{"create-user": true}, FailStep: "link-storage"}
+	starter, _, mock := newTestStarter(t, p)
+
+	mock.ExpectQuery(`SELECT \* FROM provisioning_templates`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	err := starter.Reprovision(context.Background(), testSession)
+
+	var provisionErr *provision.Error
+	if !errors.As(err, &provisionErr) || provisionErr.Step != "link-storage" {
+		t.Fatalf("got %v, want the failure of link-storage", err)
+	}
+
+	calls := p.Calls()
+
+	if len(calls) != 2 {
+		t.Fatalf("ran %d scripts, want the plan and its compensation", len(calls))
+	}
+
+	// Only the steps the plan applied are undone.
+	undo := calls[1].Script()
+
+	if !strings.Contains(undo, "close-session") {
+		t.Errorf("compensation does not close the DCV session it created:\n%s", undo)
+	}
+
+	if strings.Contains(undo, "userdel") {
+		t.Errorf("compensation deletes the account the session had:\n%s", undo)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
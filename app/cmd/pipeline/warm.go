@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+	"github.com/danutavadanei/nice-lab-go/internal/provision"
+	"github.com/google/uuid"
+)
+
+// warmPrefix starts the names of warm accounts.
+const warmPrefix = "nlw-"
+
+// warmStats counts, per lab, the sessions that got a warm account and the
+// ones that found none ready since the pipeline started.
+type warmStats struct {
+	mu     sync.Mutex
+	claims map[uint64]int64
+	misses map[uint64]int64
+}
+
+func newWarmStats() *warmStats {
+	return &warmStats{claims: make(map[uint64]int64), misses: make(map[uint64]int64)}
+}
+
+func (s *warmStats) hit(labId uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.claims[labId]++
+}
+
+func (s *warmStats) miss(labId uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.misses[labId]++
+}
+
+func (s *warmStats) get(labId uint64) (claims int64, misses int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.claims[labId], s.misses[labId]
+}
+
+// warmPool keeps the warm pools of the labs at their size. Accounts missing
+// from the pools are created together in a batch; accounts above the size,
+// or on instances that stopped and lost their DCV sessions, are retired and
+// torn down. Pools never hold more accounts than their lab has free slots,
+// and only fill on running instances.
+type warmPool struct {
+	labRep     *mysql.LabRepository
+	sessionRep *mysql.SessionRepository
+	warmRep    *mysql.WarmRepository
+	starter    *sessionStarter
+	stats      *warmStats
+	cfg        config.WarmConfig
+}
+
+// warmStatus is the state of the warm pool of a lab.
+type warmStatus struct {
+	mysql.WarmCounts
+	Size   int   `json:"size"`
+	Claims int64 `json:"claims"`
+	Misses int64 `json:"misses"`
+}
+
+func (w *warmPool) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.replenish(ctx); err != nil {
+				log.Printf("error replenishing warm pools:  %v", err)
+			}
+		}
+	}
+}
+
+func (w *warmPool) replenish(ctx context.Context) error {
+	if err := w.warmRep.PruneClaimed(ctx); err != nil {
+		return err
+	}
+
+	if _, err := w.warmRep.RetireStale(ctx, time.Now().Add(-w.cfg.CreateTimeout)); err != nil {
+		return err
+	}
+
+	labs, err := w.labRep.ListLabs(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	counts, err := w.counts(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	var jobs []provision.BatchJob
+	var created []mysql.WarmAccount
+
+	for i := range labs {
+		lab := &labs[i]
+		c := counts[lab.ID]
+
+		if lab.Health == mysql.HealthStopped {
+			if c.Ready > 0 {
+				log.Printf("lab %d: instance stopped, retiring %d warm accounts", lab.ID, c.Ready)
+
+				if _, err := w.warmRep.RetireReady(ctx, lab.ID, c.Ready); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		labType, tmpl, target, err := w.target(ctx, lab)
+
+		if err != nil {
+			log.Printf("error sizing warm pool of lab %d:  %v", lab.ID, err)
+			continue
+		}
+
+		have := c.Creating + c.Ready
+
+		if have > target {
+			if _, err := w.warmRep.RetireReady(ctx, lab.ID, have-target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for n := have; n < target; n++ {
+			name := warmPrefix + strings.ReplaceAll(uuid.New().String(), "-", "")[:8]
+
+			plan, err := tmpl.Render(provision.KindWarm, templateData(labType, lab, &mysql.User{UserName: name}))
+
+			if err != nil {
+				log.Printf("error rendering warm account of lab %d:  %v", lab.ID, err)
+				break
+			}
+
+			account, err := w.warmRep.CreateAccount(ctx, lab.ID, name)
+
+			if err != nil {
+				return err
+			}
+
+			jobs = append(jobs, provision.BatchJob{Lab: lab, Plan: plan})
+			created = append(created, account)
+		}
+	}
+
+	if len(jobs) > 0 {
+		w.create(ctx, jobs, created)
+	}
+
+	return w.teardown(ctx, labs)
+}
+
+func (w *warmPool) counts(ctx context.Context) (map[uint64]mysql.WarmCounts, error) {
+	list, err := w.warmRep.ListCounts(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[uint64]mysql.WarmCounts, len(list))
+
+	for _, c := range list {
+		counts[c.LabID] = c
+	}
+
+	return counts, nil
+}
+
+// target returns the type and template of the lab and the number of
+// accounts its pool should hold: none when the lab takes no new sessions,
+// its template has no warm steps or it is a broker lab, which runs no
+// template.
+func (w *warmPool) target(ctx context.Context, lab *mysql.Lab) (labType provision.LabType, tmpl *provision.Template, target int, err error) {
+	if lab.WarmPoolSize == 0 || lab.State != mysql.LabActive || !lab.Available || lab.Backend == mysql.BackendBroker {
+		return
+	}
+
+	if labType, err = provision.LookupLabType(lab.Type); err != nil {
+		return
+	}
+
+	if tmpl, err = resolveTemplate(ctx, w.starter.templateRep, w.starter.templates, labType, lab); err != nil {
+		return
+	}
+
+	if !tmpl.Warms() {
+		return
+	}
+
+	sessions, err := w.sessionRep.ListLiveLabSessions(ctx, lab.ID)
+
+	if err != nil {
+		return
+	}
+
+	target = lab.WarmPoolSize
+
+	if free := lab.MaxSessions - len(sessions); free < target {
+		target = free
+	}
+
+	if target < 0 {
+		target = 0
+	}
+
+	return
+}
+
+// create provisions the new accounts and makes them ready. Accounts that
+// failed are compensated by their plan and retired.
+func (w *warmPool) create(ctx context.Context, jobs []provision.BatchJob, accounts []mysql.WarmAccount) {
+	createCtx, cancel := context.WithTimeout(ctx, w.cfg.CreateTimeout)
+	defer cancel()
+
+	for i, result := range provision.ApplyBatch(createCtx, w.starter.provisioner, jobs) {
+		account := accounts[i]
+
+		if result.Err != nil {
+			log.Printf("error creating warm account %s on lab %d:  %v", account.Account, account.LabID, result.Err)
+
+			if err := w.warmRep.Retire(ctx, account.ID); err != nil {
+				log.Printf("error retiring warm account:  %v", err)
+			}
+			continue
+		}
+
+		if err := w.warmRep.SetReady(ctx, account.ID); err != nil {
+			log.Printf("error recording warm account:  %v", err)
+			continue
+		}
+
+		log.Printf("lab %d: warm account %s ready", account.LabID, account.Account)
+	}
+}
+
+// teardown removes the retired accounts from their labs. Accounts of labs
+// that are gone are forgotten; the ones of stopped instances wait for them
+// to run again.
+func (w *warmPool) teardown(ctx context.Context, labs []mysql.Lab) error {
+	retiring, err := w.warmRep.ListRetiring(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	byId := make(map[uint64]mysql.Lab, len(labs))
+
+	for _, lab := range labs {
+		byId[lab.ID] = lab
+	}
+
+	jobs := make([]func(), 0, len(retiring))
+
+	for _, account := range retiring {
+		account := account
+		lab, ok := byId[account.LabID]
+
+		if !ok {
+			if err := w.warmRep.DeleteAccount(ctx, account.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if lab.Health == mysql.HealthStopped {
+			continue
+		}
+
+		jobs = append(jobs, func() {
+			teardownCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+			defer cancel()
+
+			if err := w.starter.teardown(teardownCtx, &lab, &mysql.User{UserName: account.Account}); err != nil {
+				log.Printf("error tearing down warm account %s on lab %d:  %v", account.Account, lab.ID, err)
+				return
+			}
+
+			if err := w.warmRep.DeleteAccount(ctx, account.ID); err != nil {
+				log.Printf("error deleting warm account:  %v", err)
+			}
+		})
+	}
+
+	parallel(w.cfg.Concurrency, jobs)
+
+	return nil
+}
+
+// Status returns the warm pool of every lab that has one or still holds
+// accounts.
+func (w *warmPool) Status(ctx context.Context) ([]warmStatus, error) {
+	labs, err := w.labRep.ListLabs(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	counts, err := w.counts(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]warmStatus, 0)
+
+	for _, lab := range labs {
+		c, ok := counts[lab.ID]
+
+		if !ok && lab.WarmPoolSize == 0 {
+			continue
+		}
+
+		c.LabID = lab.ID
+		claims, misses := w.stats.get(lab.ID)
+
+		list = append(list, warmStatus{WarmCounts: c, Size: lab.WarmPoolSize, Claims: claims, Misses: misses})
+	}
+
+	return list, nil
+}
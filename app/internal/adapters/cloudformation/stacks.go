@@ -0,0 +1,127 @@
+package cloudformation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awscf "github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/aws/smithy-go"
+)
+
+var ErrStackNotFound = errors.New("stack not found")
+
+// Client is the part of the CloudFormation API used by Stacks.
+type Client interface {
+	CreateStack(ctx context.Context, params *awscf.CreateStackInput, optFns ...func(*awscf.Options)) (*awscf.CreateStackOutput, error)
+	DescribeStacks(ctx context.Context, params *awscf.DescribeStacksInput, optFns ...func(*awscf.Options)) (*awscf.DescribeStacksOutput, error)
+	DeleteStack(ctx context.Context, params *awscf.DeleteStackInput, optFns ...func(*awscf.Options)) (*awscf.DeleteStackOutput, error)
+}
+
+type Stack struct {
+	ID      string
+	Name    string
+	Status  types.StackStatus
+	Reason  string
+	Outputs map[string]string
+}
+
+// InProgress reports whether CloudFormation is still working on the stack.
+func (s Stack) InProgress() bool {
+	return strings.HasSuffix(string(s.Status), "_IN_PROGRESS")
+}
+
+// Failed reports whether the stack could not be created and must be deleted.
+func (s Stack) Failed() bool {
+	switch s.Status {
+	case types.StackStatusCreateFailed, types.StackStatusRollbackComplete, types.StackStatusRollbackFailed, types.StackStatusDeleteFailed:
+		return true
+	}
+
+	return false
+}
+
+type Stacks struct {
+	client Client
+}
+
+func NewStacks(client Client) *Stacks {
+	return &Stacks{client: client}
+}
+
+// Create launches a stack from the template body and returns its id. The
+// templates create IAM roles, so the IAM capabilities are acknowledged.
+func (st *Stacks) Create(ctx context.Context, name string, body string, parameters map[string]string, tags map[string]string) (string, error) {
+	params := &awscf.CreateStackInput{
+		StackName:    aws.String(name),
+		TemplateBody: aws.String(body),
+		Capabilities: []types.Capability{types.CapabilityCapabilityIam, types.CapabilityCapabilityNamedIam},
+		OnFailure:    types.OnFailureDelete,
+	}
+
+	for key, value := range parameters {
+		params.Parameters = append(params.Parameters, types.Parameter{
+			ParameterKey:   aws.String(key),
+			ParameterValue: aws.String(value),
+		})
+	}
+
+	for key, value := range tags {
+		params.Tags = append(params.Tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+
+	out, err := st.client.CreateStack(ctx, params)
+
+	if err != nil {
+		return "", err
+	}
+
+	return aws.ToString(out.StackId), nil
+}
+
+// Describe returns the stack by name or id. Deleted stacks can only be
+// described by id.
+func (st *Stacks) Describe(ctx context.Context, nameOrId string) (Stack, error) {
+	out, err := st.client.DescribeStacks(ctx, &awscf.DescribeStacksInput{
+		StackName: aws.String(nameOrId),
+	})
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "ValidationError" && strings.Contains(apiErr.ErrorMessage(), "does not exist") {
+		return Stack{}, fmt.Errorf("%w: %s", ErrStackNotFound, nameOrId)
+	}
+
+	if err != nil {
+		return Stack{}, err
+	}
+
+	if len(out.Stacks) == 0 {
+		return Stack{}, fmt.Errorf("%w: %s", ErrStackNotFound, nameOrId)
+	}
+
+	stack := out.Stacks[0]
+	result := Stack{
+		ID:      aws.ToString(stack.StackId),
+		Name:    aws.ToString(stack.StackName),
+		Status:  stack.StackStatus,
+		Reason:  aws.ToString(stack.StackStatusReason),
+		Outputs: make(map[string]string, len(stack.Outputs)),
+	}
+
+	for _, output := range stack.Outputs {
+		result.Outputs[aws.ToString(output.OutputKey)] = aws.ToString(output.OutputValue)
+	}
+
+	return result, nil
+}
+
+func (st *Stacks) Delete(ctx context.Context, nameOrId string) error {
+	_, err := st.client.DeleteStack(ctx, &awscf.DeleteStackInput{
+		StackName: aws.String(nameOrId),
+	})
+
+	return err
+}
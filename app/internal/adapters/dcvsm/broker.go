@@ -0,0 +1,377 @@
+package dcvsm
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+)
+
+var ErrSessionNotFound = errors.New("broker session not found")
+
+type SessionType string
+
+// Linux servers host virtual sessions, several per server; Windows servers
+// host one console session.
+const (
+	SessionVirtual SessionType = "VIRTUAL"
+	SessionConsole SessionType = "CONSOLE"
+)
+
+type SessionState string
+
+const (
+	StateCreating SessionState = "CREATING"
+	StateReady    SessionState = "READY"
+	StateDeleting SessionState = "DELETING"
+	StateDeleted  SessionState = "DELETED"
+	StateUnknown  SessionState = "UNKNOWN"
+)
+
+// Server is the DCV server hosting a session.
+type Server struct {
+	Ip         string `json:"Ip"`
+	Hostname   string `json:"Hostname"`
+	Port       string `json:"Port"`
+	WebUrlPath string `json:"WebUrlPath"`
+}
+
+// Session is a DCV session as described by the broker.
+type Session struct {
+	Id               string       `json:"Id"`
+	Name             string       `json:"Name"`
+	Owner            string       `json:"Owner"`
+	Type             SessionType  `json:"Type"`
+	State            SessionState `json:"State"`
+	Server           Server       `json:"Server"`
+	NumOfConnections int          `json:"NumOfConnections"`
+	Substate         string       `json:"Substate,omitempty"`
+	StateReason      string       `json:"StateReason,omitempty"`
+}
+
+// Live reports whether the session exists on its server or is being
+// created.
+func (s Session) Live() bool {
+	return s.State == StateCreating || s.State == StateReady
+}
+
+// CreateSessionRequest asks the broker for a session. Requirements selects
+// the servers the session may be placed on, e.g.
+// "server:Host.Os.Family = 'linux'".
+type CreateSessionRequest struct {
+	Name                 string      `json:"Name"`
+	Owner                string      `json:"Owner"`
+	Type                 SessionType `json:"Type"`
+	MaxConcurrentClients int         `json:"MaxConcurrentClients,omitempty"`
+	Requirements         string      `json:"Requirements,omitempty"`
+}
+
+// ConnectionData is what a client needs to join a session without a
+// password.
+type ConnectionData struct {
+	Session         Session `json:"Session"`
+	ConnectionToken string  `json:"ConnectionToken"`
+}
+
+// URL returns the address of the session in the DCV web client, carrying
+// the connection token.
+func (c ConnectionData) URL() string {
+	host := c.Session.Server.Hostname
+	if host == "" {
+		host = c.Session.Server.Ip
+	}
+
+	if c.Session.Server.Port != "" {
+		host = net.JoinHostPort(host, c.Session.Server.Port)
+	}
+
+	path := c.Session.Server.WebUrlPath
+	if path == "" {
+		path = "/"
+	}
+
+	return fmt.Sprintf("https://%s%s?authToken=%s#%s", host, path, url.QueryEscape(c.ConnectionToken), c.Session.Id)
+}
+
+// Broker calls the REST API of a DCV Session Manager broker, authenticating
+// with OAuth client credentials. Access tokens are cached until shortly
+// before they expire.
+type Broker struct {
+	cfg    config.BrokerConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func NewBroker(cfg config.BrokerConfig) *Broker {
+	return &Broker{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: cfg.RequestTimeout,
+			Transport: &http.Transport{
+				// Brokers often use self-signed certificates.
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify},
+			},
+		},
+	}
+}
+
+// CreateSession asks the broker for a session and returns it, usually still
+// being created.
+func (b *Broker) CreateSession(ctx context.Context, req CreateSessionRequest) (Session, error) {
+	var res struct {
+		SuccessfulList   []Session `json:"SuccessfulList"`
+		UnsuccessfulList []struct {
+			FailureReason string `json:"FailureReason"`
+		} `json:"UnsuccessfulList"`
+	}
+
+	if err := b.do(ctx, http.MethodPost, "/createSessions", nil, []CreateSessionRequest{req}, &res); err != nil {
+		return Session{}, err
+	}
+
+	if len(res.UnsuccessfulList) > 0 {
+		return Session{}, fmt.Errorf("creating broker session: %s", res.UnsuccessfulList[0].FailureReason)
+	}
+
+	if len(res.SuccessfulList) == 0 {
+		return Session{}, errors.New("creating broker session: empty response")
+	}
+
+	return res.SuccessfulList[0], nil
+}
+
+// DescribeSession returns the session, or ErrSessionNotFound when the broker
+// does not know it anymore.
+func (b *Broker) DescribeSession(ctx context.Context, id string) (Session, error) {
+	sessions, err := b.DescribeSessions(ctx, []string{id})
+
+	if err != nil {
+		return Session{}, err
+	}
+
+	for _, session := range sessions {
+		if session.Id == id {
+			return session, nil
+		}
+	}
+
+	return Session{}, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+}
+
+// DescribeSessions returns the sessions with the ids, or every session
+// when ids is empty, following the pages of the response.
+func (b *Broker) DescribeSessions(ctx context.Context, ids []string) ([]Session, error) {
+	var sessions []Session
+	var next string
+
+	for {
+		req := struct {
+			SessionIds []string `json:"SessionIds,omitempty"`
+			NextToken  string   `json:"NextToken,omitempty"`
+		}{ids, next}
+
+		var res struct {
+			Sessions  []Session `json:"Sessions"`
+			NextToken string    `json:"NextToken"`
+		}
+
+		if err := b.do(ctx, http.MethodPost, "/describeSessions", nil, req, &res); err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, res.Sessions...)
+
+		if res.NextToken == "" {
+			return sessions, nil
+		}
+
+		next = res.NextToken
+	}
+}
+
+// DeleteSession closes the session. Sessions the broker does not know are
+// taken as deleted already.
+func (b *Broker) DeleteSession(ctx context.Context, id string, owner string) error {
+	req := []struct {
+		SessionId string `json:"SessionId"`
+		Owner     string `json:"Owner"`
+		Force     bool   `json:"Force"`
+	}{{id, owner, true}}
+
+	var res struct {
+		UnsuccessfulList []struct {
+			SessionId     string `json:"SessionId"`
+			FailureReason string `json:"FailureReason"`
+		} `json:"UnsuccessfulList"`
+	}
+
+	if err := b.do(ctx, http.MethodPost, "/deleteSessions", nil, req, &res); err != nil {
+		return err
+	}
+
+	for _, failure := range res.UnsuccessfulList {
+		if strings.Contains(strings.ToLower(failure.FailureReason), "not found") {
+			continue
+		}
+
+		return fmt.Errorf("deleting broker session %s: %s", id, failure.FailureReason)
+	}
+
+	return nil
+}
+
+// GetSessionConnectionData returns the server of the session and a token
+// letting user connect to it.
+func (b *Broker) GetSessionConnectionData(ctx context.Context, id string, user string) (ConnectionData, error) {
+	var res ConnectionData
+
+	query := url.Values{"sessionId": {id}, "user": {user}}
+
+	if err := b.do(ctx, http.MethodGet, "/getSessionConnectionData", query, nil, &res); err != nil {
+		return ConnectionData{}, err
+	}
+
+	return res, nil
+}
+
+// Ping checks that the broker can be reached and accepts the credentials.
+func (b *Broker) Ping(ctx context.Context) error {
+	_, err := b.DescribeSessions(ctx, []string{"nicelab-ping"})
+
+	return err
+}
+
+func (b *Broker) do(ctx context.Context, method string, path string, query url.Values, body interface{}, out interface{}) error {
+	token, err := b.accessToken(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	var reader io.Reader
+
+	if body != nil {
+		data, err := json.Marshal(body)
+
+		if err != nil {
+			return err
+		}
+
+		reader = bytes.NewReader(data)
+	}
+
+	u := strings.TrimSuffix(b.cfg.Url, "/") + path
+
+	if query != nil {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := b.client.Do(req)
+
+	if err != nil {
+		return fmt.Errorf("broker %s: %w", path, err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusUnauthorized {
+		b.mu.Lock()
+		b.token = ""
+		b.mu.Unlock()
+	}
+
+	if res.StatusCode == http.StatusNotFound && path == "/getSessionConnectionData" {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, query.Get("sessionId"))
+	}
+
+	if res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("broker %s: %s: %s", path, res.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// accessToken returns a cached access token, or gets a new one with the
+// client credentials.
+func (b *Broker) accessToken(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.token != "" && time.Now().Before(b.expires) {
+		return b.token, nil
+	}
+
+	authUrl := b.cfg.AuthUrl
+	if authUrl == "" {
+		authUrl = b.cfg.Url
+	}
+
+	u := strings.TrimSuffix(authUrl, "/") + "/oauth2/token?grant_type=client_credentials"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	req.SetBasicAuth(b.cfg.ClientID, b.cfg.ClientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := b.client.Do(req)
+
+	if err != nil {
+		return "", fmt.Errorf("broker token: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("broker token: %s", res.Status)
+	}
+
+	var token struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("broker token: %w", err)
+	}
+
+	expiresIn, _ := strconv.Atoi(token.ExpiresIn.String())
+	if expiresIn <= 0 {
+		expiresIn = 300
+	}
+
+	b.token = token.AccessToken
+	b.expires = time.Now().Add(time.Duration(expiresIn)*time.Second - 30*time.Second)
+
+	return b.token, nil
+}
@@ -0,0 +1,507 @@
+package dcvsm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+	"github.com/google/uuid"
+)
+
+// newTestBroker serves the stub and returns a broker calling it with the
+// given client credentials.
+func newTestBroker(t *testing.T, s *stub, clientID string, clientSecret string) *Broker {
+	t.Helper()
+
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	return NewBroker(config.BrokerConfig{
+		Url:            server.URL,
+		ClientID:       clientID,
+		ClientSecret:   clientSecret,
+		RequestTimeout: 5 * time.Second,
+	})
+}
+
+func TestBrokerCachesAccessToken(t *testing.T) {
+	s := newStub("client", "secret")
+	broker := newTestBroker(t, s, "client", "secret")
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := broker.DescribeSessions(ctx, nil); err != nil {
+			t.Fatalf("describing sessions: %v", err)
+		}
+	}
+
+	if issued := s.tokensIssued(); issued != 1 {
+		t.Errorf("issued %d tokens, want 1", issued)
+	}
+}
+
+func TestBrokerRejectsBadCredentials(t *testing.T) {
+	broker := newTestBroker(t, newStub("client", "secret"), "client", "wrong")
+
+	_, err := broker.DescribeSessions(context.Background(), nil)
+
+	if err == nil || !strings.Contains(err.Error(), "broker token") {
+		t.Fatalf("got %v, want a token error", err)
+	}
+}
+
+func TestBrokerRenewsRevokedAccessToken(t *testing.T) {
+	s := newStub("client", "secret")
+	broker := newTestBroker(t, s, "client", "secret")
+	ctx := context.Background()
+
+	if _, err := broker.DescribeSessions(ctx, nil); err != nil {
+		t.Fatalf("describing sessions: %v", err)
+	}
+
+	s.revokeTokens()
+
+	if _, err := broker.DescribeSessions(ctx, nil); err == nil {
+		t.Fatal("described sessions with a revoked token")
+	}
+
+	if _, err := broker.DescribeSessions(ctx, nil); err != nil {
+		t.Fatalf("describing sessions after renewal: %v", err)
+	}
+
+	if issued := s.tokensIssued(); issued != 2 {
+		t.Errorf("issued %d tokens, want 2", issued)
+	}
+}
+
+func TestBrokerCreatesSession(t *testing.T) {
+	broker := newTestBroker(t, newStub("client", "secret"), "client", "secret")
+
+	session, err := broker.CreateSession(context.Background(), CreateSessionRequest{Name: "lab-1", Owner: "alice", Type: SessionVirtual})
+
+	if err != nil {
+		t.Fatalf("creating session: %v", err)
+	}
+
+	if session.Id == "" || session.Owner != "alice" || session.State != StateCreating {
+		t.Errorf("got %+v, want a creating session of alice", session)
+	}
+
+	if session.Server.Hostname != "localhost" {
+		t.Errorf("placed on %q, want localhost", session.Server.Hostname)
+	}
+}
+
+func TestBrokerReportsCreateSessionFailure(t *testing.T) {
+	s := newStub("client", "secret")
+	s.servers = nil
+	broker := newTestBroker(t, s, "client", "secret")
+
+	_, err := broker.CreateSession(context.Background(), CreateSessionRequest{Name: "lab-1", Owner: "alice", Type: SessionVirtual})
+
+	if err == nil || !strings.Contains(err.Error(), "No server matches the requirements") {
+		t.Fatalf("got %v, want the failure reason", err)
+	}
+}
+
+func TestBrokerDescribesSessions(t *testing.T) {
+	s := newStub("client", "secret")
+	s.readyAfter = time.Hour
+	broker := newTestBroker(t, s, "client", "secret")
+	ctx := context.Background()
+
+	first, err := broker.CreateSession(ctx, CreateSessionRequest{Name: "lab-1", Owner: "alice", Type: SessionVirtual})
+	if err != nil {
+		t.Fatalf("creating session: %v", err)
+	}
+
+	second, err := broker.CreateSession(ctx, CreateSessionRequest{Name: "lab-2", Owner: "bob", Type: SessionVirtual})
+	if err != nil {
+		t.Fatalf("creating session: %v", err)
+	}
+
+	sessions, err := broker.DescribeSessions(ctx, []string{first.Id})
+
+	if err != nil {
+		t.Fatalf("describing sessions: %v", err)
+	}
+
+	if len(sessions) != 1 || sessions[0].Id != first.Id || sessions[0].State != StateCreating {
+		t.Errorf("got %+v, want only the creating session %s", sessions, first.Id)
+	}
+
+	s.mu.Lock()
+	s.readyAfter = 0
+	s.mu.Unlock()
+	s.setConnections(second.Id, 2)
+
+	session, err := broker.DescribeSession(ctx, second.Id)
+
+	if err != nil {
+		t.Fatalf("describing session: %v", err)
+	}
+
+	if session.State != StateReady || session.NumOfConnections != 2 {
+		t.Errorf("got %+v, want a ready session with 2 connections", session)
+	}
+
+	if _, err := broker.DescribeSession(ctx, "unknown"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("got %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestBrokerGetsSessionConnectionData(t *testing.T) {
+	broker := newTestBroker(t, newStub("client", "secret"), "client", "secret")
+	ctx := context.Background()
+
+	session, err := broker.CreateSession(ctx, CreateSessionRequest{Name: "lab-1", Owner: "alice", Type: SessionVirtual})
+	if err != nil {
+		t.Fatalf("creating session: %v", err)
+	}
+
+	data, err := broker.GetSessionConnectionData(ctx, session.Id, "alice")
+
+	if err != nil {
+		t.Fatalf("getting connection data: %v", err)
+	}
+
+	if data.ConnectionToken == "" {
+		t.Fatal("got no connection token")
+	}
+
+	want := fmt.Sprintf("https://localhost:8443/?authToken=%s#%s", data.ConnectionToken, session.Id)
+	if url := data.URL(); url != want {
+		t.Errorf("URL() = %q, want %q", url, want)
+	}
+
+	if _, err := broker.GetSessionConnectionData(ctx, "unknown", "alice"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("got %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestBrokerDeletesSession(t *testing.T) {
+	broker := newTestBroker(t, newStub("client", "secret"), "client", "secret")
+	ctx := context.Background()
+
+	session, err := broker.CreateSession(ctx, CreateSessionRequest{Name: "lab-1", Owner: "alice", Type: SessionVirtual})
+	if err != nil {
+		t.Fatalf("creating session: %v", err)
+	}
+
+	if err := broker.DeleteSession(ctx, session.Id, "alice"); err != nil {
+		t.Fatalf("deleting session: %v", err)
+	}
+
+	if _, err := broker.DescribeSession(ctx, session.Id); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("got %v after deleting, want ErrSessionNotFound", err)
+	}
+
+	if err := broker.DeleteSession(ctx, session.Id, "alice"); err != nil {
+		t.Errorf("deleting a deleted session: %v", err)
+	}
+}
+
+// stub is an in-memory DCV Session Manager broker serving the part of the
+// API used by Broker. It hands out access tokens for its client
+// credentials, places sessions on its servers in turn and makes them ready
+// after readyAfter.
+type stub struct {
+	clientID     string
+	clientSecret string
+	// servers are the DCV servers sessions are placed on.
+	servers []Server
+	// readyAfter is how long sessions stay in the CREATING state.
+	readyAfter time.Duration
+
+	mu       sync.Mutex
+	tokens   map[string]bool
+	issued   int
+	sessions map[string]*stubSession
+	next     int
+}
+
+type stubSession struct {
+	Session
+	createdAt time.Time
+}
+
+// newStub returns a stub accepting the client credentials, with a single
+// server on localhost.
+func newStub(clientID string, clientSecret string) *stub {
+	return &stub{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		servers:      []Server{{Ip: "127.0.0.1", Hostname: "localhost", Port: "8443", WebUrlPath: "/"}},
+	}
+}
+
+// setConnections sets the number of clients connected to the session, as
+// if they joined or left it.
+func (s *stub) setConnections(id string, connections int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, ok := s.sessions[id]; ok {
+		session.NumOfConnections = connections
+	}
+}
+
+// tokensIssued returns the number of access tokens handed out.
+func (s *stub) tokensIssued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.issued
+}
+
+// revokeTokens makes every access token handed out so far invalid.
+func (s *stub) revokeTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens = nil
+}
+
+func (s *stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/oauth2/token" {
+		s.issueToken(w, r)
+		return
+	}
+
+	if !s.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/createSessions" && r.Method == http.MethodPost:
+		s.createSessions(w, r)
+	case r.URL.Path == "/describeSessions" && r.Method == http.MethodPost:
+		s.describeSessions(w, r)
+	case r.URL.Path == "/deleteSessions" && r.Method == http.MethodPost:
+		s.deleteSessions(w, r)
+	case r.URL.Path == "/getSessionConnectionData" && r.Method == http.MethodGet:
+		s.getSessionConnectionData(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *stub) issueToken(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+
+	if r.Method != http.MethodPost || r.URL.Query().Get("grant_type") != "client_credentials" {
+		http.Error(w, "unsupported grant", http.StatusBadRequest)
+		return
+	}
+
+	if !ok || id != s.clientID || secret != s.clientSecret {
+		http.Error(w, "invalid client", http.StatusUnauthorized)
+		return
+	}
+
+	token := uuid.New().String()
+
+	s.mu.Lock()
+	if s.tokens == nil {
+		s.tokens = make(map[string]bool)
+	}
+	s.tokens[token] = true
+	s.issued++
+	s.mu.Unlock()
+
+	writeJSON(w, map[string]interface{}{"access_token": token, "token_type": "Bearer", "expires_in": 3600})
+}
+
+func (s *stub) authorized(r *http.Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	auth := r.Header.Get("Authorization")
+
+	return len(auth) > len("Bearer ") && s.tokens[auth[len("Bearer "):]]
+}
+
+func (s *stub) createSessions(w http.ResponseWriter, r *http.Request) {
+	var reqs []CreateSessionRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sessions == nil {
+		s.sessions = make(map[string]*stubSession)
+	}
+
+	type failure struct {
+		CreateSessionRequestData CreateSessionRequest `json:"CreateSessionRequestData"`
+		FailureReason            string               `json:"FailureReason"`
+	}
+
+	successful := make([]Session, 0, len(reqs))
+	unsuccessful := make([]failure, 0)
+
+	for _, req := range reqs {
+		if req.Owner == "" || req.Name == "" {
+			unsuccessful = append(unsuccessful, failure{req, "Owner and Name are required"})
+			continue
+		}
+
+		if len(s.servers) == 0 {
+			unsuccessful = append(unsuccessful, failure{req, "No server matches the requirements"})
+			continue
+		}
+
+		session := &stubSession{
+			Session: Session{
+				Id:     uuid.New().String(),
+				Name:   req.Name,
+				Owner:  req.Owner,
+				Type:   req.Type,
+				State:  StateCreating,
+				Server: s.servers[s.next%len(s.servers)],
+			},
+			createdAt: time.Now(),
+		}
+		s.next++
+
+		s.sessions[session.Id] = session
+		successful = append(successful, session.Session)
+	}
+
+	writeJSON(w, map[string]interface{}{"RequestId": uuid.New().String(), "SuccessfulList": successful, "UnsuccessfulList": unsuccessful})
+}
+
+func (s *stub) describeSessions(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SessionIds []string `json:"SessionIds"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := make([]Session, 0)
+
+	for id, session := range s.sessions {
+		if len(req.SessionIds) > 0 && !contains(req.SessionIds, id) {
+			continue
+		}
+
+		s.advance(session)
+		sessions = append(sessions, session.Session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Id < sessions[j].Id })
+
+	writeJSON(w, map[string]interface{}{"RequestId": uuid.New().String(), "Sessions": sessions})
+}
+
+func (s *stub) deleteSessions(w http.ResponseWriter, r *http.Request) {
+	var reqs []struct {
+		SessionId string `json:"SessionId"`
+		Owner     string `json:"Owner"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type result struct {
+		SessionId     string       `json:"SessionId"`
+		State         SessionState `json:"State,omitempty"`
+		FailureReason string       `json:"FailureReason,omitempty"`
+	}
+
+	successful := make([]result, 0, len(reqs))
+	unsuccessful := make([]result, 0)
+
+	for _, req := range reqs {
+		session, ok := s.sessions[req.SessionId]
+
+		switch {
+		case !ok:
+			unsuccessful = append(unsuccessful, result{SessionId: req.SessionId, FailureReason: "Session not found"})
+		case session.Owner != req.Owner:
+			unsuccessful = append(unsuccessful, result{SessionId: req.SessionId, FailureReason: "Owner does not match"})
+		default:
+			delete(s.sessions, req.SessionId)
+			successful = append(successful, result{SessionId: req.SessionId, State: StateDeleting})
+		}
+	}
+
+	writeJSON(w, map[string]interface{}{"RequestId": uuid.New().String(), "SuccessfulList": successful, "UnsuccessfulList": unsuccessful})
+}
+
+func (s *stub) getSessionConnectionData(w http.ResponseWriter, r *http.Request) {
+	id, user := r.URL.Query().Get("sessionId"), r.URL.Query().Get("user")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	s.advance(session)
+
+	if session.State != StateReady {
+		http.Error(w, fmt.Sprintf("Session is %s", session.State), http.StatusBadRequest)
+		return
+	}
+
+	if user != session.Owner {
+		http.Error(w, "User is not allowed to connect", http.StatusForbidden)
+		return
+	}
+
+	writeJSON(w, ConnectionData{Session: session.Session, ConnectionToken: uuid.New().String()})
+}
+
+// advance makes the session ready once it was created long enough ago.
+func (s *stub) advance(session *stubSession) {
+	if session.State == StateCreating && time.Since(session.createdAt) >= s.readyAfter {
+		session.State = StateReady
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	bytes, _ := json.Marshal(v)
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
@@ -0,0 +1,152 @@
+package ec2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsec2 "github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+)
+
+var ErrInstanceNotFound = errors.New("instance not found")
+
+// Client is the part of the EC2 API used by Instances.
+type Client interface {
+	DescribeInstances(ctx context.Context, params *awsec2.DescribeInstancesInput, optFns ...func(*awsec2.Options)) (*awsec2.DescribeInstancesOutput, error)
+	StartInstances(ctx context.Context, params *awsec2.StartInstancesInput, optFns ...func(*awsec2.Options)) (*awsec2.StartInstancesOutput, error)
+	StopInstances(ctx context.Context, params *awsec2.StopInstancesInput, optFns ...func(*awsec2.Options)) (*awsec2.StopInstancesOutput, error)
+}
+
+// Instance is the subset of an EC2 instance the labs care about.
+type Instance struct {
+	ID         string
+	State      types.InstanceStateName
+	PublicDNS  string
+	PrivateDNS string
+	PublicIP   string
+	PrivateIP  string
+	Tags       map[string]string
+}
+
+// Addresses returns every name and address the instance can be reached at.
+func (i Instance) Addresses() []string {
+	var addresses []string
+
+	for _, address := range []string{i.PublicDNS, i.PublicIP, i.PrivateDNS, i.PrivateIP} {
+		if address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses
+}
+
+// Hostname returns the name the instance is reached at from outside the
+// VPC, falling back to its private name.
+func (i Instance) Hostname() string {
+	if addresses := i.Addresses(); len(addresses) > 0 {
+		return addresses[0]
+	}
+
+	return ""
+}
+
+type Instances struct {
+	client Client
+}
+
+func NewInstances(client Client) *Instances {
+	return &Instances{client: client}
+}
+
+func (ins *Instances) Get(ctx context.Context, id string) (Instance, error) {
+	out, err := ins.client.DescribeInstances(ctx, &awsec2.DescribeInstancesInput{
+		InstanceIds: []string{id},
+	})
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "InvalidInstanceID.NotFound" || apiErr.ErrorCode() == "InvalidInstanceID.Malformed") {
+		return Instance{}, fmt.Errorf("%w: %s", ErrInstanceNotFound, id)
+	}
+
+	if err != nil {
+		return Instance{}, err
+	}
+
+	for _, reservation := range out.Reservations {
+		for _, instance := range reservation.Instances {
+			if aws.ToString(instance.InstanceId) == id {
+				return newInstance(instance), nil
+			}
+		}
+	}
+
+	return Instance{}, fmt.Errorf("%w: %s", ErrInstanceNotFound, id)
+}
+
+func (ins *Instances) Start(ctx context.Context, id string) error {
+	_, err := ins.client.StartInstances(ctx, &awsec2.StartInstancesInput{
+		InstanceIds: []string{id},
+	})
+
+	return err
+}
+
+func (ins *Instances) Stop(ctx context.Context, id string) error {
+	_, err := ins.client.StopInstances(ctx, &awsec2.StopInstancesInput{
+		InstanceIds: []string{id},
+	})
+
+	return err
+}
+
+func newInstance(instance types.Instance) Instance {
+	i := Instance{
+		ID:         aws.ToString(instance.InstanceId),
+		PublicDNS:  aws.ToString(instance.PublicDnsName),
+		PrivateDNS: aws.ToString(instance.PrivateDnsName),
+		PublicIP:   aws.ToString(instance.PublicIpAddress),
+		PrivateIP:  aws.ToString(instance.PrivateIpAddress),
+		Tags:       make(map[string]string, len(instance.Tags)),
+	}
+
+	if instance.State != nil {
+		i.State = instance.State.Name
+	}
+
+	for _, tag := range instance.Tags {
+		i.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+
+	return i
+}
+
+// ListTagged returns every instance carrying the tag key, in any state.
+func (ins *Instances) ListTagged(ctx context.Context, tagKey string) ([]Instance, error) {
+	paginator := awsec2.NewDescribeInstancesPaginator(ins.client, &awsec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("tag-key"), Values: []string{tagKey}},
+		},
+	})
+
+	var instances []Instance
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, reservation := range out.Reservations {
+			for _, instance := range reservation.Instances {
+				instances = append(instances, newInstance(instance))
+			}
+		}
+	}
+
+	return instances, nil
+}
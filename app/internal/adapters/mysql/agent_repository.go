@@ -0,0 +1,293 @@
+package mysql
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+type AgentJobStatus string
+
+// Jobs are queued for the agent of their lab, run once it claims them and
+// done once it reports their result. Jobs the pipeline stopped waiting for
+// are cancelled; an agent reporting one afterwards is told so.
+const (
+	AgentJobQueued    AgentJobStatus = "queued"
+	AgentJobRunning   AgentJobStatus = "running"
+	AgentJobDone      AgentJobStatus = "done"
+	AgentJobCancelled AgentJobStatus = "cancelled"
+)
+
+// Agent is the lab agent enrolled for a lab. Its token is only known to the
+// agent; the database keeps its hash.
+type Agent struct {
+	ID         uint64     `db:"id" json:"id"`
+	LabID      uint64     `db:"lab_id" json:"lab_id"`
+	TokenHash  string     `db:"token_hash" json:"-"`
+	Hostname   string     `db:"hostname" json:"hostname"`
+	Version    string     `db:"version" json:"version"`
+	LastSeenAt *time.Time `db:"last_seen_at" json:"last_seen_at"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+}
+
+// AgentEnrollment is a one-time token a professor handed to the operator of
+// a lab to enroll its agent.
+type AgentEnrollment struct {
+	ID        uint64     `db:"id" json:"id"`
+	LabID     uint64     `db:"lab_id" json:"lab_id"`
+	TokenHash string     `db:"token_hash" json:"-"`
+	CreatedBy uint64     `db:"created_by" json:"created_by"`
+	ExpiresAt time.Time  `db:"expires_at" json:"expires_at"`
+	UsedAt    *time.Time `db:"used_at" json:"used_at"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+}
+
+// AgentJob is a script for the agent of a lab to run, with its timeout in
+// seconds.
+type AgentJob struct {
+	ID         uint64         `db:"id" json:"-"`
+	UUID       string         `db:"uuid" json:"uuid"`
+	LabID      uint64         `db:"lab_id" json:"lab_id"`
+	AgentID    *uint64        `db:"agent_id" json:"-"`
+	Family     string         `db:"family" json:"family"`
+	Script     string         `db:"script" json:"script"`
+	Timeout    int            `db:"timeout" json:"timeout"`
+	Status     AgentJobStatus `db:"status" json:"status"`
+	ExitCode   *int           `db:"exit_code" json:"exit_code"`
+	Stdout     *string        `db:"stdout" json:"stdout"`
+	Stderr     *string        `db:"stderr" json:"stderr"`
+	Error      *string        `db:"error" json:"error"`
+	CreatedAt  time.Time      `db:"created_at" json:"created_at"`
+	ClaimedAt  *time.Time     `db:"claimed_at" json:"claimed_at"`
+	FinishedAt *time.Time     `db:"finished_at" json:"finished_at"`
+}
+
+type AgentRepository struct {
+	db *sqlx.DB
+}
+
+func NewAgentRepository(db *sqlx.DB) *AgentRepository {
+	return &AgentRepository{db: db}
+}
+
+// newSecretToken returns a random token and its hash.
+func newSecretToken() (token string, hash string, err error) {
+	b := make([]byte, 32)
+
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+
+	token = hex.EncodeToString(b)
+
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateEnrollment returns a new enrollment token for the lab, valid until
+// expiresAt.
+func (rep AgentRepository) CreateEnrollment(ctx context.Context, labId uint64, userId uint64, expiresAt time.Time) (token string, err error) {
+	token, hash, err := newSecretToken()
+
+	if err != nil {
+		return "", err
+	}
+
+	qry := `INSERT INTO agent_enrollments (lab_id, token_hash, created_by, expires_at) VALUES (?, ?, ?, ?)`
+	if _, err = rep.db.ExecContext(ctx, qry, labId, hash, userId, expiresAt); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Enroll uses up the enrollment token and enrolls an agent for its lab,
+// replacing the agent enrolled before. It returns the agent and the token it
+// authenticates with; sql.ErrNoRows is returned when the enrollment token is
+// unknown, used or expired.
+func (rep AgentRepository) Enroll(ctx context.Context, enrollmentToken string, hostname string, version string) (agent Agent, token string, err error) {
+	tx, err := rep.db.BeginTxx(ctx, nil)
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var enrollment AgentEnrollment
+	qry := `SELECT * FROM agent_enrollments WHERE token_hash = ? AND used_at IS NULL AND expires_at > NOW() FOR UPDATE`
+	if err = tx.QueryRowxContext(ctx, qry, hashToken(enrollmentToken)).StructScan(&enrollment); err != nil {
+		return
+	}
+
+	qry = `UPDATE agent_enrollments SET used_at = NOW() WHERE id = ?`
+	if _, err = tx.ExecContext(ctx, qry, enrollment.ID); err != nil {
+		return
+	}
+
+	qry = `DELETE FROM agents WHERE lab_id = ?`
+	if _, err = tx.ExecContext(ctx, qry, enrollment.LabID); err != nil {
+		return
+	}
+
+	token, hash, err := newSecretToken()
+
+	if err != nil {
+		return
+	}
+
+	qry = `INSERT INTO agents (lab_id, token_hash, hostname, version, last_seen_at) VALUES (?, ?, ?, ?, NOW())`
+	if _, err = tx.ExecContext(ctx, qry, enrollment.LabID, hash, hostname, version); err != nil {
+		return
+	}
+
+	qry = `SELECT * FROM agents WHERE lab_id = ?`
+	if err = tx.QueryRowxContext(ctx, qry, enrollment.LabID).StructScan(&agent); err != nil {
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+
+	return agent, token, nil
+}
+
+// GetAgentByToken returns the agent authenticating with the token.
+func (rep AgentRepository) GetAgentByToken(ctx context.Context, token string) (agent Agent, err error) {
+	qry := `SELECT * FROM agents WHERE token_hash = ?`
+	err = rep.db.QueryRowxContext(ctx, qry, hashToken(token)).StructScan(&agent)
+
+	return
+}
+
+func (rep AgentRepository) GetLabAgent(ctx context.Context, labId uint64) (agent Agent, err error) {
+	qry := `SELECT * FROM agents WHERE lab_id = ?`
+	err = rep.db.QueryRowxContext(ctx, qry, labId).StructScan(&agent)
+
+	return
+}
+
+// DeleteLabAgent revokes the agent of the lab. Its queued jobs are left for
+// the agent enrolled next.
+func (rep AgentRepository) DeleteLabAgent(ctx context.Context, labId uint64) error {
+	qry := `DELETE FROM agents WHERE lab_id = ?`
+	_, err := rep.db.ExecContext(ctx, qry, labId)
+
+	return err
+}
+
+// Heartbeat records that the agent is online, along with what it reports
+// about itself when set.
+func (rep AgentRepository) Heartbeat(ctx context.Context, id uint64, hostname string, version string) error {
+	qry := `UPDATE agents SET last_seen_at = NOW(),
+			hostname = IF(? = '', hostname, ?), version = IF(? = '', version, ?)
+		WHERE id = ?`
+	_, err := rep.db.ExecContext(ctx, qry, hostname, hostname, version, version, id)
+
+	return err
+}
+
+// EnqueueJob queues a script for the agent of the lab.
+func (rep AgentRepository) EnqueueJob(ctx context.Context, labId uint64, family string, script string, timeout time.Duration) (AgentJob, error) {
+	id := uuid.New().String()
+
+	qry := `INSERT INTO agent_jobs (uuid, lab_id, family, script, timeout, status) VALUES (?, ?, ?, ?, ?, ?)`
+	if _, err := rep.db.ExecContext(ctx, qry, id, labId, family, script, int(timeout.Seconds()), AgentJobQueued); err != nil {
+		return AgentJob{}, err
+	}
+
+	return rep.GetJobByUUID(ctx, id)
+}
+
+func (rep AgentRepository) GetJobByUUID(ctx context.Context, id string) (job AgentJob, err error) {
+	qry := `SELECT * FROM agent_jobs WHERE uuid = ?`
+	err = rep.db.QueryRowxContext(ctx, qry, id).StructScan(&job)
+
+	return
+}
+
+// ClaimJob hands the oldest queued job of the agent's lab to the agent;
+// sql.ErrNoRows is returned when none is queued.
+func (rep AgentRepository) ClaimJob(ctx context.Context, agent Agent) (job AgentJob, err error) {
+	tx, err := rep.db.BeginTxx(ctx, nil)
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	qry := `SELECT * FROM agent_jobs WHERE lab_id = ? AND status = ? ORDER BY id ASC LIMIT 1 FOR UPDATE`
+	if err = tx.QueryRowxContext(ctx, qry, agent.LabID, AgentJobQueued).StructScan(&job); err != nil {
+		return
+	}
+
+	qry = `UPDATE agent_jobs SET status = ?, agent_id = ?, claimed_at = NOW() WHERE id = ?`
+	if _, err = tx.ExecContext(ctx, qry, AgentJobRunning, agent.ID, job.ID); err != nil {
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+
+	job.Status = AgentJobRunning
+	job.AgentID = &agent.ID
+
+	return job, nil
+}
+
+// FinishJob records the result of a job the agent runs. It returns
+// sql.ErrNoRows when the agent does not run the job, e.g. because it was
+// cancelled meanwhile.
+func (rep AgentRepository) FinishJob(ctx context.Context, agentId uint64, id string, exitCode int, stdout string, stderr string, errMsg *string) error {
+	qry := `UPDATE agent_jobs SET status = ?, exit_code = ?, stdout = ?, stderr = ?, error = ?, finished_at = NOW()
+		WHERE uuid = ? AND agent_id = ? AND status = ?`
+	res, err := rep.db.ExecContext(ctx, qry, AgentJobDone, exitCode, stdout, stderr, errMsg, id, agentId, AgentJobRunning)
+
+	if err != nil {
+		return err
+	}
+
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+
+	return nil
+}
+
+// CancelJob gives up on a job that is not done.
+func (rep AgentRepository) CancelJob(ctx context.Context, id string) error {
+	qry := `UPDATE agent_jobs SET status = ?, finished_at = NOW() WHERE uuid = ? AND status IN (?, ?)`
+	_, err := rep.db.ExecContext(ctx, qry, AgentJobCancelled, id, AgentJobQueued, AgentJobRunning)
+
+	return err
+}
+
+// PruneJobs forgets the jobs that finished before, whose output was
+// returned to the pipeline when they did.
+func (rep AgentRepository) PruneJobs(ctx context.Context, before time.Time) error {
+	qry := `DELETE FROM agent_jobs WHERE finished_at < ?`
+	_, err := rep.db.ExecContext(ctx, qry, before)
+
+	return err
+}
@@ -0,0 +1,73 @@
+package mysql
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// CalendarTokenRepository keeps the tokens calendar clients read the
+// reservation feeds with. Unlike session tokens, they grant nothing but the
+// feeds, and the database keeps only their hash.
+type CalendarTokenRepository struct {
+	db      *sqlx.DB
+	userRep *UserRepository
+}
+
+func NewCalendarTokenRepository(db *sqlx.DB, userRep *UserRepository) *CalendarTokenRepository {
+	return &CalendarTokenRepository{db: db, userRep: userRep}
+}
+
+// NewTokenForUserId returns a new calendar token for the user, revoking the
+// one they had.
+func (rep CalendarTokenRepository) NewTokenForUserId(ctx context.Context, id uint64) (token string, err error) {
+	token, hash, err := newSecretToken()
+
+	if err != nil {
+		return
+	}
+
+	tx, err := rep.db.BeginTxx(ctx, nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	qry := `UPDATE calendar_tokens SET revoked_at = NOW() WHERE user_id = ? AND revoked_at IS NULL`
+	if _, err = tx.ExecContext(ctx, qry, id); err != nil {
+		return "", err
+	}
+
+	qry = `INSERT INTO calendar_tokens (user_id, token_hash) VALUES (?, ?)`
+	if _, err = tx.ExecContext(ctx, qry, id, hash); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// RevokeUserTokens revokes the calendar token of the user, if any.
+func (rep CalendarTokenRepository) RevokeUserTokens(ctx context.Context, id uint64) error {
+	qry := `UPDATE calendar_tokens SET revoked_at = NOW() WHERE user_id = ? AND revoked_at IS NULL`
+	_, err := rep.db.ExecContext(ctx, qry, id)
+
+	return err
+}
+
+// GetUserByCalendarToken returns the user of a calendar token not revoked.
+func (rep CalendarTokenRepository) GetUserByCalendarToken(ctx context.Context, token string) (user User, err error) {
+	var userId uint64
+	qry := `SELECT user_id FROM calendar_tokens WHERE token_hash = ? AND revoked_at IS NULL`
+
+	if err = rep.db.QueryRowContext(ctx, qry, hashToken(token)).Scan(&userId); err != nil {
+		return
+	}
+
+	return rep.userRep.GetUserById(ctx, userId)
+}
@@ -0,0 +1,168 @@
+package mysql
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+type ClassStatus string
+
+const (
+	ClassScheduled ClassStatus = "scheduled"
+	ClassWarming   ClassStatus = "warming"
+	ClassOpen      ClassStatus = "open"
+	ClassEnded     ClassStatus = "ended"
+	ClassCancelled ClassStatus = "cancelled"
+)
+
+var (
+	ErrClassOverlap = errors.New("course already has a class in that time range")
+	ErrClassClosed  = errors.New("class has already ended")
+)
+
+// ClassWindow is a class of a course during which its enrolled students get
+// sessions on the labs of the course, provisioned ahead of the start.
+type ClassWindow struct {
+	ID        uint64      `db:"id" json:"id"`
+	UUID      string      `db:"uuid" json:"uuid"`
+	CourseID  uint64      `db:"course_id" json:"course_id"`
+	StartsAt  time.Time   `db:"starts_at" json:"starts_at"`
+	EndsAt    time.Time   `db:"ends_at" json:"ends_at"`
+	Status    ClassStatus `db:"status" json:"status"`
+	CreatedBy *uint64     `db:"created_by" json:"created_by"`
+	CreatedAt time.Time   `db:"created_at" json:"created_at"`
+	EndedAt   *time.Time  `db:"ended_at" json:"ended_at"`
+}
+
+type ClassRepository struct {
+	db *sqlx.DB
+}
+
+func NewClassRepository(db *sqlx.DB) *ClassRepository {
+	return &ClassRepository{db: db}
+}
+
+// CreateWindow schedules a class. The course row is locked so that classes
+// of a course cannot overlap; ErrClassOverlap is returned when they would.
+func (rep ClassRepository) CreateWindow(ctx context.Context, window ClassWindow) (ClassWindow, error) {
+	tx, err := rep.db.BeginTxx(ctx, nil)
+
+	if err != nil {
+		return ClassWindow{}, err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var lockedId uint64
+	qry := `SELECT id FROM courses WHERE id = ? FOR UPDATE`
+	if err = tx.GetContext(ctx, &lockedId, qry, window.CourseID); err != nil {
+		return ClassWindow{}, err
+	}
+
+	var overlapping int
+	qry = `SELECT COUNT(*) FROM class_windows
+		WHERE course_id = ? AND status IN (?, ?, ?) AND starts_at < ? AND ends_at > ?`
+	err = tx.GetContext(ctx, &overlapping, qry, window.CourseID, ClassScheduled, ClassWarming, ClassOpen,
+		window.EndsAt, window.StartsAt)
+
+	if err != nil {
+		return ClassWindow{}, err
+	}
+
+	if overlapping > 0 {
+		return ClassWindow{}, ErrClassOverlap
+	}
+
+	qry = `INSERT INTO class_windows (uuid, course_id, starts_at, ends_at, status, created_by) VALUES (?, ?, ?, ?, ?, ?)`
+	res, err := tx.ExecContext(ctx, qry, uuid.New().String(), window.CourseID, window.StartsAt, window.EndsAt,
+		ClassScheduled, window.CreatedBy)
+
+	if err != nil {
+		return ClassWindow{}, err
+	}
+
+	id, err := res.LastInsertId()
+
+	if err != nil {
+		return ClassWindow{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return ClassWindow{}, err
+	}
+
+	return rep.GetWindowById(ctx, uint64(id))
+}
+
+func (rep ClassRepository) GetWindowById(ctx context.Context, id uint64) (window ClassWindow, err error) {
+	qry := `SELECT * FROM class_windows WHERE id = ?`
+	err = rep.db.QueryRowxContext(ctx, qry, id).StructScan(&window)
+
+	return
+}
+
+func (rep ClassRepository) ListCourseWindows(ctx context.Context, courseId uint64) (result []ClassWindow, err error) {
+	qry := `SELECT * FROM class_windows WHERE course_id = ? ORDER BY starts_at DESC`
+	err = rep.db.SelectContext(ctx, &result, qry, courseId)
+
+	return
+}
+
+// ListDueWindows returns the classes that are not over and start within
+// lead, in the order they start.
+func (rep ClassRepository) ListDueWindows(ctx context.Context, lead time.Duration) (result []ClassWindow, err error) {
+	qry := `SELECT * FROM class_windows WHERE status IN (?, ?, ?) AND starts_at <= ? ORDER BY starts_at ASC`
+	err = rep.db.SelectContext(ctx, &result, qry, ClassScheduled, ClassWarming, ClassOpen, time.Now().Add(lead))
+
+	return
+}
+
+// SetWindowStatus moves a class from one status to another.
+func (rep ClassRepository) SetWindowStatus(ctx context.Context, id uint64, from ClassStatus, to ClassStatus) error {
+	qry := `UPDATE class_windows SET status = ? WHERE id = ? AND status = ?`
+	_, err := rep.db.ExecContext(ctx, qry, to, id, from)
+
+	return err
+}
+
+// EndWindow records that the sessions of the class were torn down.
+func (rep ClassRepository) EndWindow(ctx context.Context, id uint64) error {
+	qry := `UPDATE class_windows SET status = ?, ended_at = NOW() WHERE id = ? AND status IN (?, ?, ?)`
+	_, err := rep.db.ExecContext(ctx, qry, ClassEnded, id, ClassScheduled, ClassWarming, ClassOpen)
+
+	return err
+}
+
+// CancelWindow calls a class off. Classes that have not started warming up
+// are cancelled; the others end now, so that their sessions are torn down.
+// ErrClassClosed is returned for classes that are over.
+func (rep ClassRepository) CancelWindow(ctx context.Context, id uint64) (ClassWindow, error) {
+	window, err := rep.GetWindowById(ctx, id)
+
+	if err != nil {
+		return ClassWindow{}, err
+	}
+
+	switch window.Status {
+	case ClassScheduled:
+		qry := `UPDATE class_windows SET status = ?, ended_at = NOW() WHERE id = ? AND status = ?`
+		_, err = rep.db.ExecContext(ctx, qry, ClassCancelled, id, ClassScheduled)
+	case ClassWarming, ClassOpen:
+		qry := `UPDATE class_windows SET ends_at = LEAST(ends_at, NOW()) WHERE id = ? AND status IN (?, ?)`
+		_, err = rep.db.ExecContext(ctx, qry, id, ClassWarming, ClassOpen)
+	default:
+		return window, ErrClassClosed
+	}
+
+	if err != nil {
+		return ClassWindow{}, err
+	}
+
+	return rep.GetWindowById(ctx, id)
+}
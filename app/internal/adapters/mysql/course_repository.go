@@ -0,0 +1,110 @@
+package mysql
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// Course groups the students enrolled in it with the labs it uses. Its
+// limits apply to the sessions on its labs.
+type Course struct {
+	ID                    uint64 `db:"id" json:"id"`
+	UUID                  string `db:"uuid" json:"uuid"`
+	Name                  string `db:"name" json:"name"`
+	MaxSessionMinutes     *int   `db:"max_session_minutes" json:"max_session_minutes"`
+	ExtensionQuotaMinutes *int   `db:"extension_quota_minutes" json:"extension_quota_minutes"`
+	LabHoursBudget        *int   `db:"lab_hours_budget" json:"lab_hours_budget"`
+}
+
+type CourseRepository struct {
+	db *sqlx.DB
+}
+
+func NewCourseRepository(db *sqlx.DB) *CourseRepository {
+	return &CourseRepository{db: db}
+}
+
+func (rep CourseRepository) ListCourses(ctx context.Context) (result []Course, err error) {
+	qry := `SELECT * FROM courses ORDER BY id ASC`
+	err = rep.db.SelectContext(ctx, &result, qry)
+
+	return
+}
+
+func (rep CourseRepository) GetCourseById(ctx context.Context, id uint64) (course Course, err error) {
+	qry := `SELECT * FROM courses WHERE id = ?`
+	row := rep.db.QueryRowxContext(ctx, qry, id)
+
+	err = row.StructScan(&course)
+
+	return
+}
+
+func (rep CourseRepository) CreateCourse(ctx context.Context, course Course) (Course, error) {
+	qry := `INSERT INTO courses (uuid, name, max_session_minutes, extension_quota_minutes, lab_hours_budget)
+		VALUES (?, ?, ?, ?, ?)`
+	res, err := rep.db.ExecContext(ctx, qry, uuid.New().String(), course.Name, course.MaxSessionMinutes,
+		course.ExtensionQuotaMinutes, course.LabHoursBudget)
+
+	if err != nil {
+		return Course{}, err
+	}
+
+	id, err := res.LastInsertId()
+
+	if err != nil {
+		return Course{}, err
+	}
+
+	return rep.GetCourseById(ctx, uint64(id))
+}
+
+func (rep CourseRepository) UpdateCourse(ctx context.Context, course Course) (Course, error) {
+	qry := `UPDATE courses SET name = ?, max_session_minutes = ?, extension_quota_minutes = ?, lab_hours_budget = ?
+		WHERE id = ?`
+	_, err := rep.db.ExecContext(ctx, qry, course.Name, course.MaxSessionMinutes, course.ExtensionQuotaMinutes,
+		course.LabHoursBudget, course.ID)
+
+	if err != nil {
+		return Course{}, err
+	}
+
+	return rep.GetCourseById(ctx, course.ID)
+}
+
+func (rep CourseRepository) ListEnrolledUsers(ctx context.Context, courseId uint64) (result []User, err error) {
+	qry := `SELECT users.id, users.uuid, users.name, users.email, users.type, users.username FROM users
+		JOIN course_enrollments ON course_enrollments.user_id = users.id
+		WHERE course_enrollments.course_id = ?
+		ORDER BY users.id ASC`
+	err = rep.db.SelectContext(ctx, &result, qry, courseId)
+
+	return
+}
+
+func (rep CourseRepository) ListUserCourses(ctx context.Context, userId uint64) (result []Course, err error) {
+	qry := `SELECT courses.* FROM courses
+		JOIN course_enrollments ON course_enrollments.course_id = courses.id
+		WHERE course_enrollments.user_id = ?
+		ORDER BY courses.id ASC`
+	err = rep.db.SelectContext(ctx, &result, qry, userId)
+
+	return
+}
+
+// Enroll adds the user to the course; enrolling twice is a no-op.
+func (rep CourseRepository) Enroll(ctx context.Context, courseId uint64, userId uint64) error {
+	qry := `INSERT IGNORE INTO course_enrollments (course_id, user_id) VALUES (?, ?)`
+	_, err := rep.db.ExecContext(ctx, qry, courseId, userId)
+
+	return err
+}
+
+func (rep CourseRepository) Unenroll(ctx context.Context, courseId uint64, userId uint64) error {
+	qry := `DELETE FROM course_enrollments WHERE course_id = ? AND user_id = ?`
+	_, err := rep.db.ExecContext(ctx, qry, courseId, userId)
+
+	return err
+}
@@ -0,0 +1,179 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type ExtensionStatus string
+
+const (
+	ExtensionPending  ExtensionStatus = "pending"
+	ExtensionApproved ExtensionStatus = "approved"
+	ExtensionDenied   ExtensionStatus = "denied"
+)
+
+var (
+	ErrSessionNotExtendable = errors.New("session is not active or has no time limit")
+	ErrExtensionDecided     = errors.New("extension request was already decided")
+)
+
+// Extension is a request for more time on a session with a time limit.
+type Extension struct {
+	ID           uint64          `db:"id" json:"id"`
+	SessionID    uint64          `db:"session_id" json:"session_id"`
+	UserID       uint64          `db:"user_id" json:"user_id"`
+	Minutes      int             `db:"minutes" json:"minutes"`
+	Status       ExtensionStatus `db:"status" json:"status"`
+	AutoApproved bool            `db:"auto_approved" json:"auto_approved"`
+	DecidedBy    *uint64         `db:"decided_by" json:"decided_by"`
+	CreatedAt    time.Time       `db:"created_at" json:"created_at"`
+	DecidedAt    *time.Time      `db:"decided_at" json:"decided_at"`
+}
+
+type ExtensionRepository struct {
+	db *sqlx.DB
+}
+
+func NewExtensionRepository(db *sqlx.DB) *ExtensionRepository {
+	return &ExtensionRepository{db: db}
+}
+
+// RequestExtension asks for minutes more on the session. The request is
+// approved right away while the minutes auto-approved on the session stay
+// within quota, and waits for a professor otherwise.
+func (rep ExtensionRepository) RequestExtension(ctx context.Context, sessionId uint64, userId uint64, minutes int, quota int) (Extension, error) {
+	tx, err := rep.db.BeginTxx(ctx, nil)
+
+	if err != nil {
+		return Extension{}, err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var lockedId uint64
+	qry := `SELECT id FROM sessions WHERE id = ? AND status = ? AND expires_at IS NOT NULL FOR UPDATE`
+	err = tx.GetContext(ctx, &lockedId, qry, sessionId, SessionActive)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return Extension{}, ErrSessionNotExtendable
+	}
+
+	if err != nil {
+		return Extension{}, err
+	}
+
+	var granted int
+	qry = `SELECT COALESCE(SUM(minutes), 0) FROM session_extensions WHERE session_id = ? AND auto_approved = 1`
+	if err = tx.GetContext(ctx, &granted, qry, sessionId); err != nil {
+		return Extension{}, err
+	}
+
+	status, auto := ExtensionPending, granted+minutes <= quota
+	if auto {
+		status = ExtensionApproved
+	}
+
+	qry = `INSERT INTO session_extensions (session_id, user_id, minutes, status, auto_approved, decided_at)
+		VALUES (?, ?, ?, ?, ?, IF(?, NOW(), NULL))`
+	res, err := tx.ExecContext(ctx, qry, sessionId, userId, minutes, status, auto, auto)
+
+	if err != nil {
+		return Extension{}, err
+	}
+
+	if auto {
+		if err = extend(ctx, tx, sessionId, minutes); err != nil {
+			return Extension{}, err
+		}
+	}
+
+	id, err := res.LastInsertId()
+
+	if err != nil {
+		return Extension{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Extension{}, err
+	}
+
+	return rep.GetExtensionById(ctx, uint64(id))
+}
+
+// DecideExtension approves or denies a pending request. Approving extends
+// the session when it is still active.
+func (rep ExtensionRepository) DecideExtension(ctx context.Context, id uint64, approve bool, deciderId uint64) (Extension, error) {
+	tx, err := rep.db.BeginTxx(ctx, nil)
+
+	if err != nil {
+		return Extension{}, err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var ext Extension
+	qry := `SELECT * FROM session_extensions WHERE id = ? FOR UPDATE`
+	if err = tx.GetContext(ctx, &ext, qry, id); err != nil {
+		return Extension{}, err
+	}
+
+	if ext.Status != ExtensionPending {
+		return Extension{}, ErrExtensionDecided
+	}
+
+	status := ExtensionDenied
+	if approve {
+		status = ExtensionApproved
+	}
+
+	qry = `UPDATE session_extensions SET status = ?, decided_by = ?, decided_at = NOW() WHERE id = ?`
+	if _, err = tx.ExecContext(ctx, qry, status, deciderId, id); err != nil {
+		return Extension{}, err
+	}
+
+	if approve {
+		if err = extend(ctx, tx, ext.SessionID, ext.Minutes); err != nil {
+			return Extension{}, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Extension{}, err
+	}
+
+	return rep.GetExtensionById(ctx, id)
+}
+
+// extend moves the expiry of an active session and rearms its warnings.
+func extend(ctx context.Context, tx *sqlx.Tx, sessionId uint64, minutes int) error {
+	qry := `UPDATE sessions SET expires_at = expires_at + INTERVAL ? MINUTE, expiry_warning = NULL
+		WHERE id = ? AND status = ? AND expires_at IS NOT NULL`
+	_, err := tx.ExecContext(ctx, qry, minutes, sessionId, SessionActive)
+
+	return err
+}
+
+func (rep ExtensionRepository) GetExtensionById(ctx context.Context, id uint64) (ext Extension, err error) {
+	qry := `SELECT * FROM session_extensions WHERE id = ?`
+	row := rep.db.QueryRowxContext(ctx, qry, id)
+
+	err = row.StructScan(&ext)
+
+	return
+}
+
+func (rep ExtensionRepository) ListExtensions(ctx context.Context, status ExtensionStatus) (result []Extension, err error) {
+	qry := `SELECT * FROM session_extensions WHERE status = ? ORDER BY id ASC`
+	err = rep.db.SelectContext(ctx, &result, qry, status)
+
+	return
+}
@@ -0,0 +1,72 @@
+package mysql
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// FleetStack is a CloudFormation stack launched for a pool. Its status is
+// the last CloudFormation stack status seen.
+type FleetStack struct {
+	ID           uint64    `db:"id" json:"id"`
+	PoolID       uint64    `db:"pool_id" json:"pool_id"`
+	StackName    string    `db:"stack_name" json:"stack_name"`
+	StackID      *string   `db:"stack_id" json:"stack_id"`
+	Status       string    `db:"status" json:"status"`
+	StatusReason *string   `db:"status_reason" json:"status_reason"`
+	LabID        *uint64   `db:"lab_id" json:"lab_id"`
+	CreatedAt    time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt    time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// StackDeleted is recorded once a stack is gone.
+const StackDeleted = "DELETE_COMPLETE"
+
+type FleetRepository struct {
+	db *sqlx.DB
+}
+
+func NewFleetRepository(db *sqlx.DB) *FleetRepository {
+	return &FleetRepository{db: db}
+}
+
+// ListStacks returns the stacks of the pool that are not deleted yet.
+func (rep FleetRepository) ListStacks(ctx context.Context, poolId uint64) (result []FleetStack, err error) {
+	qry := `SELECT * FROM fleet_stacks WHERE pool_id = ? AND status != ? ORDER BY id ASC`
+	err = rep.db.SelectContext(ctx, &result, qry, poolId, StackDeleted)
+
+	return
+}
+
+func (rep FleetRepository) CreateStack(ctx context.Context, poolId uint64, name string, stackId string, status string) error {
+	qry := `INSERT INTO fleet_stacks (pool_id, stack_name, stack_id, status) VALUES (?, ?, ?, ?)`
+	_, err := rep.db.ExecContext(ctx, qry, poolId, name, stackId, status)
+
+	return err
+}
+
+func (rep FleetRepository) UpdateStack(ctx context.Context, stack FleetStack) error {
+	qry := `UPDATE fleet_stacks SET stack_id = ?, status = ?, status_reason = ?, lab_id = ? WHERE id = ?`
+	_, err := rep.db.ExecContext(ctx, qry, stack.StackID, stack.Status, stack.StatusReason, stack.LabID, stack.ID)
+
+	return err
+}
+
+// PoolDemand counts the sessions in progress, the users waiting and the
+// reservations in progress not yet honored on the labs of the pool.
+func (rep FleetRepository) PoolDemand(ctx context.Context, poolId uint64) (demand int, err error) {
+	qry := `SELECT
+		(SELECT COUNT(*) FROM sessions JOIN labs ON labs.id = sessions.lab_id
+			WHERE labs.pool_id = ? AND sessions.status IN (?, ?))
+		+ (SELECT COUNT(*) FROM queue_entries JOIN labs ON labs.id = queue_entries.lab_id
+			WHERE labs.pool_id = ? AND queue_entries.status = ?)
+		+ (SELECT COUNT(*) FROM reservations JOIN labs ON labs.id = reservations.lab_id
+			WHERE labs.pool_id = ? AND reservations.status = ?
+				AND reservations.starts_at <= NOW() AND reservations.ends_at > NOW())`
+	err = rep.db.GetContext(ctx, &demand, qry, poolId, SessionActive, SessionProvisioning, poolId, QueueWaiting,
+		poolId, ReservationBooked)
+
+	return
+}
@@ -0,0 +1,93 @@
+package mysql
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// HealthCheck is one probe of a lab: the EC2 state of its instance, the
+// ping status of its SSM agent and whether the DCV server answered.
+type HealthCheck struct {
+	ID            uint64    `db:"id" json:"id"`
+	LabID         uint64    `db:"lab_id" json:"lab_id"`
+	Status        LabHealth `db:"status" json:"status"`
+	InstanceState *string   `db:"instance_state" json:"instance_state"`
+	PingStatus    *string   `db:"ping_status" json:"ping_status"`
+	DCVReachable  bool      `db:"dcv_reachable" json:"dcv_reachable"`
+	Detail        *string   `db:"detail" json:"detail"`
+	CheckedAt     time.Time `db:"checked_at" json:"checked_at"`
+}
+
+type HealthRepository struct {
+	db *sqlx.DB
+}
+
+func NewHealthRepository(db *sqlx.DB) *HealthRepository {
+	return &HealthRepository{db: db}
+}
+
+// RecordCheck stores the check and updates the health of its lab. A lab
+// failing threshold checks in a row is made unavailable; a lab made
+// unavailable that way is made available again by its next healthy check.
+// Checks of stopped instances leave the availability alone.
+func (rep HealthRepository) RecordCheck(ctx context.Context, check HealthCheck, threshold int) error {
+	tx, err := rep.db.BeginTxx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	qry := `INSERT INTO lab_health_checks (lab_id, status, instance_state, ping_status, dcv_reachable, detail)
+		VALUES (?, ?, ?, ?, ?, ?)`
+	if _, err = tx.ExecContext(ctx, qry, check.LabID, check.Status, check.InstanceState, check.PingStatus,
+		check.DCVReachable, check.Detail); err != nil {
+		return err
+	}
+
+	switch check.Status {
+	case HealthUnhealthy:
+		qry = `UPDATE labs SET health = ?, health_checked_at = NOW(), health_failures = health_failures + 1 WHERE id = ?`
+		if _, err = tx.ExecContext(ctx, qry, check.Status, check.LabID); err != nil {
+			return err
+		}
+
+		qry = `UPDATE labs SET available = 0, health_disabled = 1 WHERE id = ? AND available = 1 AND health_failures >= ?`
+		if _, err = tx.ExecContext(ctx, qry, check.LabID, threshold); err != nil {
+			return err
+		}
+	case HealthHealthy:
+		qry = `UPDATE labs SET health = ?, health_checked_at = NOW(), health_failures = 0,
+			available = available OR health_disabled, health_disabled = 0 WHERE id = ?`
+		if _, err = tx.ExecContext(ctx, qry, check.Status, check.LabID); err != nil {
+			return err
+		}
+	default:
+		qry = `UPDATE labs SET health = ?, health_checked_at = NOW(), health_failures = 0 WHERE id = ?`
+		if _, err = tx.ExecContext(ctx, qry, check.Status, check.LabID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (rep HealthRepository) ListChecks(ctx context.Context, labId uint64, limit int) (result []HealthCheck, err error) {
+	qry := `SELECT * FROM lab_health_checks WHERE lab_id = ? ORDER BY id DESC LIMIT ?`
+	err = rep.db.SelectContext(ctx, &result, qry, labId, limit)
+
+	return
+}
+
+// PruneChecks deletes the checks made before the given time.
+func (rep HealthRepository) PruneChecks(ctx context.Context, before time.Time) error {
+	qry := `DELETE FROM lab_health_checks WHERE checked_at < ?`
+	_, err := rep.db.ExecContext(ctx, qry, before)
+
+	return err
+}
@@ -0,0 +1,88 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	driver "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// pendingKeyTTL bounds how long a claimed key without a session blocks
+// retries, so a crashed request does not lock the key forever.
+const pendingKeyTTL = 5 * time.Minute
+
+var (
+	ErrIdempotencyKeyInProgress = errors.New("idempotency key is already in progress")
+	ErrIdempotencyKeyMismatch   = errors.New("idempotency key was used for another lab")
+)
+
+type IdempotencyKey struct {
+	ID        uint64    `db:"id"`
+	UserID    uint64    `db:"user_id"`
+	LabID     uint64    `db:"lab_id"`
+	Key       string    `db:"idempotency_key"`
+	SessionID *uint64   `db:"session_id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type IdempotencyKeyRepository struct {
+	db *sqlx.DB
+}
+
+func NewIdempotencyKeyRepository(db *sqlx.DB) *IdempotencyKeyRepository {
+	return &IdempotencyKeyRepository{db: db}
+}
+
+// ClaimKey reserves the key for the user. When the key was already used and
+// completed, the stored session id is returned instead.
+func (rep IdempotencyKeyRepository) ClaimKey(ctx context.Context, userId uint64, labId uint64, key string) (sessionId *uint64, err error) {
+	qry := `DELETE FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ? AND session_id IS NULL AND created_at < ?`
+	if _, err = rep.db.ExecContext(ctx, qry, userId, key, time.Now().Add(-pendingKeyTTL)); err != nil {
+		return
+	}
+
+	qry = `INSERT INTO idempotency_keys (user_id, lab_id, idempotency_key) VALUES (?, ?, ?)`
+	_, err = rep.db.ExecContext(ctx, qry, userId, labId, key)
+
+	var mysqlErr *driver.MySQLError
+	if err == nil || !errors.As(err, &mysqlErr) || mysqlErr.Number != 1062 {
+		return
+	}
+
+	var existing IdempotencyKey
+	qry = `SELECT * FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ?`
+	if err = rep.db.QueryRowxContext(ctx, qry, userId, key).StructScan(&existing); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrIdempotencyKeyInProgress
+		}
+		return
+	}
+
+	if existing.LabID != labId {
+		return nil, ErrIdempotencyKeyMismatch
+	}
+
+	if existing.SessionID == nil {
+		return nil, ErrIdempotencyKeyInProgress
+	}
+
+	return existing.SessionID, nil
+}
+
+func (rep IdempotencyKeyRepository) CompleteKey(ctx context.Context, userId uint64, key string, sessionId uint64) error {
+	qry := `UPDATE idempotency_keys SET session_id = ? WHERE user_id = ? AND idempotency_key = ?`
+	_, err := rep.db.ExecContext(ctx, qry, sessionId, userId, key)
+
+	return err
+}
+
+// ReleaseKey drops a pending claim so the client can retry after a failure.
+func (rep IdempotencyKeyRepository) ReleaseKey(ctx context.Context, userId uint64, key string) error {
+	qry := `DELETE FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ? AND session_id IS NULL`
+	_, err := rep.db.ExecContext(ctx, qry, userId, key)
+
+	return err
+}
@@ -2,24 +2,106 @@ package mysql
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+var (
+	ErrLabInUse       = errors.New("lab has sessions in progress")
+	ErrLabUnavailable = errors.New("lab is not taking new sessions")
 )
 
 type LabType string
 
 const (
-	Kali    LabType = "kali"
-	Windows LabType = "windows"
+	Kali        LabType = "kali"
+	Ubuntu      LabType = "ubuntu"
+	AmazonLinux LabType = "amazonlinux"
+	RHEL        LabType = "rhel"
+	Windows     LabType = "windows"
+)
+
+type LabBackend string
+
+const (
+	BackendSSM LabBackend = "ssm"
+	BackendSSH LabBackend = "ssh"
+	// BackendAgent labs run the lab agent, which pulls its jobs from the
+	// pipeline, e.g. on-prem servers that cannot reach the AWS APIs.
+	BackendAgent LabBackend = "agent"
+	// BackendBroker labs are fleets of DCV servers behind a DCV Session
+	// Manager broker, which creates their sessions.
+	BackendBroker LabBackend = "broker"
+)
+
+type LabState string
+
+// Draining labs take no new session and go into maintenance once their
+// sessions end or their drain deadline passes.
+const (
+	LabActive      LabState = "active"
+	LabDraining    LabState = "draining"
+	LabMaintenance LabState = "maintenance"
+	LabRetired     LabState = "retired"
+)
+
+// LabHealth is the outcome of the last health check of a lab.
+type LabHealth string
+
+const (
+	HealthUnknown   LabHealth = "unknown"
+	HealthHealthy   LabHealth = "healthy"
+	HealthUnhealthy LabHealth = "unhealthy"
+	HealthStopped   LabHealth = "stopped"
+)
+
+// LabSource tells how a lab was added to the inventory.
+type LabSource string
+
+const (
+	SourceManual    LabSource = "manual"
+	SourceDiscovery LabSource = "discovery"
+	SourceFleet     LabSource = "fleet"
 )
 
 type Lab struct {
-	ID         uint64  `db:"id" json:"id"`
-	UUID       string  `db:"uuid" json:"uuid"`
-	Name       string  `db:"name" json:"name"`
-	Type       LabType `db:"type" json:"type"`
-	Hostname   string  `db:"hostname" json:"hostname"`
-	InstanceID string  `db:"instance_id" json:"instance_id"`
-	Available  bool    `db:"available" json:"available"`
+	ID         uint64     `db:"id" json:"id"`
+	UUID       string     `db:"uuid" json:"uuid"`
+	Name       string     `db:"name" json:"name"`
+	Type       LabType    `db:"type" json:"type"`
+	Hostname   string     `db:"hostname" json:"hostname"`
+	InstanceID string     `db:"instance_id" json:"instance_id"`
+	Available  bool       `db:"available" json:"available"`
+	Backend    LabBackend `db:"backend" json:"backend"`
+
+	PoolID      *uint64 `db:"pool_id" json:"pool_id"`
+	MaxSessions int     `db:"max_sessions" json:"max_sessions"`
+
+	// WarmPoolSize is the number of accounts kept ready on the instance for
+	// new sessions; zero disables the warm pool of the lab.
+	WarmPoolSize int `db:"warm_pool_size" json:"warm_pool_size"`
+
+	CourseID          *uint64 `db:"course_id" json:"course_id"`
+	MaxSessionMinutes *int    `db:"max_session_minutes" json:"max_session_minutes"`
+
+	State     LabState   `db:"state" json:"state"`
+	Source    LabSource  `db:"source" json:"source"`
+	DeletedAt *time.Time `db:"deleted_at" json:"deleted_at,omitempty"`
+
+	Health          LabHealth  `db:"health" json:"health"`
+	HealthCheckedAt *time.Time `db:"health_checked_at" json:"health_checked_at"`
+	HealthFailures  int        `db:"health_failures" json:"-"`
+	HealthDisabled  bool       `db:"health_disabled" json:"health_disabled"`
+
+	DrainDeadline   *time.Time `db:"drain_deadline" json:"drain_deadline,omitempty"`
+	DrainMessage    *string    `db:"drain_message" json:"drain_message,omitempty"`
+	DrainNotifiedAt *time.Time `db:"drain_notified_at" json:"-"`
+
+	TemplateName    *string `db:"template_name" json:"template_name"`
+	TemplateVersion *int    `db:"template_version" json:"template_version"`
 }
 
 type LabRepository struct {
@@ -31,8 +113,8 @@ func NewLabRepository(db *sqlx.DB) *LabRepository {
 }
 
 func (rep LabRepository) ListLabs(ctx context.Context) (result []Lab, err error) {
-	qry := `SELECT * FROM labs ORDER BY id ASC`
-	err = rep.db.SelectContext(ctx, &result, qry)
+	qry := `SELECT * FROM labs WHERE deleted_at IS NULL AND state != ? ORDER BY id ASC`
+	err = rep.db.SelectContext(ctx, &result, qry, LabRetired)
 
 	return
 }
@@ -45,3 +127,261 @@ func (rep LabRepository) GetLabById(ctx context.Context, id uint64) (lab Lab, er
 
 	return
 }
+
+// GetLabByInstanceId returns the lab of the instance that is not deleted,
+// or sql.ErrNoRows when there is none.
+func (rep LabRepository) GetLabByInstanceId(ctx context.Context, instanceId string) (lab Lab, err error) {
+	qry := `SELECT * FROM labs WHERE instance_id = ? AND deleted_at IS NULL ORDER BY id DESC LIMIT 1`
+	row := rep.db.QueryRowxContext(ctx, qry, instanceId)
+
+	err = row.StructScan(&lab)
+
+	return
+}
+
+func (rep LabRepository) ListLabsBySource(ctx context.Context, source LabSource) (result []Lab, err error) {
+	qry := `SELECT * FROM labs WHERE source = ? AND deleted_at IS NULL AND state != ? ORDER BY id ASC`
+	err = rep.db.SelectContext(ctx, &result, qry, source, LabRetired)
+
+	return
+}
+
+func (rep LabRepository) CreateLab(ctx context.Context, lab Lab) (Lab, error) {
+	if lab.State == "" {
+		lab.State = LabActive
+	}
+
+	if lab.Source == "" {
+		lab.Source = SourceManual
+	}
+
+	qry := `INSERT INTO labs (uuid, name, type, hostname, instance_id, available, backend, pool_id, max_sessions,
+		warm_pool_size, course_id, max_session_minutes, template_name, template_version, state, source)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	res, err := rep.db.ExecContext(ctx, qry, uuid.New().String(), lab.Name, lab.Type, lab.Hostname, lab.InstanceID,
+		lab.Available, lab.Backend, lab.PoolID, lab.MaxSessions, lab.WarmPoolSize, lab.CourseID, lab.MaxSessionMinutes,
+		lab.TemplateName, lab.TemplateVersion, lab.State, lab.Source)
+
+	if err != nil {
+		return Lab{}, err
+	}
+
+	id, err := res.LastInsertId()
+
+	if err != nil {
+		return Lab{}, err
+	}
+
+	return rep.GetLabById(ctx, uint64(id))
+}
+
+func (rep LabRepository) UpdateLab(ctx context.Context, lab Lab) (Lab, error) {
+	qry := `UPDATE labs SET name = ?, type = ?, hostname = ?, instance_id = ?, available = ?, backend = ?,
+		pool_id = ?, max_sessions = ?, warm_pool_size = ?, course_id = ?, max_session_minutes = ?,
+		template_name = ?, template_version = ?, source = ? WHERE id = ?`
+	_, err := rep.db.ExecContext(ctx, qry, lab.Name, lab.Type, lab.Hostname, lab.InstanceID, lab.Available,
+		lab.Backend, lab.PoolID, lab.MaxSessions, lab.WarmPoolSize, lab.CourseID, lab.MaxSessionMinutes,
+		lab.TemplateName, lab.TemplateVersion, lab.Source, lab.ID)
+
+	if err != nil {
+		return Lab{}, err
+	}
+
+	return rep.GetLabById(ctx, lab.ID)
+}
+
+// SetAvailable overrides the availability set by the health checker until
+// the next failing check.
+func (rep LabRepository) SetAvailable(ctx context.Context, id uint64, available bool) error {
+	qry := `UPDATE labs SET available = ?, health_disabled = 0 WHERE id = ?`
+	_, err := rep.db.ExecContext(ctx, qry, available, id)
+
+	return err
+}
+
+// DeleteLab removes a lab that has no session in progress; ErrLabInUse is
+// returned otherwise. The row is kept for the sessions that refer to it and
+// its waiting queue is cancelled.
+func (rep LabRepository) DeleteLab(ctx context.Context, id uint64) error {
+	tx, err := rep.db.BeginTxx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var lockedId uint64
+	qry := `SELECT id FROM labs WHERE id = ? AND deleted_at IS NULL FOR UPDATE`
+	if err = tx.GetContext(ctx, &lockedId, qry, id); err != nil {
+		return err
+	}
+
+	var inUse int
+	qry = `SELECT COUNT(*) FROM sessions WHERE lab_id = ? AND status IN (?, ?)`
+	if err = tx.GetContext(ctx, &inUse, qry, id, SessionActive, SessionProvisioning); err != nil {
+		return err
+	}
+
+	if inUse > 0 {
+		return ErrLabInUse
+	}
+
+	qry = `UPDATE labs SET available = 0, deleted_at = NOW() WHERE id = ?`
+	if _, err = tx.ExecContext(ctx, qry, id); err != nil {
+		return err
+	}
+
+	qry = `UPDATE queue_entries SET status = ? WHERE lab_id = ? AND status = ?`
+	if _, err = tx.ExecContext(ctx, qry, QueueCancelled, id, QueueWaiting); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (rep LabRepository) UpdateHostname(ctx context.Context, id uint64, hostname string) error {
+	qry := `UPDATE labs SET hostname = ? WHERE id = ?`
+	_, err := rep.db.ExecContext(ctx, qry, hostname, id)
+
+	return err
+}
+
+// ListIdleLabs returns the active labs with no session in progress, no
+// waiting queue and no session that ended after since. Labs keeping warm
+// accounts, and labs with a reservation or a class of their course in
+// progress or starting before until, are not idle either.
+func (rep LabRepository) ListIdleLabs(ctx context.Context, since time.Time, until time.Time) (result []Lab, err error) {
+	qry := `SELECT * FROM labs
+		WHERE deleted_at IS NULL AND state = ?
+		AND NOT EXISTS (
+			SELECT 1 FROM sessions WHERE sessions.lab_id = labs.id
+			AND (sessions.status IN (?, ?) OR sessions.ended_at > ?)
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM queue_entries WHERE queue_entries.lab_id = labs.id AND queue_entries.status = ?
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM warm_accounts WHERE warm_accounts.lab_id = labs.id AND warm_accounts.status IN (?, ?)
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM reservations WHERE reservations.lab_id = labs.id AND reservations.status = ?
+			AND reservations.starts_at <= ? AND reservations.ends_at > NOW()
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM class_windows WHERE class_windows.course_id = labs.course_id
+			AND class_windows.status IN (?, ?, ?) AND class_windows.starts_at <= ? AND class_windows.ends_at > NOW()
+		)
+		ORDER BY id ASC`
+	err = rep.db.SelectContext(ctx, &result, qry, LabActive, SessionActive, SessionProvisioning, since, QueueWaiting,
+		WarmCreating, WarmReady, ReservationBooked, until, ClassScheduled, ClassWarming, ClassOpen, until)
+
+	return
+}
+
+func (rep LabRepository) SetLabState(ctx context.Context, id uint64, state LabState) error {
+	qry := `UPDATE labs SET state = ? WHERE id = ?`
+	_, err := rep.db.ExecContext(ctx, qry, state, id)
+
+	return err
+}
+
+func (rep LabRepository) ListLabsByState(ctx context.Context, state LabState) (result []Lab, err error) {
+	qry := `SELECT * FROM labs WHERE state = ? AND deleted_at IS NULL ORDER BY id ASC`
+	err = rep.db.SelectContext(ctx, &result, qry, state)
+
+	return
+}
+
+// StartDrain stops the lab from taking new sessions; its users are told to
+// leave with message and their sessions are ended at deadline. Draining
+// again moves the deadline. ErrLabUnavailable is returned for labs that are
+// neither active nor draining.
+func (rep LabRepository) StartDrain(ctx context.Context, id uint64, deadline time.Time, message string) error {
+	qry := `UPDATE labs SET state = ?, drain_deadline = ?, drain_message = ?, drain_notified_at = NULL
+		WHERE id = ? AND state IN (?, ?)`
+	res, err := rep.db.ExecContext(ctx, qry, LabDraining, deadline, message, id, LabActive, LabDraining)
+
+	if err != nil {
+		return err
+	}
+
+	return expectRow(res)
+}
+
+func (rep LabRepository) MarkDrainNotified(ctx context.Context, id uint64) error {
+	qry := `UPDATE labs SET drain_notified_at = NOW() WHERE id = ?`
+	_, err := rep.db.ExecContext(ctx, qry, id)
+
+	return err
+}
+
+// FinishDrain puts a drained lab into maintenance.
+func (rep LabRepository) FinishDrain(ctx context.Context, id uint64) error {
+	qry := `UPDATE labs SET state = ? WHERE id = ? AND state = ?`
+	_, err := rep.db.ExecContext(ctx, qry, LabMaintenance, id, LabDraining)
+
+	return err
+}
+
+// CancelDrain puts a draining lab or a lab in maintenance back in service.
+// ErrLabUnavailable is returned for labs in another state.
+func (rep LabRepository) CancelDrain(ctx context.Context, id uint64) error {
+	qry := `UPDATE labs SET state = ?, drain_deadline = NULL, drain_message = NULL, drain_notified_at = NULL
+		WHERE id = ? AND state IN (?, ?)`
+	res, err := rep.db.ExecContext(ctx, qry, LabActive, id, LabDraining, LabMaintenance)
+
+	if err != nil {
+		return err
+	}
+
+	return expectRow(res)
+}
+
+// expectRow returns ErrLabUnavailable when a state change matched no lab.
+func expectRow(res sql.Result) error {
+	affected, err := res.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return ErrLabUnavailable
+	}
+
+	return nil
+}
+
+// RetireLab takes a lab whose instance is gone out of service. Its sessions
+// are ended and its waiting queue is cancelled.
+func (rep LabRepository) RetireLab(ctx context.Context, id uint64) error {
+	tx, err := rep.db.BeginTxx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	qry := `UPDATE labs SET state = ?, available = 0 WHERE id = ?`
+	if _, err = tx.ExecContext(ctx, qry, LabRetired, id); err != nil {
+		return err
+	}
+
+	qry = `UPDATE sessions SET status = ?, ended_at = NOW(), end_reason = ? WHERE lab_id = ? AND status IN (?, ?)`
+	if _, err = tx.ExecContext(ctx, qry, SessionEnded, EndReasonRetired, id, SessionActive, SessionProvisioning); err != nil {
+		return err
+	}
+
+	qry = `UPDATE queue_entries SET status = ? WHERE lab_id = ? AND status = ?`
+	if _, err = tx.ExecContext(ctx, qry, QueueCancelled, id, QueueWaiting); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,127 @@
+package mysql
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// LabPool groups identical labs so that sessions can be placed on any of
+// them.
+type LabPool struct {
+	ID   uint64  `db:"id" json:"id"`
+	UUID string  `db:"uuid" json:"uuid"`
+	Name string  `db:"name" json:"name"`
+	Type LabType `db:"type" json:"type"`
+
+	FleetMin            int     `db:"fleet_min" json:"fleet_min"`
+	FleetMax            int     `db:"fleet_max" json:"fleet_max"`
+	FleetTemplate       *string `db:"fleet_template" json:"fleet_template"`
+	FleetInstanceType   string  `db:"fleet_instance_type" json:"fleet_instance_type"`
+	FleetVolumeSize     int     `db:"fleet_volume_size" json:"fleet_volume_size"`
+	FleetIngress        string  `db:"fleet_ingress" json:"fleet_ingress"`
+	FleetLabMaxSessions int     `db:"fleet_lab_max_sessions" json:"fleet_lab_max_sessions"`
+}
+
+// LabLoad is a lab of a pool with the number of its active sessions and
+// waiting queue entries.
+type LabLoad struct {
+	Lab
+	ActiveSessions int `db:"active_sessions" json:"active_sessions"`
+	Waiting        int `db:"waiting" json:"waiting"`
+	Reserved       int `db:"reserved" json:"reserved"`
+}
+
+type PoolRepository struct {
+	db *sqlx.DB
+}
+
+func NewPoolRepository(db *sqlx.DB) *PoolRepository {
+	return &PoolRepository{db: db}
+}
+
+func (rep PoolRepository) ListPools(ctx context.Context) (result []LabPool, err error) {
+	qry := `SELECT * FROM lab_pools ORDER BY id ASC`
+	err = rep.db.SelectContext(ctx, &result, qry)
+
+	return
+}
+
+func (rep PoolRepository) GetPoolById(ctx context.Context, id uint64) (pool LabPool, err error) {
+	qry := `SELECT * FROM lab_pools WHERE id = ?`
+	row := rep.db.QueryRowxContext(ctx, qry, id)
+
+	err = row.StructScan(&pool)
+
+	return
+}
+
+// labLoadQuery selects the labs in service matching the condition on the
+// column with their load.
+const labLoadQuery = `SELECT labs.*, COUNT(sessions.id) AS active_sessions,
+	(SELECT COUNT(*) FROM queue_entries WHERE queue_entries.lab_id = labs.id AND queue_entries.status = ?) AS waiting,
+	(SELECT COUNT(*) FROM reservations WHERE reservations.lab_id = labs.id AND reservations.status = ?
+		AND reservations.starts_at <= NOW() AND reservations.ends_at > NOW()) AS reserved
+	FROM labs
+	LEFT JOIN sessions ON sessions.lab_id = labs.id AND sessions.status IN (?, ?)
+	WHERE labs.%s = ? AND labs.deleted_at IS NULL AND labs.state != ?
+	GROUP BY labs.id
+	ORDER BY labs.id ASC`
+
+// ListPoolLoad returns every lab in service in the pool with its load.
+func (rep PoolRepository) ListPoolLoad(ctx context.Context, poolId uint64) (result []LabLoad, err error) {
+	qry := fmt.Sprintf(labLoadQuery, "pool_id")
+	err = rep.db.SelectContext(ctx, &result, qry, QueueWaiting, ReservationBooked, SessionActive, SessionProvisioning, poolId, LabRetired)
+
+	return
+}
+
+// ListCourseLoad returns every lab in service of the course with its load.
+func (rep PoolRepository) ListCourseLoad(ctx context.Context, courseId uint64) (result []LabLoad, err error) {
+	qry := fmt.Sprintf(labLoadQuery, "course_id")
+	err = rep.db.SelectContext(ctx, &result, qry, QueueWaiting, ReservationBooked, SessionActive, SessionProvisioning, courseId, LabRetired)
+
+	return
+}
+
+// ListFleetPools returns the pools whose labs are scaled by the fleet.
+func (rep PoolRepository) ListFleetPools(ctx context.Context) (result []LabPool, err error) {
+	qry := `SELECT * FROM lab_pools WHERE fleet_max > 0 ORDER BY id ASC`
+	err = rep.db.SelectContext(ctx, &result, qry)
+
+	return
+}
+
+func (rep PoolRepository) CreatePool(ctx context.Context, pool LabPool) (LabPool, error) {
+	qry := `INSERT INTO lab_pools (uuid, name, type, fleet_min, fleet_max, fleet_template, fleet_instance_type,
+		fleet_volume_size, fleet_ingress, fleet_lab_max_sessions)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	res, err := rep.db.ExecContext(ctx, qry, uuid.New().String(), pool.Name, pool.Type, pool.FleetMin, pool.FleetMax,
+		pool.FleetTemplate, pool.FleetInstanceType, pool.FleetVolumeSize, pool.FleetIngress, pool.FleetLabMaxSessions)
+
+	if err != nil {
+		return LabPool{}, err
+	}
+
+	id, err := res.LastInsertId()
+
+	if err != nil {
+		return LabPool{}, err
+	}
+
+	return rep.GetPoolById(ctx, uint64(id))
+}
+
+func (rep PoolRepository) UpdatePool(ctx context.Context, pool LabPool) (LabPool, error) {
+	qry := `UPDATE lab_pools SET name = ?, type = ?, fleet_min = ?, fleet_max = ?, fleet_template = ?,
+		fleet_instance_type = ?, fleet_volume_size = ?, fleet_ingress = ?, fleet_lab_max_sessions = ? WHERE id = ?`
+	_, err := rep.db.ExecContext(ctx, qry, pool.Name, pool.Type, pool.FleetMin, pool.FleetMax, pool.FleetTemplate,
+		pool.FleetInstanceType, pool.FleetVolumeSize, pool.FleetIngress, pool.FleetLabMaxSessions, pool.ID)
+
+	if err != nil {
+		return LabPool{}, err
+	}
+
+	return rep.GetPoolById(ctx, pool.ID)
+}
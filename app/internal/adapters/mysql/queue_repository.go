@@ -0,0 +1,159 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type QueueStatus string
+
+const (
+	QueueWaiting   QueueStatus = "waiting"
+	QueueAdmitted  QueueStatus = "admitted"
+	QueueFailed    QueueStatus = "failed"
+	QueueCancelled QueueStatus = "cancelled"
+)
+
+// Queue priorities; entries with a higher priority are served first and
+// entries with the same priority in arrival order.
+const (
+	PriorityStudent   = 0
+	PriorityProfessor = 100
+)
+
+// QueueEntry is a user waiting for a slot on a full lab.
+type QueueEntry struct {
+	ID         uint64      `db:"id" json:"id"`
+	UserID     uint64      `db:"user_id" json:"user_id"`
+	LabID      uint64      `db:"lab_id" json:"lab_id"`
+	Priority   int         `db:"priority" json:"priority"`
+	Status     QueueStatus `db:"status" json:"status"`
+	SessionID  *uint64     `db:"session_id" json:"session_id"`
+	CreatedAt  time.Time   `db:"created_at" json:"created_at"`
+	AdmittedAt *time.Time  `db:"admitted_at" json:"admitted_at"`
+}
+
+type QueueRepository struct {
+	db *sqlx.DB
+}
+
+func NewQueueRepository(db *sqlx.DB) *QueueRepository {
+	return &QueueRepository{db: db}
+}
+
+// Enqueue adds the user to the lab's queue. A user already waiting for the
+// lab keeps their entry, raised to priority if it is higher.
+func (rep QueueRepository) Enqueue(ctx context.Context, userId uint64, labId uint64, priority int) (QueueEntry, error) {
+	var entry QueueEntry
+
+	qry := `SELECT * FROM queue_entries WHERE user_id = ? AND lab_id = ? AND status = ? ORDER BY id ASC LIMIT 1`
+	err := rep.db.QueryRowxContext(ctx, qry, userId, labId, QueueWaiting).StructScan(&entry)
+
+	if err == nil {
+		if priority > entry.Priority {
+			return rep.SetPriority(ctx, entry.ID, priority)
+		}
+		return entry, nil
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return QueueEntry{}, err
+	}
+
+	qry = `INSERT INTO queue_entries (user_id, lab_id, priority, status) VALUES (?, ?, ?, ?)`
+	res, err := rep.db.ExecContext(ctx, qry, userId, labId, priority, QueueWaiting)
+
+	if err != nil {
+		return QueueEntry{}, err
+	}
+
+	id, err := res.LastInsertId()
+
+	if err != nil {
+		return QueueEntry{}, err
+	}
+
+	return rep.GetEntryById(ctx, uint64(id))
+}
+
+func (rep QueueRepository) GetEntryById(ctx context.Context, id uint64) (entry QueueEntry, err error) {
+	qry := `SELECT * FROM queue_entries WHERE id = ?`
+	err = rep.db.QueryRowxContext(ctx, qry, id).StructScan(&entry)
+
+	return
+}
+
+// ListWaiting returns the lab's waiting entries in the order they are served.
+func (rep QueueRepository) ListWaiting(ctx context.Context, labId uint64) (result []QueueEntry, err error) {
+	qry := `SELECT * FROM queue_entries WHERE lab_id = ? AND status = ? ORDER BY priority DESC, id ASC`
+	err = rep.db.SelectContext(ctx, &result, qry, labId, QueueWaiting)
+
+	return
+}
+
+// ListWaitingLabs returns the ids of the labs that have a waiting queue.
+func (rep QueueRepository) ListWaitingLabs(ctx context.Context) (result []uint64, err error) {
+	qry := `SELECT DISTINCT lab_id FROM queue_entries WHERE status = ? ORDER BY lab_id ASC`
+	err = rep.db.SelectContext(ctx, &result, qry, QueueWaiting)
+
+	return
+}
+
+// Position returns the 1-based place of a waiting entry in its lab's queue.
+func (rep QueueRepository) Position(ctx context.Context, entry QueueEntry) (position int, err error) {
+	qry := `SELECT COUNT(*) FROM queue_entries
+		WHERE lab_id = ? AND status = ? AND (priority > ? OR (priority = ? AND id < ?))`
+	err = rep.db.GetContext(ctx, &position, qry, entry.LabID, QueueWaiting, entry.Priority, entry.Priority, entry.ID)
+
+	return position + 1, err
+}
+
+func (rep QueueRepository) SetPriority(ctx context.Context, id uint64, priority int) (QueueEntry, error) {
+	qry := `UPDATE queue_entries SET priority = ? WHERE id = ? AND status = ?`
+	if _, err := rep.db.ExecContext(ctx, qry, priority, id, QueueWaiting); err != nil {
+		return QueueEntry{}, err
+	}
+
+	return rep.GetEntryById(ctx, id)
+}
+
+// SetStatus moves an entry from one status to another and reports whether
+// the entry was still in the from status.
+func (rep QueueRepository) SetStatus(ctx context.Context, id uint64, from QueueStatus, to QueueStatus) (bool, error) {
+	qry := `UPDATE queue_entries SET status = ? WHERE id = ? AND status = ?`
+	res, err := rep.db.ExecContext(ctx, qry, to, id, from)
+
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+
+	return n > 0, err
+}
+
+// Admit marks a waiting entry as served by the session.
+func (rep QueueRepository) Admit(ctx context.Context, id uint64, sessionId uint64) error {
+	qry := `UPDATE queue_entries SET status = ?, session_id = ?, admitted_at = NOW() WHERE id = ? AND status = ?`
+	_, err := rep.db.ExecContext(ctx, qry, QueueAdmitted, sessionId, id, QueueWaiting)
+
+	return err
+}
+
+// AverageSessionDuration returns how long sessions on the lab lasted over
+// the last week, or zero when none ended in that period.
+func (rep QueueRepository) AverageSessionDuration(ctx context.Context, labId uint64) (time.Duration, error) {
+	var seconds sql.NullFloat64
+
+	qry := `SELECT AVG(TIMESTAMPDIFF(SECOND, created_at, ended_at)) FROM sessions
+		WHERE lab_id = ? AND status = ? AND ended_at > ?`
+	if err := rep.db.GetContext(ctx, &seconds, qry, labId, SessionEnded, time.Now().Add(-7*24*time.Hour)); err != nil {
+		return 0, err
+	}
+
+	return time.Duration(seconds.Float64 * float64(time.Second)), nil
+}
@@ -0,0 +1,82 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// QuotaOverride replaces the default limits of one user. Nil limits keep
+// the default.
+type QuotaOverride struct {
+	ID                    uint64    `db:"id" json:"-"`
+	UserID                uint64    `db:"user_id" json:"user_id"`
+	MaxConcurrentSessions *int      `db:"max_concurrent_sessions" json:"max_concurrent_sessions"`
+	WeeklyHours           *int      `db:"weekly_hours" json:"weekly_hours"`
+	UpdatedBy             *uint64   `db:"updated_by" json:"updated_by"`
+	UpdatedAt             time.Time `db:"updated_at" json:"updated_at"`
+}
+
+type QuotaRepository struct {
+	db *sqlx.DB
+}
+
+func NewQuotaRepository(db *sqlx.DB) *QuotaRepository {
+	return &QuotaRepository{db: db}
+}
+
+// GetOverride returns the override of the user, or an empty one when there
+// is none.
+func (rep QuotaRepository) GetOverride(ctx context.Context, userId uint64) (QuotaOverride, error) {
+	override := QuotaOverride{UserID: userId}
+
+	qry := `SELECT * FROM quota_overrides WHERE user_id = ?`
+	err := rep.db.QueryRowxContext(ctx, qry, userId).StructScan(&override)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return override, nil
+	}
+
+	return override, err
+}
+
+func (rep QuotaRepository) SetOverride(ctx context.Context, override QuotaOverride) error {
+	qry := `INSERT INTO quota_overrides (user_id, max_concurrent_sessions, weekly_hours, updated_by) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE max_concurrent_sessions = VALUES(max_concurrent_sessions),
+			weekly_hours = VALUES(weekly_hours), updated_by = VALUES(updated_by)`
+	_, err := rep.db.ExecContext(ctx, qry, override.UserID, override.MaxConcurrentSessions, override.WeeklyHours, override.UpdatedBy)
+
+	return err
+}
+
+// CountUserSessions counts the sessions of the user in progress on any lab.
+func (rep QuotaRepository) CountUserSessions(ctx context.Context, userId uint64) (count int, err error) {
+	qry := `SELECT COUNT(*) FROM sessions WHERE user_id = ? AND status IN (?, ?)`
+	err = rep.db.GetContext(ctx, &count, qry, userId, SessionActive, SessionProvisioning)
+
+	return
+}
+
+// UserHoursSince sums the time the user's sessions ran after since,
+// counting sessions in progress up to now.
+func (rep QuotaRepository) UserHoursSince(ctx context.Context, userId uint64, since time.Time) (hours float64, err error) {
+	qry := `SELECT COALESCE(SUM(TIMESTAMPDIFF(SECOND, GREATEST(created_at, ?), COALESCE(ended_at, NOW()))), 0) / 3600
+		FROM sessions
+		WHERE user_id = ? AND status IN (?, ?) AND (ended_at IS NULL OR ended_at > ?)`
+	err = rep.db.GetContext(ctx, &hours, qry, since, userId, SessionActive, SessionEnded, since)
+
+	return
+}
+
+// CourseHours sums the time every session of the course ran.
+func (rep QuotaRepository) CourseHours(ctx context.Context, courseId uint64) (hours float64, err error) {
+	qry := `SELECT COALESCE(SUM(TIMESTAMPDIFF(SECOND, created_at, COALESCE(ended_at, NOW()))), 0) / 3600
+		FROM sessions
+		WHERE course_id = ? AND status IN (?, ?)`
+	err = rep.db.GetContext(ctx, &hours, qry, courseId, SessionActive, SessionEnded)
+
+	return
+}
@@ -0,0 +1,270 @@
+package mysql
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+type ReservationStatus string
+
+const (
+	ReservationBooked    ReservationStatus = "booked"
+	ReservationHonored   ReservationStatus = "honored"
+	ReservationCancelled ReservationStatus = "cancelled"
+	ReservationNoShow    ReservationStatus = "no_show"
+)
+
+// PriorityReservation queues users holding a reservation for the lab ahead
+// of everybody else.
+const PriorityReservation = 200
+
+var (
+	ErrReservationConflict = errors.New("lab has no free slot for the whole reservation")
+	ErrReservationOverlap  = errors.New("user already has a reservation in that time range")
+	ErrReservationClosed   = errors.New("reservation is no longer booked")
+)
+
+// Reservation is a slot on a lab kept for a user over a time range. Pool
+// reservations are booked on one of the labs of the pool.
+type Reservation struct {
+	ID        uint64            `db:"id" json:"id"`
+	UUID      string            `db:"uuid" json:"uuid"`
+	UserID    uint64            `db:"user_id" json:"user_id"`
+	LabID     uint64            `db:"lab_id" json:"lab_id"`
+	PoolID    *uint64           `db:"pool_id" json:"pool_id"`
+	StartsAt  time.Time         `db:"starts_at" json:"starts_at"`
+	EndsAt    time.Time         `db:"ends_at" json:"ends_at"`
+	Status    ReservationStatus `db:"status" json:"status"`
+	SessionID *uint64           `db:"session_id" json:"session_id"`
+	CreatedAt time.Time         `db:"created_at" json:"created_at"`
+	UpdatedAt *time.Time        `db:"updated_at" json:"updated_at"`
+}
+
+type ReservationRepository struct {
+	db *sqlx.DB
+}
+
+func NewReservationRepository(db *sqlx.DB) *ReservationRepository {
+	return &ReservationRepository{db: db}
+}
+
+// Book reserves a slot on the lab of the reservation. The lab row is locked
+// so that concurrent bookings cannot keep more slots than the lab has at any
+// moment of the range. ErrReservationConflict is returned when the lab is
+// fully booked at some point of the range, ErrReservationOverlap when the
+// user already holds a reservation overlapping it and ErrLabUnavailable for
+// retired labs.
+func (rep ReservationRepository) Book(ctx context.Context, reservation Reservation) (Reservation, error) {
+	tx, err := rep.db.BeginTxx(ctx, nil)
+
+	if err != nil {
+		return Reservation{}, err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var locked struct {
+		MaxSessions int      `db:"max_sessions"`
+		State       LabState `db:"state"`
+	}
+	qry := `SELECT max_sessions, state FROM labs WHERE id = ? AND deleted_at IS NULL FOR UPDATE`
+	if err = tx.GetContext(ctx, &locked, qry, reservation.LabID); err != nil {
+		return Reservation{}, err
+	}
+
+	if locked.State == LabRetired {
+		return Reservation{}, ErrLabUnavailable
+	}
+
+	var overlapping int
+	qry = `SELECT COUNT(*) FROM reservations
+		WHERE user_id = ? AND status IN (?, ?) AND starts_at < ? AND ends_at > ?`
+	err = tx.GetContext(ctx, &overlapping, qry, reservation.UserID, ReservationBooked, ReservationHonored,
+		reservation.EndsAt, reservation.StartsAt)
+
+	if err != nil {
+		return Reservation{}, err
+	}
+
+	if overlapping > 0 {
+		return Reservation{}, ErrReservationOverlap
+	}
+
+	var booked []window
+	qry = `SELECT starts_at, ends_at FROM reservations
+		WHERE lab_id = ? AND status IN (?, ?) AND starts_at < ? AND ends_at > ?`
+	err = tx.SelectContext(ctx, &booked, qry, reservation.LabID, ReservationBooked, ReservationHonored,
+		reservation.EndsAt, reservation.StartsAt)
+
+	if err != nil {
+		return Reservation{}, err
+	}
+
+	maxSessions := locked.MaxSessions
+	if maxSessions < 1 {
+		maxSessions = 1
+	}
+
+	if peakOverlap(booked) >= maxSessions {
+		return Reservation{}, ErrReservationConflict
+	}
+
+	qry = `INSERT INTO reservations (uuid, user_id, lab_id, pool_id, starts_at, ends_at, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+	res, err := tx.ExecContext(ctx, qry, uuid.New().String(), reservation.UserID, reservation.LabID,
+		reservation.PoolID, reservation.StartsAt, reservation.EndsAt, ReservationBooked)
+
+	if err != nil {
+		return Reservation{}, err
+	}
+
+	id, err := res.LastInsertId()
+
+	if err != nil {
+		return Reservation{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Reservation{}, err
+	}
+
+	return rep.GetReservationById(ctx, uint64(id))
+}
+
+type window struct {
+	StartsAt time.Time `db:"starts_at"`
+	EndsAt   time.Time `db:"ends_at"`
+}
+
+// peakOverlap returns the largest number of windows in progress at the same
+// moment. A window ending when another starts does not overlap it.
+func peakOverlap(windows []window) int {
+	type edge struct {
+		at    time.Time
+		delta int
+	}
+
+	edges := make([]edge, 0, 2*len(windows))
+	for _, w := range windows {
+		edges = append(edges, edge{w.StartsAt, 1}, edge{w.EndsAt, -1})
+	}
+
+	sort.Slice(edges, func(i, j int) bool {
+		if !edges[i].at.Equal(edges[j].at) {
+			return edges[i].at.Before(edges[j].at)
+		}
+		return edges[i].delta < edges[j].delta
+	})
+
+	current, peak := 0, 0
+	for _, e := range edges {
+		current += e.delta
+		if current > peak {
+			peak = current
+		}
+	}
+
+	return peak
+}
+
+func (rep ReservationRepository) GetReservationById(ctx context.Context, id uint64) (reservation Reservation, err error) {
+	qry := `SELECT * FROM reservations WHERE id = ?`
+	err = rep.db.QueryRowxContext(ctx, qry, id).StructScan(&reservation)
+
+	return
+}
+
+// GetCurrentReservation returns the booked reservation of the user on the
+// lab whose range includes now, or sql.ErrNoRows when there is none.
+func (rep ReservationRepository) GetCurrentReservation(ctx context.Context, userId uint64, labId uint64) (reservation Reservation, err error) {
+	qry := `SELECT * FROM reservations
+		WHERE user_id = ? AND lab_id = ? AND status = ? AND starts_at <= NOW() AND ends_at > NOW()
+		ORDER BY starts_at ASC LIMIT 1`
+	err = rep.db.QueryRowxContext(ctx, qry, userId, labId, ReservationBooked).StructScan(&reservation)
+
+	return
+}
+
+// GetCurrentPoolReservation returns the booked reservation of the user on
+// the pool whose range includes now, or sql.ErrNoRows when there is none.
+func (rep ReservationRepository) GetCurrentPoolReservation(ctx context.Context, userId uint64, poolId uint64) (reservation Reservation, err error) {
+	qry := `SELECT * FROM reservations
+		WHERE user_id = ? AND pool_id = ? AND status = ? AND starts_at <= NOW() AND ends_at > NOW()
+		ORDER BY starts_at ASC LIMIT 1`
+	err = rep.db.QueryRowxContext(ctx, qry, userId, poolId, ReservationBooked).StructScan(&reservation)
+
+	return
+}
+
+// ListUserReservations returns the reservations of the user ending after
+// since, in the order they start.
+func (rep ReservationRepository) ListUserReservations(ctx context.Context, userId uint64, since time.Time) (result []Reservation, err error) {
+	qry := `SELECT * FROM reservations WHERE user_id = ? AND ends_at > ? ORDER BY starts_at ASC`
+	err = rep.db.SelectContext(ctx, &result, qry, userId, since)
+
+	return
+}
+
+// ListLabReservations returns the booked and honored reservations of the
+// lab ending after since, in the order they start.
+func (rep ReservationRepository) ListLabReservations(ctx context.Context, labId uint64, since time.Time) (result []Reservation, err error) {
+	qry := `SELECT * FROM reservations WHERE lab_id = ? AND status IN (?, ?) AND ends_at > ? ORDER BY starts_at ASC`
+	err = rep.db.SelectContext(ctx, &result, qry, labId, ReservationBooked, ReservationHonored, since)
+
+	return
+}
+
+// Cancel gives the slot of a booked reservation back. ErrReservationClosed
+// is returned when the reservation was already honored, cancelled or
+// released.
+func (rep ReservationRepository) Cancel(ctx context.Context, id uint64) error {
+	qry := `UPDATE reservations SET status = ?, updated_at = NOW() WHERE id = ? AND status = ?`
+	res, err := rep.db.ExecContext(ctx, qry, ReservationCancelled, id, ReservationBooked)
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return ErrReservationClosed
+	}
+
+	return nil
+}
+
+// ReleaseNoShows closes the booked reservations that started before
+// cutoff. Users already on the lab with a session they started before the
+// range honor their reservation with it; the others lose the slot. It
+// returns the number of reservations released.
+func (rep ReservationRepository) ReleaseNoShows(ctx context.Context, cutoff time.Time) (int64, error) {
+	qry := `UPDATE reservations
+		JOIN sessions ON sessions.user_id = reservations.user_id AND sessions.lab_id = reservations.lab_id
+			AND sessions.status = ?
+		SET reservations.status = ?, reservations.session_id = sessions.id, reservations.updated_at = NOW()
+		WHERE reservations.status = ? AND reservations.starts_at < ?`
+	if _, err := rep.db.ExecContext(ctx, qry, SessionActive, ReservationHonored, ReservationBooked, cutoff); err != nil {
+		return 0, err
+	}
+
+	qry = `UPDATE reservations SET status = ?, updated_at = NOW() WHERE status = ? AND starts_at < ?`
+	res, err := rep.db.ExecContext(ctx, qry, ReservationNoShow, ReservationBooked, cutoff)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
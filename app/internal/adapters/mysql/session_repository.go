@@ -2,19 +2,92 @@ package mysql
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"time"
+
 	"github.com/jmoiron/sqlx"
 )
 
+type SessionStatus string
+
+const (
+	SessionProvisioning SessionStatus = "provisioning"
+	SessionActive       SessionStatus = "active"
+	SessionEnded        SessionStatus = "ended"
+	SessionFailed       SessionStatus = "failed"
+)
+
+// provisioningTTL bounds how long a session stuck in provisioning, e.g.
+// after a crash, keeps its slot on the lab.
+const provisioningTTL = 10 * time.Minute
+
+var (
+	ErrLabFull      = errors.New("lab has no free slot")
+	ErrSessionLimit = errors.New("user has reached their concurrent session limit")
+)
+
+type EndReason string
+
+const (
+	EndReasonLost    EndReason = "lost"
+	EndReasonRetired EndReason = "lab_retired"
+	EndReasonDrained EndReason = "lab_drained"
+	EndReasonIdle    EndReason = "idle"
+	EndReasonExpired EndReason = "expired"
+	EndReasonClass   EndReason = "class_ended"
+)
+
 type dbSession struct {
-	ID     uint64 `db:"id"`
-	UserID uint64 `db:"user_id"`
-	LabID  uint64 `db:"lab_id"`
+	ID            uint64        `db:"id"`
+	UserID        uint64        `db:"user_id"`
+	LabID         uint64        `db:"lab_id"`
+	Status        SessionStatus `db:"status"`
+	CreatedAt     time.Time     `db:"created_at"`
+	EndedAt       *time.Time    `db:"ended_at"`
+	EndReason     *EndReason    `db:"end_reason"`
+	Diagnostics   *string       `db:"diagnostics"`
+	IdleSince     *time.Time    `db:"idle_since"`
+	IdleWarned    *time.Time    `db:"idle_warned_at"`
+	CourseID      *uint64       `db:"course_id"`
+	ExpiresAt     *time.Time    `db:"expires_at"`
+	ExpiryWarn    *int          `db:"expiry_warning"`
+	ClassWindowID *uint64       `db:"class_window_id"`
+	IdleAfter     *time.Time    `db:"idle_after"`
+	Account       *string       `db:"account"`
+	BrokerID      *string       `db:"broker_session_id"`
 }
 
 type Session struct {
-	ID   uint64 `json:"id"`
-	User User   `json:"user"`
-	Lab  Lab    `json:"lab"`
+	ID            uint64        `json:"id"`
+	User          User          `json:"user"`
+	Lab           Lab           `json:"lab"`
+	Status        SessionStatus `json:"status"`
+	CreatedAt     time.Time     `json:"created_at"`
+	EndedAt       *time.Time    `json:"ended_at"`
+	EndReason     *EndReason    `json:"end_reason"`
+	Diagnostics   *string       `json:"diagnostics,omitempty"`
+	IdleSince     *time.Time    `json:"idle_since,omitempty"`
+	IdleWarned    *time.Time    `json:"-"`
+	CourseID      *uint64       `json:"course_id"`
+	ExpiresAt     *time.Time    `json:"expires_at"`
+	ExpiryWarn    *int          `json:"-"`
+	ClassWindowID *uint64       `json:"class_window_id,omitempty"`
+	IdleAfter     *time.Time    `json:"-"`
+	Account       *string       `json:"account,omitempty"`
+	BrokerID      *string       `json:"broker_session_id,omitempty"`
+}
+
+// OSUser is the user as known on the lab instance. Sessions bound to a warm
+// account run under the name of the account.
+func (s Session) OSUser() User {
+	user := s.User
+
+	if s.Account != nil {
+		user.UserName = *s.Account
+	}
+
+	return user
 }
 
 type SessionRepository struct {
@@ -40,21 +113,13 @@ func (rep SessionRepository) ListSessions(ctx context.Context) (sessions []Sessi
 	}
 
 	for _, row := range rows {
-		var user User
-		var lab Lab
+		var session Session
 
-		if user, err = rep.userRep.GetUserById(ctx, row.UserID); err != nil {
-			return nil, err
-		}
-		if lab, err = rep.labRep.GetLabById(ctx, row.LabID); err != nil {
+		if session, err = rep.hydrate(ctx, row); err != nil {
 			return nil, err
 		}
 
-		sessions = append(sessions, Session{
-			ID:   row.ID,
-			User: user,
-			Lab:  lab,
-		})
+		sessions = append(sessions, session)
 	}
 
 	return
@@ -62,50 +127,453 @@ func (rep SessionRepository) ListSessions(ctx context.Context) (sessions []Sessi
 
 func (rep SessionRepository) GetSessionById(ctx context.Context, id uint64) (session Session, err error) {
 	var dbSes dbSession
-	var user User
-	var lab Lab
 
 	qry := `SELECT * FROM sessions WHERE id = ?`
 	row := rep.db.QueryRowxContext(ctx, qry, id)
 
-	err = row.StructScan(&dbSes)
+	if err = row.StructScan(&dbSes); err != nil {
+		return
+	}
+
+	return rep.hydrate(ctx, dbSes)
+}
 
-	if user, err = rep.userRep.GetUserById(ctx, dbSes.UserID); err != nil {
-		return Session{}, err
+// GetActiveSession returns the active session of the user on the lab, or
+// sql.ErrNoRows when there is none.
+func (rep SessionRepository) GetActiveSession(ctx context.Context, userId uint64, labId uint64) (session Session, err error) {
+	var dbSes dbSession
+
+	qry := `SELECT * FROM sessions WHERE user_id = ? AND lab_id = ? AND status = ? ORDER BY id DESC LIMIT 1`
+	row := rep.db.QueryRowxContext(ctx, qry, userId, labId, SessionActive)
+
+	if err = row.StructScan(&dbSes); err != nil {
+		return
 	}
-	if lab, err = rep.labRep.GetLabById(ctx, dbSes.LabID); err != nil {
-		return Session{}, err
+
+	return rep.hydrate(ctx, dbSes)
+}
+
+// GetActivePoolSession returns the active session of the user on any lab of
+// the pool, or sql.ErrNoRows when there is none.
+func (rep SessionRepository) GetActivePoolSession(ctx context.Context, userId uint64, poolId uint64) (session Session, err error) {
+	var dbSes dbSession
+
+	qry := `SELECT sessions.* FROM sessions
+		JOIN labs ON labs.id = sessions.lab_id
+		WHERE sessions.user_id = ? AND labs.pool_id = ? AND sessions.status = ?
+		ORDER BY sessions.id DESC LIMIT 1`
+	row := rep.db.QueryRowxContext(ctx, qry, userId, poolId, SessionActive)
+
+	if err = row.StructScan(&dbSes); err != nil {
+		return
 	}
 
-	return Session{
-		ID:   dbSes.ID,
-		User: user,
-		Lab:  lab,
-	}, nil
+	return rep.hydrate(ctx, dbSes)
+}
+
+// GetActiveCourseSession returns the active session of the user on any lab
+// of the course, or sql.ErrNoRows when there is none.
+func (rep SessionRepository) GetActiveCourseSession(ctx context.Context, userId uint64, courseId uint64) (session Session, err error) {
+	var dbSes dbSession
+
+	qry := `SELECT sessions.* FROM sessions
+		JOIN labs ON labs.id = sessions.lab_id
+		WHERE sessions.user_id = ? AND labs.course_id = ? AND sessions.status = ?
+		ORDER BY sessions.id DESC LIMIT 1`
+	row := rep.db.QueryRowxContext(ctx, qry, userId, courseId, SessionActive)
+
+	if err = row.StructScan(&dbSes); err != nil {
+		return
+	}
+
+	return rep.hydrate(ctx, dbSes)
+}
+
+// ListClassSessions returns the active sessions provisioned for the class.
+func (rep SessionRepository) ListClassSessions(ctx context.Context, classId uint64) (sessions []Session, err error) {
+	rows := make([]dbSession, 0)
+	qry := `SELECT * FROM sessions WHERE class_window_id = ? AND status = ? ORDER BY id ASC`
+
+	if err = rep.db.SelectContext(ctx, &rows, qry, classId, SessionActive); err != nil {
+		return
+	}
+
+	for _, row := range rows {
+		var session Session
+
+		if session, err = rep.hydrate(ctx, row); err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return
+}
+
+func (rep SessionRepository) ListActiveSessions(ctx context.Context) (sessions []Session, err error) {
+	rows := make([]dbSession, 0)
+	qry := `SELECT * FROM sessions WHERE status = ? ORDER BY id ASC`
+
+	if err = rep.db.SelectContext(ctx, &rows, qry, SessionActive); err != nil {
+		return
+	}
+
+	for _, row := range rows {
+		var session Session
+
+		if session, err = rep.hydrate(ctx, row); err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return
+}
+
+// ListActiveLabSessions returns the active sessions on the lab.
+func (rep SessionRepository) ListActiveLabSessions(ctx context.Context, labId uint64) (sessions []Session, err error) {
+	rows := make([]dbSession, 0)
+	qry := `SELECT * FROM sessions WHERE lab_id = ? AND status = ? ORDER BY id ASC`
+
+	if err = rep.db.SelectContext(ctx, &rows, qry, labId, SessionActive); err != nil {
+		return
+	}
+
+	for _, row := range rows {
+		var session Session
+
+		if session, err = rep.hydrate(ctx, row); err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return
+}
+
+// ListLiveLabSessions returns the sessions on the lab that are active or
+// still provisioning.
+func (rep SessionRepository) ListLiveLabSessions(ctx context.Context, labId uint64) (sessions []Session, err error) {
+	rows := make([]dbSession, 0)
+	qry := `SELECT * FROM sessions WHERE lab_id = ? AND status IN (?, ?) ORDER BY id ASC`
+
+	if err = rep.db.SelectContext(ctx, &rows, qry, labId, SessionActive, SessionProvisioning); err != nil {
+		return
+	}
+
+	for _, row := range rows {
+		var session Session
+
+		if session, err = rep.hydrate(ctx, row); err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return
 }
 
-func (rep SessionRepository) CreateSession(ctx context.Context, user User, lab Lab) (Session, error) {
-	tx, err := rep.db.Beginx()
+// ReserveSession takes a slot on the lab for the user with a session in the
+// provisioning state. The lab row is locked so that concurrent reservations
+// cannot exceed MaxSessions, and users waiting in the lab's queue ahead of
+// this one keep their turn, as do reservations in progress whose user has not
+// shown up yet. ErrLabFull is returned when there is no slot for the user and
+// ErrLabUnavailable when the lab is not active; a waiting queue entry and a
+// reservation in progress of the user are honored by the session otherwise.
+// When the user already has an active or provisioning session on the lab,
+// e.g. from a concurrent request, it is returned instead and reserved is
+// false. With a maxUserSessions limit the user row is locked as well, and
+// ErrSessionLimit is returned when the user already has that many sessions
+// in progress on any lab.
+func (rep SessionRepository) ReserveSession(ctx context.Context, user User, lab Lab, maxUserSessions *int) (session Session, reserved bool, err error) {
+	tx, err := rep.db.BeginTxx(ctx, nil)
+
+	if err != nil {
+		return Session{}, false, err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// The user row is locked before the lab row, so that reservations of
+	// the user on different labs are counted one after the other.
+	if maxUserSessions != nil {
+		var userId uint64
+		qry := `SELECT id FROM users WHERE id = ? FOR UPDATE`
+		if err = tx.GetContext(ctx, &userId, qry, user.ID); err != nil {
+			return Session{}, false, err
+		}
+	}
+
+	var locked struct {
+		MaxSessions int      `db:"max_sessions"`
+		State       LabState `db:"state"`
+	}
+	qry := `SELECT max_sessions, state FROM labs WHERE id = ? AND deleted_at IS NULL FOR UPDATE`
+	if err = tx.GetContext(ctx, &locked, qry, lab.ID); err != nil {
+		return Session{}, false, err
+	}
+
+	if locked.State != LabActive {
+		return Session{}, false, ErrLabUnavailable
+	}
+
+	var existing dbSession
+	qry = `SELECT * FROM sessions
+		WHERE user_id = ? AND lab_id = ? AND (status = ? OR (status = ? AND created_at > ?))
+		ORDER BY id DESC LIMIT 1`
+	err = tx.GetContext(ctx, &existing, qry, user.ID, lab.ID, SessionActive, SessionProvisioning, time.Now().Add(-provisioningTTL))
+
+	switch {
+	case err == nil:
+		if err = tx.Commit(); err != nil {
+			return Session{}, false, err
+		}
+
+		session, err = rep.hydrate(ctx, existing)
+
+		return session, false, err
+	case !errors.Is(err, sql.ErrNoRows):
+		return Session{}, false, err
+	}
+
+	if maxUserSessions != nil {
+		var running int
+		qry = `SELECT COUNT(*) FROM sessions WHERE user_id = ? AND status IN (?, ?)`
+		if err = tx.GetContext(ctx, &running, qry, user.ID, SessionActive, SessionProvisioning); err != nil {
+			return Session{}, false, err
+		}
+
+		if running >= *maxUserSessions {
+			return Session{}, false, ErrSessionLimit
+		}
+	}
+
+	maxSessions := locked.MaxSessions
+
+	var used int
+	qry = `SELECT COUNT(*) FROM sessions
+		WHERE lab_id = ? AND (status = ? OR (status = ? AND created_at > ?))`
+	if err = tx.GetContext(ctx, &used, qry, lab.ID, SessionActive, SessionProvisioning, time.Now().Add(-provisioningTTL)); err != nil {
+		return Session{}, false, err
+	}
+
+	if maxSessions < 1 {
+		maxSessions = 1
+	}
+
+	if used >= maxSessions {
+		return Session{}, false, ErrLabFull
+	}
+
+	// Reservations in progress hold their slot until their user shows up,
+	// unless the user is already on the lab.
+	var reservations []Reservation
+	qry = `SELECT * FROM reservations
+		WHERE lab_id = ? AND status = ? AND starts_at <= NOW() AND ends_at > NOW()
+			AND NOT EXISTS (SELECT 1 FROM sessions WHERE sessions.user_id = reservations.user_id
+				AND sessions.lab_id = reservations.lab_id AND sessions.status = ?)`
+	if err = tx.SelectContext(ctx, &reservations, qry, lab.ID, ReservationBooked, SessionActive); err != nil {
+		return Session{}, false, err
+	}
+
+	held := len(reservations)
+	var reservation *Reservation
+
+	for i := range reservations {
+		if reservations[i].UserID == user.ID {
+			reservation = &reservations[i]
+			held--
+			break
+		}
+	}
+
+	var waiting []QueueEntry
+	qry = `SELECT * FROM queue_entries WHERE lab_id = ? AND status = ? ORDER BY priority DESC, id ASC`
+	if err = tx.SelectContext(ctx, &waiting, qry, lab.ID, QueueWaiting); err != nil {
+		return Session{}, false, err
+	}
+
+	position := len(waiting)
+	var entry *QueueEntry
+
+	for i := range waiting {
+		if waiting[i].UserID == user.ID {
+			position, entry = i, &waiting[i]
+			break
+		}
+	}
+
+	// Only as many users as there are free slots may go ahead of the queue;
+	// users with a reservation take their slot whatever the queue.
+	if free := maxSessions - used - held; reservation == nil && position >= free {
+		return Session{}, false, ErrLabFull
+	}
 
-	qry := `INSERT INTO sessions (user_id, lab_id) VALUES (?, ?)`
-	qry = tx.Rebind(qry)
+	qry = `INSERT INTO sessions (user_id, lab_id, status) VALUES (?, ?, ?)`
+	res, err := tx.ExecContext(ctx, qry, user.ID, lab.ID, SessionProvisioning)
 
-	res, err := tx.ExecContext(ctx, qry, user.ID, lab.ID)
+	if err != nil {
+		return Session{}, false, err
+	}
+
+	id, err := res.LastInsertId()
 
 	if err != nil {
+		return Session{}, false, err
+	}
+
+	if entry != nil {
+		qry = `UPDATE queue_entries SET status = ?, session_id = ?, admitted_at = NOW() WHERE id = ?`
+		if _, err = tx.ExecContext(ctx, qry, QueueAdmitted, id, entry.ID); err != nil {
+			return Session{}, false, err
+		}
+	}
+
+	if reservation != nil {
+		qry = `UPDATE reservations SET status = ?, session_id = ?, updated_at = NOW() WHERE id = ?`
+		if _, err = tx.ExecContext(ctx, qry, ReservationHonored, id, reservation.ID); err != nil {
+			return Session{}, false, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Session{}, false, err
+	}
+
+	session, err = rep.GetSessionById(ctx, uint64(id))
+
+	return session, err == nil, err
+}
+
+// ActivateSession marks a reserved session as provisioned. The session
+// belongs to the course of its lab and expires after the maximum duration
+// of the lab, or else of the course, when there is one.
+func (rep SessionRepository) ActivateSession(ctx context.Context, id uint64) (Session, error) {
+	qry := `UPDATE sessions
+		JOIN labs ON labs.id = sessions.lab_id
+		LEFT JOIN courses ON courses.id = labs.course_id
+		SET sessions.status = ?, sessions.course_id = labs.course_id,
+			sessions.expires_at = NOW() + INTERVAL COALESCE(labs.max_session_minutes, courses.max_session_minutes) MINUTE
+		WHERE sessions.id = ? AND sessions.status = ?`
+	if _, err := rep.db.ExecContext(ctx, qry, SessionActive, id, SessionProvisioning); err != nil {
 		return Session{}, err
 	}
 
-	id, err := res.LastInsertId()
+	return rep.GetSessionById(ctx, id)
+}
+
+// FailSession records that provisioning a reserved session did not succeed,
+// keeping the output collected from the instance for troubleshooting, and
+// frees its slot.
+func (rep SessionRepository) FailSession(ctx context.Context, id uint64, diagnostics string) error {
+	qry := `UPDATE sessions SET status = ?, ended_at = NOW(), diagnostics = ? WHERE id = ? AND status = ?`
+	_, err := rep.db.ExecContext(ctx, qry, SessionFailed, diagnostics, id, SessionProvisioning)
+
+	return err
+}
+
+func (rep SessionRepository) EndSession(ctx context.Context, id uint64, reason EndReason) error {
+	qry := `UPDATE sessions SET status = ?, ended_at = NOW(), end_reason = ? WHERE id = ? AND status = ?`
+	_, err := rep.db.ExecContext(ctx, qry, SessionEnded, reason, id, SessionActive)
 
+	return err
+}
+
+// MarkIdle records that the session has no DCV connection, keeping the
+// time it was first seen without one. Sessions provisioned ahead of a class
+// are not idle before idle_after.
+func (rep SessionRepository) MarkIdle(ctx context.Context, id uint64) error {
+	qry := `UPDATE sessions SET idle_since = COALESCE(idle_since, GREATEST(NOW(), COALESCE(idle_after, NOW())))
+		WHERE id = ? AND status = ?`
+	_, err := rep.db.ExecContext(ctx, qry, id, SessionActive)
+
+	return err
+}
+
+func (rep SessionRepository) MarkIdleWarned(ctx context.Context, id uint64) error {
+	qry := `UPDATE sessions SET idle_warned_at = NOW() WHERE id = ?`
+	_, err := rep.db.ExecContext(ctx, qry, id)
+
+	return err
+}
+
+// ClearIdle records that the session has a DCV connection again.
+func (rep SessionRepository) ClearIdle(ctx context.Context, id uint64) error {
+	qry := `UPDATE sessions SET idle_since = NULL, idle_warned_at = NULL WHERE id = ?`
+	_, err := rep.db.ExecContext(ctx, qry, id)
+
+	return err
+}
+
+// AttachClass ties a session provisioned ahead of a class to it: the session
+// is not idle before the class starts and expires when it ends.
+func (rep SessionRepository) AttachClass(ctx context.Context, id uint64, class ClassWindow) error {
+	qry := `UPDATE sessions SET class_window_id = ?, idle_after = ?, expires_at = ?, expiry_warning = NULL WHERE id = ?`
+	_, err := rep.db.ExecContext(ctx, qry, class.ID, class.StartsAt, class.EndsAt, id)
+
+	return err
+}
+
+// BindAccount records that the session runs under a warm account of its lab.
+func (rep SessionRepository) BindAccount(ctx context.Context, id uint64, account string) error {
+	qry := `UPDATE sessions SET account = ? WHERE id = ?`
+	_, err := rep.db.ExecContext(ctx, qry, account, id)
+
+	return err
+}
+
+// BindBrokerSession records the id of the DCV session the broker created for
+// the session.
+func (rep SessionRepository) BindBrokerSession(ctx context.Context, id uint64, brokerId string) error {
+	qry := `UPDATE sessions SET broker_session_id = ? WHERE id = ?`
+	_, err := rep.db.ExecContext(ctx, qry, brokerId, id)
+
+	return err
+}
+
+// MarkExpiryWarned records the threshold, in seconds before expiry, of the
+// last warning sent for the session.
+func (rep SessionRepository) MarkExpiryWarned(ctx context.Context, id uint64, threshold int) error {
+	qry := `UPDATE sessions SET expiry_warning = ? WHERE id = ?`
+	_, err := rep.db.ExecContext(ctx, qry, threshold, id)
+
+	return err
+}
+
+func (rep SessionRepository) hydrate(ctx context.Context, dbSes dbSession) (Session, error) {
+	user, err := rep.userRep.GetUserById(ctx, dbSes.UserID)
 	if err != nil {
 		return Session{}, err
 	}
 
-	err = tx.Commit()
+	lab, err := rep.labRep.GetLabById(ctx, dbSes.LabID)
 	if err != nil {
 		return Session{}, err
 	}
 
-	return rep.GetSessionById(ctx, uint64(id))
+	return Session{
+		ID:            dbSes.ID,
+		User:          user,
+		Lab:           lab,
+		Status:        dbSes.Status,
+		CreatedAt:     dbSes.CreatedAt,
+		EndedAt:       dbSes.EndedAt,
+		EndReason:     dbSes.EndReason,
+		Diagnostics:   dbSes.Diagnostics,
+		IdleSince:     dbSes.IdleSince,
+		IdleWarned:    dbSes.IdleWarned,
+		CourseID:      dbSes.CourseID,
+		ExpiresAt:     dbSes.ExpiresAt,
+		ExpiryWarn:    dbSes.ExpiryWarn,
+		ClassWindowID: dbSes.ClassWindowID,
+		IdleAfter:     dbSes.IdleAfter,
+		Account:       dbSes.Account,
+		BrokerID:      dbSes.BrokerID,
+	}, nil
 }
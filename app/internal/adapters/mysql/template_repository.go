@@ -0,0 +1,59 @@
+package mysql
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type ProvisioningTemplate struct {
+	ID        uint64    `db:"id" json:"id"`
+	Name      string    `db:"name" json:"name"`
+	Version   int       `db:"version" json:"version"`
+	Body      string    `db:"body" json:"body"`
+	CreatedBy *uint64   `db:"created_by" json:"created_by"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+type TemplateRepository struct {
+	db *sqlx.DB
+}
+
+func NewTemplateRepository(db *sqlx.DB) *TemplateRepository {
+	return &TemplateRepository{db: db}
+}
+
+func (rep TemplateRepository) ListTemplates(ctx context.Context) (result []ProvisioningTemplate, err error) {
+	qry := `SELECT * FROM provisioning_templates ORDER BY name ASC, version ASC`
+	err = rep.db.SelectContext(ctx, &result, qry)
+
+	return
+}
+
+// GetTemplate returns the given version of a template, or the latest one
+// when version is zero.
+func (rep TemplateRepository) GetTemplate(ctx context.Context, name string, version int) (t ProvisioningTemplate, err error) {
+	qry := `SELECT * FROM provisioning_templates WHERE name = ? ORDER BY version DESC LIMIT 1`
+	args := []interface{}{name}
+
+	if version != 0 {
+		qry = `SELECT * FROM provisioning_templates WHERE name = ? AND version = ?`
+		args = append(args, version)
+	}
+
+	row := rep.db.QueryRowxContext(ctx, qry, args...)
+	err = row.StructScan(&t)
+
+	return
+}
+
+func (rep TemplateRepository) CreateTemplate(ctx context.Context, name string, version int, body string, createdBy uint64) (ProvisioningTemplate, error) {
+	qry := `INSERT INTO provisioning_templates (name, version, body, created_by) VALUES (?, ?, ?, ?)`
+
+	if _, err := rep.db.ExecContext(ctx, qry, name, version, body, createdBy); err != nil {
+		return ProvisioningTemplate{}, err
+	}
+
+	return rep.GetTemplate(ctx, name, version)
+}
@@ -2,6 +2,7 @@ package mysql
 
 import (
 	"context"
+	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -53,6 +54,31 @@ func (rep UserRepository) GetUserById(ctx context.Context, id uint64) (user User
 	return
 }
 
+// CreateUser stores a new user. The username is used verbatim as the OS
+// account on the labs, so callers must validate it first.
+func (rep UserRepository) CreateUser(ctx context.Context, user User, password string) (User, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+
+	if err != nil {
+		return User{}, err
+	}
+
+	qry := `INSERT INTO users (uuid, name, email, type, username, password) VALUES (?, ?, ?, ?, ?, ?)`
+	res, err := rep.db.ExecContext(ctx, qry, uuid.New().String(), user.Name, user.Email, user.Type, user.UserName, hashedPassword)
+
+	if err != nil {
+		return User{}, err
+	}
+
+	id, err := res.LastInsertId()
+
+	if err != nil {
+		return User{}, err
+	}
+
+	return rep.GetUserById(ctx, uint64(id))
+}
+
 func (rep UserRepository) CheckUserPassword(ctx context.Context, email string, password string) (err error) {
 	var hashedPassword string
 	qry := `SELECT password FROM users WHERE email = ?`
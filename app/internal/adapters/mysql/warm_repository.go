@@ -0,0 +1,192 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type WarmStatus string
+
+// Warm accounts are created, wait ready until a session claims them, and are
+// retired when the pool of their lab shrinks or their creation failed.
+// Claimed accounts belong to their session and are torn down with it.
+const (
+	WarmCreating WarmStatus = "creating"
+	WarmReady    WarmStatus = "ready"
+	WarmClaimed  WarmStatus = "claimed"
+	WarmRetiring WarmStatus = "retiring"
+)
+
+// WarmAccount is a generic account with its DCV session created on a lab
+// ahead of time, so that connecting does not wait for provisioning.
+type WarmAccount struct {
+	ID        uint64     `db:"id" json:"id"`
+	LabID     uint64     `db:"lab_id" json:"lab_id"`
+	Account   string     `db:"account" json:"account"`
+	Status    WarmStatus `db:"status" json:"status"`
+	SessionID *uint64    `db:"session_id" json:"session_id"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+	ReadyAt   *time.Time `db:"ready_at" json:"ready_at"`
+	ClaimedAt *time.Time `db:"claimed_at" json:"claimed_at"`
+}
+
+// WarmCounts is the number of warm accounts of a lab by status.
+type WarmCounts struct {
+	LabID    uint64 `db:"lab_id" json:"lab_id"`
+	Creating int    `db:"creating" json:"creating"`
+	Ready    int    `db:"ready" json:"ready"`
+	Claimed  int    `db:"claimed" json:"claimed"`
+	Retiring int    `db:"retiring" json:"retiring"`
+}
+
+type WarmRepository struct {
+	db *sqlx.DB
+}
+
+func NewWarmRepository(db *sqlx.DB) *WarmRepository {
+	return &WarmRepository{db: db}
+}
+
+// CreateAccount records an account about to be created on the lab.
+func (rep WarmRepository) CreateAccount(ctx context.Context, labId uint64, account string) (WarmAccount, error) {
+	qry := `INSERT INTO warm_accounts (lab_id, account, status) VALUES (?, ?, ?)`
+	res, err := rep.db.ExecContext(ctx, qry, labId, account, WarmCreating)
+
+	if err != nil {
+		return WarmAccount{}, err
+	}
+
+	id, err := res.LastInsertId()
+
+	if err != nil {
+		return WarmAccount{}, err
+	}
+
+	return rep.GetAccountById(ctx, uint64(id))
+}
+
+func (rep WarmRepository) GetAccountById(ctx context.Context, id uint64) (account WarmAccount, err error) {
+	qry := `SELECT * FROM warm_accounts WHERE id = ?`
+	err = rep.db.QueryRowxContext(ctx, qry, id).StructScan(&account)
+
+	return
+}
+
+// SetReady makes a created account available to sessions.
+func (rep WarmRepository) SetReady(ctx context.Context, id uint64) error {
+	qry := `UPDATE warm_accounts SET status = ?, ready_at = NOW() WHERE id = ? AND status = ?`
+	_, err := rep.db.ExecContext(ctx, qry, WarmReady, id, WarmCreating)
+
+	return err
+}
+
+// Claim hands the oldest ready account of the lab to the session. The
+// update picks and takes the account at once, so two sessions never get the
+// same one; sql.ErrNoRows is returned when none is ready.
+func (rep WarmRepository) Claim(ctx context.Context, labId uint64, sessionId uint64) (WarmAccount, error) {
+	qry := `UPDATE warm_accounts SET status = ?, session_id = ?, claimed_at = NOW()
+		WHERE lab_id = ? AND status = ? ORDER BY id ASC LIMIT 1`
+	res, err := rep.db.ExecContext(ctx, qry, WarmClaimed, sessionId, labId, WarmReady)
+
+	if err != nil {
+		return WarmAccount{}, err
+	}
+
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return WarmAccount{}, err
+	}
+
+	var account WarmAccount
+	qry = `SELECT * FROM warm_accounts WHERE session_id = ? AND status = ?`
+	err = rep.db.QueryRowxContext(ctx, qry, sessionId, WarmClaimed).StructScan(&account)
+
+	return account, err
+}
+
+// Retire marks the account for teardown.
+func (rep WarmRepository) Retire(ctx context.Context, id uint64) error {
+	qry := `UPDATE warm_accounts SET status = ? WHERE id = ? AND status IN (?, ?, ?)`
+	_, err := rep.db.ExecContext(ctx, qry, WarmRetiring, id, WarmCreating, WarmReady, WarmClaimed)
+
+	return err
+}
+
+// RetireReady marks up to count ready accounts of the lab for teardown,
+// newest first, and returns how many were.
+func (rep WarmRepository) RetireReady(ctx context.Context, labId uint64, count int) (int64, error) {
+	qry := `UPDATE warm_accounts SET status = ? WHERE lab_id = ? AND status = ? ORDER BY id DESC LIMIT ?`
+	res, err := rep.db.ExecContext(ctx, qry, WarmRetiring, labId, WarmReady, count)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// RetireStale marks for teardown the accounts still being created since
+// before, e.g. after a crash.
+func (rep WarmRepository) RetireStale(ctx context.Context, before time.Time) (int64, error) {
+	qry := `UPDATE warm_accounts SET status = ? WHERE status = ? AND created_at < ?`
+	res, err := rep.db.ExecContext(ctx, qry, WarmRetiring, WarmCreating, before)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// DeleteAccount forgets an account once it was torn down.
+func (rep WarmRepository) DeleteAccount(ctx context.Context, id uint64) error {
+	qry := `DELETE FROM warm_accounts WHERE id = ?`
+	_, err := rep.db.ExecContext(ctx, qry, id)
+
+	return err
+}
+
+// ListRetiring returns the accounts waiting for teardown.
+func (rep WarmRepository) ListRetiring(ctx context.Context) (result []WarmAccount, err error) {
+	qry := `SELECT * FROM warm_accounts WHERE status = ? ORDER BY id ASC`
+	err = rep.db.SelectContext(ctx, &result, qry, WarmRetiring)
+
+	return
+}
+
+// ListHeldAccounts returns the names of the accounts of the lab that no
+// session has claimed.
+func (rep WarmRepository) ListHeldAccounts(ctx context.Context, labId uint64) (result []string, err error) {
+	qry := `SELECT account FROM warm_accounts WHERE lab_id = ? AND status IN (?, ?, ?) ORDER BY id ASC`
+	err = rep.db.SelectContext(ctx, &result, qry, labId, WarmCreating, WarmReady, WarmRetiring)
+
+	return
+}
+
+// PruneClaimed forgets the accounts of sessions that are over, which their
+// teardown removed from the lab.
+func (rep WarmRepository) PruneClaimed(ctx context.Context) error {
+	qry := `DELETE w FROM warm_accounts w JOIN sessions s ON s.id = w.session_id
+		WHERE w.status = ? AND s.status IN (?, ?)`
+	_, err := rep.db.ExecContext(ctx, qry, WarmClaimed, SessionEnded, SessionFailed)
+
+	return err
+}
+
+// ListCounts returns the number of accounts of every lab that has any.
+func (rep WarmRepository) ListCounts(ctx context.Context) (result []WarmCounts, err error) {
+	qry := `SELECT lab_id,
+			COALESCE(SUM(status = ?), 0) AS creating,
+			COALESCE(SUM(status = ?), 0) AS ready,
+			COALESCE(SUM(status = ?), 0) AS claimed,
+			COALESCE(SUM(status = ?), 0) AS retiring
+		FROM warm_accounts GROUP BY lab_id ORDER BY lab_id ASC`
+	err = rep.db.SelectContext(ctx, &result, qry, WarmCreating, WarmReady, WarmClaimed, WarmRetiring)
+
+	return
+}
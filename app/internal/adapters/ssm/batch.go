@@ -0,0 +1,214 @@
+package ssm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsssm "github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// BatchResult is the outcome of a batched command on one of its instances.
+// Err is set as Wait would return it for that instance alone.
+type BatchResult struct {
+	Result
+	Err error
+}
+
+// maxBatchInstances is the most instances SendCommand takes at once.
+const maxBatchInstances = 50
+
+// RunBatch sends the same commands to every instance, in one SendCommand
+// per maxBatchInstances of them, letting SSM run them on at most the
+// configured number of instances at a time and stop once too many of them
+// failed. Instances not managed by SSM are reported with ErrInvalidInstance
+// and those whose agent is not online with ErrUndeliverable, without
+// sending them the command. The status of all invocations is polled with
+// one call per round and the output of each instance is fetched once it is
+// done. Instances SSM did not run the command on, e.g. once MaxErrors was
+// reached, are reported with ErrCancelled. Instances whose invocation does
+// not show up are waited for until ctx is done. An error is only returned
+// when a command could not be sent or polled.
+func (e *Executor) RunBatch(ctx context.Context, instanceIDs []string, document string, commands []string) (map[string]BatchResult, error) {
+	results := make(map[string]BatchResult, len(instanceIDs))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+
+	for start := 0; start < len(instanceIDs); start += maxBatchInstances {
+		end := start + maxBatchInstances
+		if end > len(instanceIDs) {
+			end = len(instanceIDs)
+		}
+
+		wg.Add(1)
+
+		go func(chunk []string) {
+			defer wg.Done()
+
+			chunkResults, err := e.runChunk(ctx, chunk, document, commands)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			for id, res := range chunkResults {
+				results[id] = res
+			}
+
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}(instanceIDs[start:end])
+	}
+
+	wg.Wait()
+
+	return results, firstErr
+}
+
+func (e *Executor) runChunk(ctx context.Context, instanceIDs []string, document string, commands []string) (map[string]BatchResult, error) {
+	results := make(map[string]BatchResult, len(instanceIDs))
+
+	online, err := e.onlineInstances(ctx, instanceIDs, results)
+
+	if err != nil || len(online) == 0 {
+		return results, err
+	}
+
+	commandID, err := e.send(ctx, online, document, commands, e.maxConcurrency, e.maxErrors)
+
+	// An instance deregistered since it was found online.
+	if errors.Is(err, ErrInvalidInstance) {
+		for _, id := range online {
+			results[id] = BatchResult{Result: Result{InstanceID: id}, Err: err}
+		}
+
+		return results, nil
+	}
+
+	if err != nil {
+		return results, err
+	}
+
+	pending := make(map[string]bool, len(online))
+	for _, id := range online {
+		pending[id] = true
+	}
+
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if err := e.sleep(ctx, attempt); err != nil {
+			return results, err
+		}
+
+		statuses, err := e.invocationStatuses(ctx, commandID)
+
+		if isThrottled(err) {
+			continue
+		}
+
+		if err != nil {
+			return results, err
+		}
+
+		for id := range pending {
+			status, ok := statuses[id]
+
+			if !ok || isPending(status) {
+				continue
+			}
+
+			res, err := e.Wait(ctx, commandID, id)
+
+			if ctx.Err() != nil {
+				return results, ctx.Err()
+			}
+
+			results[id] = BatchResult{Result: res, Err: err}
+			delete(pending, id)
+		}
+	}
+
+	return results, nil
+}
+
+// onlineInstances returns the instances whose agent is online. The others
+// are reported in results.
+func (e *Executor) onlineInstances(ctx context.Context, instanceIDs []string, results map[string]BatchResult) ([]string, error) {
+	statuses := make(map[string]types.PingStatus, len(instanceIDs))
+	params := &awsssm.DescribeInstanceInformationInput{
+		Filters: []types.InstanceInformationStringFilter{
+			{Key: aws.String("InstanceIds"), Values: instanceIDs},
+		},
+	}
+
+	for attempt := 0; ; attempt++ {
+		out, err := e.client.DescribeInstanceInformation(ctx, params)
+
+		if isThrottled(err) && attempt+1 < maxSendAttempts {
+			if err := e.sleep(ctx, attempt); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, info := range out.InstanceInformationList {
+			statuses[aws.ToString(info.InstanceId)] = info.PingStatus
+		}
+
+		if aws.ToString(out.NextToken) == "" {
+			break
+		}
+
+		params.NextToken = out.NextToken
+	}
+
+	var online []string
+
+	for _, id := range instanceIDs {
+		status, ok := statuses[id]
+
+		switch {
+		case !ok:
+			results[id] = BatchResult{Result: Result{InstanceID: id}, Err: fmt.Errorf("%w: %s", ErrInvalidInstance, id)}
+		case status != types.PingStatusOnline:
+			results[id] = BatchResult{Result: Result{InstanceID: id}, Err: fmt.Errorf("%w: agent of %s is %s", ErrUndeliverable, id, status)}
+		default:
+			online = append(online, id)
+		}
+	}
+
+	return online, nil
+}
+
+func (e *Executor) invocationStatuses(ctx context.Context, commandID string) (map[string]types.CommandInvocationStatus, error) {
+	statuses := make(map[string]types.CommandInvocationStatus)
+	params := &awsssm.ListCommandInvocationsInput{
+		CommandId: aws.String(commandID),
+	}
+
+	for {
+		out, err := e.client.ListCommandInvocations(ctx, params)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, invocation := range out.CommandInvocations {
+			statuses[aws.ToString(invocation.InstanceId)] = invocation.Status
+		}
+
+		if aws.ToString(out.NextToken) == "" {
+			return statuses, nil
+		}
+
+		params.NextToken = out.NextToken
+	}
+}
@@ -0,0 +1,345 @@
+package ssm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	awsssm "github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+)
+
+const (
+	ShellDocument      = "AWS-RunShellScript"
+	PowerShellDocument = "AWS-RunPowerShellScript"
+)
+
+// stdoutLimit and stderrLimit are the number of characters
+// GetCommandInvocation returns of each stream; anything beyond them is only
+// available in S3.
+const (
+	stdoutLimit = 24000
+	stderrLimit = 8000
+)
+
+// maxSendAttempts bounds the retries of a throttled SendCommand.
+const maxSendAttempts = 5
+
+var (
+	ErrInvalidInstance = errors.New("instance is not managed by ssm")
+	ErrUndeliverable   = errors.New("command undeliverable")
+	ErrCancelled       = errors.New("command cancelled")
+	ErrTimedOut        = errors.New("command timed out")
+)
+
+// Client is the part of the SSM API used by the Executor.
+type Client interface {
+	SendCommand(ctx context.Context, params *awsssm.SendCommandInput, optFns ...func(*awsssm.Options)) (*awsssm.SendCommandOutput, error)
+	GetCommandInvocation(ctx context.Context, params *awsssm.GetCommandInvocationInput, optFns ...func(*awsssm.Options)) (*awsssm.GetCommandInvocationOutput, error)
+	ListCommandInvocations(ctx context.Context, params *awsssm.ListCommandInvocationsInput, optFns ...func(*awsssm.Options)) (*awsssm.ListCommandInvocationsOutput, error)
+	DescribeInstanceInformation(ctx context.Context, params *awsssm.DescribeInstanceInformationInput, optFns ...func(*awsssm.Options)) (*awsssm.DescribeInstanceInformationOutput, error)
+}
+
+// ObjectStore is the part of the S3 API used to read full command output.
+type ObjectStore interface {
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+type Result struct {
+	CommandID     string
+	InstanceID    string
+	Status        types.CommandInvocationStatus
+	StatusDetails string
+	Stdout        string
+	Stderr        string
+	ExitCode      int
+	// Truncated is set when the output was cut by SSM and could not be
+	// read back in full from S3.
+	Truncated bool
+}
+
+// Backoff computes jittered exponential delays between polls and retries.
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+var DefaultBackoff = Backoff{Base: 100 * time.Millisecond, Max: 5 * time.Second}
+
+var (
+	jitterMu sync.Mutex
+	jitter   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Delay returns a random duration between half and all of the exponential
+// delay for the attempt, capped at Max.
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := b.Max
+	if attempt < 30 && b.Base<<attempt < b.Max {
+		d = b.Base << attempt
+	}
+
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+
+	return d/2 + time.Duration(jitter.Int63n(int64(d/2)+1))
+}
+
+// Executor sends commands through SSM Run Command and waits for them to
+// finish. When an output bucket is configured SSM also writes the complete
+// output there and it is read back whenever the inline output is truncated.
+type Executor struct {
+	client           Client
+	objects          ObjectStore
+	bucket           string
+	prefix           string
+	executionTimeout time.Duration
+	maxConcurrency   string
+	maxErrors        string
+	backoff          Backoff
+}
+
+func NewExecutor(client Client, objects ObjectStore, cfg config.SSMConfig) *Executor {
+	return &Executor{
+		client:           client,
+		objects:          objects,
+		bucket:           cfg.OutputS3BucketName,
+		prefix:           strings.Trim(cfg.OutputS3KeyPrefix, "/"),
+		executionTimeout: cfg.ExecutionTimeout,
+		maxConcurrency:   cfg.BatchMaxConcurrency,
+		maxErrors:        cfg.BatchMaxErrors,
+		backoff:          DefaultBackoff,
+	}
+}
+
+// Run sends the commands to the instance and waits for their result. A
+// command that ran and exited non-zero is not an error.
+func (e *Executor) Run(ctx context.Context, instanceID string, document string, commands []string) (Result, error) {
+	commandID, err := e.Send(ctx, []string{instanceID}, document, commands)
+
+	if err != nil {
+		return Result{}, err
+	}
+
+	return e.Wait(ctx, commandID, instanceID)
+}
+
+// Send starts the commands on the instances and returns the command id,
+// retrying while SSM throttles the request.
+func (e *Executor) Send(ctx context.Context, instanceIDs []string, document string, commands []string) (string, error) {
+	return e.send(ctx, instanceIDs, document, commands, "", "")
+}
+
+func (e *Executor) send(ctx context.Context, instanceIDs []string, document string, commands []string, maxConcurrency string, maxErrors string) (string, error) {
+	params := &awsssm.SendCommandInput{
+		DocumentName: aws.String(document),
+		InstanceIds:  instanceIDs,
+		Parameters: map[string][]string{
+			"commands": commands,
+		},
+	}
+
+	if maxConcurrency != "" {
+		params.MaxConcurrency = aws.String(maxConcurrency)
+	}
+
+	if maxErrors != "" {
+		params.MaxErrors = aws.String(maxErrors)
+	}
+
+	if e.executionTimeout > 0 {
+		params.Parameters["executionTimeout"] = []string{strconv.Itoa(int(e.executionTimeout.Seconds()))}
+	}
+
+	if e.outputToS3() {
+		params.OutputS3BucketName = aws.String(e.bucket)
+		params.OutputS3KeyPrefix = aws.String(e.prefix)
+	}
+
+	for attempt := 0; ; attempt++ {
+		out, err := e.client.SendCommand(ctx, params)
+
+		var invalidInstance *types.InvalidInstanceId
+		switch {
+		case err == nil:
+			return aws.ToString(out.Command.CommandId), nil
+		case errors.As(err, &invalidInstance):
+			return "", fmt.Errorf("%w: %v", ErrInvalidInstance, err)
+		case !isThrottled(err) || attempt+1 >= maxSendAttempts:
+			return "", err
+		}
+
+		if err := e.sleep(ctx, attempt); err != nil {
+			return "", err
+		}
+	}
+}
+
+// Wait polls the invocation of the command on the instance until it reaches
+// a terminal status. Invocations that are not visible yet and throttled
+// polls are retried until ctx is done.
+func (e *Executor) Wait(ctx context.Context, commandID string, instanceID string) (Result, error) {
+	params := &awsssm.GetCommandInvocationInput{
+		CommandId:  aws.String(commandID),
+		InstanceId: aws.String(instanceID),
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := e.sleep(ctx, attempt); err != nil {
+			return Result{}, err
+		}
+
+		out, err := e.client.GetCommandInvocation(ctx, params)
+
+		var notYet *types.InvocationDoesNotExist
+		switch {
+		case errors.As(err, &notYet) || isThrottled(err):
+			continue
+		case err != nil:
+			return Result{}, err
+		case isPending(out.Status):
+			continue
+		}
+
+		return e.result(ctx, commandID, instanceID, out)
+	}
+}
+
+func (e *Executor) result(ctx context.Context, commandID string, instanceID string, out *awsssm.GetCommandInvocationOutput) (Result, error) {
+	res := Result{
+		CommandID:     commandID,
+		InstanceID:    instanceID,
+		Status:        out.Status,
+		StatusDetails: aws.ToString(out.StatusDetails),
+		Stdout:        aws.ToString(out.StandardOutputContent),
+		Stderr:        aws.ToString(out.StandardErrorContent),
+		ExitCode:      int(out.ResponseCode),
+	}
+
+	if len(res.Stdout) >= stdoutLimit || len(res.Stderr) >= stderrLimit {
+		res.Truncated = true
+
+		if e.outputToS3() {
+			if err := e.readOutput(ctx, &res); err != nil {
+				res.Stderr = fmt.Sprintf("%s\nreading full output from s3: %v", res.Stderr, err)
+			}
+		}
+	}
+
+	switch {
+	case res.StatusDetails == "Undeliverable" || res.StatusDetails == "Terminated" || res.StatusDetails == "DeliveryTimedOut":
+		return res, fmt.Errorf("%w: %s on %s (%s)", ErrUndeliverable, commandID, instanceID, res.StatusDetails)
+	case res.Status == types.CommandInvocationStatusCancelled:
+		return res, fmt.Errorf("%w: %s on %s", ErrCancelled, commandID, instanceID)
+	case res.Status == types.CommandInvocationStatusTimedOut:
+		return res, fmt.Errorf("%w: %s on %s (%s)", ErrTimedOut, commandID, instanceID, res.StatusDetails)
+	case res.Status == types.CommandInvocationStatusSuccess || res.Status == types.CommandInvocationStatusFailed:
+		return res, nil
+	}
+
+	return res, fmt.Errorf("command %s on %s ended with status %s (%s)", commandID, instanceID, res.Status, res.StatusDetails)
+}
+
+// readOutput replaces the inline output with the complete one SSM wrote to
+// <prefix>/<command id>/<instance id>/<plugin>/stdout and stderr.
+func (e *Executor) readOutput(ctx context.Context, res *Result) error {
+	prefix := fmt.Sprintf("%s/%s/%s/", e.prefix, res.CommandID, res.InstanceID)
+	if e.prefix == "" {
+		prefix = fmt.Sprintf("%s/%s/", res.CommandID, res.InstanceID)
+	}
+
+	list, err := e.objects.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(e.bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	var stdout, stderr strings.Builder
+
+	for _, object := range list.Contents {
+		key := aws.ToString(object.Key)
+
+		switch {
+		case strings.HasSuffix(key, "/stdout"):
+			err = e.readObject(ctx, key, &stdout)
+		case strings.HasSuffix(key, "/stderr"):
+			err = e.readObject(ctx, key, &stderr)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if stdout.Len() > 0 {
+		res.Stdout = stdout.String()
+	}
+
+	if stderr.Len() > 0 {
+		res.Stderr = stderr.String()
+	}
+
+	res.Truncated = false
+
+	return nil
+}
+
+func (e *Executor) readObject(ctx context.Context, key string, w io.Writer) error {
+	obj, err := e.objects.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(e.bucket),
+		Key:    aws.String(key),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	defer obj.Body.Close()
+
+	_, err = io.Copy(w, obj.Body)
+
+	return err
+}
+
+func (e *Executor) outputToS3() bool {
+	return e.bucket != "" && e.objects != nil
+}
+
+func (e *Executor) sleep(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(e.backoff.Delay(attempt))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func isPending(status types.CommandInvocationStatus) bool {
+	return status == types.CommandInvocationStatusPending ||
+		status == types.CommandInvocationStatusInProgress ||
+		status == types.CommandInvocationStatusDelayed ||
+		status == types.CommandInvocationStatusCancelling
+}
+
+func isThrottled(err error) bool {
+	var apiErr smithy.APIError
+
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "ThrottlingException"
+}
@@ -0,0 +1,46 @@
+package ssm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsssm "github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// InventoryClient is the part of the SSM API used by the Inventory.
+type InventoryClient interface {
+	DescribeInstanceInformation(ctx context.Context, params *awsssm.DescribeInstanceInformationInput, optFns ...func(*awsssm.Options)) (*awsssm.DescribeInstanceInformationOutput, error)
+}
+
+// Inventory reads the instances registered with SSM.
+type Inventory struct {
+	client InventoryClient
+}
+
+func NewInventory(client InventoryClient) *Inventory {
+	return &Inventory{client: client}
+}
+
+// PingStatus returns whether the agent of a managed instance is online.
+// ErrInvalidInstance is returned when the instance is not managed by SSM.
+func (inv *Inventory) PingStatus(ctx context.Context, instanceID string) (types.PingStatus, error) {
+	out, err := inv.client.DescribeInstanceInformation(ctx, &awsssm.DescribeInstanceInformationInput{
+		Filters: []types.InstanceInformationStringFilter{
+			{Key: aws.String("InstanceIds"), Values: []string{instanceID}},
+		},
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, info := range out.InstanceInformationList {
+		if aws.ToString(info.InstanceId) == instanceID {
+			return info.PingStatus, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrInvalidInstance, instanceID)
+}
@@ -0,0 +1,169 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrForbidden is returned when the pipeline refuses the token of the agent,
+// e.g. after another agent enrolled for its lab.
+var ErrForbidden = errors.New("agent token refused")
+
+// ErrJobGone is returned when reporting a job the pipeline no longer waits
+// for.
+var ErrJobGone = errors.New("job is gone")
+
+// Job is a script the pipeline asks the agent to run, with its timeout in
+// seconds.
+type Job struct {
+	UUID    string `json:"uuid"`
+	Family  string `json:"family"`
+	Script  string `json:"script"`
+	Timeout int    `json:"timeout"`
+}
+
+// Result is what a job printed and exited with. Error is set when the job
+// could not be run at all.
+type Result struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	Error    string
+}
+
+// Client talks to the agent endpoints of the pipeline.
+type Client struct {
+	baseUrl string
+	token   string
+	http    *http.Client
+}
+
+// NewClient returns a client for the pipeline at baseUrl, authenticating
+// with the agent token once it is set.
+func NewClient(baseUrl string, token string) *Client {
+	return &Client{
+		baseUrl: strings.TrimSuffix(baseUrl, "/"),
+		token:   token,
+		http:    &http.Client{},
+	}
+}
+
+// Enroll exchanges the enrollment token for an agent token, which the
+// client uses from then on, and returns it with the id of the lab.
+func (c *Client) Enroll(ctx context.Context, enrollmentToken string, hostname string, version string) (token string, labId uint64, err error) {
+	form := url.Values{"token": {enrollmentToken}, "hostname": {hostname}, "version": {version}}
+
+	var res struct {
+		Token string `json:"token"`
+		LabID uint64 `json:"lab_id"`
+	}
+
+	if err = c.do(ctx, http.MethodPost, "/agent/enroll", form, 0, &res); err != nil {
+		return "", 0, err
+	}
+
+	c.token = res.Token
+
+	return res.Token, res.LabID, nil
+}
+
+// Heartbeat tells the pipeline that the agent is online.
+func (c *Client) Heartbeat(ctx context.Context, hostname string, version string) error {
+	form := url.Values{"hostname": {hostname}, "version": {version}}
+
+	return c.do(ctx, http.MethodPost, "/agent/heartbeat", form, 0, nil)
+}
+
+// Poll waits up to wait for a job and returns nil when none came.
+func (c *Client) Poll(ctx context.Context, wait time.Duration) (*Job, error) {
+	var job Job
+
+	path := "/agent/jobs?wait=" + url.QueryEscape(wait.String())
+
+	if err := c.do(ctx, http.MethodGet, path, nil, wait+10*time.Second, &job); err != nil {
+		return nil, err
+	}
+
+	if job.UUID == "" {
+		return nil, nil
+	}
+
+	return &job, nil
+}
+
+// Report sends the result of the job.
+func (c *Client) Report(ctx context.Context, id string, result Result) error {
+	form := url.Values{
+		"exit_code": {strconv.Itoa(result.ExitCode)},
+		"stdout":    {result.Stdout},
+		"stderr":    {result.Stderr},
+		"error":     {result.Error},
+	}
+
+	return c.do(ctx, http.MethodPost, "/agent/jobs/"+url.PathEscape(id)+"/result", form, 0, nil)
+}
+
+// do sends the request and decodes the JSON response into out, if any.
+// Requests time out after 30 seconds unless timeout is set.
+func (c *Client) do(ctx context.Context, method string, path string, form url.Values, timeout time.Duration, out interface{}) error {
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var body io.Reader
+
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseUrl+path, body)
+
+	if err != nil {
+		return err
+	}
+
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.http.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusForbidden:
+		return ErrForbidden
+	case res.StatusCode == http.StatusGone:
+		return ErrJobGone
+	case res.StatusCode == http.StatusNoContent:
+		return nil
+	case res.StatusCode >= 300:
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, res.Status, strings.TrimSpace(string(msg)))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
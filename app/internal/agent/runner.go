@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/danutavadanei/nice-lab-go/internal/provision"
+)
+
+// Runner runs jobs on the server of the agent, which runs as a privileged
+// user. Scripts are sent on stdin to a shell on Linux and to PowerShell on
+// Windows, as the SSH backend does.
+type Runner struct {
+	maxOutput int
+}
+
+func NewRunner(maxOutput int) *Runner {
+	return &Runner{maxOutput: maxOutput}
+}
+
+// Run runs the job until it exits or its timeout passes. Output past the
+// limit of the runner is dropped.
+func (r *Runner) Run(ctx context.Context, job Job) Result {
+	if job.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(job.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	var cmd *exec.Cmd
+
+	switch provision.OSFamily(job.Family) {
+	case provision.Windows:
+		cmd = exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", "-")
+	case provision.Linux:
+		cmd = exec.CommandContext(ctx, "sh", "-s")
+	default:
+		return Result{ExitCode: -1, Error: "unknown os family " + job.Family}
+	}
+
+	stdout := &limitedBuffer{limit: r.maxOutput}
+	stderr := &limitedBuffer{limit: r.maxOutput}
+
+	cmd.Stdin = strings.NewReader(job.Script)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	result := Result{Stdout: stdout.String(), Stderr: stderr.String()}
+
+	var exitErr *exec.ExitError
+
+	switch {
+	case ctx.Err() != nil:
+		result.ExitCode = -1
+		result.Error = "job timed out"
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitCode()
+	case err != nil:
+		result.ExitCode = -1
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// limitedBuffer keeps the first limit bytes written to it. The buffer is
+// not embedded, so that io.Copy cannot bypass the limit with ReadFrom.
+type limitedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room < len(p) {
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
@@ -0,0 +1,96 @@
+package calendar
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+)
+
+// Event is a VEVENT of an iCalendar feed.
+type Event struct {
+	UID         string
+	Start       time.Time
+	End         time.Time
+	Stamp       time.Time
+	Summary     string
+	Description string
+	Location    string
+	Cancelled   bool
+}
+
+// Calendar is an iCalendar (RFC 5545) feed that calendar clients can
+// subscribe to.
+type Calendar struct {
+	Name   string
+	Events []Event
+}
+
+const (
+	stampLayout = "20060102T150405Z"
+	lineLength  = 75
+)
+
+var escaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// Write writes the feed with CRLF line endings and long lines folded.
+func (c Calendar) Write(w io.Writer) error {
+	out := bufio.NewWriter(w)
+
+	line := func(name string, value string) {
+		writeFolded(out, name+":"+value)
+	}
+
+	line("BEGIN", "VCALENDAR")
+	line("VERSION", "2.0")
+	line("PRODID", "-//nice-lab//reservations//EN")
+	line("CALSCALE", "GREGORIAN")
+	line("METHOD", "PUBLISH")
+	if c.Name != "" {
+		line("X-WR-CALNAME", escaper.Replace(c.Name))
+	}
+
+	for _, event := range c.Events {
+		line("BEGIN", "VEVENT")
+		line("UID", event.UID)
+		line("DTSTAMP", event.Stamp.UTC().Format(stampLayout))
+		line("DTSTART", event.Start.UTC().Format(stampLayout))
+		line("DTEND", event.End.UTC().Format(stampLayout))
+		line("SUMMARY", escaper.Replace(event.Summary))
+		if event.Description != "" {
+			line("DESCRIPTION", escaper.Replace(event.Description))
+		}
+		if event.Location != "" {
+			line("LOCATION", escaper.Replace(event.Location))
+		}
+		if event.Cancelled {
+			line("STATUS", "CANCELLED")
+		} else {
+			line("STATUS", "CONFIRMED")
+		}
+		line("END", "VEVENT")
+	}
+
+	line("END", "VCALENDAR")
+
+	return out.Flush()
+}
+
+// writeFolded splits content lines longer than 75 octets, continuing them
+// on lines starting with a space, without cutting UTF-8 sequences.
+func writeFolded(out *bufio.Writer, content string) {
+	limit := lineLength
+
+	for len(content) > limit {
+		cut := limit
+		for cut > 0 && content[cut]&0xC0 == 0x80 {
+			cut--
+		}
+
+		_, _ = out.WriteString(content[:cut] + "\r\n ")
+		content = content[cut:]
+		limit = lineLength - 1
+	}
+
+	_, _ = out.WriteString(content + "\r\n")
+}
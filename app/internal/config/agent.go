@@ -0,0 +1,65 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"time"
+)
+
+// AgentConfig controls how the pipeline hands jobs to lab agents. Agents
+// not seen for OfflineAfter are offline; PollWait bounds their long polls
+// and must stay below the write timeout of the HTTP server.
+type AgentConfig struct {
+	OfflineAfter  time.Duration
+	JobTimeout    time.Duration
+	JobRetention  time.Duration
+	EnrollmentTTL time.Duration
+	PollWait      time.Duration
+	PollInterval  time.Duration
+}
+
+func NewAgentConfig(v *viper.Viper) AgentConfig {
+	v.SetDefault("AGENT_OFFLINE_AFTER", "90s")
+	v.SetDefault("AGENT_JOB_TIMEOUT", "10m")
+	v.SetDefault("AGENT_JOB_RETENTION", "24h")
+	v.SetDefault("AGENT_ENROLLMENT_TTL", "24h")
+	v.SetDefault("AGENT_POLL_WAIT", "20s")
+
+	return AgentConfig{
+		OfflineAfter:  v.GetDuration("AGENT_OFFLINE_AFTER"),
+		JobTimeout:    v.GetDuration("AGENT_JOB_TIMEOUT"),
+		JobRetention:  v.GetDuration("AGENT_JOB_RETENTION"),
+		EnrollmentTTL: v.GetDuration("AGENT_ENROLLMENT_TTL"),
+		PollWait:      v.GetDuration("AGENT_POLL_WAIT"),
+		PollInterval:  time.Second,
+	}
+}
+
+// LabAgentConfig configures the lab agent. The enrollment token is only used
+// on the first start; the agent token it is exchanged for is kept at
+// StatePath.
+type LabAgentConfig struct {
+	PipelineUrl       string
+	EnrollmentToken   string
+	StatePath         string
+	HeartbeatInterval time.Duration
+	PollWait          time.Duration
+	MaxOutput         int
+}
+
+func NewLabAgentConfig(v *viper.Viper) LabAgentConfig {
+	v.SetDefault("AGENT_PIPELINE_URL", "http://localhost:8080/v1/pipeline")
+	v.SetDefault("AGENT_ENROLLMENT_TOKEN", "")
+	v.SetDefault("AGENT_STATE_PATH", "/var/lib/nice-lab-agent/state.json")
+	v.SetDefault("AGENT_HEARTBEAT_INTERVAL", "30s")
+	v.SetDefault("AGENT_POLL_WAIT", "20s")
+	v.SetDefault("AGENT_MAX_OUTPUT", 1024*1024)
+
+	return LabAgentConfig{
+		PipelineUrl:       v.GetString("AGENT_PIPELINE_URL"),
+		EnrollmentToken:   v.GetString("AGENT_ENROLLMENT_TOKEN"),
+		StatePath:         v.GetString("AGENT_STATE_PATH"),
+		HeartbeatInterval: v.GetDuration("AGENT_HEARTBEAT_INTERVAL"),
+		PollWait:          v.GetDuration("AGENT_POLL_WAIT"),
+		MaxOutput:         v.GetInt("AGENT_MAX_OUTPUT"),
+	}
+}
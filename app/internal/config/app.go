@@ -7,17 +7,53 @@ import (
 )
 
 type AppConfig struct {
-	AWSConfig        *aws.Config
-	HTTPServerConfig HTTPServerConfig
-	MySQLConfig      mysql.Config
-	GatewayConfig    GatewayConfig
+	AWSConfig          *aws.Config
+	HTTPServerConfig   HTTPServerConfig
+	MySQLConfig        mysql.Config
+	GatewayConfig      GatewayConfig
+	ProvisioningConfig ProvisioningConfig
+	SSHConfig          SSHConfig
+	SSMConfig          SSMConfig
+	SchedulerConfig    SchedulerConfig
+	DiscoveryConfig    DiscoveryConfig
+	PowerConfig        PowerConfig
+	FleetConfig        FleetConfig
+	HealthConfig       HealthConfig
+	DrainConfig        DrainConfig
+	ReaperConfig       ReaperConfig
+	LimitsConfig       LimitsConfig
+	QuotaConfig        QuotaConfig
+	ReservationConfig  ReservationConfig
+	ClassConfig        ClassConfig
+	ReconcileConfig    ReconcileConfig
+	WarmConfig         WarmConfig
+	AgentConfig        AgentConfig
+	BrokerConfig       BrokerConfig
 }
 
 func NewAppConfig(v *viper.Viper) AppConfig {
 	return AppConfig{
-		AWSConfig:        NewAWSConfig(v),
-		HTTPServerConfig: NewHTTPServerConfig(v),
-		MySQLConfig:      NewMySQLConfig(v),
-		GatewayConfig:    NewGatewayConfig(v),
+		AWSConfig:          NewAWSConfig(v),
+		HTTPServerConfig:   NewHTTPServerConfig(v),
+		MySQLConfig:        NewMySQLConfig(v),
+		GatewayConfig:      NewGatewayConfig(v),
+		ProvisioningConfig: NewProvisioningConfig(v),
+		SSHConfig:          NewSSHConfig(v),
+		SSMConfig:          NewSSMConfig(v),
+		SchedulerConfig:    NewSchedulerConfig(v),
+		DiscoveryConfig:    NewDiscoveryConfig(v),
+		PowerConfig:        NewPowerConfig(v),
+		FleetConfig:        NewFleetConfig(v),
+		HealthConfig:       NewHealthConfig(v),
+		DrainConfig:        NewDrainConfig(v),
+		ReaperConfig:       NewReaperConfig(v),
+		LimitsConfig:       NewLimitsConfig(v),
+		QuotaConfig:        NewQuotaConfig(v),
+		ReservationConfig:  NewReservationConfig(v),
+		ClassConfig:        NewClassConfig(v),
+		ReconcileConfig:    NewReconcileConfig(v),
+		WarmConfig:         NewWarmConfig(v),
+		AgentConfig:        NewAgentConfig(v),
+		BrokerConfig:       NewBrokerConfig(v),
 	}
 }
@@ -13,9 +13,9 @@ func NewAWSConfig(v *viper.Viper) *aws.Config {
 	v.SetDefault("AWS_ACCESS_KEY_ID", "key")
 	v.SetDefault("AWS_SECRET_ACCESS_KEY", "secret")
 	v.SetDefault("AWS_S3_DEFAULT_BUCKET", "default-bucket")
+	v.SetDefault("AWS_ENDPOINT", "")
 
-	cfg, err := config.LoadDefaultConfig(
-		context.TODO(),
+	opts := []func(*config.LoadOptions) error{
 		config.WithCredentialsProvider(
 			credentials.NewStaticCredentialsProvider(
 				v.GetString("AWS_ACCESS_KEY_ID"),
@@ -24,7 +24,18 @@ func NewAWSConfig(v *viper.Viper) *aws.Config {
 			),
 		),
 		config.WithRegion(v.GetString("AWS_REGION")),
-	)
+	}
+
+	// AWS_ENDPOINT sends every service to a single endpoint, e.g. LocalStack.
+	if endpoint := v.GetString("AWS_ENDPOINT"); endpoint != "" {
+		opts = append(opts, config.WithEndpointResolverWithOptions(
+			aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+				return aws.Endpoint{URL: endpoint, SigningRegion: region, HostnameImmutable: true}, nil
+			}),
+		))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
 
 	if err != nil {
 		panic(err)
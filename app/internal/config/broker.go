@@ -0,0 +1,40 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"time"
+)
+
+// BrokerConfig configures the DCV Session Manager broker of broker labs. The
+// backend is enabled when a broker URL is set.
+type BrokerConfig struct {
+	Url                string
+	AuthUrl            string
+	ClientID           string
+	ClientSecret       string
+	InsecureSkipVerify bool
+	RequestTimeout     time.Duration
+	CreateTimeout      time.Duration
+	PollInterval       time.Duration
+}
+
+func NewBrokerConfig(v *viper.Viper) BrokerConfig {
+	v.SetDefault("BROKER_URL", "")
+	v.SetDefault("BROKER_AUTH_URL", "")
+	v.SetDefault("BROKER_CLIENT_ID", "")
+	v.SetDefault("BROKER_CLIENT_SECRET", "")
+	v.SetDefault("BROKER_INSECURE_SKIP_VERIFY", false)
+	v.SetDefault("BROKER_CREATE_TIMEOUT", "5m")
+	v.SetDefault("BROKER_POLL_INTERVAL", "5s")
+
+	return BrokerConfig{
+		Url:                v.GetString("BROKER_URL"),
+		AuthUrl:            v.GetString("BROKER_AUTH_URL"),
+		ClientID:           v.GetString("BROKER_CLIENT_ID"),
+		ClientSecret:       v.GetString("BROKER_CLIENT_SECRET"),
+		InsecureSkipVerify: v.GetBool("BROKER_INSECURE_SKIP_VERIFY"),
+		RequestTimeout:     time.Second * 30,
+		CreateTimeout:      v.GetDuration("BROKER_CREATE_TIMEOUT"),
+		PollInterval:       v.GetDuration("BROKER_POLL_INTERVAL"),
+	}
+}
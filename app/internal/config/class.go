@@ -0,0 +1,24 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"time"
+)
+
+type ClassConfig struct {
+	Interval    time.Duration
+	WarmupLead  time.Duration
+	Concurrency int
+}
+
+func NewClassConfig(v *viper.Viper) ClassConfig {
+	v.SetDefault("CLASS_INTERVAL", "30s")
+	v.SetDefault("CLASS_WARMUP_LEAD", "15m")
+	v.SetDefault("CLASS_CONCURRENCY", 8)
+
+	return ClassConfig{
+		Interval:    v.GetDuration("CLASS_INTERVAL"),
+		WarmupLead:  v.GetDuration("CLASS_WARMUP_LEAD"),
+		Concurrency: v.GetInt("CLASS_CONCURRENCY"),
+	}
+}
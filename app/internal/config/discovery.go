@@ -0,0 +1,21 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"time"
+)
+
+type DiscoveryConfig struct {
+	TagKey   string
+	Interval time.Duration
+}
+
+func NewDiscoveryConfig(v *viper.Viper) DiscoveryConfig {
+	v.SetDefault("DISCOVERY_TAG_KEY", "nicelab:lab-type")
+	v.SetDefault("DISCOVERY_INTERVAL", "0")
+
+	return DiscoveryConfig{
+		TagKey:   v.GetString("DISCOVERY_TAG_KEY"),
+		Interval: v.GetDuration("DISCOVERY_INTERVAL"),
+	}
+}
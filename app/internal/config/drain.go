@@ -0,0 +1,24 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"time"
+)
+
+type DrainConfig struct {
+	DefaultTimeout time.Duration
+	CheckInterval  time.Duration
+	Message        string
+}
+
+func NewDrainConfig(v *viper.Viper) DrainConfig {
+	v.SetDefault("DRAIN_DEFAULT_TIMEOUT", "30m")
+	v.SetDefault("DRAIN_CHECK_INTERVAL", "30s")
+	v.SetDefault("DRAIN_MESSAGE", "This lab is going into maintenance. Please save your work and disconnect.")
+
+	return DrainConfig{
+		DefaultTimeout: v.GetDuration("DRAIN_DEFAULT_TIMEOUT"),
+		CheckInterval:  v.GetDuration("DRAIN_CHECK_INTERVAL"),
+		Message:        v.GetString("DRAIN_MESSAGE"),
+	}
+}
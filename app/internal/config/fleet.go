@@ -0,0 +1,30 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"time"
+)
+
+type FleetConfig struct {
+	TemplatesDir string
+	StackPrefix  string
+	KeyName      string
+	VpcID        string
+	SubnetID     string
+	Interval     time.Duration
+}
+
+func NewFleetConfig(v *viper.Viper) FleetConfig {
+	v.SetDefault("FLEET_TEMPLATES_DIR", "/cf")
+	v.SetDefault("FLEET_STACK_PREFIX", "nicelab")
+	v.SetDefault("FLEET_INTERVAL", "1m")
+
+	return FleetConfig{
+		TemplatesDir: v.GetString("FLEET_TEMPLATES_DIR"),
+		StackPrefix:  v.GetString("FLEET_STACK_PREFIX"),
+		KeyName:      v.GetString("FLEET_KEY_NAME"),
+		VpcID:        v.GetString("FLEET_VPC_ID"),
+		SubnetID:     v.GetString("FLEET_SUBNET_ID"),
+		Interval:     v.GetDuration("FLEET_INTERVAL"),
+	}
+}
@@ -0,0 +1,30 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"time"
+)
+
+type HealthConfig struct {
+	CheckInterval    time.Duration
+	DCVPort          int
+	ProbeTimeout     time.Duration
+	FailureThreshold int
+	HistoryRetention time.Duration
+}
+
+func NewHealthConfig(v *viper.Viper) HealthConfig {
+	v.SetDefault("HEALTH_CHECK_INTERVAL", "1m")
+	v.SetDefault("HEALTH_DCV_PORT", 8443)
+	v.SetDefault("HEALTH_PROBE_TIMEOUT", "5s")
+	v.SetDefault("HEALTH_FAILURE_THRESHOLD", 2)
+	v.SetDefault("HEALTH_HISTORY_RETENTION", "168h")
+
+	return HealthConfig{
+		CheckInterval:    v.GetDuration("HEALTH_CHECK_INTERVAL"),
+		DCVPort:          v.GetInt("HEALTH_DCV_PORT"),
+		ProbeTimeout:     v.GetDuration("HEALTH_PROBE_TIMEOUT"),
+		FailureThreshold: v.GetInt("HEALTH_FAILURE_THRESHOLD"),
+		HistoryRetention: v.GetDuration("HEALTH_HISTORY_RETENTION"),
+	}
+}
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"sort"
+	"strings"
+	"time"
+)
+
+type LimitsConfig struct {
+	CheckInterval  time.Duration
+	WarnThresholds []time.Duration
+	ExtensionQuota time.Duration
+}
+
+// NewLimitsConfig reads SESSION_WARN_THRESHOLDS as comma separated
+// durations; entries that do not parse are ignored.
+func NewLimitsConfig(v *viper.Viper) LimitsConfig {
+	v.SetDefault("SESSION_LIMIT_INTERVAL", "30s")
+	v.SetDefault("SESSION_WARN_THRESHOLDS", "15m,5m,1m")
+	v.SetDefault("SESSION_EXTENSION_QUOTA", "30m")
+
+	var thresholds []time.Duration
+	for _, value := range strings.Split(v.GetString("SESSION_WARN_THRESHOLDS"), ",") {
+		if threshold, err := time.ParseDuration(strings.TrimSpace(value)); err == nil && threshold > 0 {
+			thresholds = append(thresholds, threshold)
+		}
+	}
+
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i] > thresholds[j] })
+
+	return LimitsConfig{
+		CheckInterval:  v.GetDuration("SESSION_LIMIT_INTERVAL"),
+		WarnThresholds: thresholds,
+		ExtensionQuota: v.GetDuration("SESSION_EXTENSION_QUOTA"),
+	}
+}
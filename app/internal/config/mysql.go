@@ -19,5 +19,6 @@ func NewMySQLConfig(v *viper.Viper) mysql.Config {
 		Addr:                 v.GetString("MYSQL_ADDR"),
 		DBName:               v.GetString("MYSQL_DATABASE"),
 		AllowNativePasswords: true,
+		ParseTime:            true,
 	}
 }
@@ -0,0 +1,24 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"time"
+)
+
+type PowerConfig struct {
+	StartOnDemand bool
+	IdleStopAfter time.Duration
+	CheckInterval time.Duration
+}
+
+func NewPowerConfig(v *viper.Viper) PowerConfig {
+	v.SetDefault("POWER_START_ON_DEMAND", false)
+	v.SetDefault("POWER_IDLE_STOP_AFTER", "0")
+	v.SetDefault("POWER_CHECK_INTERVAL", "1m")
+
+	return PowerConfig{
+		StartOnDemand: v.GetBool("POWER_START_ON_DEMAND"),
+		IdleStopAfter: v.GetDuration("POWER_IDLE_STOP_AFTER"),
+		CheckInterval: v.GetDuration("POWER_CHECK_INTERVAL"),
+	}
+}
@@ -0,0 +1,17 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+)
+
+type ProvisioningConfig struct {
+	TemplatesDir string
+}
+
+func NewProvisioningConfig(v *viper.Viper) ProvisioningConfig {
+	v.SetDefault("PROVISIONING_TEMPLATES_DIR", "")
+
+	return ProvisioningConfig{
+		TemplatesDir: v.GetString("PROVISIONING_TEMPLATES_DIR"),
+	}
+}
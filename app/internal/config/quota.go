@@ -0,0 +1,21 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+)
+
+// QuotaConfig holds the default limits of students; zero disables a limit.
+type QuotaConfig struct {
+	MaxConcurrentSessions int
+	WeeklyHours           int
+}
+
+func NewQuotaConfig(v *viper.Viper) QuotaConfig {
+	v.SetDefault("QUOTA_MAX_CONCURRENT_SESSIONS", 1)
+	v.SetDefault("QUOTA_WEEKLY_HOURS", 0)
+
+	return QuotaConfig{
+		MaxConcurrentSessions: v.GetInt("QUOTA_MAX_CONCURRENT_SESSIONS"),
+		WeeklyHours:           v.GetInt("QUOTA_WEEKLY_HOURS"),
+	}
+}
@@ -0,0 +1,27 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"time"
+)
+
+type ReaperConfig struct {
+	Interval    time.Duration
+	IdleTimeout time.Duration
+	WarnBefore  time.Duration
+	WarnMessage string
+}
+
+func NewReaperConfig(v *viper.Viper) ReaperConfig {
+	v.SetDefault("REAPER_INTERVAL", "1m")
+	v.SetDefault("REAPER_IDLE_TIMEOUT", "30m")
+	v.SetDefault("REAPER_WARN_BEFORE", "5m")
+	v.SetDefault("REAPER_WARN_MESSAGE", "This session has no connection and will be closed soon. Reconnect to keep it.")
+
+	return ReaperConfig{
+		Interval:    v.GetDuration("REAPER_INTERVAL"),
+		IdleTimeout: v.GetDuration("REAPER_IDLE_TIMEOUT"),
+		WarnBefore:  v.GetDuration("REAPER_WARN_BEFORE"),
+		WarnMessage: v.GetString("REAPER_WARN_MESSAGE"),
+	}
+}
@@ -0,0 +1,26 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"time"
+)
+
+// ReconcileConfig controls the reconciler. Without Repair it only reports
+// drift, as a dry run.
+type ReconcileConfig struct {
+	Interval    time.Duration
+	Repair      bool
+	Concurrency int
+}
+
+func NewReconcileConfig(v *viper.Viper) ReconcileConfig {
+	v.SetDefault("RECONCILE_INTERVAL", "15m")
+	v.SetDefault("RECONCILE_REPAIR", false)
+	v.SetDefault("RECONCILE_CONCURRENCY", 4)
+
+	return ReconcileConfig{
+		Interval:    v.GetDuration("RECONCILE_INTERVAL"),
+		Repair:      v.GetBool("RECONCILE_REPAIR"),
+		Concurrency: v.GetInt("RECONCILE_CONCURRENCY"),
+	}
+}
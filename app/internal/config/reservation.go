@@ -0,0 +1,27 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"time"
+)
+
+type ReservationConfig struct {
+	Interval    time.Duration
+	NoShowGrace time.Duration
+	MaxDuration time.Duration
+	MaxAdvance  time.Duration
+}
+
+func NewReservationConfig(v *viper.Viper) ReservationConfig {
+	v.SetDefault("RESERVATION_INTERVAL", "1m")
+	v.SetDefault("RESERVATION_NO_SHOW_GRACE", "10m")
+	v.SetDefault("RESERVATION_MAX_DURATION", "4h")
+	v.SetDefault("RESERVATION_MAX_ADVANCE", "720h")
+
+	return ReservationConfig{
+		Interval:    v.GetDuration("RESERVATION_INTERVAL"),
+		NoShowGrace: v.GetDuration("RESERVATION_NO_SHOW_GRACE"),
+		MaxDuration: v.GetDuration("RESERVATION_MAX_DURATION"),
+		MaxAdvance:  v.GetDuration("RESERVATION_MAX_ADVANCE"),
+	}
+}
@@ -0,0 +1,18 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"time"
+)
+
+type SchedulerConfig struct {
+	QueueDispatchInterval time.Duration
+}
+
+func NewSchedulerConfig(v *viper.Viper) SchedulerConfig {
+	v.SetDefault("QUEUE_DISPATCH_INTERVAL", "15s")
+
+	return SchedulerConfig{
+		QueueDispatchInterval: v.GetDuration("QUEUE_DISPATCH_INTERVAL"),
+	}
+}
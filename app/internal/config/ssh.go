@@ -0,0 +1,32 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"time"
+)
+
+type SSHConfig struct {
+	User                  string
+	Port                  int
+	PrivateKeyPath        string
+	KnownHostsPath        string
+	InsecureIgnoreHostKey bool
+	DialTimeout           time.Duration
+}
+
+func NewSSHConfig(v *viper.Viper) SSHConfig {
+	v.SetDefault("SSH_USER", "nicelab")
+	v.SetDefault("SSH_PORT", 22)
+	v.SetDefault("SSH_PRIVATE_KEY_PATH", "")
+	v.SetDefault("SSH_KNOWN_HOSTS_PATH", "/etc/ssh/ssh_known_hosts")
+	v.SetDefault("SSH_INSECURE_IGNORE_HOST_KEY", false)
+
+	return SSHConfig{
+		User:                  v.GetString("SSH_USER"),
+		Port:                  v.GetInt("SSH_PORT"),
+		PrivateKeyPath:        v.GetString("SSH_PRIVATE_KEY_PATH"),
+		KnownHostsPath:        v.GetString("SSH_KNOWN_HOSTS_PATH"),
+		InsecureIgnoreHostKey: v.GetBool("SSH_INSECURE_IGNORE_HOST_KEY"),
+		DialTimeout:           time.Second * 10,
+	}
+}
@@ -0,0 +1,32 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"time"
+)
+
+type SSMConfig struct {
+	OutputS3BucketName string
+	OutputS3KeyPrefix  string
+	ExecutionTimeout   time.Duration
+
+	BatchMaxConcurrency string
+	BatchMaxErrors      string
+}
+
+func NewSSMConfig(v *viper.Viper) SSMConfig {
+	v.SetDefault("SSM_OUTPUT_S3_BUCKET", "")
+	v.SetDefault("SSM_OUTPUT_S3_PREFIX", "ssm")
+	v.SetDefault("SSM_EXECUTION_TIMEOUT", "10m")
+	v.SetDefault("SSM_BATCH_MAX_CONCURRENCY", "50")
+	v.SetDefault("SSM_BATCH_MAX_ERRORS", "25%")
+
+	return SSMConfig{
+		OutputS3BucketName: v.GetString("SSM_OUTPUT_S3_BUCKET"),
+		OutputS3KeyPrefix:  v.GetString("SSM_OUTPUT_S3_PREFIX"),
+		ExecutionTimeout:   v.GetDuration("SSM_EXECUTION_TIMEOUT"),
+
+		BatchMaxConcurrency: v.GetString("SSM_BATCH_MAX_CONCURRENCY"),
+		BatchMaxErrors:      v.GetString("SSM_BATCH_MAX_ERRORS"),
+	}
+}
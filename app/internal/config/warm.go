@@ -0,0 +1,26 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"time"
+)
+
+// WarmConfig controls the replenishing of the warm pools; their size is set
+// per lab.
+type WarmConfig struct {
+	Interval      time.Duration
+	CreateTimeout time.Duration
+	Concurrency   int
+}
+
+func NewWarmConfig(v *viper.Viper) WarmConfig {
+	v.SetDefault("WARM_INTERVAL", "30s")
+	v.SetDefault("WARM_CREATE_TIMEOUT", "10m")
+	v.SetDefault("WARM_CONCURRENCY", 4)
+
+	return WarmConfig{
+		Interval:      v.GetDuration("WARM_INTERVAL"),
+		CreateTimeout: v.GetDuration("WARM_CREATE_TIMEOUT"),
+		Concurrency:   v.GetInt("WARM_CONCURRENCY"),
+	}
+}
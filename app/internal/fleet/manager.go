@@ -0,0 +1,420 @@
+package fleet
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/cloudformation"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// PoolStatus is the fleet of a pool as seen by the last reconcile.
+type PoolStatus struct {
+	Pool    mysql.LabPool      `json:"pool"`
+	Demand  int                `json:"demand"`
+	Desired int                `json:"desired"`
+	Stacks  []mysql.FleetStack `json:"stacks"`
+}
+
+// Manager scales the labs of the pools that have a fleet by launching and
+// deleting CloudFormation stacks from the lab templates. A pool keeps
+// between its fleet_min and fleet_max stacks, enough for its sessions in
+// progress and waiting users on top of the labs added by hand. Stack
+// outputs are registered as labs of the pool once the stack is created.
+type Manager struct {
+	stacks   *cloudformation.Stacks
+	poolRep  *mysql.PoolRepository
+	fleetRep *mysql.FleetRepository
+	labRep   *mysql.LabRepository
+	cfg      config.FleetConfig
+}
+
+func NewManager(
+	stacks *cloudformation.Stacks,
+	poolRep *mysql.PoolRepository,
+	fleetRep *mysql.FleetRepository,
+	labRep *mysql.LabRepository,
+	cfg config.FleetConfig,
+) *Manager {
+	return &Manager{
+		stacks:   stacks,
+		poolRep:  poolRep,
+		fleetRep: fleetRep,
+		labRep:   labRep,
+		cfg:      cfg,
+	}
+}
+
+// Run reconciles every interval until ctx is done.
+func (m *Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := m.Reconcile(ctx); err != nil {
+				log.Printf("error reconciling fleets:  %v", err)
+			}
+		}
+	}
+}
+
+// Reconcile brings every fleet pool to its desired size. A failing pool
+// does not keep the others from being reconciled.
+func (m *Manager) Reconcile(ctx context.Context) ([]PoolStatus, error) {
+	pools, err := m.poolRep.ListFleetPools(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var result []PoolStatus
+
+	for _, pool := range pools {
+		status, err := m.ReconcilePool(ctx, pool)
+
+		if err != nil {
+			log.Printf("error reconciling fleet of pool %d:  %v", pool.ID, err)
+			continue
+		}
+
+		result = append(result, status)
+	}
+
+	return result, nil
+}
+
+func (m *Manager) ReconcilePool(ctx context.Context, pool mysql.LabPool) (PoolStatus, error) {
+	status := PoolStatus{Pool: pool}
+
+	stacks, err := m.fleetRep.ListStacks(ctx, pool.ID)
+
+	if err != nil {
+		return status, err
+	}
+
+	var live []mysql.FleetStack
+
+	for _, stack := range stacks {
+		stack, err := m.refresh(ctx, pool, stack)
+
+		if err != nil {
+			return status, err
+		}
+
+		if stack.Status != mysql.StackDeleted && !isDeleting(stack) {
+			live = append(live, stack)
+		}
+	}
+
+	loads, err := m.poolRep.ListPoolLoad(ctx, pool.ID)
+
+	if err != nil {
+		return status, err
+	}
+
+	status.Demand, err = m.fleetRep.PoolDemand(ctx, pool.ID)
+
+	if err != nil {
+		return status, err
+	}
+
+	status.Desired = desiredSize(pool, status.Demand, loads)
+
+	for i := len(live); i < status.Desired; i++ {
+		if err := m.launch(ctx, pool); err != nil {
+			return status, err
+		}
+	}
+
+	if len(live) > status.Desired {
+		if err := m.shrink(ctx, live, loads, len(live)-status.Desired); err != nil {
+			return status, err
+		}
+	}
+
+	status.Stacks, err = m.fleetRep.ListStacks(ctx, pool.ID)
+
+	return status, err
+}
+
+// desiredSize is the number of stacks needed for the demand once the labs
+// of the pool that are not part of the fleet are full.
+func desiredSize(pool mysql.LabPool, demand int, loads []mysql.LabLoad) int {
+	for _, load := range loads {
+		if load.Source != mysql.SourceFleet && load.Available && load.State == mysql.LabActive {
+			demand -= capacity(load.MaxSessions)
+		}
+	}
+
+	perLab := capacity(pool.FleetLabMaxSessions)
+	desired := 0
+
+	if demand > 0 {
+		desired = (demand + perLab - 1) / perLab
+	}
+
+	if desired < pool.FleetMin {
+		desired = pool.FleetMin
+	}
+
+	if desired > pool.FleetMax {
+		desired = pool.FleetMax
+	}
+
+	return desired
+}
+
+func capacity(maxSessions int) int {
+	if maxSessions < 1 {
+		return 1
+	}
+
+	return maxSessions
+}
+
+func isDeleting(stack mysql.FleetStack) bool {
+	return stack.Status == string(types.StackStatusDeleteInProgress)
+}
+
+// refresh records the current status of a stack that CloudFormation is
+// working on, registers the lab of a created stack and deletes failed ones.
+func (m *Manager) refresh(ctx context.Context, pool mysql.LabPool, stack mysql.FleetStack) (mysql.FleetStack, error) {
+	if !isInProgress(stack.Status) && !isFailed(stack.Status) {
+		return stack, nil
+	}
+
+	nameOrId := stackRef(stack)
+	current, err := m.stacks.Describe(ctx, nameOrId)
+
+	switch {
+	case errors.Is(err, cloudformation.ErrStackNotFound):
+		stack.Status = mysql.StackDeleted
+	case err != nil:
+		return stack, err
+	default:
+		stack.Status = string(current.Status)
+
+		if current.Reason != "" {
+			stack.StatusReason = &current.Reason
+		}
+	}
+
+	if stack.Status == string(types.StackStatusCreateComplete) && stack.LabID == nil {
+		lab, err := m.register(ctx, pool, current)
+
+		if err != nil {
+			return stack, err
+		}
+
+		stack.LabID = &lab.ID
+		log.Printf("pool %d: stack %s registered as lab %d", pool.ID, stack.StackName, lab.ID)
+	}
+
+	if isFailed(stack.Status) {
+		log.Printf("pool %d: deleting failed stack %s", pool.ID, stack.StackName)
+
+		if err := m.stacks.Delete(ctx, nameOrId); err != nil {
+			return stack, err
+		}
+
+		stack.Status = string(types.StackStatusDeleteInProgress)
+	}
+
+	return stack, m.fleetRep.UpdateStack(ctx, stack)
+}
+
+// stackRef identifies the stack by id, which still works once it is deleted.
+func stackRef(stack mysql.FleetStack) string {
+	if stack.StackID != nil {
+		return *stack.StackID
+	}
+
+	return stack.StackName
+}
+
+func isInProgress(status string) bool {
+	return cloudformation.Stack{Status: types.StackStatus(status)}.InProgress()
+}
+
+func isFailed(status string) bool {
+	return cloudformation.Stack{Status: types.StackStatus(status)}.Failed()
+}
+
+// register adds the instance of a created stack to the pool. Discovery may
+// have found the instance first, in which case its lab is taken over.
+func (m *Manager) register(ctx context.Context, pool mysql.LabPool, stack cloudformation.Stack) (mysql.Lab, error) {
+	instanceId := stack.Outputs["InstanceID"]
+
+	if instanceId == "" {
+		return mysql.Lab{}, fmt.Errorf("stack %s has no InstanceID output", stack.Name)
+	}
+
+	lab, err := m.labRep.GetLabByInstanceId(ctx, instanceId)
+
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return mysql.Lab{}, err
+	}
+
+	lab.Name = stack.Name
+	lab.Type = pool.Type
+	lab.InstanceID = instanceId
+	lab.Available = true
+	lab.Backend = mysql.BackendSSM
+	lab.PoolID = &pool.ID
+	lab.MaxSessions = pool.FleetLabMaxSessions
+	lab.Source = mysql.SourceFleet
+
+	if lab.Hostname == "" {
+		lab.Hostname = stack.Outputs["PublicIP"]
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return m.labRep.CreateLab(ctx, lab)
+	}
+
+	return m.labRep.UpdateLab(ctx, lab)
+}
+
+func (m *Manager) launch(ctx context.Context, pool mysql.LabPool) error {
+	name := fmt.Sprintf("%s-pool%d-%s", m.cfg.StackPrefix, pool.ID, uuid.New().String()[:8])
+
+	body, err := m.template(pool)
+
+	if err != nil {
+		return err
+	}
+
+	volumeSize := ""
+	if pool.FleetVolumeSize > 0 {
+		volumeSize = strconv.Itoa(pool.FleetVolumeSize)
+	}
+
+	parameters, err := templateParameters(body, map[string]string{
+		"ec2Name":      name,
+		"instanceType": pool.FleetInstanceType,
+		"volumeSize":   volumeSize,
+		"ingressIPv4":  pool.FleetIngress,
+		"keyName":      m.cfg.KeyName,
+		"vpcID":        m.cfg.VpcID,
+		"subnetID":     m.cfg.SubnetID,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	tags := map[string]string{
+		"nicelab:pool": strconv.FormatUint(pool.ID, 10),
+	}
+
+	stackId, err := m.stacks.Create(ctx, name, string(body), parameters, tags)
+
+	if err != nil {
+		return fmt.Errorf("creating stack %s: %w", name, err)
+	}
+
+	log.Printf("pool %d: launching stack %s", pool.ID, name)
+
+	return m.fleetRep.CreateStack(ctx, pool.ID, name, stackId, string(types.StackStatusCreateInProgress))
+}
+
+// template reads the template of the pool, by default the one of its lab
+// type.
+func (m *Manager) template(pool mysql.LabPool) ([]byte, error) {
+	name := fmt.Sprintf("%s-nice-dcv.yaml", pool.Type)
+
+	if pool.FleetTemplate != nil {
+		name = *pool.FleetTemplate
+	}
+
+	return os.ReadFile(filepath.Join(m.cfg.TemplatesDir, filepath.Base(name)))
+}
+
+// poolParameters are the template parameters set from the pool, which the
+// template must declare for the pool to get what it asks for.
+var poolParameters = map[string]bool{"instanceType": true, "volumeSize": true, "ingressIPv4": true}
+
+// templateParameters keeps the values of the parameters the template
+// declares; empty values leave the template default. Values of the pool the
+// template does not declare are an error rather than dropped.
+func templateParameters(body []byte, values map[string]string) (map[string]string, error) {
+	var tmpl struct {
+		Parameters map[string]yaml.Node `yaml:"Parameters"`
+	}
+
+	if err := yaml.Unmarshal(body, &tmpl); err != nil {
+		return nil, fmt.Errorf("parsing stack template: %w", err)
+	}
+
+	result := make(map[string]string)
+
+	for key, value := range values {
+		if value == "" {
+			continue
+		}
+
+		if _, ok := tmpl.Parameters[key]; ok {
+			result[key] = value
+		} else if poolParameters[key] {
+			return nil, fmt.Errorf("stack template does not declare parameter %s", key)
+		}
+	}
+
+	return result, nil
+}
+
+// shrink deletes up to count stacks whose lab has no session in progress,
+// nobody waiting and no reservation in progress. Stacks that are still being
+// created are kept.
+func (m *Manager) shrink(ctx context.Context, stacks []mysql.FleetStack, loads []mysql.LabLoad, count int) error {
+	idle := make(map[uint64]bool)
+
+	for _, load := range loads {
+		if load.ActiveSessions == 0 && load.Waiting == 0 && load.Reserved == 0 {
+			idle[load.ID] = true
+		}
+	}
+
+	for i := len(stacks) - 1; i >= 0 && count > 0; i-- {
+		stack := stacks[i]
+
+		if stack.LabID == nil || !idle[*stack.LabID] {
+			continue
+		}
+
+		if err := m.labRep.RetireLab(ctx, *stack.LabID); err != nil {
+			return err
+		}
+
+		log.Printf("pool %d: deleting stack %s of idle lab %d", stack.PoolID, stack.StackName, *stack.LabID)
+
+		if err := m.stacks.Delete(ctx, stackRef(stack)); err != nil {
+			return err
+		}
+
+		stack.Status = string(types.StackStatusDeleteInProgress)
+
+		if err := m.fleetRep.UpdateStack(ctx, stack); err != nil {
+			return err
+		}
+
+		count--
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package fleet
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+func TestTemplateParametersOfLabTemplates(t *testing.T) {
+	for _, name := range []string{"kali-nice-dcv.yaml", "ubuntu-nice-dcv.yaml", "windows-nice-dcv.yaml"} {
+		body, err := os.ReadFile(filepath.Join("..", "..", "..", "cf", name))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parameters, err := templateParameters(body, map[string]string{
+			"ec2Name":      "stack",
+			"instanceType": "t3.large",
+			"volumeSize":   "40",
+			"ingressIPv4":  "10.0.0.0/8",
+			"keyName":      "",
+		})
+
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		if parameters["volumeSize"] != "40" || parameters["instanceType"] != "t3.large" {
+			t.Errorf("%s: parameters = %v, want the pool's", name, parameters)
+		}
+
+		if _, ok := parameters["keyName"]; ok {
+			t.Errorf("%s: empty keyName was passed rather than left to the template", name)
+		}
+	}
+}
+
+func TestTemplateParametersRejectsUndeclaredPoolValue(t *testing.T) {
+	body := []byte("Parameters:\n  instanceType:\n    Type: String\n")
+
+	if _, err := templateParameters(body, map[string]string{"instanceType": "t3.large", "volumeSize": "40"}); err == nil {
+		t.Error("volumeSize was dropped without an error")
+	}
+
+	parameters, err := templateParameters(body, map[string]string{"instanceType": "t3.large", "volumeSize": "", "vpcID": "vpc-1"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parameters) != 1 || parameters["instanceType"] != "t3.large" {
+		t.Errorf("parameters = %v, want only instanceType", parameters)
+	}
+}
+
+func TestShrinkKeepsLabsWithReservationInProgress(t *testing.T) {
+	conn, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	m := &Manager{labRep: mysql.NewLabRepository(sqlx.NewDb(conn, "mysql"))}
+
+	labId := uint64(5)
+	stacks := []mysql.FleetStack{{ID: 1, PoolID: 2, StackName: "nicelab-pool2-a", LabID: &labId}}
+	loads := []mysql.LabLoad{{Lab: mysql.Lab{ID: labId}, Reserved: 1}}
+
+	// The lab would be retired first, which no query is expected for.
+	if err := m.shrink(context.Background(), stacks, loads, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,242 @@
+package inventory
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/ec2"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/provision"
+)
+
+type SyncResult struct {
+	Created []uint64 `json:"created"`
+	Updated []uint64 `json:"updated"`
+	Retired []uint64 `json:"retired"`
+	Skipped []string `json:"skipped"`
+}
+
+// Discovery keeps the labs in sync with the EC2 instances carrying the lab
+// type tag. Instances are added as labs, their hostnames follow the
+// instances, and discovered labs whose instance is terminated or no longer
+// tagged are retired.
+//
+// Besides the lab type tag, "<prefix>backend" and "<prefix>max-sessions"
+// tags are read, where prefix is the lab type tag key up to its last colon,
+// and the Name tag names the lab.
+type Discovery struct {
+	instances *ec2.Instances
+	labRep    *mysql.LabRepository
+	tagKey    string
+	tagPrefix string
+}
+
+func NewDiscovery(instances *ec2.Instances, labRep *mysql.LabRepository, tagKey string) *Discovery {
+	return &Discovery{
+		instances: instances,
+		labRep:    labRep,
+		tagKey:    tagKey,
+		tagPrefix: tagKey[:strings.LastIndex(tagKey, ":")+1],
+	}
+}
+
+// Run syncs every interval until ctx is done.
+func (d *Discovery) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			result, err := d.Sync(ctx)
+
+			if err != nil {
+				log.Printf("error discovering labs:  %v", err)
+				continue
+			}
+
+			if len(result.Created)+len(result.Updated)+len(result.Retired) > 0 {
+				log.Printf("discovered labs: %d created, %d updated, %d retired",
+					len(result.Created), len(result.Updated), len(result.Retired))
+			}
+		}
+	}
+}
+
+func (d *Discovery) Sync(ctx context.Context) (SyncResult, error) {
+	var result SyncResult
+
+	instances, err := d.instances.ListTagged(ctx, d.tagKey)
+
+	if err != nil {
+		return result, err
+	}
+
+	live := make(map[string]bool)
+
+	for _, instance := range instances {
+		if instance.State == types.InstanceStateNameTerminated || instance.State == types.InstanceStateNameShuttingDown {
+			continue
+		}
+
+		live[instance.ID] = true
+
+		lab, err := d.labRep.GetLabByInstanceId(ctx, instance.ID)
+
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			lab, err = d.create(ctx, instance)
+
+			if errors.Is(err, ErrInvalidLab) {
+				result.Skipped = append(result.Skipped, instance.ID)
+				log.Printf("skipping instance %s:  %v", instance.ID, err)
+				continue
+			}
+
+			if err != nil {
+				return result, err
+			}
+
+			result.Created = append(result.Created, lab.ID)
+		case err != nil:
+			return result, err
+		default:
+			updated, err := d.update(ctx, lab, instance)
+
+			if err != nil {
+				return result, err
+			}
+
+			if updated {
+				result.Updated = append(result.Updated, lab.ID)
+			}
+		}
+	}
+
+	labs, err := d.labRep.ListLabsBySource(ctx, mysql.SourceDiscovery)
+
+	if err != nil {
+		return result, err
+	}
+
+	// An empty listing more likely means a wrong tag key or region than
+	// every lab being terminated at once.
+	if len(live) == 0 && len(labs) > 0 {
+		log.Printf("no instance tagged %s found, not retiring %d discovered labs", d.tagKey, len(labs))
+		return result, nil
+	}
+
+	for _, lab := range labs {
+		if live[lab.InstanceID] {
+			continue
+		}
+
+		if err := d.labRep.RetireLab(ctx, lab.ID); err != nil {
+			return result, err
+		}
+
+		result.Retired = append(result.Retired, lab.ID)
+	}
+
+	return result, nil
+}
+
+func (d *Discovery) create(ctx context.Context, instance ec2.Instance) (mysql.Lab, error) {
+	lab := mysql.Lab{
+		Name:        instance.ID,
+		InstanceID:  instance.ID,
+		Hostname:    instance.Hostname(),
+		Available:   true,
+		Backend:     mysql.BackendSSM,
+		MaxSessions: 1,
+		Source:      mysql.SourceDiscovery,
+	}
+
+	if err := d.fromTags(&lab, instance); err != nil {
+		return mysql.Lab{}, err
+	}
+
+	return d.labRep.CreateLab(ctx, lab)
+}
+
+// update refreshes the lab from its instance. Labs added by hand only have
+// their hostname refreshed; discovered labs also follow the tags.
+func (d *Discovery) update(ctx context.Context, lab mysql.Lab, instance ec2.Instance) (bool, error) {
+	next := lab
+
+	if hostname := instance.Hostname(); hostname != "" {
+		next.Hostname = hostname
+	}
+
+	if lab.Source == mysql.SourceDiscovery {
+		if err := d.fromTags(&next, instance); err != nil {
+			log.Printf("ignoring tags of instance %s:  %v", instance.ID, err)
+			next = lab
+		}
+	}
+
+	changed := next.Hostname != lab.Hostname || next.Name != lab.Name || next.Type != lab.Type ||
+		next.Backend != lab.Backend || next.MaxSessions != lab.MaxSessions
+
+	if changed {
+		if _, err := d.labRep.UpdateLab(ctx, next); err != nil {
+			return false, err
+		}
+	}
+
+	if lab.State == mysql.LabRetired && lab.Source == mysql.SourceDiscovery {
+		if err := d.labRep.SetLabState(ctx, lab.ID, mysql.LabActive); err != nil {
+			return false, err
+		}
+
+		if err := d.labRep.SetAvailable(ctx, lab.ID, true); err != nil {
+			return false, err
+		}
+
+		changed = true
+	}
+
+	return changed, nil
+}
+
+func (d *Discovery) fromTags(lab *mysql.Lab, instance ec2.Instance) error {
+	lab.Type = mysql.LabType(instance.Tags[d.tagKey])
+
+	if _, err := provision.LookupLabType(lab.Type); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidLab, err)
+	}
+
+	if name := instance.Tags["Name"]; name != "" {
+		lab.Name = name
+	}
+
+	if backend := instance.Tags[d.tagPrefix+"backend"]; backend != "" {
+		lab.Backend = mysql.LabBackend(backend)
+	}
+
+	// Agent and broker labs run outside EC2 and are never discovered.
+	if lab.Backend != mysql.BackendSSM && lab.Backend != mysql.BackendSSH {
+		return fmt.Errorf("%w: unknown backend %q", ErrInvalidLab, lab.Backend)
+	}
+
+	if value := instance.Tags[d.tagPrefix+"max-sessions"]; value != "" {
+		maxSessions, err := strconv.Atoi(value)
+
+		if err != nil || maxSessions < 1 {
+			return fmt.Errorf("%w: invalid max-sessions %q", ErrInvalidLab, value)
+		}
+
+		lab.MaxSessions = maxSessions
+	}
+
+	return nil
+}
@@ -0,0 +1,194 @@
+package inventory
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsec2 "github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/ec2"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/spf13/viper"
+)
+
+// localStack returns an EC2 client of LocalStack, e.g. the one of
+// docker-compose.yml, and a tag key of the test's own, which keeps it clear
+// of other instances. The test is skipped unless LOCALSTACK_ENDPOINT is set,
+// e.g. to http://localhost:4566.
+func localStack(t *testing.T) (*awsec2.Client, string) {
+	t.Helper()
+
+	endpoint := os.Getenv("LOCALSTACK_ENDPOINT")
+
+	if endpoint == "" {
+		t.Skip("LOCALSTACK_ENDPOINT is not set")
+	}
+
+	v := viper.New()
+	v.Set("AWS_ENDPOINT", endpoint)
+	v.Set("AWS_ACCESS_KEY_ID", "test")
+	v.Set("AWS_SECRET_ACCESS_KEY", "test")
+
+	return awsec2.NewFromConfig(*config.NewAWSConfig(v)), "nicelab-test-" + uuid.New().String()[:8] + ":lab-type"
+}
+
+// runLabInstance runs an instance tagged as a Kali lab named name, which is
+// terminated at the end of the test.
+func runLabInstance(t *testing.T, ctx context.Context, client *awsec2.Client, tagKey string, name string) string {
+	t.Helper()
+
+	prefix := tagKey[:len(tagKey)-len("lab-type")]
+
+	out, err := client.RunInstances(ctx, &awsec2.RunInstancesInput{
+		ImageId:      aws.String("ami-df5de72bdb3b"),
+		InstanceType: types.InstanceTypeT3Micro,
+		MinCount:     aws.Int32(1),
+		MaxCount:     aws.Int32(1),
+		TagSpecifications: []types.TagSpecification{{
+			ResourceType: types.ResourceTypeInstance,
+			Tags: []types.Tag{
+				{Key: aws.String(tagKey), Value: aws.String(string(mysql.Kali))},
+				{Key: aws.String(prefix + "backend"), Value: aws.String(string(mysql.BackendSSH))},
+				{Key: aws.String(prefix + "max-sessions"), Value: aws.String("3")},
+				{Key: aws.String("Name"), Value: aws.String(name)},
+			},
+		}},
+	})
+
+	if err != nil {
+		t.Fatalf("running instance: %v", err)
+	}
+
+	instanceId := aws.ToString(out.Instances[0].InstanceId)
+
+	t.Cleanup(func() {
+		_, _ = client.TerminateInstances(context.Background(), &awsec2.TerminateInstancesInput{InstanceIds: []string{instanceId}})
+	})
+
+	return instanceId
+}
+
+func discoveredLabRow(rows *sqlmock.Rows, id uint64, name string, instanceId string) *sqlmock.Rows {
+	return rows.AddRow(id, name, mysql.Kali, instanceId, true, mysql.BackendSSH, 3, mysql.LabActive, mysql.SourceDiscovery)
+}
+
+func discoveredLabRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "name", "type", "instance_id", "available", "backend", "max_sessions", "state", "source"})
+}
+
+// expectCreate expects the lab of the instance to be created with id.
+func expectCreate(mock sqlmock.Sqlmock, id uint64, name string, instanceId string) {
+	mock.ExpectQuery(`SELECT \* FROM labs WHERE instance_id = \?`).WithArgs(instanceId).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec(`INSERT INTO labs`).
+		WithArgs(sqlmock.AnyArg(), name, mysql.Kali, sqlmock.AnyArg(), instanceId, true, mysql.BackendSSH,
+			sqlmock.AnyArg(), 3, 0, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+			mysql.LabActive, mysql.SourceDiscovery).
+		WillReturnResult(sqlmock.NewResult(int64(id), 1))
+	mock.ExpectQuery(`SELECT \* FROM labs WHERE id = \?`).WithArgs(id).WillReturnRows(discoveredLabRow(discoveredLabRows(), id, name, instanceId))
+}
+
+func newTestDiscovery(t *testing.T, client *awsec2.Client, tagKey string) (*Discovery, sqlmock.Sqlmock) {
+	t.Helper()
+
+	conn, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return NewDiscovery(ec2.NewInstances(client), mysql.NewLabRepository(sqlx.NewDb(conn, "mysql")), tagKey), mock
+}
+
+func TestDiscoveryCreatesLabFromLocalStack(t *testing.T) {
+	client, tagKey := localStack(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	instanceId := runLabInstance(t, ctx, client, tagKey, "discovered-kali")
+	discovery, mock := newTestDiscovery(t, client, tagKey)
+
+	expectCreate(mock, 5, "discovered-kali", instanceId)
+	mock.ExpectQuery(`SELECT \* FROM labs WHERE source = \?`).WithArgs(mysql.SourceDiscovery, mysql.LabRetired).
+		WillReturnRows(discoveredLabRow(discoveredLabRows(), 5, "discovered-kali", instanceId))
+
+	result, err := discovery.Sync(ctx)
+
+	if err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+
+	if len(result.Created) != 1 || result.Created[0] != 5 {
+		t.Errorf("created %v, want [5]", result.Created)
+	}
+
+	if len(result.Retired) != 0 || len(result.Skipped) != 0 {
+		t.Errorf("retired %v and skipped %v, want none", result.Retired, result.Skipped)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDiscoveryRetiresLabOfTerminatedInstanceFromLocalStack(t *testing.T) {
+	client, tagKey := localStack(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	first := runLabInstance(t, ctx, client, tagKey, "discovered-kali-1")
+	discovery, mock := newTestDiscovery(t, client, tagKey)
+
+	expectCreate(mock, 5, "discovered-kali-1", first)
+	mock.ExpectQuery(`SELECT \* FROM labs WHERE source = \?`).WithArgs(mysql.SourceDiscovery, mysql.LabRetired).
+		WillReturnRows(discoveredLabRow(discoveredLabRows(), 5, "discovered-kali-1", first))
+
+	if _, err := discovery.Sync(ctx); err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+
+	// Another instance stays tagged, since discovery does not retire every
+	// lab at once.
+	second := runLabInstance(t, ctx, client, tagKey, "discovered-kali-2")
+
+	if _, err := client.TerminateInstances(ctx, &awsec2.TerminateInstancesInput{InstanceIds: []string{first}}); err != nil {
+		t.Fatalf("terminating instance: %v", err)
+	}
+
+	expectCreate(mock, 6, "discovered-kali-2", second)
+	mock.ExpectQuery(`SELECT \* FROM labs WHERE source = \?`).WithArgs(mysql.SourceDiscovery, mysql.LabRetired).
+		WillReturnRows(discoveredLabRow(discoveredLabRow(discoveredLabRows(), 5, "discovered-kali-1", first), 6, "discovered-kali-2", second))
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE labs SET state = \?, available = 0 WHERE id = \?`).WithArgs(mysql.LabRetired, 5).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE sessions SET status = \?`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`UPDATE queue_entries SET status = \?`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	result, err := discovery.Sync(ctx)
+
+	if err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+
+	if len(result.Created) != 1 || result.Created[0] != 6 {
+		t.Errorf("created %v, want [6]", result.Created)
+	}
+
+	if len(result.Retired) != 1 || result.Retired[0] != 5 {
+		t.Errorf("retired %v, want [5]", result.Retired)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
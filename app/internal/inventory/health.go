@@ -0,0 +1,273 @@
+package inventory
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/dcvsm"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/ec2"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/ssm"
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+	"github.com/danutavadanei/nice-lab-go/internal/provision"
+)
+
+// Health checks that labs can take sessions: their instance is running, its
+// SSM agent, or the lab agent of agent labs, is online and the DCV server
+// answers over HTTPS. Broker labs are healthy while their broker answers. Labs failing
+// in a row are made unavailable until they pass again.
+type Health struct {
+	instances *ec2.Instances
+	managed   *ssm.Inventory
+	labRep    *mysql.LabRepository
+	healthRep *mysql.HealthRepository
+	agents    *provision.AgentProvisioner
+	broker    *dcvsm.Broker
+	client    *http.Client
+	cfg       config.HealthConfig
+}
+
+func NewHealth(
+	instances *ec2.Instances,
+	managed *ssm.Inventory,
+	labRep *mysql.LabRepository,
+	healthRep *mysql.HealthRepository,
+	agents *provision.AgentProvisioner,
+	broker *dcvsm.Broker,
+	cfg config.HealthConfig,
+) *Health {
+	return &Health{
+		instances: instances,
+		managed:   managed,
+		labRep:    labRep,
+		healthRep: healthRep,
+		agents:    agents,
+		broker:    broker,
+		client: &http.Client{
+			Timeout: cfg.ProbeTimeout,
+			Transport: &http.Transport{
+				// DCV servers use self-signed certificates.
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		cfg: cfg,
+	}
+}
+
+// Run checks every lab each check interval until ctx is done.
+func (h *Health) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.cfg.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.CheckAll(ctx); err != nil {
+				log.Printf("error checking lab health:  %v", err)
+			}
+		}
+	}
+}
+
+// CheckAll checks and records the health of the labs in service, except the
+// ones in maintenance, and prunes the history past its retention.
+func (h *Health) CheckAll(ctx context.Context) error {
+	labs, err := h.labRep.ListLabs(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	for _, lab := range labs {
+		// Labs in maintenance are expected to go down while being patched.
+		if lab.State == mysql.LabMaintenance {
+			continue
+		}
+
+		check, err := h.Check(ctx, lab)
+
+		if err != nil {
+			log.Printf("error checking health of lab %d:  %v", lab.ID, err)
+			continue
+		}
+
+		if err := h.healthRep.RecordCheck(ctx, check, h.cfg.FailureThreshold); err != nil {
+			return err
+		}
+
+		if check.Status != lab.Health {
+			log.Printf("lab %d: health changed from %s to %s", lab.ID, lab.Health, check.Status)
+		}
+	}
+
+	return h.healthRep.PruneChecks(ctx, time.Now().Add(-h.cfg.HistoryRetention))
+}
+
+// Check probes the lab. Errors are only returned when the lab could not be
+// checked, e.g. when the EC2 API fails, and not when it is unhealthy.
+// Instances that are stopped or starting are reported as stopped, since
+// they are started on demand.
+func (h *Health) Check(ctx context.Context, lab mysql.Lab) (mysql.HealthCheck, error) {
+	check := mysql.HealthCheck{LabID: lab.ID, Status: mysql.HealthHealthy}
+
+	var problems []string
+
+	if lab.Backend == mysql.BackendAgent {
+		return h.checkAgent(ctx, lab, check)
+	}
+
+	if lab.Backend == mysql.BackendBroker {
+		return h.checkBroker(ctx, lab, check), nil
+	}
+
+	instance, err := h.instances.Get(ctx, lab.InstanceID)
+
+	switch {
+	case errors.Is(err, ec2.ErrInstanceNotFound):
+		// Labs outside EC2 are reached over SSH and only have DCV probed.
+		if lab.Backend == mysql.BackendSSM {
+			problems = append(problems, "instance not found")
+		}
+	case err != nil:
+		return check, err
+	default:
+		state := string(instance.State)
+		check.InstanceState = &state
+
+		switch instance.State {
+		case types.InstanceStateNameRunning:
+		case types.InstanceStateNameTerminated, types.InstanceStateNameShuttingDown:
+			problems = append(problems, "instance is "+state)
+		default:
+			check.Status = mysql.HealthStopped
+			return check, nil
+		}
+	}
+
+	if lab.Backend == mysql.BackendSSM && len(problems) == 0 {
+		status, err := h.managed.PingStatus(ctx, lab.InstanceID)
+
+		switch {
+		case errors.Is(err, ssm.ErrInvalidInstance):
+			problems = append(problems, "ssm agent is not registered")
+		case err != nil:
+			return check, err
+		default:
+			ping := string(status)
+			check.PingStatus = &ping
+
+			if status != ssmtypes.PingStatusOnline {
+				problems = append(problems, "ssm agent is "+ping)
+			}
+		}
+	}
+
+	return h.finish(ctx, lab, check, problems), nil
+}
+
+// checkAgent checks a lab running the lab agent, which has no instance. The
+// status of its agent is recorded as the ping status.
+func (h *Health) checkAgent(ctx context.Context, lab mysql.Lab, check mysql.HealthCheck) (mysql.HealthCheck, error) {
+	var problems []string
+
+	_, online, err := h.agents.LabAgent(ctx, lab.ID)
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		problems = append(problems, "lab agent is not enrolled")
+	case err != nil:
+		return check, err
+	default:
+		ping := "online"
+
+		if !online {
+			ping = "offline"
+			problems = append(problems, "lab agent is offline")
+		}
+
+		check.PingStatus = &ping
+	}
+
+	return h.finish(ctx, lab, check, problems), nil
+}
+
+// checkBroker checks that the broker of a broker lab answers. The DCV server
+// is only probed for labs pinned to a host.
+func (h *Health) checkBroker(ctx context.Context, lab mysql.Lab, check mysql.HealthCheck) mysql.HealthCheck {
+	var problems []string
+
+	if h.broker == nil {
+		problems = append(problems, "broker is not configured")
+	} else if err := h.broker.Ping(ctx); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if lab.Hostname == "" {
+		return withProblems(check, problems)
+	}
+
+	return h.finish(ctx, lab, check, problems)
+}
+
+// finish probes DCV and sets the status of the check from the problems
+// found.
+func (h *Health) finish(ctx context.Context, lab mysql.Lab, check mysql.HealthCheck, problems []string) mysql.HealthCheck {
+	if err := h.probeDCV(ctx, lab.Hostname); err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		check.DCVReachable = true
+	}
+
+	return withProblems(check, problems)
+}
+
+// withProblems marks the check unhealthy when problems were found.
+func withProblems(check mysql.HealthCheck, problems []string) mysql.HealthCheck {
+	if len(problems) > 0 {
+		detail := strings.Join(problems, "; ")
+		check.Status = mysql.HealthUnhealthy
+		check.Detail = &detail
+	}
+
+	return check
+}
+
+// probeDCV succeeds when the DCV web server answers, whatever the response.
+func (h *Health) probeDCV(ctx context.Context, hostname string) error {
+	if hostname == "" {
+		return errors.New("dcv: lab has no hostname")
+	}
+
+	url := "https://" + net.JoinHostPort(hostname, strconv.Itoa(h.cfg.DCVPort)) + "/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return fmt.Errorf("dcv: %w", err)
+	}
+
+	res, err := h.client.Do(req)
+
+	if err != nil {
+		return fmt.Errorf("dcv: %w", err)
+	}
+
+	_ = res.Body.Close()
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/ec2"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/ssm"
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+)
+
+var (
+	ErrInstanceStarting = errors.New("lab instance is starting")
+	ErrInstanceGone     = errors.New("lab instance is terminated")
+)
+
+// Power starts lab instances when sessions are requested and stops them
+// once they have been idle for a while.
+type Power struct {
+	instances *ec2.Instances
+	managed   *ssm.Inventory
+	labRep    *mysql.LabRepository
+	cfg       config.PowerConfig
+}
+
+func NewPower(instances *ec2.Instances, managed *ssm.Inventory, labRep *mysql.LabRepository, cfg config.PowerConfig) *Power {
+	return &Power{
+		instances: instances,
+		managed:   managed,
+		labRep:    labRep,
+		cfg:       cfg,
+	}
+}
+
+// Wake starts the lab instance like Start when instances are started on
+// demand, and leaves it alone otherwise.
+func (p *Power) Wake(ctx context.Context, lab *mysql.Lab) error {
+	if !p.cfg.StartOnDemand {
+		return nil
+	}
+
+	return p.Start(ctx, lab)
+}
+
+// Start makes sure the lab instance can be provisioned. A running instance
+// whose agent is online has its hostname refreshed, in the database and on
+// lab. Otherwise the instance is started when stopped and ErrInstanceStarting
+// is returned; callers retry later. Agent and broker labs, and labs whose
+// instance is not known to EC2, are left alone.
+func (p *Power) Start(ctx context.Context, lab *mysql.Lab) error {
+	if lab.Backend == mysql.BackendAgent || lab.Backend == mysql.BackendBroker {
+		return nil
+	}
+
+	instance, err := p.instances.Get(ctx, lab.InstanceID)
+
+	if errors.Is(err, ec2.ErrInstanceNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	switch instance.State {
+	case types.InstanceStateNameRunning:
+	case types.InstanceStateNameStopped:
+		log.Printf("lab %d: starting instance %s", lab.ID, instance.ID)
+
+		if err := p.instances.Start(ctx, instance.ID); err != nil {
+			return err
+		}
+
+		return ErrInstanceStarting
+	case types.InstanceStateNameTerminated, types.InstanceStateNameShuttingDown:
+		return fmt.Errorf("%w: %s", ErrInstanceGone, instance.ID)
+	default:
+		// pending, or stopping and started on a later call
+		return ErrInstanceStarting
+	}
+
+	if lab.Backend == mysql.BackendSSM {
+		status, err := p.managed.PingStatus(ctx, instance.ID)
+
+		switch {
+		case errors.Is(err, ssm.ErrInvalidInstance):
+			// the agent has not registered since boot yet
+			return ErrInstanceStarting
+		case err != nil:
+			return err
+		case status != ssmtypes.PingStatusOnline:
+			return ErrInstanceStarting
+		}
+	}
+
+	if hostname := instance.Hostname(); hostname != "" && hostname != lab.Hostname {
+		if err := p.labRep.UpdateHostname(ctx, lab.ID, hostname); err != nil {
+			return err
+		}
+
+		log.Printf("lab %d: hostname changed from %s to %s", lab.ID, lab.Hostname, hostname)
+		lab.Hostname = hostname
+	}
+
+	return nil
+}
+
+// Run stops idle instances every check interval until ctx is done.
+func (p *Power) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.cfg.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.StopIdle(ctx); err != nil {
+				log.Printf("error stopping idle labs:  %v", err)
+			}
+		}
+	}
+}
+
+// StopIdle stops the running instances of labs without a session in
+// progress, a waiting queue or a session that ended in the idle period.
+// Labs keeping warm accounts, or expecting a reservation or a class within
+// the idle period, keep running.
+func (p *Power) StopIdle(ctx context.Context) error {
+	now := time.Now()
+	labs, err := p.labRep.ListIdleLabs(ctx, now.Add(-p.cfg.IdleStopAfter), now.Add(p.cfg.IdleStopAfter))
+
+	if err != nil {
+		return err
+	}
+
+	for _, lab := range labs {
+		if lab.Backend == mysql.BackendAgent || lab.Backend == mysql.BackendBroker {
+			continue
+		}
+
+		instance, err := p.instances.Get(ctx, lab.InstanceID)
+
+		if errors.Is(err, ec2.ErrInstanceNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if instance.State != types.InstanceStateNameRunning {
+			continue
+		}
+
+		log.Printf("lab %d: stopping idle instance %s", lab.ID, instance.ID)
+
+		if err := p.instances.Stop(ctx, instance.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/ec2"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/ssm"
+	"github.com/danutavadanei/nice-lab-go/internal/provision"
+)
+
+var ErrInvalidLab = errors.New("invalid lab")
+
+// Validator checks lab definitions against the instances they point to.
+type Validator struct {
+	instances *ec2.Instances
+	managed   *ssm.Inventory
+}
+
+func NewValidator(instances *ec2.Instances, managed *ssm.Inventory) *Validator {
+	return &Validator{instances: instances, managed: managed}
+}
+
+// Validate returns an error wrapping ErrInvalidLab when the lab has an
+// unknown type or backend, or when its instance does not exist, is
+// terminated, is running but not reachable at its hostname or, for SSM
+// labs, is not
+// managed by SSM. Agent labs have no instance and only need a hostname;
+// broker labs need neither, their hostname pins their sessions to a server
+// of the broker. Other errors come from the AWS APIs.
+func (v *Validator) Validate(ctx context.Context, lab *mysql.Lab) error {
+	if strings.TrimSpace(lab.Name) == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidLab)
+	}
+
+	if _, err := provision.LookupLabType(lab.Type); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidLab, err)
+	}
+
+	if lab.Backend != mysql.BackendSSM && lab.Backend != mysql.BackendSSH && lab.Backend != mysql.BackendAgent &&
+		lab.Backend != mysql.BackendBroker {
+		return fmt.Errorf("%w: unknown backend %q", ErrInvalidLab, lab.Backend)
+	}
+
+	if lab.MaxSessions < 1 {
+		return fmt.Errorf("%w: max_sessions must be positive", ErrInvalidLab)
+	}
+
+	if lab.Backend == mysql.BackendAgent {
+		if strings.TrimSpace(lab.Hostname) == "" {
+			return fmt.Errorf("%w: hostname is required", ErrInvalidLab)
+		}
+
+		return nil
+	}
+
+	if lab.Backend == mysql.BackendBroker {
+		if strings.ContainsAny(lab.Hostname, `'"\`) {
+			return fmt.Errorf("%w: invalid hostname %q", ErrInvalidLab, lab.Hostname)
+		}
+
+		return nil
+	}
+
+	instance, err := v.instances.Get(ctx, lab.InstanceID)
+
+	if errors.Is(err, ec2.ErrInstanceNotFound) {
+		return fmt.Errorf("%w: %v", ErrInvalidLab, err)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if instance.State == types.InstanceStateNameTerminated || instance.State == types.InstanceStateNameShuttingDown {
+		return fmt.Errorf("%w: instance %s is %s", ErrInvalidLab, instance.ID, instance.State)
+	}
+
+	// Stopped instances lose their public name, it is refreshed on start.
+	stopped := instance.State == types.InstanceStateNameStopped || instance.State == types.InstanceStateNameStopping
+
+	if !stopped && !matchesHostname(instance, lab.Hostname) {
+		return fmt.Errorf("%w: instance %s is not reachable at %q (known as %s)",
+			ErrInvalidLab, instance.ID, lab.Hostname, strings.Join(instance.Addresses(), ", "))
+	}
+
+	if lab.Backend != mysql.BackendSSM {
+		return nil
+	}
+
+	if _, err := v.managed.PingStatus(ctx, lab.InstanceID); err != nil {
+		if errors.Is(err, ssm.ErrInvalidInstance) {
+			return fmt.Errorf("%w: %v", ErrInvalidLab, err)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func matchesHostname(instance ec2.Instance, hostname string) bool {
+	for _, address := range instance.Addresses() {
+		if strings.EqualFold(address, hostname) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,159 @@
+package provision
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+)
+
+// AgentProvisioner queues commands for the lab agent, which long-polls the
+// pipeline for them and runs them on its server, and waits for the result
+// it reports. It is used for servers that can neither run the SSM agent nor
+// be reached over SSH.
+type AgentProvisioner struct {
+	agentRep *mysql.AgentRepository
+	cfg      config.AgentConfig
+}
+
+func NewAgentProvisioner(agentRep *mysql.AgentRepository, cfg config.AgentConfig) *AgentProvisioner {
+	return &AgentProvisioner{agentRep: agentRep, cfg: cfg}
+}
+
+// Online tells whether the agent was seen recently enough to take jobs.
+func (p *AgentProvisioner) Online(agent mysql.Agent) bool {
+	return agent.LastSeenAt != nil && time.Since(*agent.LastSeenAt) < p.cfg.OfflineAfter
+}
+
+// Run fails with KindAgentOffline when the lab has no agent online, or when
+// it goes offline before claiming the job. The job times out with ctx, or
+// after the job timeout when ctx has no deadline; it is cancelled when ctx
+// is done before the agent reports it.
+func (p *AgentProvisioner) Run(ctx context.Context, lab *mysql.Lab, family OSFamily, commands []string) (Output, error) {
+	if err := p.checkOnline(ctx, lab.ID); err != nil {
+		return Output{}, err
+	}
+
+	if err := p.agentRep.PruneJobs(ctx, time.Now().Add(-p.cfg.JobRetention)); err != nil {
+		log.Printf("error pruning agent jobs:  %v", err)
+	}
+
+	timeout := p.cfg.JobTimeout
+
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	job, err := p.agentRep.EnqueueJob(ctx, lab.ID, string(family), strings.Join(commands, "\n")+"\n", timeout)
+
+	if err != nil {
+		return Output{}, err
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(p.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-runCtx.Done():
+			p.cancel(job.UUID)
+			return Output{}, runCtx.Err()
+		case <-ticker.C:
+		}
+
+		job, err = p.agentRep.GetJobByUUID(runCtx, job.UUID)
+
+		if err != nil {
+			if runCtx.Err() != nil {
+				continue
+			}
+			return Output{}, err
+		}
+
+		switch job.Status {
+		case mysql.AgentJobDone:
+			return jobOutput(job)
+		case mysql.AgentJobCancelled:
+			return Output{}, fmt.Errorf("agent job %s was cancelled", job.UUID)
+		case mysql.AgentJobQueued:
+			if err := p.checkOnline(runCtx, lab.ID); err != nil {
+				p.cancel(job.UUID)
+				return Output{}, err
+			}
+		}
+	}
+}
+
+// LabAgent returns the agent enrolled for the lab and whether it is online;
+// sql.ErrNoRows is returned when none is.
+func (p *AgentProvisioner) LabAgent(ctx context.Context, labId uint64) (mysql.Agent, bool, error) {
+	agent, err := p.agentRep.GetLabAgent(ctx, labId)
+
+	if err != nil {
+		return agent, false, err
+	}
+
+	return agent, p.Online(agent), nil
+}
+
+func (p *AgentProvisioner) checkOnline(ctx context.Context, labId uint64) error {
+	_, online, err := p.LabAgent(ctx, labId)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return &Error{Kind: KindAgentOffline, Err: fmt.Errorf("lab %d has no agent enrolled", labId)}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !online {
+		return &Error{Kind: KindAgentOffline, Err: fmt.Errorf("agent of lab %d is offline", labId)}
+	}
+
+	return nil
+}
+
+// cancel gives up on the job, even once the context of the run is done.
+func (p *AgentProvisioner) cancel(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := p.agentRep.CancelJob(ctx, id); err != nil {
+		log.Printf("error cancelling agent job %s:  %v", id, err)
+	}
+}
+
+// jobOutput returns what the job printed. Jobs the agent could not run at
+// all are errors, like failing to reach an instance over the other
+// backends.
+func jobOutput(job mysql.AgentJob) (Output, error) {
+	var out Output
+
+	if job.Stdout != nil {
+		out.Stdout = *job.Stdout
+	}
+
+	if job.Stderr != nil {
+		out.Stderr = *job.Stderr
+	}
+
+	if job.ExitCode != nil {
+		out.ExitCode = *job.ExitCode
+	}
+
+	if job.Error != nil && *job.Error != "" {
+		return out, fmt.Errorf("agent job %s: %s", job.UUID, *job.Error)
+	}
+
+	return out, nil
+}
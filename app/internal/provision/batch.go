@@ -0,0 +1,376 @@
+package provision
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/ssm"
+)
+
+// batchPrefix starts the lines a batch script prints around each job.
+const batchPrefix = "::nicelab-batch::"
+
+var ErrBatchUnsupported = errors.New("backend does not run batches")
+
+// LabOutput is what a batch printed on one of its labs. Err is set when the
+// batch could not run there. Truncated is set when the output was cut, so
+// that the jobs whose end it lacks have an unknown outcome.
+type LabOutput struct {
+	Output
+	Truncated bool
+	Err       error
+}
+
+// BatchRunner runs the same script on several labs with a single request.
+type BatchRunner interface {
+	RunBatch(ctx context.Context, labs []*mysql.Lab, family OSFamily, commands []string) (map[uint64]LabOutput, error)
+}
+
+// BatchJob is the plan of one user on one lab.
+type BatchJob struct {
+	Lab  *mysql.Lab
+	Plan Plan
+}
+
+// BatchResult is the outcome of a job, as Apply would return it.
+type BatchResult struct {
+	Results []StepResult
+	Err     error
+}
+
+// ApplyBatch applies the plans of many users at once. Jobs on labs sharing
+// a backend and OS family are grouped into one script that runs the plans
+// of each lab one after the other, sent to all the labs with a single
+// request; its output is split back into the results of every job. Jobs
+// the provisioner cannot batch, and those whose output was cut, are applied
+// one by one. Failed steps are compensated per job like Apply does.
+func ApplyBatch(ctx context.Context, p Provisioner, jobs []BatchJob) []BatchResult {
+	type groupKey struct {
+		backend mysql.LabBackend
+		family  OSFamily
+	}
+
+	results := make([]BatchResult, len(jobs))
+	groups := make(map[groupKey][]int)
+	var order []groupKey
+
+	for i, job := range jobs {
+		key := groupKey{backend: job.Lab.Backend, family: job.Plan.Family}
+		if key.backend == "" {
+			key.backend = mysql.BackendSSM
+		}
+
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+
+		groups[key] = append(groups[key], i)
+	}
+
+	runner, batches := p.(BatchRunner)
+
+	for _, key := range order {
+		indexes := groups[key]
+
+		if batches {
+			err := applyGroup(ctx, p, runner, key.family, jobs, indexes, results)
+
+			if err == nil {
+				continue
+			}
+
+			if !errors.Is(err, ErrBatchUnsupported) {
+				for _, i := range indexes {
+					results[i] = BatchResult{Err: asError(err, Output{})}
+				}
+				continue
+			}
+		}
+
+		for _, i := range indexes {
+			stepResults, err := Apply(ctx, p, jobs[i].Lab, jobs[i].Plan)
+			results[i] = BatchResult{Results: stepResults, Err: err}
+		}
+	}
+
+	return results
+}
+
+func applyGroup(ctx context.Context, p Provisioner, runner BatchRunner, family OSFamily, jobs []BatchJob, indexes []int, results []BatchResult) error {
+	var labs []*mysql.Lab
+	seen := make(map[uint64]bool)
+
+	for _, i := range indexes {
+		if lab := jobs[i].Lab; !seen[lab.ID] {
+			seen[lab.ID] = true
+			labs = append(labs, lab)
+		}
+	}
+
+	outputs, err := runner.RunBatch(ctx, labs, family, batchScript(family, jobs, indexes))
+
+	if err != nil {
+		return err
+	}
+
+	sections := make(map[uint64]map[int]Output)
+
+	for _, i := range indexes {
+		job := jobs[i]
+		out, ok := outputs[job.Lab.ID]
+
+		if !ok {
+			results[i] = BatchResult{Err: &Error{Kind: KindAgentOffline, Err: fmt.Errorf("lab %d: no batch output", job.Lab.ID)}}
+			continue
+		}
+
+		if out.Err != nil {
+			results[i] = BatchResult{Err: asError(out.Err, out.Output)}
+			continue
+		}
+
+		if _, ok := sections[job.Lab.ID]; !ok {
+			sections[job.Lab.ID] = splitBatch(out.Output, out.Truncated)
+		}
+
+		section, ok := sections[job.Lab.ID][i]
+
+		// The job may have run past the end of the output; its steps
+		// check whether they were applied, so it is applied again.
+		if !ok && out.Truncated {
+			stepResults, err := Apply(ctx, p, job.Lab, job.Plan)
+			results[i] = BatchResult{Results: stepResults, Err: err}
+			continue
+		}
+
+		if !ok {
+			results[i] = BatchResult{Err: &Error{Kind: KindStepFailed, Output: out.String(), Err: errors.New("job did not run")}}
+			continue
+		}
+
+		stepResults, err := classify(ctx, p, job.Lab, job.Plan, section)
+		results[i] = BatchResult{Results: stepResults, Err: err}
+	}
+
+	return nil
+}
+
+// batchScript runs, on each lab, the plans of the jobs on it. The lab is
+// told by the instance id SSM exports to the commands it runs. Each plan
+// runs on its own, in a subshell or a child PowerShell, so that a failing
+// step only stops the plan it belongs to. The script itself succeeds so
+// that only instances it could not run on count as errors.
+func batchScript(family OSFamily, jobs []BatchJob, indexes []int) []string {
+	byInstance := make(map[string][]int)
+	var instances []string
+
+	for _, i := range indexes {
+		id := jobs[i].Lab.InstanceID
+
+		if _, ok := byInstance[id]; !ok {
+			instances = append(instances, id)
+		}
+
+		byInstance[id] = append(byInstance[id], i)
+	}
+
+	var commands []string
+
+	if family == Windows {
+		commands = append(commands, "switch ($env:AWS_SSM_INSTANCE_ID) {")
+
+		for _, id := range instances {
+			commands = append(commands, PowerShellQuote(id)+" {")
+
+			for _, i := range byInstance[id] {
+				script := strings.Join(jobs[i].Plan.Script(), "\n")
+
+				commands = append(commands,
+					fmt.Sprintf("Write-Output '%s%d::begin'", batchPrefix, i),
+					fmt.Sprintf("& powershell.exe -NoProfile -NonInteractive -EncodedCommand %s 2>&1", encodePowerShell(script)),
+					fmt.Sprintf("Write-Output \"%s%d::end::$LASTEXITCODE\"", batchPrefix, i),
+				)
+			}
+
+			commands = append(commands, "}")
+		}
+
+		return append(commands, "}", "exit 0")
+	}
+
+	commands = append(commands, `case "$AWS_SSM_INSTANCE_ID" in`)
+
+	for _, id := range instances {
+		commands = append(commands, ShellQuote(id)+")")
+
+		for _, i := range byInstance[id] {
+			commands = append(commands, fmt.Sprintf("echo '%s%d::begin'", batchPrefix, i), "(")
+			commands = append(commands, jobs[i].Plan.Script()...)
+			commands = append(commands, ")", fmt.Sprintf("echo \"%s%d::end::$?\"", batchPrefix, i))
+		}
+
+		commands = append(commands, ";;")
+	}
+
+	return append(commands, "esac", "exit 0")
+}
+
+// encodePowerShell encodes a script for -EncodedCommand, which takes base64
+// of UTF-16LE.
+func encodePowerShell(script string) string {
+	units := utf16.Encode([]rune(script))
+	buf := make([]byte, 2*len(units))
+
+	for i, unit := range units {
+		binary.LittleEndian.PutUint16(buf[2*i:], unit)
+	}
+
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// splitBatch returns the output of every job found in the output of a batch
+// script, by job index. Jobs cut short report the exit code of the script,
+// unless the output was truncated, in which case they are left out.
+func splitBatch(out Output, truncated bool) map[int]Output {
+	sections := make(map[int]Output)
+	current := -1
+	var buf strings.Builder
+
+	scanner := bufio.NewScanner(strings.NewReader(out.Stdout))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if !strings.HasPrefix(line, batchPrefix) {
+			if current >= 0 {
+				buf.WriteString(line)
+				buf.WriteString("\n")
+			}
+			continue
+		}
+
+		parts := strings.Split(strings.TrimPrefix(line, batchPrefix), "::")
+		index, err := strconv.Atoi(parts[0])
+
+		if err != nil || len(parts) < 2 {
+			continue
+		}
+
+		switch {
+		case parts[1] == "begin":
+			current = index
+			buf.Reset()
+		case parts[1] == "end" && index == current:
+			code := 1
+			if len(parts) == 3 {
+				code, _ = strconv.Atoi(parts[2])
+			}
+
+			sections[index] = Output{Stdout: buf.String(), Stderr: out.Stderr, ExitCode: code}
+			current = -1
+		}
+	}
+
+	if current >= 0 && !truncated {
+		code := out.ExitCode
+		if code == 0 {
+			code = 1
+		}
+
+		sections[current] = Output{Stdout: buf.String(), Stderr: out.Stderr, ExitCode: code}
+	}
+
+	return sections
+}
+
+// RunBatch runs the script on the instances of the labs with as few
+// SendCommand as SSM allows. Labs whose instance is not managed by SSM or
+// is offline are reported as offline.
+func (p *SSMProvisioner) RunBatch(ctx context.Context, labs []*mysql.Lab, family OSFamily, commands []string) (map[uint64]LabOutput, error) {
+	document := ssm.ShellDocument
+
+	if family == Windows {
+		document = ssm.PowerShellDocument
+	}
+
+	byInstance := make(map[string]*mysql.Lab, len(labs))
+	instanceIDs := make([]string, 0, len(labs))
+
+	for _, lab := range labs {
+		if _, ok := byInstance[lab.InstanceID]; !ok {
+			instanceIDs = append(instanceIDs, lab.InstanceID)
+		}
+
+		byInstance[lab.InstanceID] = lab
+	}
+
+	res, err := p.exec.RunBatch(ctx, instanceIDs, document, commands)
+
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := make(map[uint64]LabOutput, len(labs))
+
+	for _, lab := range labs {
+		result, ok := res[lab.InstanceID]
+
+		if !ok {
+			continue
+		}
+
+		out := LabOutput{
+			Output: Output{
+				Stdout:   result.Stdout,
+				Stderr:   result.Stderr,
+				ExitCode: result.ExitCode,
+			},
+			Truncated: result.Truncated,
+			Err:       result.Err,
+		}
+
+		if errors.Is(result.Err, ssm.ErrInvalidInstance) || errors.Is(result.Err, ssm.ErrUndeliverable) || errors.Is(result.Err, ssm.ErrCancelled) {
+			out.Err = &Error{Kind: KindAgentOffline, Err: result.Err}
+		}
+
+		outputs[lab.ID] = out
+	}
+
+	return outputs, nil
+}
+
+// RunBatch hands the batch to the backend of the labs, which must all share
+// one. ErrBatchUnsupported is returned when the backend cannot run batches.
+func (r *Router) RunBatch(ctx context.Context, labs []*mysql.Lab, family OSFamily, commands []string) (map[uint64]LabOutput, error) {
+	if len(labs) == 0 {
+		return nil, nil
+	}
+
+	backend := labs[0].Backend
+	if backend == "" {
+		backend = mysql.BackendSSM
+	}
+
+	for _, lab := range labs {
+		if lab.Backend != backend && !(lab.Backend == "" && backend == mysql.BackendSSM) {
+			return nil, fmt.Errorf("%w: labs of several backends", ErrBatchUnsupported)
+		}
+	}
+
+	runner, ok := r.backends[backend].(BatchRunner)
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrBatchUnsupported, backend)
+	}
+
+	return runner.RunBatch(ctx, labs, family, commands)
+}
@@ -0,0 +1,83 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+)
+
+// batchProvisioner returns outputs for every batch and applies every step
+// of the scripts it runs alone.
+type batchProvisioner struct {
+	outputs map[uint64]LabOutput
+
+	mu   sync.Mutex
+	runs []uint64
+}
+
+func (p *batchProvisioner) Run(_ context.Context, lab *mysql.Lab, _ OSFamily, _ []string) (Output, error) {
+	p.mu.Lock()
+	p.runs = append(p.runs, lab.ID)
+	p.mu.Unlock()
+
+	return Output{Stdout: Marker("create-user", StepApplied, "0") + "\n"}, nil
+}
+
+func (p *batchProvisioner) RunBatch(context.Context, []*mysql.Lab, OSFamily, []string) (map[uint64]LabOutput, error) {
+	return p.outputs, nil
+}
+
+var batchPlan = Plan{Family: Linux, Steps: []Step{{Name: "create-user", Command: "useradd 'alice'"}}}
+
+// batchSection is what the batch script prints for a job that ran.
+func batchSection(index int) string {
+	return fmt.Sprintf("%s%d::begin\n%s\n%s%d::end::0\n", batchPrefix, index, Marker("create-user", StepApplied, "0"), batchPrefix, index)
+}
+
+func TestApplyBatchFailsOnlyJobsOfOfflineLabs(t *testing.T) {
+	online := &mysql.Lab{ID: 1, InstanceID: "i-online"}
+	offline := &mysql.Lab{ID: 2, InstanceID: "i-offline"}
+
+	p := &batchProvisioner{outputs: map[uint64]LabOutput{
+		online.ID:  {Output: Output{Stdout: batchSection(0)}},
+		offline.ID: {Err: &Error{Kind: KindAgentOffline, Err: errors.New("agent of i-offline is ConnectionLost")}},
+	}}
+
+	results := ApplyBatch(context.Background(), p, []BatchJob{{Lab: online, Plan: batchPlan}, {Lab: offline, Plan: batchPlan}})
+
+	if results[0].Err != nil {
+		t.Errorf("job on the online lab failed: %v", results[0].Err)
+	}
+
+	if !errors.Is(results[1].Err, ErrAgentOffline) {
+		t.Errorf("got %v for the offline lab, want it offline", results[1].Err)
+	}
+}
+
+func TestApplyBatchAppliesJobsCutFromTruncatedOutput(t *testing.T) {
+	lab := &mysql.Lab{ID: 1, InstanceID: "i-lab"}
+
+	p := &batchProvisioner{outputs: map[uint64]LabOutput{
+		lab.ID: {
+			Output:    Output{Stdout: batchSection(0) + fmt.Sprintf("%s1::begin\n%s", batchPrefix, strings.Repeat("x", 64))},
+			Truncated: true,
+		},
+	}}
+
+	results := ApplyBatch(context.Background(), p, []BatchJob{{Lab: lab, Plan: batchPlan}, {Lab: lab, Plan: batchPlan}})
+
+	for i, result := range results {
+		if result.Err != nil {
+			t.Errorf("job %d failed: %v", i, result.Err)
+		}
+	}
+
+	if len(p.runs) != 1 {
+		t.Errorf("applied %d jobs again, want the one cut from the output", len(p.runs))
+	}
+}
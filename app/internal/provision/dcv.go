@@ -0,0 +1,64 @@
+package provision
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// DescribeSessionCommands exits with a non-zero code when the DCV session
+// does not exist on the instance.
+func DescribeSessionCommands(t LabType, session string) []string {
+	if t.Family == Windows {
+		return []string{
+			PowerShellCall(t.DCVPath, "describe-session", session),
+			"exit $LASTEXITCODE",
+		}
+	}
+
+	return []string{
+		ShellJoin(t.DCVPath, "describe-session", session),
+	}
+}
+
+// NotifyUserCommands shows message to the users connected to the DCV
+// session.
+func NotifyUserCommands(t LabType, session string, message string) []string {
+	if t.Family == Windows {
+		return []string{
+			PowerShellCall(t.DCVPath, "notify-user", "--session", session, message),
+			"exit $LASTEXITCODE",
+		}
+	}
+
+	return []string{
+		ShellJoin(t.DCVPath, "notify-user", "--session", session, message),
+	}
+}
+
+// ListConnectionsCommands prints the connections of the DCV session as JSON
+// and exits with a non-zero code when the session does not exist.
+func ListConnectionsCommands(t LabType, session string) []string {
+	if t.Family == Windows {
+		return []string{
+			PowerShellCall(t.DCVPath, "list-connections", "--json", session),
+			"exit $LASTEXITCODE",
+		}
+	}
+
+	return []string{
+		ShellJoin(t.DCVPath, "list-connections", "--json", session),
+	}
+}
+
+// CountConnections returns the number of connections in the output of
+// ListConnectionsCommands.
+func CountConnections(stdout string) (int, error) {
+	var connections []json.RawMessage
+
+	if err := json.Unmarshal([]byte(strings.TrimSpace(stdout)), &connections); err != nil {
+		return 0, fmt.Errorf("parsing dcv connections: %w", err)
+	}
+
+	return len(connections), nil
+}
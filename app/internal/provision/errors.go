@@ -0,0 +1,58 @@
+package provision
+
+import (
+	"fmt"
+)
+
+// Kind classifies the outcome of a provisioning step.
+type Kind string
+
+const (
+	KindUserExists     Kind = "user_exists"
+	KindSessionExists  Kind = "dcv_session_exists"
+	KindStorageMissing Kind = "fs_mount_missing"
+	KindAgentOffline   Kind = "agent_offline"
+	KindStepFailed     Kind = "step_failed"
+)
+
+var (
+	ErrStorageMissing = &Error{Kind: KindStorageMissing}
+	ErrAgentOffline   = &Error{Kind: KindAgentOffline}
+	ErrStepFailed     = &Error{Kind: KindStepFailed}
+)
+
+// Error is returned when a lab could not be provisioned. Output holds the
+// diagnostic output collected from the instance, including compensation.
+type Error struct {
+	Kind    Kind
+	Step    string
+	Output  string
+	Results []StepResult
+	Err     error
+}
+
+func (e *Error) Error() string {
+	msg := string(e.Kind)
+
+	if e.Step != "" {
+		msg = fmt.Sprintf("%s: step %s", msg, e.Step)
+	}
+
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s: %v", msg, e.Err)
+	}
+
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is matches errors of the same kind, so errors.Is(err, ErrAgentOffline)
+// works regardless of the step or output carried by err.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+
+	return ok && t.Kind == e.Kind
+}
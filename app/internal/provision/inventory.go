@@ -0,0 +1,129 @@
+package provision
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// inventoryPrefix starts the lines InventoryCommands prints before each
+// section of the inventory.
+const inventoryPrefix = "::nicelab-inventory::"
+
+// Inventory is what runs on a lab instance: its DCV sessions, the accounts
+// of the managed group and the users with a storage folder.
+type Inventory struct {
+	Sessions []DCVSession `json:"sessions"`
+	Accounts []string     `json:"accounts"`
+	Storage  []string     `json:"storage"`
+}
+
+type DCVSession struct {
+	ID    string `json:"id"`
+	Owner string `json:"owner"`
+}
+
+// InventoryCommands prints the inventory of the instance, one section after
+// the other. They exit with a non-zero code when DCV or the storage cannot
+// be listed, so that a broken server is not mistaken for an empty one.
+func InventoryCommands(t LabType) []string {
+	if t.Family == Windows {
+		storageDir := PowerShellQuote(t.StorageDir)
+
+		return []string{
+			"$sessions = " + PowerShellCall(t.DCVPath, "list-sessions", "--json"),
+			"if ($LASTEXITCODE -ne 0) { exit 1 }",
+			fmt.Sprintf("Write-Output '%ssessions'", inventoryPrefix),
+			"Write-Output ($sessions -join \"`n\")",
+			fmt.Sprintf("Write-Output '%saccounts'", inventoryPrefix),
+			fmt.Sprintf("Get-LocalGroupMember -Group %s -ErrorAction SilentlyContinue | ForEach-Object { $_.Name.Split('\\')[-1] }", PowerShellQuote(t.ManagedGroup)),
+			fmt.Sprintf("if (-not (Test-Path -LiteralPath %s)) { exit 2 }", PowerShellQuote(t.StorageRoot)),
+			fmt.Sprintf("Write-Output '%sstorage'", inventoryPrefix),
+			fmt.Sprintf("Get-ChildItem -LiteralPath %s -Directory | Where-Object { Test-Path -LiteralPath (Join-Path $_.FullName %s) } | ForEach-Object { $_.Name }", PowerShellQuote(t.StorageRoot), storageDir),
+			"exit 0",
+		}
+	}
+
+	return []string{
+		"sessions=$(" + ShellJoin(t.DCVPath, "list-sessions", "--json") + ") || exit 1",
+		fmt.Sprintf("echo '%ssessions'", inventoryPrefix),
+		`printf '%s\n' "$sessions"`,
+		fmt.Sprintf("echo '%saccounts'", inventoryPrefix),
+		fmt.Sprintf("getent group %s | cut -d: -f4 | tr ',' '\\n'", ShellQuote(t.ManagedGroup)),
+		fmt.Sprintf("mountpoint -q %s || exit 2", ShellQuote(t.StorageRoot)),
+		fmt.Sprintf("echo '%sstorage'", inventoryPrefix),
+		fmt.Sprintf("for dir in %s/*/%s; do [ -d \"$dir\" ] && basename \"$(dirname \"$dir\")\"; done", ShellQuote(t.StorageRoot), ShellQuote(t.StorageDir)),
+		"exit 0",
+	}
+}
+
+// ParseInventory reads the output of InventoryCommands. Windows account
+// names are case-insensitive and are returned in lower case.
+func ParseInventory(t LabType, stdout string) (Inventory, error) {
+	var inv Inventory
+	sections := make(map[string][]string)
+	current := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(stdout))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, inventoryPrefix) {
+			current = strings.TrimPrefix(line, inventoryPrefix)
+			sections[current] = []string{}
+			continue
+		}
+
+		if current != "" && line != "" {
+			sections[current] = append(sections[current], line)
+		}
+	}
+
+	for _, name := range []string{"sessions", "accounts", "storage"} {
+		if _, ok := sections[name]; !ok {
+			return Inventory{}, fmt.Errorf("parsing inventory: no %s section", name)
+		}
+	}
+
+	normalize := func(name string) string {
+		if t.Family == Windows {
+			if i := strings.LastIndex(name, `\`); i >= 0 {
+				name = name[i+1:]
+			}
+
+			return strings.ToLower(name)
+		}
+
+		return name
+	}
+
+	if body := strings.Join(sections["sessions"], "\n"); body != "" {
+		if err := json.Unmarshal([]byte(body), &inv.Sessions); err != nil {
+			return Inventory{}, fmt.Errorf("parsing dcv sessions: %w", err)
+		}
+	}
+
+	if inv.Sessions == nil {
+		return Inventory{}, errors.New("parsing dcv sessions: no session list")
+	}
+
+	for i := range inv.Sessions {
+		inv.Sessions[i].Owner = normalize(inv.Sessions[i].Owner)
+	}
+
+	inv.Accounts = make([]string, 0, len(sections["accounts"]))
+	for _, account := range sections["accounts"] {
+		inv.Accounts = append(inv.Accounts, normalize(account))
+	}
+
+	inv.Storage = make([]string, 0, len(sections["storage"]))
+	for _, folder := range sections["storage"] {
+		inv.Storage = append(inv.Storage, normalize(folder))
+	}
+
+	return inv, nil
+}
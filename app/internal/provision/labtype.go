@@ -0,0 +1,91 @@
+package provision
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+)
+
+var ErrUnknownLabType = errors.New("unknown lab type")
+
+// LabType describes how a kind of lab instance is provisioned. Profile names
+// the template used when the lab does not have one attached. Accounts created
+// for sessions join ManagedGroup, which tells them apart from the other
+// accounts of the instance.
+type LabType struct {
+	Name         mysql.LabType `json:"name"`
+	Family       OSFamily      `json:"family"`
+	Profile      string        `json:"profile"`
+	DCVPath      string        `json:"dcv_path"`
+	StorageRoot  string        `json:"storage_root"`
+	StorageDir   string        `json:"storage_dir"`
+	HomeRoot     string        `json:"home_root"`
+	ManagedGroup string        `json:"managed_group"`
+}
+
+var (
+	debianLabType = LabType{
+		Family:       Linux,
+		Profile:      "debian",
+		DCVPath:      "/usr/bin/dcv",
+		StorageRoot:  "/var/fsx",
+		StorageDir:   "linux",
+		HomeRoot:     "/home",
+		ManagedGroup: "nicelab",
+	}
+	rhelLabType = LabType{
+		Family:       Linux,
+		Profile:      "rhel",
+		DCVPath:      "/usr/bin/dcv",
+		StorageRoot:  "/var/fsx",
+		StorageDir:   "linux",
+		HomeRoot:     "/home",
+		ManagedGroup: "nicelab",
+	}
+	windowsLabType = LabType{
+		Family:       Windows,
+		Profile:      "windows",
+		DCVPath:      "C:\\Program Files\\NICE\\DCV\\Server\\bin\\dcv.exe",
+		StorageRoot:  "Z:\\",
+		StorageDir:   "windows",
+		HomeRoot:     "C:\\Users",
+		ManagedGroup: "nicelab",
+	}
+)
+
+var labTypes = map[mysql.LabType]LabType{
+	mysql.Kali:        withName(debianLabType, mysql.Kali),
+	mysql.Ubuntu:      withName(debianLabType, mysql.Ubuntu),
+	mysql.AmazonLinux: withName(rhelLabType, mysql.AmazonLinux),
+	mysql.RHEL:        withName(rhelLabType, mysql.RHEL),
+	mysql.Windows:     withName(windowsLabType, mysql.Windows),
+}
+
+func withName(t LabType, name mysql.LabType) LabType {
+	t.Name = name
+	return t
+}
+
+func LookupLabType(name mysql.LabType) (LabType, error) {
+	t, ok := labTypes[name]
+
+	if !ok {
+		return LabType{}, fmt.Errorf("%w: %q", ErrUnknownLabType, name)
+	}
+
+	return t, nil
+}
+
+func LabTypes() []LabType {
+	list := make([]LabType, 0, len(labTypes))
+
+	for _, t := range labTypes {
+		list = append(list, t)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
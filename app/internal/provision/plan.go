@@ -0,0 +1,282 @@
+package provision
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+)
+
+type OSFamily string
+
+const (
+	Linux   OSFamily = "linux"
+	Windows OSFamily = "windows"
+)
+
+// MarkerPrefix starts the lines the generated scripts print after each step.
+const MarkerPrefix = "::nicelab::"
+
+type StepStatus string
+
+const (
+	StepApplied StepStatus = "applied"
+	StepExists  StepStatus = "exists"
+	StepFailed  StepStatus = "failed"
+	StepSkipped StepStatus = "skipped"
+)
+
+// Step is a single provisioning action. When Exists succeeds on the instance
+// the step is considered already applied and Command is not run. Undo
+// reverts Command and is used for compensation when a later step fails.
+type Step struct {
+	Name       string
+	Command    string
+	Exists     string
+	Undo       string
+	ExistsKind Kind
+	FailKind   Kind
+}
+
+type StepResult struct {
+	Step     string     `json:"step"`
+	Status   StepStatus `json:"status"`
+	Kind     Kind       `json:"kind,omitempty"`
+	ExitCode int        `json:"exit_code"`
+	Output   string     `json:"output,omitempty"`
+}
+
+// Output is what a Provisioner collected from running a script.
+type Output struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+func (o Output) String() string {
+	if o.Stderr == "" {
+		return o.Stdout
+	}
+
+	return fmt.Sprintf("%s\n--- stderr ---\n%s", o.Stdout, o.Stderr)
+}
+
+type Plan struct {
+	Family OSFamily
+	Steps  []Step
+}
+
+// Script renders the plan as commands that report each step's outcome and
+// stop at the first failing step.
+func (p Plan) Script() []string {
+	commands := make([]string, 0, len(p.Steps)+1)
+
+	if p.Family == Windows {
+		commands = append(commands, "$ErrorActionPreference = 'Stop'")
+	}
+
+	for _, step := range p.Steps {
+		if p.Family == Windows {
+			commands = append(commands, powerShellStep(step))
+		} else {
+			commands = append(commands, shellStep(step))
+		}
+	}
+
+	return commands
+}
+
+// UndoScript renders the compensation for the steps that were applied, in
+// reverse order. Steps that already existed are left untouched.
+func (p Plan) UndoScript(results []StepResult) []string {
+	applied := make(map[string]bool)
+	for _, result := range results {
+		if result.Status == StepApplied {
+			applied[result.Step] = true
+		}
+	}
+
+	var commands []string
+	for i := len(p.Steps) - 1; i >= 0; i-- {
+		step := p.Steps[i]
+
+		if step.Undo == "" || !applied[step.Name] {
+			continue
+		}
+
+		if p.Family == Windows {
+			commands = append(commands, fmt.Sprintf("try { %s } catch { Write-Output $_ }", step.Undo))
+		} else {
+			commands = append(commands, fmt.Sprintf("%s || true", step.Undo))
+		}
+	}
+
+	return commands
+}
+
+// Results matches the markers printed by Script against the plan steps.
+func (p Plan) Results(out Output) []StepResult {
+	reported := make(map[string]StepResult)
+	var buf strings.Builder
+
+	scanner := bufio.NewScanner(strings.NewReader(out.Stdout))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if !strings.HasPrefix(line, MarkerPrefix) {
+			buf.WriteString(line)
+			buf.WriteString("\n")
+			continue
+		}
+
+		parts := strings.Split(strings.TrimPrefix(line, MarkerPrefix), "::")
+		if len(parts) != 3 {
+			continue
+		}
+
+		code, _ := strconv.Atoi(parts[2])
+		reported[parts[0]] = StepResult{
+			Step:     parts[0],
+			Status:   StepStatus(parts[1]),
+			ExitCode: code,
+			Output:   strings.TrimSpace(buf.String()),
+		}
+		buf.Reset()
+	}
+
+	results := make([]StepResult, 0, len(p.Steps))
+	failed := false
+
+	for _, step := range p.Steps {
+		result, ok := reported[step.Name]
+
+		switch {
+		case !ok && !failed && out.ExitCode != 0:
+			result = StepResult{Step: step.Name, Status: StepFailed, ExitCode: out.ExitCode}
+		case !ok:
+			result = StepResult{Step: step.Name, Status: StepSkipped}
+		}
+
+		switch result.Status {
+		case StepExists:
+			result.Kind = step.ExistsKind
+		case StepFailed:
+			failed = true
+			result.Kind = step.FailKind
+			if result.Kind == "" {
+				result.Kind = KindStepFailed
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// Apply runs the plan and classifies every step. When a step fails, the
+// steps applied before it are undone and an *Error describing the failure
+// is returned.
+func Apply(ctx context.Context, p Provisioner, lab *mysql.Lab, plan Plan) ([]StepResult, error) {
+	out, err := p.Run(ctx, lab, plan.Family, plan.Script())
+
+	if err != nil {
+		return nil, asError(err, out)
+	}
+
+	return classify(ctx, p, lab, plan, out)
+}
+
+// classify matches the output of the plan against its steps and undoes the
+// applied steps when one failed.
+func classify(ctx context.Context, p Provisioner, lab *mysql.Lab, plan Plan, out Output) ([]StepResult, error) {
+	results := plan.Results(out)
+
+	for _, result := range results {
+		if result.Status != StepFailed {
+			continue
+		}
+
+		diagnostics := out.String()
+
+		if undo := plan.UndoScript(results); len(undo) > 0 {
+			undoOut, undoErr := p.Run(ctx, lab, plan.Family, undo)
+
+			diagnostics = fmt.Sprintf("%s\n--- compensation ---\n%s", diagnostics, undoOut)
+			if undoErr != nil {
+				diagnostics = fmt.Sprintf("%s\n%v", diagnostics, undoErr)
+			}
+		}
+
+		return results, &Error{
+			Kind:    result.Kind,
+			Step:    result.Step,
+			Output:  diagnostics,
+			Results: results,
+		}
+	}
+
+	return results, nil
+}
+
+func asError(err error, out Output) *Error {
+	if e, ok := err.(*Error); ok {
+		if e.Output == "" {
+			e.Output = out.String()
+		}
+		return e
+	}
+
+	return &Error{Kind: KindStepFailed, Output: out.String(), Err: err}
+}
+
+// Marker is the line a generated script prints once the step ended with
+// status and the exit code, which may be a variable of the script.
+func Marker(step string, status StepStatus, code string) string {
+	return fmt.Sprintf("%s%s::%s::%s", MarkerPrefix, step, status, code)
+}
+
+func shellStep(step Step) string {
+	run := fmt.Sprintf(
+		"{ %s ; } 2>&1; rc=$?; if [ $rc -ne 0 ]; then echo \"%s\"; exit $rc; fi; echo \"%s\"",
+		step.Command,
+		Marker(step.Name, StepFailed, "$rc"),
+		Marker(step.Name, StepApplied, "0"),
+	)
+
+	if step.Exists == "" {
+		return run
+	}
+
+	return fmt.Sprintf(
+		"if { %s ; } >/dev/null 2>&1; then echo \"%s\"; else %s; fi",
+		step.Exists,
+		Marker(step.Name, StepExists, "0"),
+		run,
+	)
+}
+
+func powerShellStep(step Step) string {
+	run := fmt.Sprintf(
+		"$global:LASTEXITCODE = 0; try { & { %s }; $nlRc = [int]$global:LASTEXITCODE } catch { Write-Output $_; $nlRc = 1 }; "+
+			"if ($nlRc -ne 0) { Write-Output \"%s\"; exit $nlRc }; Write-Output '%s'",
+		step.Command,
+		Marker(step.Name, StepFailed, "$nlRc"),
+		Marker(step.Name, StepApplied, "0"),
+	)
+
+	if step.Exists == "" {
+		return run
+	}
+
+	return fmt.Sprintf(
+		"$global:LASTEXITCODE = 0; $nlExists = $false; try { & { %s } *> $null; $nlExists = ([int]$global:LASTEXITCODE -eq 0) } catch { }; "+
+			"if ($nlExists) { Write-Output '%s' } else { %s }",
+		step.Exists,
+		Marker(step.Name, StepExists, "0"),
+		run,
+	)
+}
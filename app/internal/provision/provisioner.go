@@ -0,0 +1,39 @@
+package provision
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+)
+
+// Provisioner runs commands on a lab instance as a single script and
+// returns what the script printed. A non-zero exit code is not an error;
+// errors are reserved for failing to reach the instance.
+type Provisioner interface {
+	Run(ctx context.Context, lab *mysql.Lab, family OSFamily, commands []string) (Output, error)
+}
+
+// Router dispatches to the provisioner configured for the lab's backend.
+type Router struct {
+	backends map[mysql.LabBackend]Provisioner
+}
+
+func NewRouter(backends map[mysql.LabBackend]Provisioner) *Router {
+	return &Router{backends: backends}
+}
+
+func (r *Router) Run(ctx context.Context, lab *mysql.Lab, family OSFamily, commands []string) (Output, error) {
+	backend := lab.Backend
+	if backend == "" {
+		backend = mysql.BackendSSM
+	}
+
+	p, ok := r.backends[backend]
+
+	if !ok || p == nil {
+		return Output{}, fmt.Errorf("lab %d: backend %q is not configured", lab.ID, backend)
+	}
+
+	return p.Run(ctx, lab, family, commands)
+}
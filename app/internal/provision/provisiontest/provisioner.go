@@ -0,0 +1,105 @@
+// Package provisiontest provides a fake provisioner for testing code that
+// provisions labs, without reaching any instance.
+package provisiontest
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/provision"
+)
+
+// Call is a script the Provisioner was asked to run.
+type Call struct {
+	LabID    uint64
+	Family   provision.OSFamily
+	Commands []string
+}
+
+// Script returns the commands of the call as a single script.
+func (c Call) Script() string {
+	return strings.Join(c.Commands, "\n")
+}
+
+// Provisioner records every script it runs and simulates their outcome.
+// Scripts rendered from a Plan report every step as applied unless
+// configured otherwise.
+type Provisioner struct {
+	// Existing steps report that they were already applied.
+	Existing map[string]bool
+	// FailStep makes the named step fail with FailExitCode.
+	FailStep     string
+	FailExitCode int
+	// ExitCode is returned for scripts that are not rendered from a Plan.
+	ExitCode int
+	// Err is returned for every call, e.g. to simulate an offline agent.
+	Err error
+	// Respond overrides the simulation entirely when set.
+	Respond func(call Call) (provision.Output, error)
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+var stepMarker = regexp.MustCompile(regexp.QuoteMeta(provision.MarkerPrefix) + `([a-z0-9-]+)::` + string(provision.StepApplied))
+
+func (f *Provisioner) Run(_ context.Context, lab *mysql.Lab, family provision.OSFamily, commands []string) (provision.Output, error) {
+	call := Call{LabID: lab.ID, Family: family, Commands: append([]string(nil), commands...)}
+
+	f.mu.Lock()
+	f.calls = append(f.calls, call)
+	f.mu.Unlock()
+
+	if f.Respond != nil {
+		return f.Respond(call)
+	}
+
+	if f.Err != nil {
+		return provision.Output{}, f.Err
+	}
+
+	var out strings.Builder
+	steps := 0
+
+	for _, command := range commands {
+		match := stepMarker.FindStringSubmatch(command)
+		if match == nil {
+			continue
+		}
+
+		steps++
+		step := match[1]
+
+		switch {
+		case step == f.FailStep:
+			code := f.FailExitCode
+			if code == 0 {
+				code = 1
+			}
+			out.WriteString(fmt.Sprintf("simulated failure of %s\n%s\n", step, provision.Marker(step, provision.StepFailed, fmt.Sprint(code))))
+			return provision.Output{Stdout: out.String(), ExitCode: code}, nil
+		case f.Existing[step]:
+			out.WriteString(provision.Marker(step, provision.StepExists, "0") + "\n")
+		default:
+			out.WriteString(provision.Marker(step, provision.StepApplied, "0") + "\n")
+		}
+	}
+
+	if steps == 0 {
+		return provision.Output{ExitCode: f.ExitCode}, nil
+	}
+
+	return provision.Output{Stdout: out.String()}, nil
+}
+
+// Calls returns the scripts run so far.
+func (f *Provisioner) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]Call(nil), f.calls...)
+}
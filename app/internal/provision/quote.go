@@ -0,0 +1,90 @@
+package provision
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// usernamePattern accepts portable POSIX user names that are also valid
+// Windows local account names. The length limit matches both the Windows
+// limit and the users.username column.
+var usernamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,19}$`)
+
+var reservedUsernames = map[string]bool{
+	"root":           true,
+	"admin":          true,
+	"administrator":  true,
+	"guest":          true,
+	"defaultaccount": true,
+	"nobody":         true,
+	"daemon":         true,
+	"dcv":            true,
+	"dcvsmagent":     true,
+	"ssm-user":       true,
+	"ec2-user":       true,
+	"kali":           true,
+	"ubuntu":         true,
+}
+
+var ErrInvalidUsername = errors.New("invalid username")
+
+// ValidateUsername rejects names that cannot be used verbatim as an OS
+// account on every lab type.
+func ValidateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return fmt.Errorf("%w: %q must match %s", ErrInvalidUsername, username, usernamePattern)
+	}
+
+	if reservedUsernames[username] {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidUsername, username)
+	}
+
+	return nil
+}
+
+// ShellQuote quotes s as a single POSIX shell word. NUL bytes cannot be
+// passed in an argument and are dropped.
+func ShellQuote(s string) string {
+	s = strings.ReplaceAll(s, "\x00", "")
+
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+// ShellJoin quotes every argument and joins them into a command line.
+func ShellJoin(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = ShellQuote(arg)
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// powerShellQuotes are the characters PowerShell treats as a single quote.
+var powerShellQuotes = strings.NewReplacer(
+	"'", "''",
+	"‘", "‘‘",
+	"’", "’’",
+	"‚", "‚‚",
+	"‛", "‛‛",
+	"\x00", "",
+)
+
+// PowerShellQuote quotes s as a verbatim PowerShell string literal.
+func PowerShellQuote(s string) string {
+	return "'" + powerShellQuotes.Replace(s) + "'"
+}
+
+// PowerShellCall invokes the executable at path with every argument passed
+// as a verbatim string literal.
+func PowerShellCall(path string, args ...string) string {
+	quoted := make([]string, len(args)+1)
+	quoted[0] = PowerShellQuote(path)
+	for i, arg := range args {
+		quoted[i+1] = PowerShellQuote(arg)
+	}
+
+	return "& " + strings.Join(quoted, " ")
+}
@@ -0,0 +1,139 @@
+package provision
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+var quoteSeeds = []string{
+	"",
+	"alice",
+	"it's",
+	`"double"`,
+	"$(id) `id` ${HOME} $HOME",
+	"; rm -rf / #",
+	"'; echo injected; '",
+	"a\nb\r\nc",
+	"\\'\\",
+	"tab\there",
+	"nul\x00byte",
+	"‘smart’ ‚quotes‛",
+	"$env:PATH @(1) $(Get-Date)",
+	"unicode ☃ ünïcödé",
+}
+
+// FuzzShellQuote checks that the quoted value reaches sh as one argument
+// holding exactly the value, without its NUL bytes.
+func FuzzShellQuote(f *testing.F) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		f.Skip("sh is not installed")
+	}
+
+	for _, seed := range quoteSeeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		out, err := exec.Command("sh", "-c", "printf %s "+ShellQuote(s)).Output()
+
+		if err != nil {
+			t.Fatalf("sh failed for %q: %v", s, err)
+		}
+
+		if want := strings.ReplaceAll(s, "\x00", ""); string(out) != want {
+			t.Fatalf("ShellQuote(%q) printed %q", s, out)
+		}
+	})
+}
+
+// FuzzPowerShellQuote checks that PowerShell parses the quoted value as a
+// string literal holding exactly the value, without its NUL bytes. The
+// script is passed encoded, so that the command line cannot alter it.
+func FuzzPowerShellQuote(f *testing.F) {
+	shell := powerShell()
+
+	if shell == "" {
+		f.Skip("PowerShell is not installed")
+	}
+
+	for _, seed := range quoteSeeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		if !utf8.ValidString(s) {
+			t.Skip("PowerShell scripts are UTF-16")
+		}
+
+		script := "[Console]::OutputEncoding = [Text.UTF8Encoding]::new($false); [Console]::Out.Write(" + PowerShellQuote(s) + ")"
+		out, err := exec.Command(shell, "-NoProfile", "-NonInteractive", "-EncodedCommand", encodePowerShell(script)).Output()
+
+		if err != nil {
+			t.Fatalf("%s failed for %q: %v", shell, s, err)
+		}
+
+		if want := strings.ReplaceAll(s, "\x00", ""); string(out) != want {
+			t.Fatalf("PowerShellQuote(%q) printed %q", s, out)
+		}
+	})
+}
+
+func powerShell() string {
+	for _, name := range []string{"pwsh", "powershell"} {
+		if path, err := exec.LookPath(name); err == nil {
+			return path
+		}
+	}
+
+	return ""
+}
+
+func TestValidateUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		valid    bool
+	}{
+		{"alice", true},
+		{"_svc", true},
+		{"j-doe_2", true},
+		{"a", true},
+		{"abcdefghijklmnopqrst", true},
+		{"abcdefghijklmnopqrstu", false},
+		{"1alice", false},
+		{"9", false},
+		{"-alice", false},
+		{"Alice", false},
+		{"", false},
+		{"al ice", false},
+		{"al'ice", false},
+		{"alice\n", false},
+		{"root", false},
+		{"admin", false},
+		{"administrator", false},
+		{"guest", false},
+		{"defaultaccount", false},
+		{"nobody", false},
+		{"daemon", false},
+		{"dcv", false},
+		{"dcvsmagent", false},
+		{"ssm-user", false},
+		{"ec2-user", false},
+		{"kali", false},
+		{"ubuntu", false},
+	}
+
+	for _, tt := range tests {
+		err := ValidateUsername(tt.username)
+
+		if tt.valid && err != nil {
+			t.Errorf("ValidateUsername(%q) = %v, want nil", tt.username, err)
+		}
+
+		if !tt.valid && !errors.Is(err, ErrInvalidUsername) {
+			t.Errorf("ValidateUsername(%q) = %v, want ErrInvalidUsername", tt.username, err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHProvisioner runs commands over SSH with key based authentication, for
+// labs that do not have the SSM agent. The script is sent on stdin to a
+// privileged shell on Linux and to PowerShell on Windows.
+type SSHProvisioner struct {
+	cfg          config.SSHConfig
+	clientConfig *ssh.ClientConfig
+}
+
+func NewSSHProvisioner(cfg config.SSHConfig) (*SSHProvisioner, error) {
+	key, err := os.ReadFile(cfg.PrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+
+	if !cfg.InsecureIgnoreHostKey {
+		if hostKeyCallback, err = knownhosts.New(cfg.KnownHostsPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return &SSHProvisioner{
+		cfg: cfg,
+		clientConfig: &ssh.ClientConfig{
+			User:            cfg.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         cfg.DialTimeout,
+		},
+	}, nil
+}
+
+func (p *SSHProvisioner) Run(ctx context.Context, lab *mysql.Lab, family OSFamily, commands []string) (Output, error) {
+	addr := net.JoinHostPort(lab.Hostname, strconv.Itoa(p.cfg.Port))
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return Output{}, &Error{Kind: KindAgentOffline, Err: err}
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, p.clientConfig)
+	if err != nil {
+		_ = conn.Close()
+		return Output{}, &Error{Kind: KindAgentOffline, Err: err}
+	}
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return Output{}, err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	session.Stdin = strings.NewReader(strings.Join(commands, "\n") + "\n")
+
+	remote := "sudo -n sh -s"
+	if family == Windows {
+		remote = "powershell -NoProfile -NonInteractive -Command -"
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(remote)
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		_ = session.Signal(ssh.SIGKILL)
+		_ = client.Close()
+		return Output{}, ctx.Err()
+	}
+
+	out := Output{Stdout: stdout.String(), Stderr: stderr.String()}
+
+	var exitErr *ssh.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		out.ExitCode = exitErr.ExitStatus()
+	case err != nil:
+		return out, fmt.Errorf("ssh %s: %w", addr, err)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,40 @@
+package provision
+
+import (
+	"context"
+	"errors"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/ssm"
+)
+
+// SSMProvisioner runs commands through the SSM agent on the lab instance.
+type SSMProvisioner struct {
+	exec *ssm.Executor
+}
+
+func NewSSMProvisioner(exec *ssm.Executor) *SSMProvisioner {
+	return &SSMProvisioner{exec: exec}
+}
+
+func (p *SSMProvisioner) Run(ctx context.Context, lab *mysql.Lab, family OSFamily, commands []string) (Output, error) {
+	document := ssm.ShellDocument
+
+	if family == Windows {
+		document = ssm.PowerShellDocument
+	}
+
+	res, err := p.exec.Run(ctx, lab.InstanceID, document, commands)
+
+	out := Output{
+		Stdout:   res.Stdout,
+		Stderr:   res.Stderr,
+		ExitCode: res.ExitCode,
+	}
+
+	if errors.Is(err, ssm.ErrInvalidInstance) || errors.Is(err, ssm.ErrUndeliverable) {
+		return out, &Error{Kind: KindAgentOffline, Err: err}
+	}
+
+	return out, err
+}
@@ -0,0 +1,402 @@
+package provision
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed templates/*.yaml
+var embeddedTemplates embed.FS
+
+type TemplateKind string
+
+const (
+	KindProvision TemplateKind = "provision"
+	KindTeardown  TemplateKind = "teardown"
+	// KindWarm creates a generic account with its DCV session ahead of
+	// time, and KindBind hands it to a user; see Template.Warm.
+	KindWarm TemplateKind = "warm"
+	KindBind TemplateKind = "bind"
+)
+
+var (
+	ErrTemplateNotFound = errors.New("provisioning template not found")
+	ErrInvalidTemplate  = errors.New("invalid provisioning template")
+)
+
+var stepNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// TemplateData is available to every step of a template.
+type TemplateData struct {
+	User     mysql.User
+	Lab      mysql.Lab
+	Type     LabType
+	Session  SessionData
+	Password string
+}
+
+type SessionData struct {
+	ID   uint64
+	Name string
+}
+
+type StepTemplate struct {
+	Name       string `yaml:"name" json:"name"`
+	Run        string `yaml:"run" json:"run"`
+	Exists     string `yaml:"exists,omitempty" json:"exists,omitempty"`
+	Undo       string `yaml:"undo,omitempty" json:"undo,omitempty"`
+	ExistsKind Kind   `yaml:"exists_kind,omitempty" json:"exists_kind,omitempty"`
+	FailKind   Kind   `yaml:"fail_kind,omitempty" json:"fail_kind,omitempty"`
+
+	run, exists, undo *template.Template
+}
+
+// Template describes the steps that provision and tear down a user session
+// on one kind of lab. Templates are versioned and immutable once stored.
+//
+// Templates with Warm and Bind steps support warm pools. Warm steps render
+// with the generic account as the user and Bind steps with the user of the
+// session, the account being the session name; warm accounts are torn down
+// with the Teardown steps.
+type Template struct {
+	Name      string         `yaml:"name" json:"name"`
+	Version   int            `yaml:"version" json:"version"`
+	Family    OSFamily       `yaml:"family" json:"family"`
+	Provision []StepTemplate `yaml:"provision" json:"provision"`
+	Teardown  []StepTemplate `yaml:"teardown" json:"teardown"`
+	Warm      []StepTemplate `yaml:"warm,omitempty" json:"warm,omitempty"`
+	Bind      []StepTemplate `yaml:"bind,omitempty" json:"bind,omitempty"`
+	Source    string         `yaml:"-" json:"source"`
+}
+
+var templateFuncs = template.FuncMap{
+	"sh":     ShellQuote,
+	"shjoin": ShellJoin,
+	"ps":     PowerShellQuote,
+	"pscall": PowerShellCall,
+}
+
+// ParseTemplate decodes and validates a template. Every step must parse,
+// render against sample data and quote every interpolated string.
+func ParseTemplate(body []byte, source string) (*Template, error) {
+	var t Template
+
+	decoder := yaml.NewDecoder(bytes.NewReader(body))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(&t); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidTemplate, source, err)
+	}
+
+	t.Source = source
+
+	if err := t.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidTemplate, source, err)
+	}
+
+	return &t, nil
+}
+
+// Render returns the plan of the given kind for the data.
+func (t *Template) Render(kind TemplateKind, data TemplateData) (Plan, error) {
+	if err := ValidateUsername(data.User.UserName); err != nil {
+		return Plan{}, err
+	}
+
+	return t.render(kind, data)
+}
+
+// Warms tells whether the template supports warm pools.
+func (t *Template) Warms() bool {
+	return len(t.Warm) > 0 && len(t.Bind) > 0
+}
+
+func (t *Template) steps(kind TemplateKind) []StepTemplate {
+	switch kind {
+	case KindTeardown:
+		return t.Teardown
+	case KindWarm:
+		return t.Warm
+	case KindBind:
+		return t.Bind
+	}
+
+	return t.Provision
+}
+
+func (t *Template) render(kind TemplateKind, data TemplateData) (Plan, error) {
+	steps := t.steps(kind)
+
+	plan := Plan{Family: t.Family, Steps: make([]Step, 0, len(steps))}
+
+	for _, st := range steps {
+		step := Step{Name: st.Name, ExistsKind: st.ExistsKind, FailKind: st.FailKind}
+
+		var err error
+		if step.Command, err = execute(st.run, data); err != nil {
+			return Plan{}, fmt.Errorf("step %s: %w", st.Name, err)
+		}
+		if step.Exists, err = execute(st.exists, data); err != nil {
+			return Plan{}, fmt.Errorf("step %s: %w", st.Name, err)
+		}
+		if step.Undo, err = execute(st.undo, data); err != nil {
+			return Plan{}, fmt.Errorf("step %s: %w", st.Name, err)
+		}
+
+		plan.Steps = append(plan.Steps, step)
+	}
+
+	return plan, nil
+}
+
+func (t *Template) validate() error {
+	if t.Name == "" || !stepNamePattern.MatchString(t.Name) {
+		return fmt.Errorf("name %q must match %s", t.Name, stepNamePattern)
+	}
+
+	if t.Version < 1 {
+		return fmt.Errorf("version must be positive")
+	}
+
+	if t.Family != Linux && t.Family != Windows {
+		return fmt.Errorf("unknown family %q", t.Family)
+	}
+
+	if len(t.Provision) == 0 {
+		return fmt.Errorf("no provision steps")
+	}
+
+	if (len(t.Warm) == 0) != (len(t.Bind) == 0) {
+		return fmt.Errorf("warm and bind steps go together")
+	}
+
+	for _, steps := range [][]StepTemplate{t.Provision, t.Teardown, t.Warm, t.Bind} {
+		seen := make(map[string]bool)
+
+		for i := range steps {
+			st := &steps[i]
+
+			if !stepNamePattern.MatchString(st.Name) {
+				return fmt.Errorf("step name %q must match %s", st.Name, stepNamePattern)
+			}
+			if seen[st.Name] {
+				return fmt.Errorf("duplicate step %q", st.Name)
+			}
+			seen[st.Name] = true
+
+			if strings.TrimSpace(st.Run) == "" {
+				return fmt.Errorf("step %s has no run command", st.Name)
+			}
+
+			var err error
+			if st.run, err = parse(st.Name, st.Run); err != nil {
+				return err
+			}
+			if st.exists, err = parse(st.Name, st.Exists); err != nil {
+				return err
+			}
+			if st.undo, err = parse(st.Name, st.Undo); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, kind := range []TemplateKind{KindProvision, KindTeardown, KindWarm, KindBind} {
+		plan, err := t.render(kind, probeData)
+		if err != nil {
+			return err
+		}
+
+		for _, step := range plan.Steps {
+			for _, cmd := range []string{step.Command, step.Exists, step.Undo} {
+				if unquotedProbe.MatchString(cmd) {
+					return fmt.Errorf("step %s interpolates a value without sh/ps quoting", step.Name)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// probeData fills every string with a value containing a quote. Quoting
+// functions escape it, so finding it verbatim in a rendered command means a
+// value was interpolated unquoted.
+var probeData = TemplateData{
+	User: mysql.User{
+		ID:       1,
+		UUID:     "nlprobe'0",
+		Name:     "nlprobe'1",
+		Email:    "nlprobe'2",
+		Type:     mysql.Student,
+		UserName: "nlprobe'3",
+	},
+	Lab: mysql.Lab{
+		ID:         1,
+		UUID:       "nlprobe'4",
+		Name:       "nlprobe'5",
+		Type:       "nlprobe'6",
+		Hostname:   "nlprobe'7",
+		InstanceID: "nlprobe'8",
+	},
+	Type: LabType{
+		Name:         "nlprobe'9",
+		Family:       "nlprobe'10",
+		Profile:      "nlprobe'11",
+		DCVPath:      "nlprobe'12",
+		StorageRoot:  "nlprobe'13",
+		StorageDir:   "nlprobe'14",
+		HomeRoot:     "nlprobe'15",
+		ManagedGroup: "nlprobe'16",
+	},
+	Session:  SessionData{ID: 1, Name: "nlprobe'17"},
+	Password: "nlprobe'18",
+}
+
+var unquotedProbe = regexp.MustCompile(`nlprobe'\d`)
+
+func parse(name string, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+
+	tpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("step %s: %v", name, err)
+	}
+
+	return tpl, nil
+}
+
+func execute(tpl *template.Template, data TemplateData) (string, error) {
+	if tpl == nil {
+		return "", nil
+	}
+
+	var buf strings.Builder
+	if err := tpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// Templates holds every version of the templates loaded from files.
+type Templates struct {
+	byName map[string][]*Template
+}
+
+// LoadTemplates loads the built-in templates and then every *.yaml file in
+// dir, which may add new templates or versions. dir may be empty.
+func LoadTemplates(dir string) (*Templates, error) {
+	templates := &Templates{byName: make(map[string][]*Template)}
+
+	entries, err := embeddedTemplates.ReadDir("templates")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		body, err := embeddedTemplates.ReadFile("templates/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		if err := templates.add(body, "embedded:"+entry.Name()); err != nil {
+			return nil, err
+		}
+	}
+
+	if dir == "" {
+		return templates, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		body, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := templates.add(body, file); err != nil {
+			return nil, err
+		}
+	}
+
+	return templates, nil
+}
+
+func (ts *Templates) add(body []byte, source string) error {
+	t, err := ParseTemplate(body, source)
+	if err != nil {
+		return err
+	}
+
+	versions := ts.byName[t.Name]
+	for i, existing := range versions {
+		if existing.Version == t.Version {
+			versions[i] = t
+			return nil
+		}
+	}
+
+	versions = append(versions, t)
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	ts.byName[t.Name] = versions
+
+	return nil
+}
+
+// Get returns the given version of a template, or the latest one when
+// version is zero.
+func (ts *Templates) Get(name string, version int) (*Template, error) {
+	versions := ts.byName[name]
+
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+
+	if version == 0 {
+		return versions[len(versions)-1], nil
+	}
+
+	for _, t := range versions {
+		if t.Version == version {
+			return t, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s version %d", ErrTemplateNotFound, name, version)
+}
+
+func (ts *Templates) List() []*Template {
+	var list []*Template
+
+	for _, versions := range ts.byName {
+		list = append(list, versions...)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Version < list[j].Version
+	})
+
+	return list
+}
@@ -0,0 +1,283 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/config"
+)
+
+var ErrExceeded = errors.New("quota exceeded")
+
+type Kind string
+
+const (
+	KindConcurrentSessions Kind = "concurrent_sessions"
+	KindWeeklyHours        Kind = "weekly_hours"
+	KindCourseHours        Kind = "course_hours"
+)
+
+// Allowance is one limit with its usage. A nil limit is unlimited.
+type Allowance struct {
+	Limit     *float64 `json:"limit"`
+	Used      float64  `json:"used"`
+	Remaining *float64 `json:"remaining"`
+}
+
+func allowance(limit *int, used float64) Allowance {
+	a := Allowance{Used: used}
+
+	if limit != nil {
+		l := float64(*limit)
+		remaining := l - used
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		a.Limit, a.Remaining = &l, &remaining
+	}
+
+	return a
+}
+
+func (a Allowance) exhausted() bool {
+	return a.Remaining != nil && *a.Remaining <= 0
+}
+
+type CourseAllowance struct {
+	CourseID uint64 `json:"course_id"`
+	Name     string `json:"name"`
+	Allowance
+}
+
+// Report is the usage of a user against their limits.
+type Report struct {
+	ConcurrentSessions Allowance         `json:"concurrent_sessions"`
+	WeeklyHours        Allowance         `json:"weekly_hours"`
+	WeekResetsAt       time.Time         `json:"week_resets_at"`
+	Courses            []CourseAllowance `json:"courses"`
+	Exempt             bool              `json:"exempt"`
+}
+
+// Exceeded tells which limit refused a session.
+type Exceeded struct {
+	Kind      Kind       `json:"error"`
+	Limit     float64    `json:"limit"`
+	Used      float64    `json:"used"`
+	CourseID  *uint64    `json:"course_id,omitempty"`
+	ResetsAt  *time.Time `json:"resets_at,omitempty"`
+	Message   string     `json:"message"`
+	Temporary bool       `json:"-"`
+}
+
+func (e *Exceeded) Error() string {
+	return fmt.Sprintf("%s: %s", ErrExceeded, e.Message)
+}
+
+func (e *Exceeded) Unwrap() error {
+	return ErrExceeded
+}
+
+// Checker evaluates the concurrent session and weekly hour limits of
+// students, overridable per user, and the lab hour budget of courses.
+// Professors are not limited.
+type Checker struct {
+	quotaRep  *mysql.QuotaRepository
+	courseRep *mysql.CourseRepository
+	cfg       config.QuotaConfig
+}
+
+func NewChecker(quotaRep *mysql.QuotaRepository, courseRep *mysql.CourseRepository, cfg config.QuotaConfig) *Checker {
+	return &Checker{
+		quotaRep:  quotaRep,
+		courseRep: courseRep,
+		cfg:       cfg,
+	}
+}
+
+// weekStart returns the Monday 00:00 UTC the week of t started at.
+func weekStart(t time.Time) time.Time {
+	t = t.UTC()
+	offset := (int(t.Weekday()) + 6) % 7
+
+	return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, time.UTC)
+}
+
+// Report returns the usage of the user against the limits that apply to
+// them, including the budget of every course they are enrolled in.
+func (c *Checker) Report(ctx context.Context, user mysql.User) (Report, error) {
+	report := Report{Exempt: user.Type == mysql.Professor}
+
+	override, err := c.quotaRep.GetOverride(ctx, user.ID)
+
+	if err != nil {
+		return report, err
+	}
+
+	concurrent, weekly := limit(c.cfg.MaxConcurrentSessions), limit(c.cfg.WeeklyHours)
+
+	if override.MaxConcurrentSessions != nil {
+		concurrent = override.MaxConcurrentSessions
+	}
+
+	if override.WeeklyHours != nil {
+		weekly = override.WeeklyHours
+	}
+
+	sessions, err := c.quotaRep.CountUserSessions(ctx, user.ID)
+
+	if err != nil {
+		return report, err
+	}
+
+	start := weekStart(time.Now())
+	hours, err := c.quotaRep.UserHoursSince(ctx, user.ID, start)
+
+	if err != nil {
+		return report, err
+	}
+
+	report.ConcurrentSessions = allowance(concurrent, float64(sessions))
+	report.WeeklyHours = allowance(weekly, hours)
+	report.WeekResetsAt = start.AddDate(0, 0, 7)
+
+	courses, err := c.courseRep.ListUserCourses(ctx, user.ID)
+
+	if err != nil {
+		return report, err
+	}
+
+	report.Courses = make([]CourseAllowance, 0, len(courses))
+	for _, course := range courses {
+		budget, err := c.course(ctx, course)
+
+		if err != nil {
+			return report, err
+		}
+
+		report.Courses = append(report.Courses, budget)
+	}
+
+	return report, nil
+}
+
+func (c *Checker) course(ctx context.Context, course mysql.Course) (CourseAllowance, error) {
+	hours, err := c.quotaRep.CourseHours(ctx, course.ID)
+
+	if err != nil {
+		return CourseAllowance{}, err
+	}
+
+	return CourseAllowance{
+		CourseID:  course.ID,
+		Name:      course.Name,
+		Allowance: allowance(course.LabHoursBudget, hours),
+	}, nil
+}
+
+// limit treats zero as unlimited.
+func limit(value int) *int {
+	if value <= 0 {
+		return nil
+	}
+
+	return &value
+}
+
+// Check returns an *Exceeded error when the user may not start a new
+// session on the lab. The concurrent session limit is temporary; the hour
+// limits last until the week or the course budget is reset.
+func (c *Checker) Check(ctx context.Context, user mysql.User, lab mysql.Lab) error {
+	if user.Type == mysql.Professor {
+		return nil
+	}
+
+	report, err := c.Report(ctx, user)
+
+	if err != nil {
+		return err
+	}
+
+	if report.ConcurrentSessions.exhausted() {
+		return concurrentExceeded(*report.ConcurrentSessions.Limit, report.ConcurrentSessions.Used)
+	}
+
+	if report.WeeklyHours.exhausted() {
+		return &Exceeded{
+			Kind:     KindWeeklyHours,
+			Limit:    *report.WeeklyHours.Limit,
+			Used:     report.WeeklyHours.Used,
+			ResetsAt: &report.WeekResetsAt,
+			Message:  "weekly lab hours used up",
+		}
+	}
+
+	if lab.CourseID == nil {
+		return nil
+	}
+
+	course, err := c.courseRep.GetCourseById(ctx, *lab.CourseID)
+
+	if err != nil {
+		return err
+	}
+
+	budget, err := c.course(ctx, course)
+
+	if err != nil {
+		return err
+	}
+
+	if budget.exhausted() {
+		return &Exceeded{
+			Kind:     KindCourseHours,
+			Limit:    *budget.Limit,
+			Used:     budget.Used,
+			CourseID: &course.ID,
+			Message:  "lab hour budget of the course used up",
+		}
+	}
+
+	return nil
+}
+
+// ConcurrentLimit returns the number of sessions the user may run at once,
+// or nil when they are not limited. Sessions are reserved within it with
+// mysql.SessionRepository.ReserveSession, which counts them in the same
+// transaction; Check alone cannot stop parallel requests from exceeding it.
+func (c *Checker) ConcurrentLimit(ctx context.Context, user mysql.User) (*int, error) {
+	if user.Type == mysql.Professor {
+		return nil, nil
+	}
+
+	override, err := c.quotaRep.GetOverride(ctx, user.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if override.MaxConcurrentSessions != nil {
+		return override.MaxConcurrentSessions, nil
+	}
+
+	return limit(c.cfg.MaxConcurrentSessions), nil
+}
+
+// ConcurrentExceeded is the error of a session refused by the concurrent
+// session limit, for callers that enforced it themselves.
+func ConcurrentExceeded(limit int) *Exceeded {
+	return concurrentExceeded(float64(limit), float64(limit))
+}
+
+func concurrentExceeded(limit float64, used float64) *Exceeded {
+	return &Exceeded{
+		Kind:      KindConcurrentSessions,
+		Limit:     limit,
+		Used:      used,
+		Message:   "end a session before starting another one",
+		Temporary: true,
+	}
+}
@@ -0,0 +1,136 @@
+package reconcile
+
+import (
+	"sort"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"github.com/danutavadanei/nice-lab-go/internal/provision"
+)
+
+// Kind tells how a lab differs from the sessions table.
+type Kind string
+
+const (
+	// SessionMissing is an active session whose DCV session is gone, e.g.
+	// after the instance rebooted.
+	SessionMissing Kind = "session_missing"
+	// StorageMissing is an active session without its storage folder.
+	StorageMissing Kind = "storage_missing"
+	// AccountUnmanaged is an active session whose account is not in the
+	// managed group, e.g. one provisioned by a template that predates it.
+	AccountUnmanaged Kind = "account_unmanaged"
+	// OrphanSession is a DCV session of a managed account without a session.
+	OrphanSession Kind = "orphan_session"
+	// OrphanAccount is a managed account without a session.
+	OrphanAccount Kind = "orphan_account"
+	// OrphanStorage is a storage folder of no known user.
+	OrphanStorage Kind = "orphan_storage"
+)
+
+// Action is how a drift is repaired.
+type Action string
+
+const (
+	// ActionNone leaves the drift for an operator. Storage is never
+	// deleted, since it holds the data of users.
+	ActionNone Action = "none"
+	// ActionRecreate provisions the session again, keeping its row. The
+	// session is closed when that fails.
+	ActionRecreate Action = "recreate"
+	// ActionClose tears the account and its DCV session down.
+	ActionClose Action = "close"
+)
+
+// Drift is one difference between a lab and the sessions table.
+type Drift struct {
+	Kind      Kind    `json:"kind"`
+	UserName  string  `json:"username"`
+	SessionID *uint64 `json:"session_id,omitempty"`
+	Action    Action  `json:"action"`
+	Repaired  bool    `json:"repaired"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Diff compares the inventory of a lab with its active and provisioning
+// sessions. Sessions still provisioning are not checked, but own their
+// account and DCV session, as the warm pool owns the accounts it holds.
+// known holds the usernames of every user, whose storage folders are
+// expected to stay after their sessions end. Accounts outside the managed
+// group and reserved names are never touched.
+func Diff(sessions []mysql.Session, held []string, inv provision.Inventory, known map[string]bool) []Drift {
+	var drift []Drift
+
+	owned := make(map[string]bool, len(sessions))
+	dcvSessions := make(map[string]bool, len(inv.Sessions))
+	accounts := make(map[string]bool, len(inv.Accounts))
+	storage := make(map[string]bool, len(inv.Storage))
+
+	for _, session := range sessions {
+		owned[session.OSUser().UserName] = true
+	}
+
+	for _, account := range held {
+		owned[account] = true
+	}
+
+	for _, session := range inv.Sessions {
+		dcvSessions[session.ID] = true
+	}
+
+	for _, account := range inv.Accounts {
+		accounts[account] = true
+	}
+
+	for _, folder := range inv.Storage {
+		storage[folder] = true
+	}
+
+	for _, session := range sessions {
+		if session.Status != mysql.SessionActive {
+			continue
+		}
+
+		// Sessions bound to a warm account run under the account's name but
+		// keep the storage of their user.
+		id, username, account := session.ID, session.User.UserName, session.OSUser().UserName
+
+		switch {
+		case !dcvSessions[account]:
+			drift = append(drift, Drift{Kind: SessionMissing, UserName: account, SessionID: &id, Action: ActionRecreate})
+		case !storage[username]:
+			drift = append(drift, Drift{Kind: StorageMissing, UserName: username, SessionID: &id, Action: ActionRecreate})
+		}
+
+		if dcvSessions[account] && !accounts[account] {
+			drift = append(drift, Drift{Kind: AccountUnmanaged, UserName: account, SessionID: &id, Action: ActionNone})
+		}
+	}
+
+	for _, session := range inv.Sessions {
+		if accounts[session.Owner] && !owned[session.Owner] && provision.ValidateUsername(session.Owner) == nil {
+			drift = append(drift, Drift{Kind: OrphanSession, UserName: session.Owner, Action: ActionClose})
+		}
+	}
+
+	for account := range accounts {
+		if !owned[account] && provision.ValidateUsername(account) == nil {
+			drift = append(drift, Drift{Kind: OrphanAccount, UserName: account, Action: ActionClose})
+		}
+	}
+
+	for folder := range storage {
+		if !known[folder] {
+			drift = append(drift, Drift{Kind: OrphanStorage, UserName: folder, Action: ActionNone})
+		}
+	}
+
+	sort.SliceStable(drift, func(i, j int) bool {
+		if drift[i].UserName != drift[j].UserName {
+			return drift[i].UserName < drift[j].UserName
+		}
+
+		return drift[i].Kind < drift[j].Kind
+	})
+
+	return drift
+}
@@ -0,0 +1,108 @@
+package scheduler
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+)
+
+var ErrNoCapacity = errors.New("no lab in the pool has free capacity")
+
+// Place picks the lab of a pool a new session should go to. Labs that do
+// not take sessions or whose sessions and reserved slots already
+// reach MaxSessions are skipped.
+// Among the rest the one with the lowest relative load wins, then the one
+// with fewer sessions, then the lowest id, so placement is deterministic.
+func Place(labs []mysql.LabLoad) (mysql.Lab, error) {
+	candidates := make([]mysql.LabLoad, 0, len(labs))
+
+	for _, lab := range labs {
+		if TakesSessions(lab.Lab) && used(lab) < capacity(lab.Lab) {
+			candidates = append(candidates, lab)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return mysql.Lab{}, ErrNoCapacity
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+
+		// used(a)/capacity(a) < used(b)/capacity(b)
+		left, right := used(a)*capacity(b.Lab), used(b)*capacity(a.Lab)
+		if left != right {
+			return left < right
+		}
+
+		if used(a) != used(b) {
+			return used(a) < used(b)
+		}
+
+		return a.ID < b.ID
+	})
+
+	return candidates[0].Lab, nil
+}
+
+// Shortest picks the available, active lab of a pool whose queue is the shortest
+// relative to its capacity, for users waiting on a full pool. Ties go to the
+// lowest id.
+func Shortest(labs []mysql.LabLoad) (mysql.Lab, error) {
+	var best *mysql.LabLoad
+
+	for i := range labs {
+		lab := &labs[i]
+
+		if !TakesSessions(lab.Lab) {
+			continue
+		}
+
+		if best == nil || lab.Waiting*capacity(best.Lab) < best.Waiting*capacity(lab.Lab) {
+			best = lab
+		}
+	}
+
+	if best == nil {
+		return mysql.Lab{}, ErrNoCapacity
+	}
+
+	return best.Lab, nil
+}
+
+// TakesSessions reports whether new sessions may be placed on the lab: it
+// is not deleted, is available, which unhealthy labs are not, and is active.
+func TakesSessions(lab mysql.Lab) bool {
+	return lab.DeletedAt == nil && lab.Available && lab.State == mysql.LabActive
+}
+
+// used counts the slots of the lab taken by sessions and held by
+// reservations in progress.
+func used(lab mysql.LabLoad) int {
+	return lab.ActiveSessions + lab.Reserved
+}
+
+// capacity treats labs without a configured limit as single-session labs.
+func capacity(lab mysql.Lab) int {
+	if lab.MaxSessions < 1 {
+		return 1
+	}
+
+	return lab.MaxSessions
+}
+
+// defaultSessionDuration is assumed when a lab has no session history.
+const defaultSessionDuration = 45 * time.Minute
+
+// EstimateWait approximates how long the entry at position waits for a slot
+// on a lab with the given capacity, assuming its slots free up evenly over
+// the average session duration.
+func EstimateWait(position int, lab mysql.Lab, average time.Duration) time.Duration {
+	if average <= 0 {
+		average = defaultSessionDuration
+	}
+
+	return time.Duration(position) * average / time.Duration(capacity(lab))
+}
@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"context"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"net/http"
+	"strings"
+)
+
+// AgentAuthenticationMiddleware authenticates lab agents by the token they
+// got when enrolling, sent as a bearer token, and puts the agent in the
+// request context.
+type AgentAuthenticationMiddleware struct {
+	agentRep *mysql.AgentRepository
+}
+
+func NewAgentAuthenticationMiddleware(agentRep *mysql.AgentRepository) *AgentAuthenticationMiddleware {
+	return &AgentAuthenticationMiddleware{agentRep: agentRep}
+}
+
+func (amw *AgentAuthenticationMiddleware) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if token == "" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if agent, err := amw.agentRep.GetAgentByToken(r.Context(), token); err == nil {
+			r = r.WithContext(context.WithValue(r.Context(), "agent", agent))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	})
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"context"
+	"github.com/danutavadanei/nice-lab-go/internal/adapters/mysql"
+	"net/http"
+)
+
+// CalendarAuthenticationMiddleware authenticates calendar clients, which
+// cannot send headers, by the calendar token in the query, and puts its user
+// in the request context. Session tokens are not accepted.
+type CalendarAuthenticationMiddleware struct {
+	calendarTokenRep *mysql.CalendarTokenRepository
+}
+
+func NewCalendarAuthenticationMiddleware(calendarTokenRep *mysql.CalendarTokenRepository) *CalendarAuthenticationMiddleware {
+	return &CalendarAuthenticationMiddleware{calendarTokenRep: calendarTokenRep}
+}
+
+func (cmw *CalendarAuthenticationMiddleware) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+
+		if token == "" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if user, err := cmw.calendarTokenRep.GetUserByCalendarToken(r.Context(), token); err == nil {
+			r = r.WithContext(context.WithValue(r.Context(), "user", user))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	})
+}
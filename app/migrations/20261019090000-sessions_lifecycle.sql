@@ -0,0 +1,20 @@
+
+-- +migrate Up
+ALTER TABLE `sessions`
+  ADD COLUMN `status` varchar(255) NOT NULL DEFAULT 'active',
+  ADD COLUMN `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  ADD COLUMN `ended_at` timestamp NULL DEFAULT NULL,
+  ADD COLUMN `end_reason` varchar(255) DEFAULT NULL,
+  ADD INDEX `sessions_user_lab_status` (`user_id`, `lab_id`, `status`);
+
+-- Sessions from before the lifecycle was tracked are long gone from their
+-- labs and must not take their slots.
+UPDATE `sessions` SET `status` = 'ended', `ended_at` = NOW(), `end_reason` = 'migrated';
+
+-- +migrate Down
+ALTER TABLE `sessions`
+  DROP INDEX `sessions_user_lab_status`,
+  DROP COLUMN `end_reason`,
+  DROP COLUMN `ended_at`,
+  DROP COLUMN `created_at`,
+  DROP COLUMN `status`;
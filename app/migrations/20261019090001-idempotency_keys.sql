@@ -0,0 +1,15 @@
+
+-- +migrate Up
+CREATE TABLE `idempotency_keys` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `user_id` bigint unsigned NOT NULL,
+  `lab_id` bigint unsigned NOT NULL,
+  `idempotency_key` varchar(255) NOT NULL,
+  `session_id` bigint unsigned DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idempotency_keys_user_key` (`user_id`, `idempotency_key`)
+) DEFAULT CHARSET=utf8;
+
+-- +migrate Down
+DROP TABLE `idempotency_keys`;
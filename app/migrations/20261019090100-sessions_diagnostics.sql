@@ -0,0 +1,8 @@
+
+-- +migrate Up
+ALTER TABLE `sessions`
+  ADD COLUMN `diagnostics` text DEFAULT NULL;
+
+-- +migrate Down
+ALTER TABLE `sessions`
+  DROP COLUMN `diagnostics`;
@@ -0,0 +1,15 @@
+
+-- +migrate Up
+CREATE TABLE `provisioning_templates` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `name` varchar(255) NOT NULL,
+  `version` int unsigned NOT NULL,
+  `body` text NOT NULL,
+  `created_by` bigint unsigned DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `provisioning_templates_name_version` (`name`, `version`)
+) DEFAULT CHARSET=utf8;
+
+-- +migrate Down
+DROP TABLE `provisioning_templates`;
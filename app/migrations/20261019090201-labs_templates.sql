@@ -0,0 +1,10 @@
+
+-- +migrate Up
+ALTER TABLE `labs`
+  ADD COLUMN `template_name` varchar(255) DEFAULT NULL,
+  ADD COLUMN `template_version` int unsigned DEFAULT NULL;
+
+-- +migrate Down
+ALTER TABLE `labs`
+  DROP COLUMN `template_version`,
+  DROP COLUMN `template_name`;
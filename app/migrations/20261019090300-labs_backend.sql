@@ -0,0 +1,8 @@
+
+-- +migrate Up
+ALTER TABLE `labs`
+  ADD COLUMN `backend` varchar(255) NOT NULL DEFAULT 'ssm';
+
+-- +migrate Down
+ALTER TABLE `labs`
+  DROP COLUMN `backend`;
@@ -0,0 +1,12 @@
+
+-- +migrate Up
+CREATE TABLE `lab_pools` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `uuid` char(36) DEFAULT NULL,
+  `name` varchar(255) NOT NULL,
+  `type` varchar(255) NOT NULL,
+  PRIMARY KEY (`id`)
+) DEFAULT CHARSET=utf8;
+
+-- +migrate Down
+DROP TABLE `lab_pools`;
@@ -0,0 +1,12 @@
+
+-- +migrate Up
+ALTER TABLE `labs`
+  ADD COLUMN `pool_id` bigint unsigned DEFAULT NULL,
+  ADD COLUMN `max_sessions` int unsigned NOT NULL DEFAULT 1,
+  ADD INDEX `labs_pool_id_index` (`pool_id`);
+
+-- +migrate Down
+ALTER TABLE `labs`
+  DROP INDEX `labs_pool_id_index`,
+  DROP COLUMN `max_sessions`,
+  DROP COLUMN `pool_id`;
@@ -0,0 +1,18 @@
+
+-- +migrate Up
+CREATE TABLE `queue_entries` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `user_id` bigint unsigned NOT NULL,
+  `lab_id` bigint unsigned NOT NULL,
+  `priority` int NOT NULL DEFAULT 0,
+  `status` varchar(255) NOT NULL DEFAULT 'waiting',
+  `session_id` bigint unsigned DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `admitted_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `queue_entries_lab_status` (`lab_id`, `status`, `priority`, `id`),
+  INDEX `queue_entries_user_status` (`user_id`, `status`)
+) DEFAULT CHARSET=utf8;
+
+-- +migrate Down
+DROP TABLE `queue_entries`;
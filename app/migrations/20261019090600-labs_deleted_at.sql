@@ -0,0 +1,19 @@
+-- +migrate Up
+ALTER TABLE `labs`
+  ADD COLUMN `deleted_at` timestamp NULL DEFAULT NULL;
+
+-- Labs created by hand before CreateLab set it have no uuid, which a Lab
+-- cannot be loaded without.
+UPDATE `labs` SET `uuid` = UUID() WHERE `uuid` IS NULL;
+
+ALTER TABLE `labs`
+  MODIFY `uuid` char(36) NOT NULL,
+  ADD UNIQUE KEY `labs_uuid` (`uuid`);
+
+-- +migrate Down
+ALTER TABLE `labs`
+  DROP INDEX `labs_uuid`,
+  MODIFY `uuid` char(36) DEFAULT NULL;
+
+ALTER TABLE `labs`
+  DROP COLUMN `deleted_at`;
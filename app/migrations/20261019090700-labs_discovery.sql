@@ -0,0 +1,12 @@
+
+-- +migrate Up
+ALTER TABLE `labs`
+  ADD COLUMN `state` varchar(255) NOT NULL DEFAULT 'active',
+  ADD COLUMN `source` varchar(255) NOT NULL DEFAULT 'manual',
+  ADD INDEX `labs_instance_id` (`instance_id`(64));
+
+-- +migrate Down
+ALTER TABLE `labs`
+  DROP INDEX `labs_instance_id`,
+  DROP COLUMN `source`,
+  DROP COLUMN `state`;
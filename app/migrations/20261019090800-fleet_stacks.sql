@@ -0,0 +1,19 @@
+
+-- +migrate Up
+CREATE TABLE `fleet_stacks` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `pool_id` bigint unsigned NOT NULL,
+  `stack_name` varchar(255) NOT NULL,
+  `stack_id` varchar(1024) DEFAULT NULL,
+  `status` varchar(255) NOT NULL,
+  `status_reason` text DEFAULT NULL,
+  `lab_id` bigint unsigned DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `fleet_stacks_stack_name` (`stack_name`),
+  INDEX `fleet_stacks_pool_status` (`pool_id`, `status`)
+) DEFAULT CHARSET=utf8;
+
+-- +migrate Down
+DROP TABLE `fleet_stacks`;
@@ -0,0 +1,20 @@
+
+-- +migrate Up
+ALTER TABLE `lab_pools`
+  ADD COLUMN `fleet_min` int unsigned NOT NULL DEFAULT 0,
+  ADD COLUMN `fleet_max` int unsigned NOT NULL DEFAULT 0,
+  ADD COLUMN `fleet_template` varchar(255) DEFAULT NULL,
+  ADD COLUMN `fleet_instance_type` varchar(255) NOT NULL DEFAULT 't3.medium',
+  ADD COLUMN `fleet_volume_size` int unsigned NOT NULL DEFAULT 0,
+  ADD COLUMN `fleet_ingress` varchar(255) NOT NULL DEFAULT '0.0.0.0/0',
+  ADD COLUMN `fleet_lab_max_sessions` int unsigned NOT NULL DEFAULT 1;
+
+-- +migrate Down
+ALTER TABLE `lab_pools`
+  DROP COLUMN `fleet_lab_max_sessions`,
+  DROP COLUMN `fleet_ingress`,
+  DROP COLUMN `fleet_volume_size`,
+  DROP COLUMN `fleet_instance_type`,
+  DROP COLUMN `fleet_template`,
+  DROP COLUMN `fleet_max`,
+  DROP COLUMN `fleet_min`;
@@ -0,0 +1,14 @@
+
+-- +migrate Up
+ALTER TABLE `labs`
+  ADD COLUMN `health` varchar(255) NOT NULL DEFAULT 'unknown',
+  ADD COLUMN `health_checked_at` timestamp NULL DEFAULT NULL,
+  ADD COLUMN `health_failures` int unsigned NOT NULL DEFAULT 0,
+  ADD COLUMN `health_disabled` tinyint(1) NOT NULL DEFAULT 0;
+
+-- +migrate Down
+ALTER TABLE `labs`
+  DROP COLUMN `health_disabled`,
+  DROP COLUMN `health_failures`,
+  DROP COLUMN `health_checked_at`,
+  DROP COLUMN `health`;
@@ -0,0 +1,18 @@
+
+-- +migrate Up
+CREATE TABLE `lab_health_checks` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `lab_id` bigint unsigned NOT NULL,
+  `status` varchar(255) NOT NULL,
+  `instance_state` varchar(255) DEFAULT NULL,
+  `ping_status` varchar(255) DEFAULT NULL,
+  `dcv_reachable` tinyint(1) NOT NULL DEFAULT 0,
+  `detail` text DEFAULT NULL,
+  `checked_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  INDEX `lab_health_checks_lab_checked_at` (`lab_id`, `checked_at`),
+  INDEX `lab_health_checks_checked_at` (`checked_at`)
+) DEFAULT CHARSET=utf8;
+
+-- +migrate Down
+DROP TABLE `lab_health_checks`;
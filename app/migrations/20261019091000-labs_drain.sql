@@ -0,0 +1,12 @@
+
+-- +migrate Up
+ALTER TABLE `labs`
+  ADD COLUMN `drain_deadline` timestamp NULL DEFAULT NULL,
+  ADD COLUMN `drain_message` varchar(1024) DEFAULT NULL,
+  ADD COLUMN `drain_notified_at` timestamp NULL DEFAULT NULL;
+
+-- +migrate Down
+ALTER TABLE `labs`
+  DROP COLUMN `drain_notified_at`,
+  DROP COLUMN `drain_message`,
+  DROP COLUMN `drain_deadline`;
@@ -0,0 +1,10 @@
+
+-- +migrate Up
+ALTER TABLE `sessions`
+  ADD COLUMN `idle_since` timestamp NULL DEFAULT NULL,
+  ADD COLUMN `idle_warned_at` timestamp NULL DEFAULT NULL;
+
+-- +migrate Down
+ALTER TABLE `sessions`
+  DROP COLUMN `idle_warned_at`,
+  DROP COLUMN `idle_since`;
@@ -0,0 +1,13 @@
+
+-- +migrate Up
+CREATE TABLE `courses` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `uuid` char(36) DEFAULT NULL,
+  `name` varchar(255) NOT NULL,
+  `max_session_minutes` int unsigned DEFAULT NULL,
+  `extension_quota_minutes` int unsigned DEFAULT NULL,
+  PRIMARY KEY (`id`)
+) DEFAULT CHARSET=utf8;
+
+-- +migrate Down
+DROP TABLE `courses`;
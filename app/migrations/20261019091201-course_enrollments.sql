@@ -0,0 +1,14 @@
+
+-- +migrate Up
+CREATE TABLE `course_enrollments` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `course_id` bigint unsigned NOT NULL,
+  `user_id` bigint unsigned NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `course_enrollments_course_user` (`course_id`, `user_id`),
+  INDEX `course_enrollments_user_id` (`user_id`)
+) DEFAULT CHARSET=utf8;
+
+-- +migrate Down
+DROP TABLE `course_enrollments`;
@@ -0,0 +1,12 @@
+
+-- +migrate Up
+ALTER TABLE `labs`
+  ADD COLUMN `course_id` bigint unsigned DEFAULT NULL,
+  ADD COLUMN `max_session_minutes` int unsigned DEFAULT NULL,
+  ADD INDEX `labs_course_id_index` (`course_id`);
+
+-- +migrate Down
+ALTER TABLE `labs`
+  DROP INDEX `labs_course_id_index`,
+  DROP COLUMN `max_session_minutes`,
+  DROP COLUMN `course_id`;
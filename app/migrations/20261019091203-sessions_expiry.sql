@@ -0,0 +1,14 @@
+
+-- +migrate Up
+ALTER TABLE `sessions`
+  ADD COLUMN `course_id` bigint unsigned DEFAULT NULL,
+  ADD COLUMN `expires_at` timestamp NULL DEFAULT NULL,
+  ADD COLUMN `expiry_warning` int unsigned DEFAULT NULL,
+  ADD INDEX `sessions_course_id_index` (`course_id`);
+
+-- +migrate Down
+ALTER TABLE `sessions`
+  DROP INDEX `sessions_course_id_index`,
+  DROP COLUMN `expiry_warning`,
+  DROP COLUMN `expires_at`,
+  DROP COLUMN `course_id`;
@@ -0,0 +1,19 @@
+
+-- +migrate Up
+CREATE TABLE `session_extensions` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `session_id` bigint unsigned NOT NULL,
+  `user_id` bigint unsigned NOT NULL,
+  `minutes` int unsigned NOT NULL,
+  `status` varchar(255) NOT NULL,
+  `auto_approved` tinyint(1) NOT NULL DEFAULT 0,
+  `decided_by` bigint unsigned DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `decided_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `session_extensions_session_id` (`session_id`),
+  INDEX `session_extensions_status` (`status`)
+) DEFAULT CHARSET=utf8;
+
+-- +migrate Down
+DROP TABLE `session_extensions`;
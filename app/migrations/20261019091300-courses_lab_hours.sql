@@ -0,0 +1,8 @@
+
+-- +migrate Up
+ALTER TABLE `courses`
+  ADD COLUMN `lab_hours_budget` int unsigned DEFAULT NULL;
+
+-- +migrate Down
+ALTER TABLE `courses`
+  DROP COLUMN `lab_hours_budget`;
@@ -0,0 +1,15 @@
+
+-- +migrate Up
+CREATE TABLE `quota_overrides` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `user_id` bigint unsigned NOT NULL,
+  `max_concurrent_sessions` int unsigned DEFAULT NULL,
+  `weekly_hours` int unsigned DEFAULT NULL,
+  `updated_by` bigint unsigned DEFAULT NULL,
+  `updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `quota_overrides_user_id` (`user_id`)
+) DEFAULT CHARSET=utf8;
+
+-- +migrate Down
+DROP TABLE `quota_overrides`;
@@ -0,0 +1,22 @@
+
+-- +migrate Up
+CREATE TABLE `reservations` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `uuid` char(36) DEFAULT NULL,
+  `user_id` bigint unsigned NOT NULL,
+  `lab_id` bigint unsigned NOT NULL,
+  `pool_id` bigint unsigned DEFAULT NULL,
+  `starts_at` timestamp NOT NULL,
+  `ends_at` timestamp NOT NULL,
+  `status` varchar(255) NOT NULL,
+  `session_id` bigint unsigned DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `reservations_lab_window` (`lab_id`, `starts_at`, `ends_at`),
+  INDEX `reservations_user_id` (`user_id`),
+  INDEX `reservations_status` (`status`)
+) DEFAULT CHARSET=utf8;
+
+-- +migrate Down
+DROP TABLE `reservations`;
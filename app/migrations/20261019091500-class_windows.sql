@@ -0,0 +1,19 @@
+
+-- +migrate Up
+CREATE TABLE `class_windows` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `uuid` char(36) DEFAULT NULL,
+  `course_id` bigint unsigned NOT NULL,
+  `starts_at` timestamp NOT NULL,
+  `ends_at` timestamp NOT NULL,
+  `status` varchar(255) NOT NULL,
+  `created_by` bigint unsigned DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `ended_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `class_windows_course_id` (`course_id`),
+  INDEX `class_windows_status_starts_at` (`status`, `starts_at`)
+) DEFAULT CHARSET=utf8;
+
+-- +migrate Down
+DROP TABLE `class_windows`;
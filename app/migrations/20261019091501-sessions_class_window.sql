@@ -0,0 +1,12 @@
+
+-- +migrate Up
+ALTER TABLE `sessions`
+  ADD COLUMN `class_window_id` bigint unsigned DEFAULT NULL,
+  ADD COLUMN `idle_after` timestamp NULL DEFAULT NULL,
+  ADD INDEX `sessions_class_window_id_index` (`class_window_id`);
+
+-- +migrate Down
+ALTER TABLE `sessions`
+  DROP INDEX `sessions_class_window_id_index`,
+  DROP COLUMN `idle_after`,
+  DROP COLUMN `class_window_id`;
@@ -0,0 +1,19 @@
+
+-- +migrate Up
+CREATE TABLE `warm_accounts` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `lab_id` bigint unsigned NOT NULL,
+  `account` varchar(32) NOT NULL,
+  `status` varchar(255) NOT NULL,
+  `session_id` bigint unsigned DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `ready_at` timestamp NULL DEFAULT NULL,
+  `claimed_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `warm_accounts_lab_account` (`lab_id`, `account`),
+  INDEX `warm_accounts_lab_id_status` (`lab_id`, `status`),
+  INDEX `warm_accounts_session_id` (`session_id`)
+) DEFAULT CHARSET=utf8;
+
+-- +migrate Down
+DROP TABLE `warm_accounts`;
@@ -0,0 +1,8 @@
+
+-- +migrate Up
+ALTER TABLE `labs`
+  ADD COLUMN `warm_pool_size` int unsigned NOT NULL DEFAULT 0;
+
+-- +migrate Down
+ALTER TABLE `labs`
+  DROP COLUMN `warm_pool_size`;
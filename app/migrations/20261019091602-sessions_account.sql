@@ -0,0 +1,8 @@
+
+-- +migrate Up
+ALTER TABLE `sessions`
+  ADD COLUMN `account` varchar(32) DEFAULT NULL;
+
+-- +migrate Down
+ALTER TABLE `sessions`
+  DROP COLUMN `account`;
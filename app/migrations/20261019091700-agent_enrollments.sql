@@ -0,0 +1,17 @@
+
+-- +migrate Up
+CREATE TABLE `agent_enrollments` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `lab_id` bigint unsigned NOT NULL,
+  `token_hash` char(64) NOT NULL,
+  `created_by` bigint unsigned NOT NULL,
+  `expires_at` timestamp NOT NULL,
+  `used_at` timestamp NULL DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `agent_enrollments_token_hash` (`token_hash`),
+  INDEX `agent_enrollments_lab_id` (`lab_id`)
+) DEFAULT CHARSET=utf8;
+
+-- +migrate Down
+DROP TABLE `agent_enrollments`;
@@ -0,0 +1,17 @@
+
+-- +migrate Up
+CREATE TABLE `agents` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `lab_id` bigint unsigned NOT NULL,
+  `token_hash` char(64) NOT NULL,
+  `hostname` varchar(255) NOT NULL DEFAULT '',
+  `version` varchar(255) NOT NULL DEFAULT '',
+  `last_seen_at` timestamp NULL DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `agents_lab_id` (`lab_id`),
+  UNIQUE KEY `agents_token_hash` (`token_hash`)
+) DEFAULT CHARSET=utf8;
+
+-- +migrate Down
+DROP TABLE `agents`;
@@ -0,0 +1,26 @@
+
+-- +migrate Up
+CREATE TABLE `agent_jobs` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `uuid` char(36) NOT NULL,
+  `lab_id` bigint unsigned NOT NULL,
+  `agent_id` bigint unsigned DEFAULT NULL,
+  `family` varchar(255) NOT NULL,
+  `script` mediumtext NOT NULL,
+  `timeout` int unsigned NOT NULL,
+  `status` varchar(255) NOT NULL,
+  `exit_code` int DEFAULT NULL,
+  `stdout` mediumtext,
+  `stderr` mediumtext,
+  `error` text,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `claimed_at` timestamp NULL DEFAULT NULL,
+  `finished_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `agent_jobs_uuid` (`uuid`),
+  INDEX `agent_jobs_lab_id_status` (`lab_id`, `status`),
+  INDEX `agent_jobs_finished_at` (`finished_at`)
+) DEFAULT CHARSET=utf8;
+
+-- +migrate Down
+DROP TABLE `agent_jobs`;
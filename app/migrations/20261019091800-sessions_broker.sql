@@ -0,0 +1,8 @@
+
+-- +migrate Up
+ALTER TABLE `sessions`
+  ADD COLUMN `broker_session_id` varchar(255) DEFAULT NULL;
+
+-- +migrate Down
+ALTER TABLE `sessions`
+  DROP COLUMN `broker_session_id`;
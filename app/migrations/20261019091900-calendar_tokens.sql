@@ -0,0 +1,15 @@
+
+-- +migrate Up
+CREATE TABLE `calendar_tokens` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `user_id` bigint unsigned NOT NULL,
+  `token_hash` char(64) NOT NULL,
+  `revoked_at` timestamp NULL DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `calendar_tokens_token_hash` (`token_hash`),
+  INDEX `calendar_tokens_user_id` (`user_id`)
+) DEFAULT CHARSET=utf8;
+
+-- +migrate Down
+DROP TABLE `calendar_tokens`;